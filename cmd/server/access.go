@@ -0,0 +1,587 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"s3photoalbum/internal"
+	"strings"
+	"time"
+)
+
+// Albums can be shared with other users, or all members of a group. Viewers
+// can see the album and the albums below it, contributors can also upload
+// to them and edit the captions and tags of their media. Everything else,
+// e.g. renaming or deleting the album, is left to the owner.
+
+const (
+	accessView       = "view"
+	accessContribute = "contribute"
+	// Not stored, the owners have all rights on their albums
+	accessOwner = "owner"
+)
+
+// accessRanks orders the access levels, each includes the rights of the
+// lower ones
+var accessRanks = map[string]int{accessView: 1, accessContribute: 2, accessOwner: 3}
+
+var (
+	errAccess          = errors.New("invalid access")
+	errGroupName       = errors.New("invalid group name")
+	errGranteeNotFound = errors.New("user or group not found")
+)
+
+// AlbumAccess gives a user or the members of a group access to an album of
+// the owner, including the albums below it. The access follows the album
+// when it is renamed and is deleted with it.
+type AlbumAccess struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	Owner     string `gorm:"uniqueIndex:idx_album_accesses_grantee;not null"`
+	Album     string `gorm:"uniqueIndex:idx_album_accesses_grantee;not null"`
+	// Either the user or the group the album is shared with is set
+	Username  string `gorm:"uniqueIndex:idx_album_accesses_grantee;index;not null;default:''"`
+	GroupName string `gorm:"uniqueIndex:idx_album_accesses_grantee;index;not null;default:''"`
+	// accessView or accessContribute
+	Access string `gorm:"not null"`
+}
+
+// GroupMember makes a user member of a group. Groups are managed by the
+// admins and exist as long as they have members.
+type GroupMember struct {
+	ID        uint   `gorm:"primaryKey"`
+	GroupName string `gorm:"uniqueIndex:idx_group_members_name_username;not null"`
+	Username  string `gorm:"uniqueIndex:idx_group_members_name_username;index;not null"`
+}
+
+// userGroup is a group with its members
+type userGroup struct {
+	Name    string
+	Members []string
+}
+
+// sharedAlbum is an album of another user shared with the current user
+type sharedAlbum struct {
+	s3photoalbum.Album
+	// The highest access given to the user or their groups
+	Access string
+}
+
+// URL returns the path of the album page
+func (album sharedAlbum) URL() string {
+	return escapedPath("/shared", album.Owner, "albums", album.Name)
+}
+
+// CoverURL returns the path of the album cover, empty if there is none
+func (album sharedAlbum) CoverURL() string {
+	if !strings.HasPrefix(album.Cover, "/thumbnails/") {
+		return album.Cover
+	}
+	return escapedPath("/shared", album.Owner, "thumbnails") + strings.TrimPrefix(album.Cover, "/thumbnails")
+}
+
+// accessStatus returns the HTTP status for errors of sharing albums
+func accessStatus(err error) int {
+	switch {
+	case errors.Is(err, errAccess), errors.Is(err, errGroupName):
+		return http.StatusBadRequest
+	case errors.Is(err, errGranteeNotFound):
+		return http.StatusNotFound
+	}
+	return albumStatus(err)
+}
+
+// albumOwner returns the owner of the album of the request, the user in the
+// path of the routes of shared albums or else the current user
+func albumOwner(c *gin.Context) string {
+	if owner := c.GetString("owner"); owner != "" {
+		return owner
+	}
+	return c.GetString("username")
+}
+
+// sharedAlbumRoute passes the owner in the path of the routes of albums
+// shared by other users to the handler as "owner" in the context
+func sharedAlbumRoute(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("owner", c.Param("owner"))
+		handler(c)
+	}
+}
+
+// albumsPath returns the path below which the user finds the album pages of
+// the owner
+func albumsPath(username, owner string) string {
+	if owner == username {
+		return "/albums"
+	}
+	return escapedPath("/shared", owner, "albums")
+}
+
+// thumbnailsPath returns the path below which the user finds the thumbnails
+// of the owner
+func thumbnailsPath(username, owner string) string {
+	if owner == username {
+		return "/thumbnails"
+	}
+	return escapedPath("/shared", owner, "thumbnails")
+}
+
+// coverPath returns the path of a cover of the owner for the user, as the
+// index stores the covers as paths of the owner's thumbnails
+func coverPath(username, owner, cover string) string {
+	if owner == username {
+		return cover
+	}
+	return sharedAlbum{Album: s3photoalbum.Album{Owner: owner, Cover: cover}}.CoverURL()
+}
+
+// grantedTo restricts the query to the access given to the user or one of
+// their groups
+func grantedTo(query *gorm.DB, username string) *gorm.DB {
+	groups := DB.Model(&GroupMember{}).Select("group_name").Where("username = ?", username)
+	return query.Where("(username = ? OR group_name IN (?))", username, groups)
+}
+
+// enclosingAlbums returns the album and all albums containing it
+func enclosingAlbums(album string) []string {
+	albums := []string{album}
+	for parent := parentAlbum(album); parent != ""; parent = parentAlbum(parent) {
+		albums = append(albums, parent)
+	}
+	return albums
+}
+
+// albumAccess returns the access of the user to the album of the owner,
+// given for the album or one containing it, empty if they have none
+func albumAccess(username, owner, album string) (string, error) {
+
+	if username == owner {
+		return accessOwner, nil
+	}
+
+	var granted []string
+	query := DB.Model(&AlbumAccess{}).Where("owner = ? AND album IN ?", owner, enclosingAlbums(album))
+	if err := grantedTo(query, username).Pluck("access", &granted).Error; err != nil {
+		return "", err
+	}
+
+	access := ""
+	for _, a := range granted {
+		if accessRanks[a] > accessRanks[access] {
+			access = a
+		}
+	}
+	return access, nil
+}
+
+// hasAlbumAccess checks that the current user has at least the access to
+// the album of the request's owner
+func hasAlbumAccess(c *gin.Context, album, access string) (bool, error) {
+	granted, err := albumAccess(c.GetString("username"), albumOwner(c), album)
+	if err != nil {
+		return false, err
+	}
+	return accessRanks[granted] >= accessRanks[access], nil
+}
+
+// setAlbumAccess gives the user or the group access to the album of the
+// owner, an empty access removes it
+func setAlbumAccess(owner, album, username, group, access string) error {
+
+	if !validAlbumPath(album) {
+		return errAlbumName
+	}
+	if (username == "") == (group == "") {
+		return fmt.Errorf("%w: either a user or a group is required", errAccess)
+	}
+	if access != "" && access != accessView && access != accessContribute {
+		return fmt.Errorf("%w: %q", errAccess, access)
+	}
+
+	existing, err := findAlbum(owner, album)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return errAlbumNotFound
+	}
+
+	if access == "" {
+		return DB.Where("owner = ? AND album = ? AND username = ? AND group_name = ?", owner, album, username, group).
+			Delete(&AlbumAccess{}).Error
+	}
+
+	if username == owner {
+		return fmt.Errorf("%w: albums can't be shared with their owner", errAccess)
+	}
+	if username != "" {
+		user, err := findUserByUsername(username)
+		if err != nil {
+			return err
+		}
+		if user.ID == 0 {
+			return fmt.Errorf("%w: %s", errGranteeNotFound, username)
+		}
+	} else {
+		members, err := groupMembers(group)
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			return fmt.Errorf("%w: %s", errGranteeNotFound, group)
+		}
+	}
+
+	return DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "owner"}, {Name: "album"}, {Name: "username"}, {Name: "group_name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"access"}),
+	}).Create(&AlbumAccess{Owner: owner, Album: album, Username: username, GroupName: group, Access: access}).Error
+}
+
+// listAlbumAccess returns the users and groups the album of the owner is
+// shared with, users first
+func listAlbumAccess(owner, album string) ([]AlbumAccess, error) {
+	var access []AlbumAccess
+	err := DB.Where("owner = ? AND album = ?", owner, album).Order("group_name, username").Find(&access).Error
+	return access, err
+}
+
+// moveAlbumAccess changes the album of the access to a renamed album and the
+// albums below it
+func moveAlbumAccess(owner, album, target string) error {
+	var access []AlbumAccess
+	if err := inAlbum(DB.Where("owner = ?", owner), "album", album).Find(&access).Error; err != nil {
+		return err
+	}
+	for _, a := range access {
+		if err := DB.Model(&a).Update("album", target+strings.TrimPrefix(a.Album, album)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteAlbumAccess deletes the access to a deleted album and the albums
+// below it
+func deleteAlbumAccess(owner, album string) error {
+	return inAlbum(DB.Where("owner = ?", owner), "album", album).Delete(&AlbumAccess{}).Error
+}
+
+// listSharedAlbums returns the albums of other users shared with the user or
+// their groups, by owner and name
+func listSharedAlbums(username string) ([]sharedAlbum, error) {
+
+	var granted []AlbumAccess
+	if err := grantedTo(DB.Where("owner <> ?", username), username).Order("owner, album").Find(&granted).Error; err != nil {
+		return nil, err
+	}
+
+	ret := []sharedAlbum{}
+	for _, access := range granted {
+		// Shared with the user and one of their groups
+		if n := len(ret); n > 0 && ret[n-1].Owner == access.Owner && ret[n-1].Name == access.Album {
+			if accessRanks[access.Access] > accessRanks[ret[n-1].Access] {
+				ret[n-1].Access = access.Access
+			}
+			continue
+		}
+
+		album, err := findAlbum(access.Owner, access.Album)
+		if err != nil {
+			return nil, err
+		}
+		if album != nil {
+			ret = append(ret, sharedAlbum{Album: *album, Access: access.Access})
+		}
+	}
+	return ret, nil
+}
+
+// sharedSubAlbums converts the albums below a shared album for its page
+func sharedSubAlbums(albums []s3photoalbum.Album, access string) []sharedAlbum {
+	ret := []sharedAlbum{}
+	for _, album := range albums {
+		ret = append(ret, sharedAlbum{Album: album, Access: access})
+	}
+	return ret
+}
+
+// validGroupName checks that s can be used as name of a group
+func validGroupName(s string) bool {
+	return validPathElement(s) && s == strings.TrimSpace(s) && !strings.Contains(s, ",")
+}
+
+// listGroups returns all groups with their members, by name
+func listGroups() ([]userGroup, error) {
+
+	var members []GroupMember
+	if err := DB.Order("group_name, username").Find(&members).Error; err != nil {
+		return nil, err
+	}
+
+	ret := []userGroup{}
+	for _, member := range members {
+		if n := len(ret); n == 0 || ret[n-1].Name != member.GroupName {
+			ret = append(ret, userGroup{Name: member.GroupName})
+		}
+		ret[len(ret)-1].Members = append(ret[len(ret)-1].Members, member.Username)
+	}
+	return ret, nil
+}
+
+// groupMembers returns the members of the group by name, none if there is no
+// such group
+func groupMembers(name string) ([]string, error) {
+	var members []string
+	err := DB.Model(&GroupMember{}).Where("group_name = ?", name).Order("username").Pluck("username", &members).Error
+	return members, err
+}
+
+// setGroupMembers replaces the members of the group, creating it if needed.
+// A group without members is deleted together with the access given to it.
+func setGroupMembers(name string, usernames []string) error {
+
+	if !validGroupName(name) {
+		return errGroupName
+	}
+
+	members := []GroupMember{}
+	seen := map[string]bool{}
+	for _, username := range usernames {
+		username = strings.TrimSpace(username)
+		if username == "" || seen[username] {
+			continue
+		}
+		user, err := findUserByUsername(username)
+		if err != nil {
+			return err
+		}
+		if user.ID == 0 {
+			return fmt.Errorf("%w: %s", errGranteeNotFound, username)
+		}
+		members = append(members, GroupMember{GroupName: name, Username: username})
+		seen[username] = true
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_name = ?", name).Delete(&GroupMember{}).Error; err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			return tx.Where("group_name = ?", name).Delete(&AlbumAccess{}).Error
+		}
+		return tx.Create(&members).Error
+	})
+}
+
+// deleteUserAccess removes a deleted user from the groups and the albums
+// shared with them, so that a new user of the same name doesn't get them
+func deleteUserAccess(username string) error {
+	if username == "" {
+		return nil
+	}
+	if err := DB.Where("username = ?", username).Delete(&GroupMember{}).Error; err != nil {
+		return err
+	}
+	return DB.Where("username = ?", username).Delete(&AlbumAccess{}).Error
+}
+
+// albumAccessHandler shares the album with a user or group from the form on
+// the album page, or removes the access with an empty access
+func albumAccessHandler(c *gin.Context) {
+
+	album := c.GetString("album")
+	err := setAlbumAccess(c.GetString("username"), album, strings.TrimSpace(c.PostForm("user")), strings.TrimSpace(c.PostForm("group")), c.PostForm("access"))
+	if err != nil {
+		if accessStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(accessStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, escapedPath("/albums", album))
+}
+
+// groupHandler sets the members of a group from the form on the user
+// management page, the members are separated by commas
+func groupHandler(c *gin.Context) {
+
+	if err := setGroupMembers(c.PostForm("name"), strings.Split(c.PostForm("members"), ",")); err != nil {
+		if accessStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(accessStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/users")
+}
+
+func newAPIAlbumAccess(access AlbumAccess) apiAlbumAccess {
+	return apiAlbumAccess{
+		User:      access.Username,
+		Group:     access.GroupName,
+		Access:    access.Access,
+		CreatedAt: access.CreatedAt,
+	}
+}
+
+// apiListAlbumAccess lists the users and groups an album is shared with, to
+// its owner only
+func apiListAlbumAccess(c *gin.Context) {
+
+	album := c.GetString("album")
+	ok, err := hasAlbumAccess(c, album, accessOwner)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list access")
+		return
+	}
+	existing, err := findAlbum(albumOwner(c), album)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list access")
+		return
+	}
+	if !ok || existing == nil {
+		apiError(c, http.StatusNotFound, "album not found")
+		return
+	}
+
+	access, err := listAlbumAccess(albumOwner(c), album)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list access")
+		return
+	}
+
+	ret := []apiAlbumAccess{}
+	for _, a := range access {
+		ret = append(ret, newAPIAlbumAccess(a))
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+// apiSetAlbumAccess shares an album with a user or group, or removes the
+// access, and returns who the album is shared with
+func apiSetAlbumAccess(c *gin.Context) {
+
+	var req apiSetAlbumAccessRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if err := setAlbumAccess(c.GetString("username"), c.GetString("album"), req.User, req.Group, req.Access); err != nil {
+		if accessStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, accessStatus(err), err.Error())
+		return
+	}
+
+	apiListAlbumAccess(c)
+}
+
+func newAPISharedAlbum(album sharedAlbum) apiSharedAlbum {
+	ret := apiSharedAlbum{
+		Owner:  album.Owner,
+		Access: album.Access,
+		URL:    album.URL(),
+		Album:  newAPIAlbum(album.Album),
+	}
+	ret.Album.Cover = album.CoverURL()
+	return ret
+}
+
+func apiListSharedAlbums(c *gin.Context) {
+
+	username := c.GetString("username")
+	albums, err := listSharedAlbums(username)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list shared albums")
+		return
+	}
+
+	ret := []apiSharedAlbum{}
+	for _, album := range albums {
+		ret = append(ret, newAPISharedAlbum(album))
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+func apiListGroups(c *gin.Context) {
+
+	groups, err := listGroups()
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list groups")
+		return
+	}
+
+	ret := []apiGroup{}
+	for _, group := range groups {
+		ret = append(ret, apiGroup{Name: group.Name, Members: group.Members})
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+// apiSetGroup replaces the members of a group, creating it if needed
+func apiSetGroup(c *gin.Context) {
+
+	var req apiSetGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if len(req.Members) == 0 {
+		apiError(c, http.StatusBadRequest, "members are required")
+		return
+	}
+
+	if err := setGroupMembers(c.Param("name"), req.Members); err != nil {
+		if accessStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, accessStatus(err), err.Error())
+		return
+	}
+
+	members, err := groupMembers(c.Param("name"))
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to get group")
+		return
+	}
+	c.JSON(http.StatusOK, apiGroup{Name: c.Param("name"), Members: members})
+}
+
+// apiDeleteGroup deletes a group and the access given to it
+func apiDeleteGroup(c *gin.Context) {
+
+	members, err := groupMembers(c.Param("name"))
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to delete group")
+		return
+	}
+	if len(members) == 0 {
+		apiError(c, http.StatusNotFound, "group not found")
+		return
+	}
+
+	if err := setGroupMembers(c.Param("name"), nil); err != nil {
+		if accessStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, accessStatus(err), err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAlbumAccess(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	alice := loginAs(t, r, "alice")
+	bob := loginAs(t, r, "bob")
+	aliceToken := apiLoginAs(t, r, "alice")
+	bobToken := apiLoginAs(t, r, "bob")
+
+	for _, target := range []string{
+		"/shared/alice/albums/summer",
+		"/shared/alice/albums/summer/beach.jpg",
+		"/shared/alice/thumbnails/summer/beach.jpg.jpg",
+	} {
+		if w := doRequest(r, http.MethodGet, target, nil, bob); w.Code != http.StatusNotFound {
+			t.Errorf("%s without access: expected status %d, got %d", target, http.StatusNotFound, w.Code)
+		}
+	}
+
+	w := doRequest(r, http.MethodPost, "/albums/summer/access", url.Values{"user": {"bob"}, "access": {accessView}}, alice)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/albums/summer" {
+		t.Fatalf("share album: got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if w := doRequest(r, http.MethodGet, "/albums/summer", nil, alice); !strings.Contains(w.Body.String(), `class="album-access"`) || !strings.Contains(w.Body.String(), "bob") {
+		t.Errorf("album page of the owner does not list the access")
+	}
+
+	body := doRequest(r, http.MethodGet, "/", nil, bob).Body.String()
+	if !strings.Contains(body, "Shared with me") || !strings.Contains(body, `href="/shared/alice/albums/summer"`) {
+		t.Errorf("index without the shared album")
+	}
+
+	notes := "Private note"
+	if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/summer/items/beach.jpg", aliceToken, apiUpdateItemRequest{Notes: &notes}, nil); status != http.StatusOK {
+		t.Fatalf("notes: got status %d", status)
+	}
+
+	w = doRequest(r, http.MethodGet, "/shared/alice/albums/summer", nil, bob)
+	body = w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "/shared/alice/thumbnails/summer/beach.jpg.jpg") {
+		t.Fatalf("shared album: got status %d, body %s", w.Code, body)
+	}
+	for _, s := range []string{`class="upload"`, `action="/albums/summer`, `class="album-access"`, notes} {
+		if strings.Contains(body, s) {
+			t.Errorf("shared album with view access contains %q", s)
+		}
+	}
+	for _, target := range []string{"/shared/alice/albums/summer/beach.jpg", "/shared/alice/thumbnails/summer/beach.jpg.jpg"} {
+		if w := doRequest(r, http.MethodGet, target, nil, bob); w.Code == http.StatusNotFound {
+			t.Errorf("%s with access: got status %d", target, w.Code)
+		}
+	}
+	if w := doRequest(r, http.MethodGet, "/shared/alice/albums/winter", nil, bob); w.Code != http.StatusNotFound {
+		t.Errorf("album not shared: expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	caption := url.Values{"item": {"beach.jpg"}, "title": {"Beach"}, "caption": {""}, "notes": {""}}
+	if w := doRequest(r, http.MethodPost, "/shared/alice/albums/summer/caption", caption, bob); w.Code != http.StatusNotFound {
+		t.Errorf("caption with view access: expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := uploadShared(t, r, "/shared/alice/albums/summer/upload", "shell.jpg", bob); w.Code != http.StatusNotFound {
+		t.Errorf("upload with view access: expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/shared/alice/albums/summer/uploads", bobToken, apiCreateUploadRequest{Name: "clip.mp4", Size: int64(len(testMP4))}, nil); status != http.StatusNotFound {
+		t.Errorf("chunked upload with view access: expected status %d, got %d", http.StatusNotFound, status)
+	}
+	title := "Shore"
+	if status := apiRequest(t, r, http.MethodPatch, "/api/v1/shared/alice/albums/summer/items/sunset.jpg", bobToken, apiUpdateItemRequest{Title: &title}, nil); status != http.StatusNotFound {
+		t.Errorf("item update with view access: expected status %d, got %d", http.StatusNotFound, status)
+	}
+
+	t.Run("contribute", func(t *testing.T) {
+		var access []apiAlbumAccess
+		if status := apiRequest(t, r, http.MethodPut, "/api/v1/albums/summer/access", aliceToken, apiSetAlbumAccessRequest{User: "bob", Access: accessContribute}, &access); status != http.StatusOK || len(access) != 1 || access[0].Access != accessContribute {
+			t.Fatalf("contribute access: got status %d, access %+v", status, access)
+		}
+
+		w := uploadShared(t, r, "/shared/alice/albums/summer/upload", "shell.jpg", bob)
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/shared/alice/albums/summer" {
+			t.Fatalf("upload: got %d %q", w.Code, w.Header().Get("Location"))
+		}
+		if s3.GetObject(testMediaBucket, "alice/summer/shell.jpg") == nil {
+			t.Errorf("upload not stored in the album of the owner")
+		}
+
+		var upload apiUpload
+		if status := apiRequest(t, r, http.MethodPost, "/api/v1/shared/alice/albums/summer/uploads", bobToken, apiCreateUploadRequest{Name: "clip.mp4", Size: int64(len(testMP4))}, &upload); status != http.StatusCreated {
+			t.Fatalf("chunked upload: got status %d", status)
+		}
+		if status := apiRequest(t, r, http.MethodGet, "/api/v1/uploads/"+upload.ID, aliceToken, nil, nil); status != http.StatusNotFound {
+			t.Errorf("upload of other user: expected status %d, got %d", http.StatusNotFound, status)
+		}
+		var uploaded apiMediaItem
+		if w := patchUpload(t, r, upload.ID, bobToken, 0, testMP4, &uploaded); w.Code != http.StatusCreated || uploaded.URL != "/shared/alice/albums/summer/clip.mp4" {
+			t.Errorf("chunked upload: got %d, item %+v", w.Code, uploaded)
+		}
+		if s3.GetObject(testMediaBucket, "alice/summer/clip.mp4") == nil {
+			t.Errorf("chunked upload not stored in the album of the owner")
+		}
+
+		if w := doRequest(r, http.MethodPost, "/shared/alice/albums/summer/caption", caption, bob); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/shared/alice/albums/summer" {
+			t.Fatalf("caption: got %d %q", w.Code, w.Header().Get("Location"))
+		}
+		var item apiMediaItem
+		if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/summer/items/beach.jpg", aliceToken, nil, &item); status != http.StatusOK || item.Title != "Beach" || item.Notes != notes {
+			t.Errorf("caption not set: got status %d, item %+v", status, item)
+		}
+		var shared apiMediaItem
+		if status := apiRequest(t, r, http.MethodGet, "/api/v1/shared/alice/albums/summer/items/beach.jpg", bobToken, nil, &shared); status != http.StatusOK || shared.Title != "Beach" || shared.Notes != "" {
+			t.Errorf("shared item: got status %d, item %+v", status, shared)
+		}
+		var updated apiMediaItem
+		if status := apiRequest(t, r, http.MethodPatch, "/api/v1/shared/alice/albums/summer/items/sunset.jpg", bobToken, apiUpdateItemRequest{Title: &title, Tags: &[]string{"dusk"}}, &updated); status != http.StatusOK ||
+			updated.Title != "Shore" || !reflect.DeepEqual(updated.Tags, []string{"dusk"}) {
+			t.Errorf("item update: got status %d, item %+v", status, updated)
+		}
+		favorite := true
+		for target, body := range map[string]apiUpdateItemRequest{
+			"/api/v1/shared/alice/albums/summer/items/sunset.jpg": {Favorite: &favorite},
+			"/api/v1/shared/alice/albums/summer/items/beach.jpg":  {Notes: &notes},
+			"/api/v1/shared/alice/albums/summer":                  {},
+		} {
+			if status := apiRequest(t, r, http.MethodPatch, target, bobToken, body, nil); status == http.StatusOK {
+				t.Errorf("%s %+v: got status %d", target, body, status)
+			}
+		}
+
+		var edits []apiCaptionEdit
+		if status := apiRequest(t, r, http.MethodGet, "/api/v1/shared/alice/albums/summer/items/beach.jpg/history", bobToken, nil, &edits); status != http.StatusOK || len(edits) != 1 || edits[0].Username != "bob" {
+			t.Errorf("history: got status %d, edits %+v", status, edits)
+		}
+	})
+
+	t.Run("groups", func(t *testing.T) {
+		if status := apiRequest(t, r, http.MethodPut, "/api/v1/groups/family", bobToken, apiSetGroupRequest{Members: []string{"bob"}}, nil); status != http.StatusForbidden {
+			t.Errorf("group of non-admin: expected status %d, got %d", http.StatusForbidden, status)
+		}
+		var group apiGroup
+		if status := apiRequest(t, r, http.MethodPut, "/api/v1/groups/family", aliceToken, apiSetGroupRequest{Members: []string{"bob"}}, &group); status != http.StatusOK || len(group.Members) != 1 {
+			t.Fatalf("create group: got status %d, group %+v", status, group)
+		}
+		if status := apiRequest(t, r, http.MethodPut, "/api/v1/albums/winter/access", aliceToken, apiSetAlbumAccessRequest{Group: "family", Access: accessView}, nil); status != http.StatusOK {
+			t.Fatalf("share with group: got status %d", status)
+		}
+
+		var shared []apiSharedAlbum
+		if status := apiRequest(t, r, http.MethodGet, "/api/v1/shared", bobToken, nil, &shared); status != http.StatusOK || len(shared) != 2 {
+			t.Fatalf("shared albums: got status %d, albums %+v", status, shared)
+		}
+		if shared[1].Album.Name != "winter" || shared[1].Owner != "alice" || shared[1].Access != accessView || shared[1].URL != "/shared/alice/albums/winter" {
+			t.Errorf("unexpected shared album %+v", shared[1])
+		}
+
+		var items []apiMediaItem
+		if status := apiRequest(t, r, http.MethodGet, "/api/v1/shared/alice/albums/winter/items", bobToken, nil, &items); status != http.StatusOK || len(items) != 1 || !strings.HasPrefix(items[0].ThumbnailURL, "/shared/alice/thumbnails/winter/") {
+			t.Errorf("items of shared album: got status %d, items %+v", status, items)
+		}
+
+		if status := apiRequest(t, r, http.MethodDelete, "/api/v1/groups/family", aliceToken, nil, nil); status != http.StatusNoContent {
+			t.Errorf("delete group: expected status %d, got %d", http.StatusNoContent, status)
+		}
+		if status := apiRequest(t, r, http.MethodGet, "/api/v1/shared/alice/albums/winter", bobToken, nil, nil); status != http.StatusNotFound {
+			t.Errorf("album of deleted group: expected status %d, got %d", http.StatusNotFound, status)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, req := range []struct {
+			body   apiSetAlbumAccessRequest
+			status int
+		}{
+			{apiSetAlbumAccessRequest{User: "alice", Access: accessView}, http.StatusBadRequest},
+			{apiSetAlbumAccessRequest{User: "bob", Access: accessOwner}, http.StatusBadRequest},
+			{apiSetAlbumAccessRequest{User: "bob", Group: "family", Access: accessView}, http.StatusBadRequest},
+			{apiSetAlbumAccessRequest{User: "carol", Access: accessView}, http.StatusNotFound},
+			{apiSetAlbumAccessRequest{Group: "unknown", Access: accessView}, http.StatusNotFound},
+		} {
+			if status := apiRequest(t, r, http.MethodPut, "/api/v1/albums/summer/access", aliceToken, req.body, nil); status != req.status {
+				t.Errorf("%+v: expected status %d, got %d", req.body, req.status, status)
+			}
+		}
+		if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/summer/access", bobToken, nil, nil); status != http.StatusNotFound {
+			t.Errorf("access of other user: expected status %d, got %d", http.StatusNotFound, status)
+		}
+	})
+
+	t.Run("rename and remove", func(t *testing.T) {
+		var job apiJob
+		if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/summer", aliceToken, apiUpdateAlbumRequest{Name: "holiday"}, &job); status != http.StatusAccepted {
+			t.Fatalf("rename: expected status %d, got %d", http.StatusAccepted, status)
+		}
+		jobs.get("alice", job.ID).wait()
+		if w := doRequest(r, http.MethodGet, "/shared/alice/albums/holiday", nil, bob); w.Code != http.StatusOK {
+			t.Errorf("renamed album: got status %d", w.Code)
+		}
+
+		if w := doRequest(r, http.MethodPost, "/albums/holiday/access", url.Values{"user": {"bob"}, "access": {""}}, alice); w.Code != http.StatusSeeOther {
+			t.Fatalf("remove access: got %d", w.Code)
+		}
+		if w := doRequest(r, http.MethodGet, "/shared/alice/albums/holiday", nil, bob); w.Code != http.StatusNotFound {
+			t.Errorf("removed access: expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+}
+
+// uploadShared posts a JPEG as multipart form to the upload route of a
+// shared album
+func uploadShared(t *testing.T, r http.Handler, target, name string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("files", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(testJPEG); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.AddCookie(cookie)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
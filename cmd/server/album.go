@@ -2,115 +2,637 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/minio/minio-go/v7"
-	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"net/http"
-	"net/url"
 	"path"
+	"s3photoalbum/internal"
 	"strings"
-	"time"
 )
 
-type Album struct {
-	gorm.Model
-	Name  string `gorm:"not null"`
-	Cover string `gorm:"not null"`
+var (
+	errAlbumName     = errors.New("invalid album name")
+	errAlbumExists   = errors.New("album already exists")
+	errAlbumNotFound = errors.New("album not found")
+)
+
+// albumStatus returns the HTTP status for errors of the album operations
+func albumStatus(err error) int {
+	switch {
+	case errors.Is(err, errAlbumName), errors.Is(err, errAlbumDetails):
+		return http.StatusBadRequest
+	case errors.Is(err, errAlbumNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errAlbumExists), errors.Is(err, errAlbumBusy):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// albumSettings are the columns of the albums set by the users instead of the
+// index, they are kept when renaming albums
+var albumSettings = []string{"keep_empty", "cover_name", "title", "description", "start_date", "end_date", "position"}
+
+func getAlbumsByUsername(username string) ([]s3photoalbum.Album, error) {
+
+	var albums []s3photoalbum.Album
+	err := DB.Where("owner = ?", username).Order("name").Find(&albums).Error
+	return albums, err
 }
 
-func getAlbumsByUsername(username string) ([]Album, error) {
+// getSubAlbums returns the albums directly in the parent album, the
+// top-level albums for an empty parent, in one of the album sort orders
+func getSubAlbums(owner, parent, sort string) ([]s3photoalbum.Album, error) {
+
+	order, ok := albumSortColumns[sort]
+	if !ok {
+		order = albumSortColumns[albumSortManual]
+	}
 
-	var albums []Album
-	albumNames, err := listObjectsByPrefix(username + "/")
+	var albums []s3photoalbum.Album
+	err := DB.Where("owner = ? AND parent = ?", owner, parent).Order(order).Find(&albums).Error
+	return albums, err
+}
+
+// breadcrumb is a link to an enclosing album on the album page
+type breadcrumb struct {
+	Name string
+	URL  string
+}
 
-	for _, v := range albumNames {
-		coverImg, err2 := listFirstObjectByPrefix(username + "/" + v + "/")
-		if err2 != nil {
-			return albums, err2
+// albumBreadcrumbs returns the links to the index page and all albums
+// enclosing the album the user has access to
+func albumBreadcrumbs(username, owner, album string) ([]breadcrumb, error) {
+
+	crumbs := []breadcrumb{{Name: "Albums", URL: "/"}}
+	elems := strings.Split(album, "/")
+	for i := range elems[:len(elems)-1] {
+		name := path.Join(elems[:i+1]...)
+		access, err := albumAccess(username, owner, name)
+		if err != nil {
+			return nil, err
+		}
+		if access == "" {
+			continue
 		}
-		albums = append(albums, Album{
-			Name:  v,
-			Cover: "/thumbnails/" + v + "/" + coverImg + ".jpg",
+		crumbs = append(crumbs, breadcrumb{
+			Name: elems[i],
+			URL:  escapedPath(albumsPath(username, owner), name),
 		})
 	}
-	return albums, err
+	return crumbs, nil
 }
 
 func albumHandler(c *gin.Context) {
 
-	images, err := listObjectsByPrefix(path.Join(c.GetString("username"), c.Param("album")) + "/")
+	username, owner := c.GetString("username"), albumOwner(c)
+	name := c.GetString("album")
+
+	access, err := albumAccess(username, owner, name)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if access == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	query := parseAlbumQuery(c)
+	page, err := listAlbumPage(owner, name, query)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	keys := make([]string, len(page.Items))
+	for i, item := range page.Items {
+		keys[i] = item.Key
+	}
+	info, err := findItemInfo(username, keys)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	subAlbums, err := getSubAlbums(owner, name, albumSortManual)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Nil for albums that do not exist yet
+	album, err := findAlbum(owner, name)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	title, coverName := path.Base(name), ""
+	if album != nil {
+		title, coverName = albumDisplayTitle(*album), album.CoverName
+	}
+
+	breadcrumbs, err := albumBreadcrumbs(username, owner, name)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	data := gin.H{
+		"context":        c,
+		"albumTitle":     title,
+		"albumPath":      name,
+		"album":          album,
+		"owner":          owner,
+		"isOwner":        access == accessOwner,
+		"canContribute":  accessRanks[access] >= accessRanks[accessContribute],
+		"albumsPath":     albumsPath(username, owner),
+		"thumbnailsPath": thumbnailsPath(username, owner),
+		"breadcrumbs":    breadcrumbs,
+		"images":         page.Items,
+		"info":           info,
+		"coverName":      coverName,
+		"sort":           query.Sort,
+		"desc":           query.Desc,
+		"limit":          query.Limit,
+	}
+	if page.Prev != "" {
+		data["prevURL"] = query.url("before", page.Prev)
+	}
+	if page.Next != "" {
+		data["nextURL"] = query.url("after", page.Next)
+	}
+
+	if access != accessOwner {
+		data["sharedAlbums"] = sharedSubAlbums(subAlbums, access)
+		c.HTML(http.StatusOK, "album.html", data)
+		return
+	}
+	data["albums"] = subAlbums
 
+	// Targets for moving and copying
+	albums, err := getAlbumsByUsername(owner)
 	if err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	targets := []string{}
+	for _, target := range albums {
+		if target.Name != name {
+			targets = append(targets, target.Name)
+		}
+	}
+	data["targets"] = targets
+
+	// Users and groups the album is shared with
+	if album != nil {
+		sharedWith, err := listAlbumAccess(owner, name)
+		if err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		data["sharedWith"] = sharedWith
+	}
+
+	c.HTML(http.StatusOK, "album.html", data)
+}
+
+// findAlbum returns the album of the owner, nil if there is none
+func findAlbum(owner, name string) (*s3photoalbum.Album, error) {
+	var albums []s3photoalbum.Album
+	if err := DB.Where("owner = ? AND name = ?", owner, name).Limit(1).Find(&albums).Error; err != nil || len(albums) == 0 {
+		return nil, err
+	}
+	return &albums[0], nil
+}
+
+// createAlbum creates an empty album, which is kept until it is deleted.
+// Enclosing albums are created as needed.
+func createAlbum(owner, name string) (*s3photoalbum.Album, error) {
+
+	if !validNewAlbumPath(name) {
+		return nil, errAlbumName
+	}
+
+	existing, err := findAlbum(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, errAlbumExists
+	}
+
+	album := s3photoalbum.Album{Owner: owner, Name: name, Parent: parentAlbum(name), KeepEmpty: true}
+	if err := DB.Create(&album).Error; err != nil {
+		return nil, err
+	}
+	if err := index.UpdateAlbums(owner); err != nil {
+		return nil, err
+	}
+	return &album, nil
+}
+
+// startRenameAlbum starts a job moving all media of the album, including
+// its sub-albums, and their thumbnails to the new name. The new name is a
+// path too, so albums can be moved to other albums.
+func startRenameAlbum(owner, name, newName string) (*albumJob, error) {
+
+	if !validAlbumPath(name) || !validNewAlbumPath(newName) {
+		return nil, errAlbumName
+	}
+	if strings.HasPrefix(newName, name+"/") {
+		return nil, fmt.Errorf("%w: album can't be moved into itself", errAlbumName)
+	}
+
+	album, err := findAlbum(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	if album == nil {
+		return nil, errAlbumNotFound
+	}
+
+	existing, err := findAlbum(owner, newName)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, errAlbumExists
+	}
+
+	job := &albumJob{Owner: owner, Operation: jobRename, Album: name, Target: newName}
+	return job, jobs.start(job, renameAlbum)
+}
+
+// startDeleteAlbum starts a job deleting all media of the album, including
+// its sub-albums, and their thumbnails
+func startDeleteAlbum(owner, name string) (*albumJob, error) {
+
+	if !validAlbumPath(name) {
+		return nil, errAlbumName
+	}
+
+	album, err := findAlbum(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	if album == nil {
+		return nil, errAlbumNotFound
+	}
+
+	job := &albumJob{Owner: owner, Operation: jobDelete, Album: name}
+	return job, jobs.start(job, deleteAlbum)
+}
+
+// listAlbumKeys returns the keys of all media below the album prefix. The
+// bucket is listed, as the index may lag behind.
+func listAlbumKeys(ctx context.Context, owner, album string) ([]string, error) {
+	var keys []string
+	for object := range store.List(ctx, config.S3MediaBucket, s3photoalbum.ListOptions{
+		Prefix:    path.Join(owner, album) + "/",
+		Recursive: true,
+	}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		keys = append(keys, object.Key)
+	}
+	return keys, nil
+}
+
+func renameAlbum(job *albumJob) error {
+
+	ctx := context.Background()
+	oldPrefix := path.Join(job.Owner, job.Album) + "/"
+	newPrefix := path.Join(job.Owner, job.Target) + "/"
+
+	// Keep the settings of the albums. Read before moving, as albums without
+	// media are removed from the index with their last item.
+	var kept []s3photoalbum.Album
+	if err := inAlbum(DB.Where("owner = ?", job.Owner), "name", job.Album).Find(&kept).Error; err != nil {
+		return err
 	}
 
-	c.HTML(http.StatusOK, "album.html", 
-	gin.H{
-			"context": c,
-			"albumTitle": c.Param("album"),
-			"images": images,
+	keys, err := listAlbumKeys(ctx, job.Owner, job.Album)
+	if err != nil {
+		return err
+	}
+	job.setTotal(len(keys))
+
+	for _, key := range keys {
+		if err := moveObject(ctx, key, newPrefix+strings.TrimPrefix(key, oldPrefix)); err != nil {
+			return err
+		}
+		job.advance()
+	}
+
+	for _, album := range kept {
+		name := job.Target + strings.TrimPrefix(album.Name, job.Album)
+		if err := DB.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "owner"}, {Name: "name"}},
+			DoUpdates: clause.AssignmentColumns(albumSettings),
+		}).Create(&s3photoalbum.Album{
+			Owner:       job.Owner,
+			Name:        name,
+			Parent:      parentAlbum(name),
+			CoverName:   album.CoverName,
+			Title:       album.Title,
+			Description: album.Description,
+			StartDate:   album.StartDate,
+			EndDate:     album.EndDate,
+			Position:    album.Position,
+			KeepEmpty:   album.KeepEmpty,
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	if err := moveShareLinks(job.Owner, job.Album, job.Target); err != nil {
+		return err
+	}
+	if err := moveAlbumAccess(job.Owner, job.Album, job.Target); err != nil {
+		return err
+	}
+	if err := inAlbum(DB.Unscoped().Where("owner = ?", job.Owner), "name", job.Album).Delete(&s3photoalbum.Album{}).Error; err != nil {
+		return err
+	}
+	return index.UpdateAlbums(job.Owner)
+}
+
+func deleteAlbum(job *albumJob) error {
+
+	ctx := context.Background()
+
+	keys, err := listAlbumKeys(ctx, job.Owner, job.Album)
+	if err != nil {
+		return err
+	}
+	job.setTotal(len(keys))
+
+	for _, key := range keys {
+		if err := deleteObject(ctx, key); err != nil {
+			return err
+		}
+		job.advance()
+	}
+
+	if err := deleteShareLinks(job.Owner, job.Album); err != nil {
+		return err
+	}
+	if err := deleteAlbumAccess(job.Owner, job.Album); err != nil {
+		return err
+	}
+	if err := inAlbum(DB.Unscoped().Where("owner = ?", job.Owner), "name", job.Album).Delete(&s3photoalbum.Album{}).Error; err != nil {
+		return err
+	}
+	return index.UpdateAlbums(job.Owner)
+}
+
+// moveObject moves a media object and its thumbnail to a new key
+func moveObject(ctx context.Context, key, newKey string) error {
+	if err := copyObject(ctx, key, newKey); err != nil {
+		return err
+	}
+	if err := moveFavorites(key, newKey); err != nil {
+		return err
+	}
+	return deleteObject(ctx, key)
+}
+
+// copyObject copies a media object and its thumbnail to a new key. The
+// thumbnail is copied first, so that the thumbnailer finds it when it is
+// notified about the new media and does not create it again.
+func copyObject(ctx context.Context, key, newKey string) error {
+
+	if _, err := store.Copy(ctx, config.S3ThumbnailBucket, key+".jpg", newKey+".jpg"); err != nil && !errors.Is(err, s3photoalbum.ErrNotExist) {
+		return err
+	}
+	if _, err := store.Copy(ctx, config.S3MediaBucket, key, newKey); err != nil {
+		return err
+	}
+	if err := index.Update(ctx, newKey); err != nil {
+		return err
+	}
+	if err := copyCaption(key, newKey); err != nil {
+		return err
+	}
+	if err := copyTags(key, newKey); err != nil {
+		return err
+	}
+	urlCache.forget(config.S3MediaBucket, newKey)
+	urlCache.forget(config.S3ThumbnailBucket, newKey+".jpg")
+	return nil
+}
+
+// deleteObject deletes a media object and its thumbnail
+func deleteObject(ctx context.Context, key string) error {
+
+	if err := store.Delete(ctx, config.S3MediaBucket, key); err != nil {
+		return err
+	}
+	if err := store.Delete(ctx, config.S3ThumbnailBucket, key+".jpg"); err != nil {
+		return err
+	}
+	if err := deleteCaption(key); err != nil {
+		return err
+	}
+	if err := deleteFavorites(key); err != nil {
+		return err
+	}
+	return index.Remove(key)
+}
+
+// createAlbumHandler creates an empty album from the form on the index page
+func createAlbumHandler(c *gin.Context) {
+
+	album, err := createAlbum(c.GetString("username"), c.PostForm("name"))
+	if err != nil {
+		if albumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(albumStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, escapedPath("/albums", album.Name))
+}
+
+func renameAlbumHandler(c *gin.Context) {
+
+	job, err := startRenameAlbum(c.GetString("username"), c.GetString("album"), c.PostForm("name"))
+	if err != nil {
+		if albumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(albumStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, escapedPath("/jobs", job.ID))
+}
+
+// confirmDeleteAlbumHandler asks for confirmation before deleting an album
+func confirmDeleteAlbumHandler(c *gin.Context) {
+
+	owner := c.GetString("username")
+	album, err := findAlbum(owner, c.GetString("album"))
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if album == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	// Including the media of the sub-albums
+	var itemCount int64
+	if err := inAlbum(DB.Model(&s3photoalbum.MediaItem{}).Where("owner = ?", owner), "album", album.Name).Count(&itemCount).Error; err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.HTML(http.StatusOK, "album_delete.html", gin.H{
+		"context":   c,
+		"title":     "Delete " + album.Name,
+		"album":     album,
+		"itemCount": itemCount,
 	})
 }
 
-func checkBucketKeyExists(key, bucket string) bool {
-	_, err := minioClient.StatObject(context.Background(), bucket, key, minio.StatObjectOptions{})
-	return err == nil
+func deleteAlbumHandler(c *gin.Context) {
+
+	job, err := startDeleteAlbum(c.GetString("username"), c.GetString("album"))
+	if err != nil {
+		if albumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(albumStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, escapedPath("/jobs", job.ID))
 }
 
-func getFullResURI(imgPath string) string {
+// findMediaItem returns the indexed media item with the key, nil if there is
+// none
+func findMediaItem(key string) (*s3photoalbum.MediaItem, error) {
+	var items []s3photoalbum.MediaItem
+	if err := DB.Where("key = ?", key).Limit(1).Find(&items).Error; err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return &items[0], nil
+}
 
-	reqParams := make(url.Values)
+// lookupObject returns the indexed media item an object of the media or
+// thumbnail bucket belongs to, nil if the object does not exist
+func lookupObject(bucket, key string) *s3photoalbum.MediaItem {
 
-	if !checkBucketKeyExists(imgPath,config.S3MediaBucket) {
-		log.Warnf("Image %s does not exist", imgPath)
-		return "/static/missing.png"
+	if urlCache.isMissing(bucket, key) {
+		return nil
 	}
 
-	// Generates a presigned url which expires in a hour.
-	presignedURL, err := minioClient.PresignedGetObject(context.Background(),config.S3MediaBucket, imgPath, time.Second*1*60*60, reqParams)
+	mediaKey := key
+	if bucket == config.S3ThumbnailBucket {
+		if !strings.HasSuffix(key, ".jpg") {
+			return nil
+		}
+		mediaKey = strings.TrimSuffix(key, ".jpg")
+	}
+
+	item, err := findMediaItem(mediaKey)
 	if err != nil {
-		log.Warn(err)
-		return "/static/missing.png"
+		log.Error(err)
+		return nil
 	}
 
-	log.Debug("Found full-res URL: ", presignedURL.String())
-	return presignedURL.String()
+	// Check if the real file exists and has a thumbnail
+	if item == nil || (bucket == config.S3ThumbnailBucket && item.ThumbnailStatus != s3photoalbum.ThumbnailReady) {
+		log.Debugf("Object %s/%s does not exist", bucket, key)
+		urlCache.addMissing(bucket, key)
+		return nil
+	}
+	return item
 }
 
-func getThumbnailURI(thumbPath string) string {
-	// Set request parameters for content-disposition.
-	reqParams := make(url.Values)
+// getObjectURI returns a presigned URL of the object
+func getObjectURI(bucket, key string) string {
 	// TODO for download
 	// reqParams.Set("response-content-disposition", "attachment; filename=\""+ps.ByName("image")+"\"")
 
-	// Check if the real file exists
-	if !checkBucketKeyExists(strings.TrimSuffix(thumbPath, ".jpg"),config.S3MediaBucket) {
-		return "/static/missing.png"
-	}
-
-	// Check if a thumbnail exists
-	if !checkBucketKeyExists(thumbPath,config.S3ThumbnailBucket) {
+	item := lookupObject(bucket, key)
+	if item == nil {
 		return "/static/missing.png"
 	}
 
-	presignedURL, err := minioClient.PresignedGetObject(context.Background(), config.S3ThumbnailBucket, thumbPath, time.Second*1*60*60, reqParams)
+	// Thumbnails are regenerated when the media changes, so the ETag of the
+	// media identifies the thumbnail version too
+	presignedURL, err := presign(bucket, key, item.ETag)
 	if err != nil {
 		log.Error(err)
 		return "/static/missing.png"
 	}
 
-	log.Debug("Found thumbnail URL: ", presignedURL.String())
-	return presignedURL.String()
-
+	log.Debug("Found URL: ", presignedURL)
+	return presignedURL
 }
 
-func thumbnailHandler(c *gin.Context) {
-	imgPath := path.Join(c.GetString("username"), c.Param("album"), c.Param("image"))
-	c.Redirect(http.StatusSeeOther, getThumbnailURI(imgPath))
+// serveObject delivers an object of the media or thumbnail bucket as
+// configured by MediaDelivery
+func serveObject(c *gin.Context, bucket, key string) {
+	if config.MediaDelivery == s3photoalbum.MediaDeliveryProxy {
+		proxyObject(c, bucket, key)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, getObjectURI(bucket, key))
 }
 
+// imageHandler serves the media item "item" of the album "album" in the
+// context
 func imageHandler(c *gin.Context) {
-	imgPath := path.Join(c.GetString("username"), c.Param("album"), c.Param("image"))
-	c.Redirect(http.StatusSeeOther, getFullResURI(imgPath))
+
+	album, item := c.GetString("album"), c.GetString("item")
+	ok, err := hasAlbumAccess(c, album, accessView)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	serveObject(c, config.S3MediaBucket, path.Join(albumOwner(c), album, item))
+}
+
+func thumbnailHandler(c *gin.Context) {
+	imgPath := albumParam(c)
+	if !validAlbumPath(imgPath) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	ok, err := hasAlbumAccess(c, parentAlbum(imgPath), accessView)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	serveObject(c, config.S3ThumbnailBucket, path.Join(albumOwner(c), imgPath))
 }
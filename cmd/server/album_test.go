@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// waitForJob waits for the job the response redirected to and returns it
+func waitForJob(t *testing.T, location, owner string) *albumJob {
+	t.Helper()
+
+	if !strings.HasPrefix(location, "/jobs/") {
+		t.Fatalf("expected redirect to a job, got %q", location)
+	}
+	job := jobs.get(owner, path.Base(location))
+	if job == nil {
+		t.Fatalf("job %s not found", location)
+	}
+	job.wait()
+	return job
+}
+
+// albumNames returns the names of the albums of the user from the API
+func albumNames(t *testing.T, r *gin.Engine, token string) []string {
+	t.Helper()
+
+	var albums []apiAlbum
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums", token, nil, &albums); status != http.StatusOK {
+		t.Fatalf("list albums: expected status %d, got %d", http.StatusOK, status)
+	}
+	names := []string{}
+	for _, album := range albums {
+		names = append(names, album.Name)
+	}
+	return names
+}
+
+func TestCreateAlbum(t *testing.T) {
+	r, _ := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	w := doRequest(r, http.MethodPost, "/albums", url.Values{"name": {"autumn"}}, cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/albums/autumn" {
+		t.Fatalf("expected redirect to the album, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	if w := doRequest(r, http.MethodPost, "/albums", url.Values{"name": {"autumn"}}, cookie); w.Code != http.StatusConflict {
+		t.Errorf("existing album: expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+	if w := doRequest(r, http.MethodPost, "/albums", url.Values{"name": {".."}}, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid name: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	var album apiAlbum
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums", token, apiCreateAlbumRequest{Name: "spring"}, &album); status != http.StatusCreated {
+		t.Fatalf("create album: expected status %d, got %d", http.StatusCreated, status)
+	}
+	if album != (apiAlbum{Name: "spring"}) {
+		t.Errorf("unexpected album %+v", album)
+	}
+
+	if names, expected := albumNames(t, r, token), []string{"autumn", "spring", "summer", "winter"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected albums %v, got %v", expected, names)
+	}
+
+	// Empty albums survive the reconciliation
+	if err := index.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var items []apiMediaItem
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/autumn/items", token, nil, &items); status != http.StatusOK || len(items) != 0 {
+		t.Errorf("empty album: got status %d, items %v", status, items)
+	}
+
+	w = doRequest(r, http.MethodGet, "/", nil, cookie)
+	if !strings.Contains(w.Body.String(), `<img src="/static/missing.png" alt="autumn"`) {
+		t.Errorf("expected placeholder cover for the empty album")
+	}
+}
+
+func TestRenameAlbum(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	w := doRequest(r, http.MethodPost, "/albums/summer/rename", url.Values{"name": {"holiday"}}, cookie)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect, got %d", w.Code)
+	}
+	job := waitForJob(t, w.Header().Get("Location"), "alice")
+	if status := job.status(); status.Err != nil || status.Total != 3 || status.Done != 3 {
+		t.Fatalf("unexpected job status %+v", status)
+	}
+
+	if w := doRequest(r, http.MethodGet, w.Header().Get("Location"), nil, cookie); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `href="/albums/holiday"`) {
+		t.Errorf("job page: got status %d without link to the album", w.Code)
+	}
+
+	for _, name := range []string{"beach.jpg", "sunset.jpg", "video.mp4"} {
+		if s3.GetObject(testMediaBucket, "alice/summer/"+name) != nil {
+			t.Errorf("%s not removed from the old album", name)
+		}
+		obj := s3.GetObject(testMediaBucket, "alice/holiday/"+name)
+		if obj == nil || !bytes.Equal(obj.Data, []byte("media alice/summer/"+name)) {
+			t.Errorf("%s not moved: %+v", name, obj)
+		}
+	}
+	if obj := s3.GetObject(testThumbBucket, "alice/holiday/beach.jpg.jpg"); obj == nil || s3.GetObject(testThumbBucket, "alice/summer/beach.jpg.jpg") != nil {
+		t.Errorf("thumbnail not moved")
+	}
+
+	if names, expected := albumNames(t, r, token), []string{"holiday", "winter"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected albums %v, got %v", expected, names)
+	}
+
+	var items []apiMediaItem
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/holiday/items", token, nil, &items); status != http.StatusOK || len(items) != 3 {
+		t.Errorf("renamed album: got status %d, items %v", status, items)
+	}
+
+	for name, tt := range map[string]struct {
+		album, target string
+		status        int
+	}{
+		"existing target": {"winter", "holiday", http.StatusConflict},
+		"missing album":   {"summer", "other", http.StatusNotFound},
+		"invalid name":    {"winter", "a/../b", http.StatusBadRequest},
+		"reserved name":   {"winter", "a/items", http.StatusBadRequest},
+		"into itself":     {"winter", "winter/a", http.StatusBadRequest},
+	} {
+		if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/"+tt.album, token, apiUpdateAlbumRequest{Name: tt.target}, nil); status != tt.status {
+			t.Errorf("%s: expected status %d, got %d", name, tt.status, status)
+		}
+	}
+
+	var apiJobResp apiJob
+	if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/winter", token, apiUpdateAlbumRequest{Name: "snow"}, &apiJobResp); status != http.StatusAccepted {
+		t.Fatalf("rename: expected status %d, got %d", http.StatusAccepted, status)
+	}
+	jobs.get("alice", apiJobResp.ID).wait()
+
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/jobs/"+apiJobResp.ID, token, nil, &apiJobResp); status != http.StatusOK ||
+		!apiJobResp.Finished || apiJobResp.Done != 1 || apiJobResp.Error != "" {
+		t.Errorf("job: got status %d, job %+v", status, apiJobResp)
+	}
+
+	// Jobs of other users are not visible
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/jobs/"+apiJobResp.ID, apiLoginAs(t, r, "bob"), nil, nil); status != http.StatusNotFound {
+		t.Errorf("job of other user: expected status %d, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestDeleteAlbum(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	w := doRequest(r, http.MethodGet, "/albums/summer/delete", nil, cookie)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "all of its 3 photos and videos") {
+		t.Fatalf("confirmation page: got status %d", w.Code)
+	}
+	if w := doRequest(r, http.MethodGet, "/albums/party/delete", nil, cookie); w.Code != http.StatusNotFound {
+		t.Errorf("album of other user: expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	w = doRequest(r, http.MethodPost, "/albums/summer/delete", nil, cookie)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect, got %d", w.Code)
+	}
+	if status := waitForJob(t, w.Header().Get("Location"), "alice").status(); status.Err != nil || status.Done != 3 {
+		t.Fatalf("unexpected job status %+v", status)
+	}
+
+	for _, bucket := range []string{testMediaBucket, testThumbBucket} {
+		for _, key := range s3.Keys(bucket) {
+			if strings.HasPrefix(key, "alice/summer/") {
+				t.Errorf("%s/%s not deleted", bucket, key)
+			}
+		}
+	}
+	if names, expected := albumNames(t, r, token), []string{"winter"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected albums %v, got %v", expected, names)
+	}
+
+	// Empty albums are deleted too
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums", token, apiCreateAlbumRequest{Name: "empty"}, nil); status != http.StatusCreated {
+		t.Fatalf("create album: expected status %d, got %d", http.StatusCreated, status)
+	}
+	var job apiJob
+	if status := apiRequest(t, r, http.MethodDelete, "/api/v1/albums/empty", token, nil, &job); status != http.StatusAccepted {
+		t.Fatalf("delete album: expected status %d, got %d", http.StatusAccepted, status)
+	}
+	jobs.get("alice", job.ID).wait()
+	if names, expected := albumNames(t, r, token), []string{"winter"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected albums %v, got %v", expected, names)
+	}
+
+	if status := apiRequest(t, r, http.MethodDelete, "/api/v1/albums/party", token, nil, nil); status != http.StatusNotFound {
+		t.Errorf("album of other user: expected status %d, got %d", http.StatusNotFound, status)
+	}
+	if s3.GetObject(testMediaBucket, "bob/party/cake.jpg") == nil {
+		t.Errorf("media of other user deleted")
+	}
+}
+
+func TestFailedAlbumJob(t *testing.T) {
+	r, _ := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+
+	job := &albumJob{Owner: "alice", Operation: jobDelete, Album: "trip #1/day 2"}
+	if err := jobs.start(job, func(*albumJob) error { return errors.New("storage unavailable") }); err != nil {
+		t.Fatal(err)
+	}
+	job.wait()
+
+	// The link back to the album is escaped like the other album URLs
+	w := doRequest(r, http.MethodGet, "/jobs/"+job.ID, nil, cookie)
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, "Failed: storage unavailable") ||
+		!strings.Contains(body, `<a href="/albums/trip%20%231/day%202">Back to the album</a>`) {
+		t.Errorf("job page: got status %d, body %s", w.Code, body)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Albums can be nested to any depth, so their routes take the album path as
+// wildcard parameter. Actions and items follow the album path, e.g.
+// /albums/2021/summer/rename or /api/v1/albums/2021/summer/items/beach.jpg,
+// the handlers registered for the wildcard routes dispatch them.
+
+// reservedAlbumNames can't be used for new albums, as they are the actions
+// following the album paths in the routes
+var reservedAlbumNames = map[string]bool{
+	"access":   true,
+	"caption":  true,
+	"copy":     true,
+	"cover":    true,
+	"delete":   true,
+	"details":  true,
+	"favorite": true,
+	"items":    true,
+	"move":     true,
+	"rename":   true,
+	"share":    true,
+	"shares":   true,
+	"upload":   true,
+	"uploads":  true,
+}
+
+// validAlbumPath checks that s is a path of albums that can be used as part
+// of an object key without escaping the user's prefix
+func validAlbumPath(s string) bool {
+	for _, elem := range strings.Split(s, "/") {
+		if !validPathElement(elem) {
+			return false
+		}
+	}
+	return true
+}
+
+// validNewAlbumPath checks that s can be used as path of a new album
+func validNewAlbumPath(s string) bool {
+	if !validAlbumPath(s) {
+		return false
+	}
+	for _, elem := range strings.Split(s, "/") {
+		if reservedAlbumNames[elem] {
+			return false
+		}
+	}
+	return true
+}
+
+// parentAlbum returns the path of the album containing the album, empty for
+// top-level albums
+func parentAlbum(album string) string {
+	if parent := path.Dir(album); parent != "." {
+		return parent
+	}
+	return ""
+}
+
+// albumsOverlap reports whether the albums are the same or one contains the
+// other
+func albumsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// inAlbum restricts the query to the rows whose column is the album or one
+// of the albums below it
+func inAlbum(query *gorm.DB, column, album string) *gorm.DB {
+	// Names below the album sort between "<album>/" and "<album>0", as '0'
+	// follows '/'
+	return query.Where(fmt.Sprintf("(%s = ? OR (%s >= ? AND %s < ?))", column, column, column),
+		album, album+"/", album+"0")
+}
+
+// albumParam returns the album path of a wildcard route
+func albumParam(c *gin.Context) string {
+	return strings.Trim(c.Param("album"), "/")
+}
+
+// withAlbum passes the album path of a wildcard route to the handler as
+// "album" in the context
+func withAlbum(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("album", albumParam(c))
+		handler(c)
+	}
+}
+
+// albumActionRoute dispatches the wildcard route to the handler of the action
+// in its last element, passing the album path before it as "album" in the
+// context. notFound handles unknown actions.
+func albumActionRoute(actions map[string]gin.HandlerFunc, notFound gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		p := albumParam(c)
+		handler, ok := actions[path.Base(p)]
+		if !ok || parentAlbum(p) == "" {
+			notFound(c)
+			return
+		}
+
+		c.Set("album", parentAlbum(p))
+		handler(c)
+	}
+}
+
+// albumPageRoute handles GET requests below /albums: media items, album pages
+// and the confirmation page for deleting an album, in this order. The albums
+// of other users shared with the user are handled below /shared/<owner>/albums.
+func albumPageRoute(c *gin.Context) {
+
+	owner := albumOwner(c)
+	p := albumParam(c)
+	if !validAlbumPath(p) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	item, err := findMediaItem(path.Join(owner, p))
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if item != nil {
+		c.Set("album", parentAlbum(p))
+		c.Set("item", path.Base(p))
+		imageHandler(c)
+		return
+	}
+
+	album, err := findAlbum(owner, p)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	parent := parentAlbum(p)
+	switch {
+	case album == nil && parent != "" && path.Base(p) == "delete" && owner == c.GetString("username"):
+		c.Set("album", parent)
+		confirmDeleteAlbumHandler(c)
+	case album == nil && parent != "" && uploadContentTypes[strings.ToLower(path.Ext(p))] != "":
+		// Media that does not exist (yet)
+		c.Set("album", parent)
+		c.Set("item", path.Base(p))
+		imageHandler(c)
+	default:
+		// Also shown for albums that do not exist yet, to upload to them
+		c.Set("album", p)
+		albumHandler(c)
+	}
+}
+
+// apiAlbumRoute handles GET requests below /api/v1/albums: the items of an
+// album, a single item, the history of its caption, who the album is shared
+// with and albums
+func apiAlbumRoute(c *gin.Context) {
+
+	p := albumParam(c)
+	parent := parentAlbum(p)
+	switch {
+	case path.Base(p) == "history" && path.Base(parentAlbum(parent)) == "items":
+		c.Set("album", parentAlbum(parentAlbum(parent)))
+		c.Set("item", path.Base(parent))
+		apiGetItemHistory(c)
+	case path.Base(p) == "items":
+		c.Set("album", parent)
+		apiListAlbumItems(c)
+	case path.Base(parent) == "items":
+		c.Set("album", parentAlbum(parent))
+		c.Set("item", path.Base(p))
+		apiGetAlbumItem(c)
+	case path.Base(p) == "access" && parent != "":
+		c.Set("album", parent)
+		apiListAlbumAccess(c)
+	default:
+		c.Set("album", p)
+		apiGetAlbum(c)
+	}
+}
+
+// apiPatchAlbumRoute handles PATCH requests below /api/v1/albums: single items
+// and albums
+func apiPatchAlbumRoute(c *gin.Context) {
+
+	p := albumParam(c)
+	parent := parentAlbum(p)
+	if path.Base(parent) == "items" {
+		c.Set("album", parentAlbum(parent))
+		c.Set("item", path.Base(p))
+		apiUpdateAlbumItem(c)
+		return
+	}
+
+	c.Set("album", p)
+	apiUpdateAlbum(c)
+}
+
+// apiPatchSharedAlbumRoute handles PATCH requests below /api/v1/shared: only
+// single items, the albums are changed by their owners
+func apiPatchSharedAlbumRoute(c *gin.Context) {
+
+	p := albumParam(c)
+	parent := parentAlbum(p)
+	if path.Base(parent) != "items" {
+		apiError(c, http.StatusNotFound, "not found")
+		return
+	}
+
+	c.Set("album", parentAlbum(parent))
+	c.Set("item", path.Base(p))
+	apiUpdateAlbumItem(c)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAlbumsOverlap(t *testing.T) {
+	for _, tt := range []struct {
+		a, b     string
+		expected bool
+	}{
+		{"2021", "2021", true},
+		{"2021", "2021/summer", true},
+		{"2021/summer/beach", "2021", true},
+		{"2021", "2021-old", false},
+		{"2021/summer", "2021/winter", false},
+	} {
+		if got := albumsOverlap(tt.a, tt.b); got != tt.expected {
+			t.Errorf("albumsOverlap(%q, %q): expected %v, got %v", tt.a, tt.b, tt.expected, got)
+		}
+	}
+}
+
+func TestNestedAlbums(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	for _, key := range []string{"alice/2021/summer/a.jpg", "alice/2021/b.jpg"} {
+		if err := s3.PutObject(testMediaBucket, key, []byte("media "+key), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s3.PutObject(testThumbBucket, key+".jpg", []byte("thumb "+key), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index page only shows the top-level albums
+	w := doRequest(r, http.MethodGet, "/", nil, cookie)
+	if !strings.Contains(w.Body.String(), `href="/albums/2021"`) || strings.Contains(w.Body.String(), `href="/albums/2021/summer"`) {
+		t.Errorf("expected only top-level albums on the index page")
+	}
+
+	w = doRequest(r, http.MethodGet, "/albums/2021/summer", nil, cookie)
+	for _, s := range []string{
+		`<a href="/">Albums</a>`,
+		`<a href="/albums/2021">2021</a>`,
+		`<h2>summer</h2>`,
+		`<img src="/thumbnails/2021/summer/a.jpg.jpg"`,
+		`action="/albums/2021/summer/upload"`,
+	} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("album page does not contain %s", s)
+		}
+	}
+
+	w = doRequest(r, http.MethodGet, "/albums/2021", nil, cookie)
+	for _, s := range []string{
+		`<a href="/albums/2021/summer">`,
+		`<img src="/thumbnails/2021/summer/a.jpg.jpg" alt="summer"`,
+		`<img src="/thumbnails/2021/b.jpg.jpg" alt="image"`,
+	} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("album page does not contain %s", s)
+		}
+	}
+
+	for _, tt := range []struct {
+		path, location string
+	}{
+		{"/albums/2021/summer/a.jpg", s3.URL + "/" + testMediaBucket + "/alice/2021/summer/a.jpg?"},
+		{"/thumbnails/2021/summer/a.jpg.jpg", s3.URL + "/" + testThumbBucket + "/alice/2021/summer/a.jpg.jpg?"},
+		{"/albums/2021/summer/nope.jpg", "/static/missing.png"},
+	} {
+		w := doRequest(r, http.MethodGet, tt.path, nil, cookie)
+		if location := w.Header().Get("Location"); w.Code != http.StatusSeeOther || !strings.HasPrefix(location, tt.location) {
+			t.Errorf("%s: expected redirect to %s, got %d %s", tt.path, tt.location, w.Code, location)
+		}
+	}
+
+	// Paths can't leave the user's prefix
+	for _, p := range []string{"/albums/../bob/party/cake.jpg", "/thumbnails/../bob/party/cake.jpg.jpg"} {
+		if w := doRequest(r, http.MethodGet, p, nil, cookie); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got %d", p, http.StatusNotFound, w.Code)
+		}
+	}
+
+	if names, expected := albumNames(t, r, token), []string{"2021", "2021/summer", "summer", "winter"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected albums %v, got %v", expected, names)
+	}
+
+	var album apiAlbum
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/2021", token, nil, &album); status != http.StatusOK ||
+		album != (apiAlbum{Name: "2021", Cover: "/thumbnails/2021/b.jpg.jpg", ItemCount: 1, AlbumCount: 1}) {
+		t.Errorf("got status %d, album %+v", status, album)
+	}
+	var item apiMediaItem
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/2021/summer/items/a.jpg", token, nil, &item); status != http.StatusOK ||
+		item.URL != "/albums/2021/summer/a.jpg" || item.ThumbnailURL != "/thumbnails/2021/summer/a.jpg.jpg" {
+		t.Errorf("got status %d, item %+v", status, item)
+	}
+	var items []apiMediaItem
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/2021/items", token, nil, &items); status != http.StatusOK || len(items) != 1 {
+		t.Errorf("got status %d, items %+v", status, items)
+	}
+
+	// Enclosing albums are created with new albums
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums", token, apiCreateAlbumRequest{Name: "2022/spring/new"}, &album); status != http.StatusCreated ||
+		album.Parent != "2022/spring" {
+		t.Fatalf("create album: got status %d, album %+v", status, album)
+	}
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/2022", token, nil, &album); status != http.StatusOK || album.AlbumCount != 1 {
+		t.Errorf("got status %d, album %+v", status, album)
+	}
+
+	// Moving an album moves its sub-albums too
+	var job apiJob
+	if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/2021", token, apiUpdateAlbumRequest{Name: "2022/old"}, &job); status != http.StatusAccepted {
+		t.Fatalf("rename: expected status %d, got %d", http.StatusAccepted, status)
+	}
+	jobs.get("alice", job.ID).wait()
+	if s3.GetObject(testMediaBucket, "alice/2022/old/summer/a.jpg") == nil || s3.GetObject(testThumbBucket, "alice/2022/old/b.jpg.jpg") == nil {
+		t.Errorf("media not moved: %v", s3.Keys(testMediaBucket))
+	}
+	if names, expected := albumNames(t, r, token), []string{"2022", "2022/old", "2022/old/summer", "2022/spring", "2022/spring/new", "summer", "winter"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected albums %v, got %v", expected, names)
+	}
+
+	w = doRequest(r, http.MethodGet, "/albums/2022/delete", nil, cookie)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "all of its 2 photos and videos") {
+		t.Fatalf("confirmation page: got status %d", w.Code)
+	}
+	w = doRequest(r, http.MethodPost, "/albums/2022/delete", nil, cookie)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect, got %d", w.Code)
+	}
+	waitForJob(t, w.Header().Get("Location"), "alice")
+	if names, expected := albumNames(t, r, token), []string{"summer", "winter"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected albums %v, got %v", expected, names)
+	}
+	for _, key := range s3.Keys(testMediaBucket) {
+		if strings.HasPrefix(key, "alice/2022/") {
+			t.Errorf("%s not deleted", key)
+		}
+	}
+}
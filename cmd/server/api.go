@@ -0,0 +1,832 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"path"
+	"s3photoalbum/internal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types returned by the JSON API. They are kept separate from the database
+// models so that no internal fields (e.g. password hashes) are leaked.
+
+type apiErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type apiToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type apiAlbum struct {
+	// Path of the album, e.g. "2021/summer" for nested albums
+	Name string `json:"name"`
+	// Name of the enclosing album, empty for top-level albums
+	Parent string `json:"parent,omitempty"`
+	Cover  string `json:"cover"`
+	// Name of the item chosen as cover, empty if picked automatically
+	CoverItem   string `json:"coverItem,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Dates formatted as YYYY-MM-DD
+	StartDate  string `json:"startDate,omitempty"`
+	EndDate    string `json:"endDate,omitempty"`
+	Position   int    `json:"position"`
+	ItemCount  int    `json:"itemCount"`
+	AlbumCount int    `json:"albumCount"`
+}
+
+type apiMediaItem struct {
+	Key          string    `json:"key"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	ContentType  string    `json:"contentType,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	ThumbnailURL string    `json:"thumbnailUrl"`
+	URL          string    `json:"url"`
+	Title        string    `json:"title,omitempty"`
+	Caption      string    `json:"caption,omitempty"`
+	Notes        string    `json:"notes,omitempty"`
+	// Tags set by the users and from the EXIF keywords
+	Tags []string `json:"tags,omitempty"`
+	// EXIF metadata, omitted if unknown
+	CaptureTime *time.Time `json:"captureTime,omitempty"`
+	Width       int        `json:"width,omitempty"`
+	Height      int        `json:"height,omitempty"`
+	CameraModel string     `json:"cameraModel,omitempty"`
+	LensModel   string     `json:"lensModel,omitempty"`
+	// In seconds
+	ExposureTime float64  `json:"exposureTime,omitempty"`
+	FNumber      float64  `json:"fNumber,omitempty"`
+	ISO          int      `json:"iso,omitempty"`
+	FocalLength  float64  `json:"focalLength,omitempty"`
+	Duration     float64  `json:"duration,omitempty"`
+	Latitude     *float64 `json:"latitude,omitempty"`
+	Longitude    *float64 `json:"longitude,omitempty"`
+	Altitude     *float64 `json:"altitude,omitempty"`
+	// Names of the nearest city, found offline by the thumbnailer
+	City    string `json:"city,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Country string `json:"country,omitempty"`
+	// Starred by the current user
+	Favorite bool `json:"favorite"`
+}
+
+type apiTag struct {
+	Name string `json:"name"`
+	// Number of media items with the tag
+	Count int `json:"count"`
+}
+
+type apiSmartAlbum struct {
+	Name string `json:"name"`
+	// Tags separated by commas, e.g. "beach, sunset, -night"
+	Query string `json:"query"`
+	// Thumbnail of the newest matching item, empty if none matches
+	Cover string `json:"cover"`
+}
+
+type apiTimelinePage struct {
+	// Newest first by the date taken
+	Items []apiMediaItem `json:"items"`
+	// Cursor for the "after" parameter of the next page, empty on the last
+	// page
+	Next string `json:"next"`
+}
+
+type apiTimelineMonth struct {
+	// Formatted as YYYY-MM
+	Month string `json:"month"`
+	// Number of media items taken in the month
+	Count int `json:"count"`
+}
+
+// apiGeoJSON is a GeoJSON feature collection of geotagged media items
+type apiGeoJSON struct {
+	// Always "FeatureCollection"
+	Type     string          `json:"type"`
+	Features []apiGeoFeature `json:"features"`
+}
+
+type apiGeoFeature struct {
+	// Always "Feature"
+	Type       string           `json:"type"`
+	Geometry   apiGeoPoint      `json:"geometry"`
+	Properties apiGeoProperties `json:"properties"`
+}
+
+type apiGeoPoint struct {
+	// Always "Point"
+	Type string `json:"type"`
+	// Longitude and latitude in degrees, followed by the altitude in meters
+	// if known
+	Coordinates []float64 `json:"coordinates"`
+}
+
+type apiGeoProperties struct {
+	Key          string     `json:"key"`
+	Name         string     `json:"name"`
+	Album        string     `json:"album"`
+	CaptureTime  *time.Time `json:"captureTime,omitempty"`
+	ThumbnailURL string     `json:"thumbnailUrl"`
+	URL          string     `json:"url"`
+}
+
+type apiShareLink struct {
+	Token string `json:"token"`
+	// Path of the shared album page, relative to the server
+	URL       string     `json:"url"`
+	Album     string     `json:"album"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Expired   bool       `json:"expired"`
+	// Whether the visitors have to enter a password
+	Password      bool `json:"password"`
+	AllowDownload bool `json:"allowDownload"`
+}
+
+type apiAlbumAccess struct {
+	// Either the user or the group the album is shared with
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+	// "view" or "contribute"
+	Access    string    `json:"access"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type apiSharedAlbum struct {
+	Owner string `json:"owner"`
+	// "view" or "contribute"
+	Access string `json:"access"`
+	// Path of the album page, the album is found below /api/v1 at the same
+	// path
+	URL   string   `json:"url"`
+	Album apiAlbum `json:"album"`
+}
+
+type apiGroup struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+type apiCaptionEdit struct {
+	Username string `json:"username"`
+	// One of title, caption, notes and tags
+	Field    string    `json:"field"`
+	OldValue string    `json:"oldValue"`
+	NewValue string    `json:"newValue"`
+	Time     time.Time `json:"time"`
+}
+
+type apiUpload struct {
+	ID     string `json:"id"`
+	Album  string `json:"album"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+}
+
+type apiJob struct {
+	ID        string `json:"id"`
+	Operation string `json:"operation"`
+	Album     string `json:"album"`
+	Target    string `json:"target,omitempty"`
+	Total     int    `json:"total"`
+	Done      int    `json:"done"`
+	Finished  bool   `json:"finished"`
+	Error     string `json:"error,omitempty"`
+}
+
+type apiUser struct {
+	ID       uint   `json:"id"`
+	Username string `json:"username"`
+	IsAdmin  bool   `json:"isAdmin"`
+}
+
+type apiCacheMetrics struct {
+	Hits         uint64 `json:"hits"`
+	NegativeHits uint64 `json:"negativeHits"`
+	Misses       uint64 `json:"misses"`
+	Evictions    uint64 `json:"evictions"`
+	Size         int    `json:"size"`
+}
+
+type apiMetrics struct {
+	PresignCache apiCacheMetrics `json:"presignCache"`
+}
+
+type apiLoginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type apiCreateUserRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	IsAdmin  bool   `json:"isAdmin"`
+}
+
+type apiCreateAlbumRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type apiUpdateAlbumRequest struct {
+	// New name of the album
+	Name string `json:"name" binding:"required"`
+}
+
+type apiUpdateItemRequest struct {
+	// Fields that are left out are kept
+	Title   *string `json:"title,omitempty"`
+	Caption *string `json:"caption,omitempty"`
+	Notes   *string `json:"notes,omitempty"`
+	// Tags set by the users, replacing the current ones. The tags from the
+	// EXIF keywords are kept.
+	Tags *[]string `json:"tags,omitempty"`
+	// Stars or unstars the item for the current user
+	Favorite *bool `json:"favorite,omitempty"`
+}
+
+type apiCreateSmartAlbumRequest struct {
+	Name string `json:"name" binding:"required"`
+	// Tags separated by commas, those prefixed with a minus are excluded
+	Query string `json:"query" binding:"required"`
+}
+
+type apiCreateShareLinkRequest struct {
+	// Omitted for links that don't expire
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Omitted for links without password
+	Password      string `json:"password,omitempty"`
+	AllowDownload bool   `json:"allowDownload"`
+}
+
+type apiSetAlbumAccessRequest struct {
+	// Either the user or the group to share the album with
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+	// "view" or "contribute", empty to remove the access
+	Access string `json:"access"`
+}
+
+type apiSetGroupRequest struct {
+	// Usernames of the members
+	Members []string `json:"members"`
+}
+
+type apiTransferItemsRequest struct {
+	// Names of the items in the album
+	Items []string `json:"items" binding:"required"`
+	// Name of the album to copy or move them to
+	Target string `json:"target" binding:"required"`
+}
+
+type apiSetCoverRequest struct {
+	// Name of an item in the album, empty to pick the cover automatically
+	Item string `json:"item"`
+}
+
+type apiSetDetailsRequest struct {
+	// Shown instead of the name, empty to show the name
+	Title string `json:"title"`
+	// Markdown text shown on the album page
+	Description string `json:"description"`
+	// Dates formatted as YYYY-MM-DD, empty if not set
+	StartDate string `json:"startDate"`
+	EndDate   string `json:"endDate"`
+	// Position in the manual order of the albums, lower first
+	Position int `json:"position"`
+}
+
+type apiCreateUploadRequest struct {
+	Name string `json:"name" binding:"required"`
+	Size int64  `json:"size"`
+}
+
+// apiError aborts the request with a JSON error body
+func apiError(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, apiErrorResponse{Error: message})
+}
+
+// validPathElement checks that a parameter can be used as single element of
+// an object key without escaping the user's prefix
+func validPathElement(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.Contains(s, "/")
+}
+
+// escapedPath joins the elements to an URL path, escaping them as needed
+func escapedPath(elem ...string) string {
+	return (&url.URL{Path: path.Join(elem...)}).EscapedPath()
+}
+
+func newAPIUser(user User) apiUser {
+	return apiUser{
+		ID:       user.ID,
+		Username: user.Username,
+		IsAdmin:  user.IsAdmin,
+	}
+}
+
+// newAPIMediaItem converts the item, with the paths the user finds it at
+func newAPIMediaItem(username string, item s3photoalbum.MediaItem, info itemInfo) apiMediaItem {
+	return apiMediaItem{
+		Key:          item.Key,
+		Name:         item.Name,
+		Size:         item.Size,
+		LastModified: item.LastModified,
+		ContentType:  item.ContentType,
+		ETag:         item.ETag,
+		ThumbnailURL: escapedPath(thumbnailsPath(username, item.Owner), item.Album, item.Name+".jpg"),
+		URL:          escapedPath(albumsPath(username, item.Owner), item.Album, item.Name),
+		Title:        info.Caption.Title,
+		Caption:      info.Caption.Caption,
+		Notes:        info.Caption.Notes,
+		Tags:         info.Tags,
+		CaptureTime:  item.CaptureTime,
+		Width:        item.Width,
+		Height:       item.Height,
+		CameraModel:  item.CameraModel,
+		LensModel:    item.LensModel,
+		ExposureTime: item.ExposureTime,
+		FNumber:      item.FNumber,
+		ISO:          item.ISO,
+		FocalLength:  item.FocalLength,
+		Duration:     item.Duration,
+		Latitude:     item.Latitude,
+		Longitude:    item.Longitude,
+		Altitude:     item.Altitude,
+		City:         item.City,
+		Region:       item.Region,
+		Country:      item.Country,
+		Favorite:     info.Favorite,
+	}
+}
+
+// newAPIMediaItems converts the items together with their captions, tags and
+// whether the user has starred them
+func newAPIMediaItems(username string, items []s3photoalbum.MediaItem) ([]apiMediaItem, error) {
+
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	info, err := findItemInfo(username, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []apiMediaItem{}
+	for _, item := range items {
+		ret = append(ret, newAPIMediaItem(username, item, info[item.Key]))
+	}
+	return ret, nil
+}
+
+func newAPISmartAlbum(album SmartAlbum, cover string) apiSmartAlbum {
+	return apiSmartAlbum{
+		Name:  album.Name,
+		Query: album.Query,
+		Cover: cover,
+	}
+}
+
+func newAPICaptionEdit(edit ItemCaptionEdit) apiCaptionEdit {
+	return apiCaptionEdit{
+		Username: edit.Username,
+		Field:    edit.Field,
+		OldValue: edit.OldValue,
+		NewValue: edit.NewValue,
+		Time:     edit.CreatedAt,
+	}
+}
+
+func newAPIUpload(upload Upload) apiUpload {
+	return apiUpload{
+		ID:     upload.ID,
+		Album:  upload.Album,
+		Name:   upload.Name,
+		Size:   upload.Size,
+		Offset: upload.Offset,
+	}
+}
+
+func newAPIJob(job *albumJob) apiJob {
+	status := job.status()
+	ret := apiJob{
+		ID:        job.ID,
+		Operation: job.Operation,
+		Album:     job.Album,
+		Target:    job.Target,
+		Total:     status.Total,
+		Done:      status.Done,
+		Finished:  status.Finished(),
+	}
+	if status.Err != nil {
+		ret.Error = status.Err.Error()
+	}
+	return ret
+}
+
+func newAPIAlbum(album s3photoalbum.Album) apiAlbum {
+	return apiAlbum{
+		Name:        album.Name,
+		Parent:      album.Parent,
+		Cover:       album.Cover,
+		CoverItem:   album.CoverName,
+		Title:       album.Title,
+		Description: album.Description,
+		StartDate:   formatDate(album.StartDate),
+		EndDate:     formatDate(album.EndDate),
+		Position:    album.Position,
+		ItemCount:   album.ItemCount,
+		AlbumCount:  album.AlbumCount,
+	}
+}
+
+// setupAPIRoutes registers the JSON API below /api/v1
+func setupAPIRoutes(r *gin.Engine) {
+
+	api := r.Group("/api/v1")
+	api.POST("/login", apiLogin)
+
+	// Routes accessible to logged in users
+	api.Use(verifyAPIToken)
+	api.GET("/me", apiGetMe)
+	api.GET("/albums", apiListAlbums)
+	api.POST("/albums", apiCreateAlbum)
+	api.GET("/albums/*album", apiAlbumRoute)
+	api.PATCH("/albums/*album", apiPatchAlbumRoute)
+	api.DELETE("/albums/*album", withAlbum(apiDeleteAlbum))
+	api.PUT("/albums/*album", albumActionRoute(map[string]gin.HandlerFunc{
+		"access":  apiSetAlbumAccess,
+		"cover":   apiSetAlbumCover,
+		"details": apiSetAlbumDetails,
+	}, func(c *gin.Context) { apiError(c, http.StatusNotFound, "not found") }))
+	api.POST("/albums/*album", albumActionRoute(map[string]gin.HandlerFunc{
+		"copy":    apiTransferItems(transferCopy),
+		"move":    apiTransferItems(transferMove),
+		"shares":  apiCreateShareLink,
+		"uploads": apiCreateUpload,
+	}, func(c *gin.Context) { apiError(c, http.StatusNotFound, "not found") }))
+	api.GET("/uploads/:id", apiGetUpload)
+	api.PATCH("/uploads/:id", apiPatchUpload)
+	api.DELETE("/uploads/:id", apiDeleteUpload)
+	api.GET("/jobs/:id", apiGetJob)
+	api.GET("/tags", apiListTags)
+	api.GET("/tags/:tag/items", apiListTagItems)
+	api.GET("/smart-albums", apiListSmartAlbums)
+	api.POST("/smart-albums", apiCreateSmartAlbum)
+	api.GET("/smart-albums/:name/items", apiListSmartAlbumItems)
+	api.DELETE("/smart-albums/:name", apiDeleteSmartAlbum)
+	api.GET("/search", apiSearch)
+	api.GET("/favorites", apiListFavorites)
+	api.GET("/timeline", apiGetTimeline)
+	api.GET("/timeline/months", apiListTimelineMonths)
+	api.GET("/map", apiGetMap)
+	api.GET("/shares", apiListShareLinks)
+	api.DELETE("/shares/:token", apiDeleteShareLink)
+	api.GET("/shared", apiListSharedAlbums)
+	api.GET("/shared/:owner/albums/*album", sharedAlbumRoute(apiAlbumRoute))
+	api.PATCH("/shared/:owner/albums/*album", sharedAlbumRoute(apiPatchSharedAlbumRoute))
+	api.POST("/shared/:owner/albums/*album", sharedAlbumRoute(albumActionRoute(map[string]gin.HandlerFunc{
+		"uploads": apiCreateUpload,
+	}, func(c *gin.Context) { apiError(c, http.StatusNotFound, "not found") })))
+	api.GET("/groups", apiListGroups)
+
+	// Routes accessible to admins only
+	api.Use(verifyAPIAdmin)
+	api.GET("/users", apiListUsers)
+	api.POST("/users", apiCreateUser)
+	api.DELETE("/users/:id", apiDeleteUser)
+	api.PUT("/groups/:name", apiSetGroup)
+	api.DELETE("/groups/:name", apiDeleteGroup)
+	api.GET("/metrics", apiGetMetrics)
+}
+
+func apiLogin(c *gin.Context) {
+
+	var req apiLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "username and password are required")
+		return
+	}
+
+	user, err := checkCredentials(req.Username, req.Password)
+	if err != nil {
+		log.Warn("Invalid credentials", err)
+		apiError(c, http.StatusUnauthorized, "authentication failed")
+		return
+	}
+
+	token, err := generateToken(*user)
+	if err != nil {
+		log.Error("token error", err)
+		apiError(c, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+
+	claims, err := validateToken(token)
+	if err != nil {
+		log.Error("token error", err)
+		apiError(c, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+
+	c.JSON(http.StatusOK, apiToken{
+		Token:     token,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+	})
+}
+
+func apiGetMe(c *gin.Context) {
+	user, err := findUserByID(c.GetUint("id"))
+	if err != nil || user.ID == 0 {
+		apiError(c, http.StatusNotFound, "user not found")
+		return
+	}
+	c.JSON(http.StatusOK, newAPIUser(*user))
+}
+
+func apiListAlbums(c *gin.Context) {
+
+	albums, err := getAlbumsByUsername(c.GetString("username"))
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list albums")
+		return
+	}
+
+	ret := []apiAlbum{}
+	for _, album := range albums {
+		ret = append(ret, newAPIAlbum(album))
+	}
+
+	c.JSON(http.StatusOK, ret)
+}
+
+func apiGetAlbum(c *gin.Context) {
+
+	name := c.GetString("album")
+	if !validAlbumPath(name) {
+		apiError(c, http.StatusBadRequest, "invalid album name")
+		return
+	}
+
+	ok, err := hasAlbumAccess(c, name, accessView)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to get album")
+		return
+	}
+	album, err := findAlbum(albumOwner(c), name)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to get album")
+		return
+	}
+
+	if !ok || album == nil {
+		apiError(c, http.StatusNotFound, "album not found")
+		return
+	}
+
+	ret := newAPIAlbum(*album)
+	ret.Cover = coverPath(c.GetString("username"), album.Owner, ret.Cover)
+	c.JSON(http.StatusOK, ret)
+}
+
+func apiCreateAlbum(c *gin.Context) {
+
+	var req apiCreateAlbumRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	album, err := createAlbum(c.GetString("username"), req.Name)
+	if err != nil {
+		if albumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, albumStatus(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, newAPIAlbum(*album))
+}
+
+// apiUpdateAlbum renames the album in the background, the progress can be
+// followed with the returned job
+func apiUpdateAlbum(c *gin.Context) {
+
+	var req apiUpdateAlbumRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	job, err := startRenameAlbum(c.GetString("username"), c.GetString("album"), req.Name)
+	if err != nil {
+		if albumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, albumStatus(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusAccepted, newAPIJob(job))
+}
+
+// apiDeleteAlbum deletes the album in the background, the progress can be
+// followed with the returned job
+func apiDeleteAlbum(c *gin.Context) {
+
+	job, err := startDeleteAlbum(c.GetString("username"), c.GetString("album"))
+	if err != nil {
+		if albumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, albumStatus(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusAccepted, newAPIJob(job))
+}
+
+func apiListAlbumItems(c *gin.Context) {
+
+	album := c.GetString("album")
+	if !validAlbumPath(album) {
+		apiError(c, http.StatusBadRequest, "invalid album name")
+		return
+	}
+
+	ok, err := hasAlbumAccess(c, album, accessView)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list album")
+		return
+	}
+	existing, err := findAlbum(albumOwner(c), album)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list album")
+		return
+	}
+	if !ok || existing == nil {
+		apiError(c, http.StatusNotFound, "album not found")
+		return
+	}
+
+	var items []s3photoalbum.MediaItem
+	if err := DB.Where("owner = ? AND album = ?", albumOwner(c), album).Order("name").Find(&items).Error; err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list album")
+		return
+	}
+
+	ret, err := newAPIMediaItems(c.GetString("username"), items)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list album")
+		return
+	}
+
+	c.JSON(http.StatusOK, ret)
+}
+
+func apiGetAlbumItem(c *gin.Context) {
+
+	album := c.GetString("album")
+	item := c.GetString("item")
+	if !validAlbumPath(album) || !validPathElement(item) {
+		apiError(c, http.StatusBadRequest, "invalid album or item name")
+		return
+	}
+
+	ok, err := hasAlbumAccess(c, album, accessView)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to get item")
+		return
+	}
+	mediaItem, err := findMediaItem(path.Join(albumOwner(c), album, item))
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to get item")
+		return
+	}
+	if !ok || mediaItem == nil {
+		apiError(c, http.StatusNotFound, "item not found")
+		return
+	}
+
+	info, err := findItemInfo(c.GetString("username"), []string{mediaItem.Key})
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to get item")
+		return
+	}
+
+	c.JSON(http.StatusOK, newAPIMediaItem(c.GetString("username"), *mediaItem, info[mediaItem.Key]))
+}
+
+func apiListUsers(c *gin.Context) {
+
+	var users []User
+	if res := DB.Find(&users); res.Error != nil {
+		log.Error(res.Error)
+		apiError(c, http.StatusInternalServerError, "failed to list users")
+		return
+	}
+
+	ret := []apiUser{}
+	for _, user := range users {
+		ret = append(ret, newAPIUser(user))
+	}
+
+	c.JSON(http.StatusOK, ret)
+}
+
+func apiCreateUser(c *gin.Context) {
+
+	var req apiCreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "username and password are required")
+		return
+	}
+
+	if existing, err := findUserByUsername(req.Username); err == nil && existing.ID != 0 {
+		apiError(c, http.StatusConflict, "user already exists")
+		return
+	}
+
+	passwordHash, err := hashAndSalt(req.Password)
+	if err != nil {
+		log.Error("failed to hash pass", err)
+		apiError(c, http.StatusInternalServerError, "failed to create user")
+		return
+	}
+
+	user, err := insertUser(req.Username, passwordHash, req.IsAdmin)
+	if err != nil {
+		log.Error("failed to insert user", err)
+		apiError(c, http.StatusInternalServerError, "failed to create user")
+		return
+	}
+
+	c.JSON(http.StatusCreated, newAPIUser(*user))
+}
+
+func apiDeleteUser(c *gin.Context) {
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	user, err := findUserByID(uint(id))
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to delete user")
+		return
+	}
+
+	result := DB.Unscoped().Delete(&User{}, id)
+	if result.Error != nil {
+		log.Error(result.Error)
+		apiError(c, http.StatusConflict, result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		apiError(c, http.StatusNotFound, "user not found")
+		return
+	}
+	if err := deleteUserAccess(user.Username); err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to delete user")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func apiGetMetrics(c *gin.Context) {
+	stats := urlCache.statistics()
+	c.JSON(http.StatusOK, apiMetrics{
+		PresignCache: apiCacheMetrics{
+			Hits:         stats.Hits,
+			NegativeHits: stats.NegativeHits,
+			Misses:       stats.Misses,
+			Evictions:    stats.Evictions,
+			Size:         stats.Size,
+		},
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiRequest sends a JSON request, authenticated with the bearer token if
+// it is not empty, and decodes the response into out
+func apiRequest(t *testing.T, r *gin.Engine, method, target, token string, body, out interface{}) int {
+	t.Helper()
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, target, &reqBody)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if out != nil && w.Body.Len() > 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: invalid JSON response %q: %v", method, target, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+// apiLoginAs returns a token for the user obtained from the API
+func apiLoginAs(t *testing.T, r *gin.Engine, username string) string {
+	t.Helper()
+
+	var token apiToken
+	status := apiRequest(t, r, http.MethodPost, "/api/v1/login", "", apiLoginRequest{
+		Username: username,
+		Password: testPassword,
+	}, &token)
+
+	if status != http.StatusOK || token.Token == "" {
+		t.Fatalf("login as %s failed with status %d", username, status)
+	}
+	return token.Token
+}
+
+func TestAPIAuthentication(t *testing.T) {
+	r, _ := setupTestServer(t)
+
+	var errResp apiErrorResponse
+
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/login", "", apiLoginRequest{
+		Username: "alice",
+		Password: "wrong",
+	}, &errResp); status != http.StatusUnauthorized || errResp.Error == "" {
+		t.Errorf("login with wrong password: got status %d, error %q", status, errResp.Error)
+	}
+
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums", "", nil, &errResp); status != http.StatusUnauthorized {
+		t.Errorf("request without token: expected status %d, got %d", http.StatusUnauthorized, status)
+	}
+
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums", "invalid", nil, &errResp); status != http.StatusUnauthorized {
+		t.Errorf("request with invalid token: expected status %d, got %d", http.StatusUnauthorized, status)
+	}
+
+	var me apiUser
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/me", apiLoginAs(t, r, "bob"), nil, &me); status != http.StatusOK || me.Username != "bob" {
+		t.Errorf("request with token: got status %d, user %q", status, me.Username)
+	}
+
+	// The cookie set by the HTML login is accepted too
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/me", nil)
+	req.AddCookie(loginAs(t, r, "alice"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("request with cookie: expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	// And the bearer token for the HTML pages
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+apiLoginAs(t, r, "alice"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("HTML page with bearer token: expected status %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestAPIAlbums(t *testing.T) {
+	r, _ := setupTestServer(t)
+	token := apiLoginAs(t, r, "alice")
+
+	var albums []apiAlbum
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums", token, nil, &albums); status != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, status)
+	}
+
+	expected := []apiAlbum{
+		{Name: "summer", Cover: "/thumbnails/summer/beach.jpg.jpg", ItemCount: 3},
+		{Name: "winter", Cover: "/thumbnails/winter/snow.jpg.jpg", ItemCount: 1},
+	}
+	if len(albums) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, albums)
+	}
+	for i := range expected {
+		if albums[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], albums[i])
+		}
+	}
+
+	var album apiAlbum
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/winter", token, nil, &album); status != http.StatusOK || album != expected[1] {
+		t.Errorf("get album: got status %d, album %v", status, album)
+	}
+
+	var errResp apiErrorResponse
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/party", token, nil, &errResp); status != http.StatusNotFound || errResp.Error == "" {
+		t.Errorf("album of other user: got status %d, error %q", status, errResp.Error)
+	}
+}
+
+func TestAPIAlbumItems(t *testing.T) {
+	r, _ := setupTestServer(t)
+	token := apiLoginAs(t, r, "alice")
+
+	var items []apiMediaItem
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/summer/items", token, nil, &items); status != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, status)
+	}
+
+	if len(items) != 3 {
+		t.Fatalf("expected 3 items, got %v", items)
+	}
+
+	beach := items[0]
+	if beach.Key != "alice/summer/beach.jpg" ||
+		beach.Name != "beach.jpg" ||
+		beach.Size != int64(len("media alice/summer/beach.jpg")) ||
+		beach.LastModified.IsZero() ||
+		beach.ThumbnailURL != "/thumbnails/summer/beach.jpg.jpg" ||
+		beach.URL != "/albums/summer/beach.jpg" {
+		t.Errorf("unexpected item %+v", beach)
+	}
+
+	var item apiMediaItem
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/summer/items/sunset.jpg", token, nil, &item); status != http.StatusOK {
+		t.Fatalf("get item: expected status %d, got %d", http.StatusOK, status)
+	}
+	if item.Key != "alice/summer/sunset.jpg" || item.ContentType != "image/jpeg" || item.ETag == "" {
+		t.Errorf("unexpected item %+v", item)
+	}
+
+	for _, target := range []string{
+		"/api/v1/albums/summer/items/nope.jpg",
+		"/api/v1/albums/party/items/cake.jpg",
+		"/api/v1/albums/party/items",
+	} {
+		var errResp apiErrorResponse
+		if status := apiRequest(t, r, http.MethodGet, target, token, nil, &errResp); status != http.StatusNotFound || errResp.Error == "" {
+			t.Errorf("%s: got status %d, error %q", target, status, errResp.Error)
+		}
+	}
+}
+
+func TestAPIUsers(t *testing.T) {
+	r, _ := setupTestServer(t)
+	admin := apiLoginAs(t, r, "alice")
+
+	var errResp apiErrorResponse
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/users", apiLoginAs(t, r, "bob"), nil, &errResp); status != http.StatusForbidden {
+		t.Errorf("non-admin: expected status %d, got %d", http.StatusForbidden, status)
+	}
+
+	var created apiUser
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/users", admin, apiCreateUserRequest{
+		Username: "carol",
+		Password: "pass",
+	}, &created); status != http.StatusCreated || created.Username != "carol" || created.IsAdmin {
+		t.Fatalf("create user: got status %d, user %+v", status, created)
+	}
+
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/users", admin, apiCreateUserRequest{
+		Username: "carol",
+		Password: "pass",
+	}, &errResp); status != http.StatusConflict {
+		t.Errorf("create duplicate user: expected status %d, got %d", http.StatusConflict, status)
+	}
+
+	var users []apiUser
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/users", admin, nil, &users); status != http.StatusOK || len(users) != 3 {
+		t.Errorf("list users: got status %d, users %+v", status, users)
+	}
+
+	target := "/api/v1/users/" + strconv.FormatUint(uint64(created.ID), 10)
+	if status := apiRequest(t, r, http.MethodDelete, target, admin, nil, nil); status != http.StatusNoContent {
+		t.Errorf("delete user: expected status %d, got %d", http.StatusNoContent, status)
+	}
+	if status := apiRequest(t, r, http.MethodDelete, target, admin, nil, &errResp); status != http.StatusNotFound {
+		t.Errorf("delete deleted user: expected status %d, got %d", http.StatusNotFound, status)
+	}
+}
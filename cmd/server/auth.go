@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt"
@@ -8,6 +10,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -21,27 +24,67 @@ func verifyAdmin(c *gin.Context) {
 	c.Next()
 }
 
-func verifyToken(c *gin.Context) {
+// tokenFromRequest returns the JWT sent as "Authorization: Bearer" header
+// or, if there is none, as cookie
+func tokenFromRequest(c *gin.Context) (string, error) {
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer "), nil
+	}
+	return c.Cookie("token")
+}
 
-	token, err := c.Cookie("token")
+// authenticate validates the token of the request and stores the user's
+// claims in the context
+func authenticate(c *gin.Context) error {
+
+	token, err := tokenFromRequest(c)
 	if err != nil {
-		log.Info("No token cookie, redirecting")
-		c.Abort()
-		c.Redirect(http.StatusSeeOther, "/login")
-		return
+		return errors.New("no token")
 	}
 
 	claims, err := validateToken(token)
 	if err != nil {
-		log.Info("Failed to validate token, redirecting")
-		c.Abort()
-		c.Redirect(http.StatusSeeOther, "/login")
-		return
+		return err
 	}
 
 	c.Set("id", claims.UserID)
 	c.Set("username", claims.Subject)
 	c.Set("isadmin", claims.IsAdmin)
+	return nil
+}
+
+func verifyToken(c *gin.Context) {
+
+	if err := authenticate(c); err != nil {
+		log.Info("Failed to validate token, redirecting: ", err)
+		c.Abort()
+		c.Redirect(http.StatusSeeOther, "/login")
+		return
+	}
+
+	c.Next()
+}
+
+// verifyAPIToken is the verifyToken equivalent for the JSON API
+func verifyAPIToken(c *gin.Context) {
+
+	if err := authenticate(c); err != nil {
+		log.Info("Failed to validate API token: ", err)
+		apiError(c, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	c.Next()
+}
+
+// verifyAPIAdmin is the verifyAdmin equivalent for the JSON API
+func verifyAPIAdmin(c *gin.Context) {
+
+	if !c.GetBool("isadmin") {
+		apiError(c, http.StatusForbidden, "admin privileges required")
+		return
+	}
+
 	c.Next()
 }
 
@@ -69,6 +112,14 @@ type authClaims struct {
 	IsAdmin bool `json:"isadmin"`
 }
 
+// derivedKey returns a key for the purpose derived from the JWT key, so that
+// signatures made for one purpose aren't valid for another
+func derivedKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(config.JwtKey))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
 func generateToken(user User) (string, error) {
 	expiresAt := time.Now().Add(24 * time.Hour).Unix()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS512, authClaims{
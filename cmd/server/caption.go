@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ItemCaption is the title, caption and notes of a media item set by the
+// users. They are stored apart from the S3 objects and the index, and follow
+// the items when they are moved or copied.
+type ItemCaption struct {
+	Key       string `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// User of the last edit
+	UpdatedBy string `gorm:"not null;default:''"`
+	Title     string `gorm:"not null;default:''"`
+	Caption   string `gorm:"not null;default:''"`
+	Notes     string `gorm:"not null;default:''"`
+}
+
+// ItemCaptionEdit records the change of a field of an ItemCaption or of the
+// tags set by the users
+type ItemCaptionEdit struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	Key       string `gorm:"index;not null"`
+	Username  string `gorm:"not null"`
+	Field     string `gorm:"not null"`
+	OldValue  string `gorm:"not null"`
+	NewValue  string `gorm:"not null"`
+}
+
+// Upper limit for the length of the fields of the captions in characters
+const maxCaptionLength = 10000
+
+var errCaptionLength = fmt.Errorf("title, caption and notes are limited to %d characters", maxCaptionLength)
+
+// captionStatus returns the HTTP status for errors of setItemCaption and
+// setItemTags
+func captionStatus(err error) int {
+	if errors.Is(err, errCaptionLength) || errors.Is(err, errTagName) || errors.Is(err, errTagsLength) {
+		return http.StatusBadRequest
+	}
+	return transferStatus(err)
+}
+
+// itemInfo is the data of a media item set by the users
+type itemInfo struct {
+	Caption ItemCaption
+	// All tags, and only those set by the users
+	Tags       []string
+	ManualTags []string
+	// Starred by the current user
+	Favorite bool
+}
+
+// findItemInfo returns the captions and tags of the media items with the
+// keys and whether the user starred them, by key. The notes are private and
+// left out of the captions of items of other users.
+func findItemInfo(username string, keys []string) (map[string]itemInfo, error) {
+
+	captions, err := findCaptions(keys)
+	if err != nil {
+		return nil, err
+	}
+	tags, manualTags, err := findTags(keys)
+	if err != nil {
+		return nil, err
+	}
+	favorites, err := findFavorites(username, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]itemInfo{}
+	for _, key := range keys {
+		caption := captions[key]
+		if !strings.HasPrefix(key, username+"/") {
+			caption.Notes = ""
+		}
+		ret[key] = itemInfo{Caption: caption, Tags: tags[key], ManualTags: manualTags[key], Favorite: favorites[key]}
+	}
+	return ret, nil
+}
+
+// captionUpdate changes the fields of an ItemCaption, nil fields are kept
+type captionUpdate struct {
+	Title   *string
+	Caption *string
+	Notes   *string
+}
+
+// findCaptions returns the captions of the media items with the keys, by key.
+// Items without caption are left out.
+func findCaptions(keys []string) (map[string]ItemCaption, error) {
+
+	ret := map[string]ItemCaption{}
+	if len(keys) == 0 {
+		return ret, nil
+	}
+
+	var captions []ItemCaption
+	if err := DB.Where("key IN ?", keys).Find(&captions).Error; err != nil {
+		return nil, err
+	}
+	for _, caption := range captions {
+		ret[caption.Key] = caption
+	}
+	return ret, nil
+}
+
+// setItemCaption changes the caption of the item in the album of the owner
+// and records an edit by the user for every changed field
+func setItemCaption(username, owner, album, item string, update captionUpdate) error {
+
+	if !validAlbumPath(album) || !validPathElement(item) {
+		return errAlbumName
+	}
+
+	fields := []struct {
+		name  string
+		value *string
+		field func(*ItemCaption) *string
+	}{
+		{"title", update.Title, func(c *ItemCaption) *string { return &c.Title }},
+		{"caption", update.Caption, func(c *ItemCaption) *string { return &c.Caption }},
+		{"notes", update.Notes, func(c *ItemCaption) *string { return &c.Notes }},
+	}
+	for _, f := range fields {
+		if f.value != nil && utf8.RuneCountInString(*f.value) > maxCaptionLength {
+			return errCaptionLength
+		}
+	}
+
+	key := path.Join(owner, album, item)
+	mediaItem, err := findMediaItem(key)
+	if err != nil {
+		return err
+	}
+	if mediaItem == nil {
+		return fmt.Errorf("%w: %s", errItemNotFound, item)
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+
+		caption := ItemCaption{Key: key}
+		if err := tx.Where("key = ?", key).Limit(1).Find(&caption).Error; err != nil {
+			return err
+		}
+
+		var edits []ItemCaptionEdit
+		for _, f := range fields {
+			if current := f.field(&caption); f.value != nil && *f.value != *current {
+				edits = append(edits, ItemCaptionEdit{
+					Key:      key,
+					Username: username,
+					Field:    f.name,
+					OldValue: *current,
+					NewValue: *f.value,
+				})
+				*current = *f.value
+			}
+		}
+		if len(edits) == 0 {
+			return nil
+		}
+
+		caption.UpdatedBy = username
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&caption).Error; err != nil {
+			return err
+		}
+		return tx.Create(&edits).Error
+	})
+}
+
+// copyCaption copies the caption of the media item with the key and its
+// edits to newKey
+func copyCaption(key, newKey string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+
+		var captions []ItemCaption
+		if err := tx.Where("key = ?", key).Limit(1).Find(&captions).Error; err != nil || len(captions) == 0 {
+			return err
+		}
+		caption := captions[0]
+		caption.Key = newKey
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&caption).Error; err != nil {
+			return err
+		}
+
+		var edits []ItemCaptionEdit
+		if err := tx.Where("key = ?", key).Order("id").Find(&edits).Error; err != nil {
+			return err
+		}
+		for i := range edits {
+			edits[i].ID = 0
+			edits[i].Key = newKey
+		}
+		if len(edits) == 0 {
+			return nil
+		}
+		return tx.Create(&edits).Error
+	})
+}
+
+// deleteCaption deletes the caption of the media item with the key and its
+// edits
+func deleteCaption(key string) error {
+	if err := DB.Where("key = ?", key).Delete(&ItemCaptionEdit{}).Error; err != nil {
+		return err
+	}
+	return DB.Where("key = ?", key).Delete(&ItemCaption{}).Error
+}
+
+// captionHandler sets the caption and the tags of an item from the form in
+// the lightbox of the album page. The tags are separated by commas.
+func captionHandler(c *gin.Context) {
+
+	username, owner, album, item := c.GetString("username"), albumOwner(c), c.GetString("album"), c.PostForm("item")
+
+	ok, err := hasAlbumAccess(c, album, accessContribute)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	title, caption, notes := c.PostForm("title"), c.PostForm("caption"), c.PostForm("notes")
+	update := captionUpdate{Title: &title, Caption: &caption}
+	// The notes are private, the form of contributors leaves them out
+	if owner == username {
+		update.Notes = &notes
+	}
+	err = setItemCaption(username, owner, album, item, update)
+	if tags, ok := c.GetPostForm("tags"); ok && err == nil {
+		err = setItemTags(username, owner, album, item, strings.Split(tags, ","))
+	}
+	if err != nil {
+		if captionStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(captionStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, escapedPath(albumsPath(username, owner), album))
+}
+
+func apiUpdateAlbumItem(c *gin.Context) {
+
+	var req apiUpdateItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	username, owner := c.GetString("username"), albumOwner(c)
+	album, item := c.GetString("album"), c.GetString("item")
+
+	ok, err := hasAlbumAccess(c, album, accessContribute)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to update item")
+		return
+	}
+	if !ok {
+		apiError(c, http.StatusNotFound, "item not found")
+		return
+	}
+	// Favorites and notes stay with the owner
+	if req.Favorite != nil && owner != username {
+		apiError(c, http.StatusBadRequest, "favorites can only be set in own albums")
+		return
+	}
+	if req.Notes != nil && owner != username {
+		apiError(c, http.StatusBadRequest, "notes can only be set in own albums")
+		return
+	}
+
+	err = setItemCaption(username, owner, album, item, captionUpdate{
+		Title:   req.Title,
+		Caption: req.Caption,
+		Notes:   req.Notes,
+	})
+	if req.Tags != nil && err == nil {
+		err = setItemTags(username, owner, album, item, *req.Tags)
+	}
+	if req.Favorite != nil && err == nil {
+		err = setFavorite(username, owner, album, item, *req.Favorite)
+	}
+	if err != nil {
+		if captionStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, captionStatus(err), err.Error())
+		return
+	}
+
+	mediaItem, err := findMediaItem(path.Join(owner, album, item))
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to get item")
+		return
+	}
+	if mediaItem == nil {
+		apiError(c, http.StatusNotFound, "item not found")
+		return
+	}
+	info, err := findItemInfo(username, []string{mediaItem.Key})
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to get item")
+		return
+	}
+	c.JSON(http.StatusOK, newAPIMediaItem(username, *mediaItem, info[mediaItem.Key]))
+}
+
+// apiGetItemHistory lists the edits of the caption of an item, oldest first
+func apiGetItemHistory(c *gin.Context) {
+
+	album, item := c.GetString("album"), c.GetString("item")
+	if !validAlbumPath(album) || !validPathElement(item) {
+		apiError(c, http.StatusBadRequest, "invalid album or item name")
+		return
+	}
+
+	ok, err := hasAlbumAccess(c, album, accessView)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to get item")
+		return
+	}
+	key := path.Join(albumOwner(c), album, item)
+	mediaItem, err := findMediaItem(key)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to get item")
+		return
+	}
+	if !ok || mediaItem == nil {
+		apiError(c, http.StatusNotFound, "item not found")
+		return
+	}
+
+	var edits []ItemCaptionEdit
+	if err := DB.Where("key = ?", key).Order("id").Find(&edits).Error; err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to get history")
+		return
+	}
+
+	ret := []apiCaptionEdit{}
+	for _, edit := range edits {
+		// The notes are private to the owner
+		if edit.Field == "notes" && albumOwner(c) != c.GetString("username") {
+			continue
+		}
+		ret = append(ret, newAPICaptionEdit(edit))
+	}
+	c.JSON(http.StatusOK, ret)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestItemCaption(t *testing.T) {
+	r, _ := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	w := doRequest(r, http.MethodPost, "/albums/summer/caption", url.Values{
+		"item":    {"beach.jpg"},
+		"title":   {"Beach"},
+		"caption": {"Waves and sand"},
+		"notes":   {""},
+	}, cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/albums/summer" {
+		t.Fatalf("expected redirect to the album, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	notes := "Shot at noon"
+	var item apiMediaItem
+	if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/summer/items/beach.jpg", token, apiUpdateItemRequest{Notes: &notes}, &item); status != http.StatusOK ||
+		item.Title != "Beach" || item.Caption != "Waves and sand" || item.Notes != notes {
+		t.Fatalf("update item: got status %d, item %+v", status, item)
+	}
+
+	var items []apiMediaItem
+	apiRequest(t, r, http.MethodGet, "/api/v1/albums/summer/items", token, nil, &items)
+	if len(items) != 3 || items[0].Name != "beach.jpg" || items[0].Title != "Beach" || items[1].Title != "" {
+		t.Errorf("unexpected items %+v", items)
+	}
+
+	w = doRequest(r, http.MethodGet, "/albums/summer", nil, cookie)
+	for _, s := range []string{
+		`data-title="Beach" data-description=".caption-0"`,
+		`<p class="caption">Waves and sand</p>`,
+		`<p class="notes">Shot at noon</p>`,
+		`Edited by alice`,
+		`action="/albums/summer/caption"`,
+	} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("album page does not contain %s", s)
+		}
+	}
+
+	// Saving the same values records no edits
+	title := "Beach"
+	apiRequest(t, r, http.MethodPatch, "/api/v1/albums/summer/items/beach.jpg", token, apiUpdateItemRequest{Title: &title}, nil)
+
+	var history []apiCaptionEdit
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/summer/items/beach.jpg/history", token, nil, &history); status != http.StatusOK || len(history) != 3 {
+		t.Fatalf("history: got status %d, edits %+v", status, history)
+	}
+	for i, expected := range []apiCaptionEdit{
+		{Username: "alice", Field: "title", NewValue: "Beach"},
+		{Username: "alice", Field: "caption", NewValue: "Waves and sand"},
+		{Username: "alice", Field: "notes", NewValue: notes},
+	} {
+		if edit := history[i]; edit.Username != expected.Username || edit.Field != expected.Field ||
+			edit.OldValue != "" || edit.NewValue != expected.NewValue || edit.Time.IsZero() {
+			t.Errorf("edit %d: expected %+v, got %+v", i, expected, edit)
+		}
+	}
+
+	// The caption and its history follow the item
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums/summer/move", token, apiTransferItemsRequest{
+		Items:  []string{"beach.jpg"},
+		Target: "winter",
+	}, &items); status != http.StatusOK || len(items) != 1 || items[0].Title != "Beach" {
+		t.Fatalf("move: got status %d, items %+v", status, items)
+	}
+	var moved []apiCaptionEdit
+	if apiRequest(t, r, http.MethodGet, "/api/v1/albums/winter/items/beach.jpg/history", token, nil, &moved); len(moved) != 3 {
+		t.Errorf("history not moved: %+v", moved)
+	}
+	captions, err := findCaptions([]string{"alice/summer/beach.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captions) != 0 {
+		t.Errorf("caption of the old key not removed: %+v", captions)
+	}
+
+	long := strings.Repeat("x", maxCaptionLength+1)
+	for name, tt := range map[string]struct {
+		path   string
+		status int
+	}{
+		"missing item": {"/api/v1/albums/summer/items/beach.jpg", http.StatusNotFound},
+		"other user":   {"/api/v1/albums/party/items/cake.jpg", http.StatusNotFound},
+		"invalid name": {"/api/v1/albums/summer/items/..", http.StatusBadRequest},
+	} {
+		if status := apiRequest(t, r, http.MethodPatch, tt.path, token, apiUpdateItemRequest{Title: &title}, nil); status != tt.status {
+			t.Errorf("%s: expected status %d, got %d", name, tt.status, status)
+		}
+	}
+	if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/winter/items/beach.jpg", token, apiUpdateItemRequest{Caption: &long}, nil); status != http.StatusBadRequest {
+		t.Errorf("too long: expected status %d, got %d", http.StatusBadRequest, status)
+	}
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/party/items/cake.jpg/history", token, nil, nil); status != http.StatusNotFound {
+		t.Errorf("history of other user: expected status %d, got %d", http.StatusNotFound, status)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path"
+	"s3photoalbum/internal"
+)
+
+// setAlbumCover makes the media item with the name the cover of the album.
+// An empty name resets the cover to the one picked by the cover strategy.
+func setAlbumCover(owner, name, item string) (*s3photoalbum.Album, error) {
+
+	if !validAlbumPath(name) || (item != "" && !validPathElement(item)) {
+		return nil, errAlbumName
+	}
+
+	album, err := findAlbum(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	if album == nil {
+		return nil, errAlbumNotFound
+	}
+
+	if item != "" {
+		mediaItem, err := findMediaItem(path.Join(owner, name, item))
+		if err != nil {
+			return nil, err
+		}
+		if mediaItem == nil {
+			return nil, fmt.Errorf("%w: %s", errItemNotFound, item)
+		}
+	}
+
+	if err := DB.Model(album).Update("cover_name", item).Error; err != nil {
+		return nil, err
+	}
+	if err := index.UpdateAlbums(owner); err != nil {
+		return nil, err
+	}
+	return findAlbum(owner, name)
+}
+
+// coverHandler sets the cover of the album from the form on the album page
+func coverHandler(c *gin.Context) {
+
+	album := c.GetString("album")
+	if _, err := setAlbumCover(c.GetString("username"), album, c.PostForm("item")); err != nil {
+		if transferStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(transferStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, escapedPath("/albums", album))
+}
+
+func apiSetAlbumCover(c *gin.Context) {
+
+	var req apiSetCoverRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "item is required")
+		return
+	}
+
+	album, err := setAlbumCover(c.GetString("username"), c.GetString("album"), req.Item)
+	if err != nil {
+		if transferStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, transferStatus(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, newAPIAlbum(*album))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAlbumCover(t *testing.T) {
+	r, _ := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	w := doRequest(r, http.MethodPost, "/albums/summer/cover", url.Values{"item": {"sunset.jpg"}}, cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/albums/summer" {
+		t.Fatalf("expected redirect to the album, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	var album apiAlbum
+	apiRequest(t, r, http.MethodGet, "/api/v1/albums/summer", token, nil, &album)
+	if album.Cover != "/thumbnails/summer/sunset.jpg.jpg" || album.CoverItem != "sunset.jpg" {
+		t.Errorf("unexpected album %+v", album)
+	}
+
+	w = doRequest(r, http.MethodGet, "/albums/summer", nil, cookie)
+	if !strings.Contains(w.Body.String(), `value="sunset.jpg" class="cover chosen"`) {
+		t.Errorf("chosen cover not marked on the album page")
+	}
+	w = doRequest(r, http.MethodGet, "/", nil, cookie)
+	if !strings.Contains(w.Body.String(), `<img src="/thumbnails/summer/sunset.jpg.jpg" alt="summer"`) {
+		t.Errorf("chosen cover not shown on the index page")
+	}
+
+	// The cover is kept by the reconciler and when renaming the album
+	if err := index.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var job apiJob
+	if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/summer", token, apiUpdateAlbumRequest{Name: "holiday"}, &job); status != http.StatusAccepted {
+		t.Fatalf("rename: expected status %d, got %d", http.StatusAccepted, status)
+	}
+	jobs.get("alice", job.ID).wait()
+	var renamed apiAlbum
+	apiRequest(t, r, http.MethodGet, "/api/v1/albums/holiday", token, nil, &renamed)
+	if renamed.Cover != "/thumbnails/holiday/sunset.jpg.jpg" {
+		t.Errorf("cover not kept: %+v", renamed)
+	}
+
+	var reset apiAlbum
+	if status := apiRequest(t, r, http.MethodPut, "/api/v1/albums/holiday/cover", token, apiSetCoverRequest{}, &reset); status != http.StatusOK ||
+		reset.Cover != "/thumbnails/holiday/beach.jpg.jpg" || reset.CoverItem != "" {
+		t.Errorf("reset cover: got status %d, album %+v", status, reset)
+	}
+
+	for name, tt := range map[string]struct {
+		album, item string
+		status      int
+	}{
+		"missing item":    {"holiday", "nope.jpg", http.StatusNotFound},
+		"missing album":   {"nope", "beach.jpg", http.StatusNotFound},
+		"other user":      {"party", "cake.jpg", http.StatusNotFound},
+		"item in another": {"winter", "beach.jpg", http.StatusNotFound},
+		"invalid item":    {"holiday", "../winter/snow.jpg", http.StatusBadRequest},
+	} {
+		if status := apiRequest(t, r, http.MethodPut, "/api/v1/albums/"+tt.album+"/cover", token, apiSetCoverRequest{Item: tt.item}, nil); status != tt.status {
+			t.Errorf("%s: expected status %d, got %d", name, tt.status, status)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/yuin/goldmark"
+	"html/template"
+	"net/http"
+	"path"
+	"s3photoalbum/internal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errAlbumDetails = errors.New("invalid album details")
+
+// Format of the album dates in forms and the API
+const dateFormat = "2006-01-02"
+
+// Sort orders of the albums on the index page, passed as "sort" query
+// parameter
+const (
+	albumSortManual = "manual"
+	albumSortDate   = "date"
+	albumSortName   = "name"
+)
+
+// albumSortColumns are the SQL expressions of the album sort orders. Newest
+// albums come first when sorting by date, albums without dates last.
+var albumSortColumns = map[string]string{
+	albumSortManual: "position, name",
+	albumSortDate:   "start_date IS NULL, start_date DESC, end_date DESC, name",
+	albumSortName:   "name",
+}
+
+// albumDetails are the metadata of an album set by its owner
+type albumDetails struct {
+	Title       string
+	Description string
+	// Dates formatted as YYYY-MM-DD, empty if not set
+	StartDate string
+	EndDate   string
+	Position  int
+}
+
+// parseDate parses a date of the album details, nil for an empty date
+func parseDate(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(dateFormat, s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: dates have to be formatted as YYYY-MM-DD", errAlbumDetails)
+	}
+	return &t, nil
+}
+
+// formatDate formats a date of the album details, empty if it is not set
+func formatDate(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(dateFormat)
+}
+
+// setAlbumDetails replaces the title, description, dates and position of the
+// album
+func setAlbumDetails(owner, name string, details albumDetails) (*s3photoalbum.Album, error) {
+
+	if !validAlbumPath(name) {
+		return nil, errAlbumName
+	}
+
+	startDate, err := parseDate(details.StartDate)
+	if err != nil {
+		return nil, err
+	}
+	endDate, err := parseDate(details.EndDate)
+	if err != nil {
+		return nil, err
+	}
+	if startDate != nil && endDate != nil && endDate.Before(*startDate) {
+		return nil, fmt.Errorf("%w: the album ends before it starts", errAlbumDetails)
+	}
+
+	album, err := findAlbum(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	if album == nil {
+		return nil, errAlbumNotFound
+	}
+
+	if err := DB.Model(album).Updates(map[string]interface{}{
+		"title":       strings.TrimSpace(details.Title),
+		"description": details.Description,
+		"start_date":  startDate,
+		"end_date":    endDate,
+		"position":    details.Position,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return findAlbum(owner, name)
+}
+
+// albumDisplayTitle returns the title of the album, or the last element of
+// its path if it has none
+func albumDisplayTitle(album s3photoalbum.Album) string {
+	if album.Title != "" {
+		return album.Title
+	}
+	return path.Base(album.Name)
+}
+
+// albumDateRange formats the dates of an album for display
+func albumDateRange(start, end *time.Time) string {
+	const layout = "2 Jan 2006"
+	switch {
+	case start == nil && end == nil:
+		return ""
+	case start == nil:
+		return "until " + end.Format(layout)
+	case end == nil || end.Equal(*start):
+		return start.Format(layout)
+	}
+	return start.Format(layout) + " – " + end.Format(layout)
+}
+
+// markdown renders the description of an album. goldmark leaves out raw HTML
+// and dangerous links, so the result is safe to include in the pages.
+func markdown(text string) template.HTML {
+	var buf bytes.Buffer
+	if err := goldmark.Convert([]byte(text), &buf); err != nil {
+		log.Error(err)
+		return ""
+	}
+	return template.HTML(buf.String())
+}
+
+// detailsHandler sets the details of the album from the form on the album
+// page
+func detailsHandler(c *gin.Context) {
+
+	album := c.GetString("album")
+	details := albumDetails{
+		Title:       c.PostForm("title"),
+		Description: c.PostForm("description"),
+		StartDate:   c.PostForm("startDate"),
+		EndDate:     c.PostForm("endDate"),
+	}
+	if position := c.PostForm("position"); position != "" {
+		var err error
+		if details.Position, err = strconv.Atoi(position); err != nil {
+			c.String(http.StatusBadRequest, "%s: position has to be a number", errAlbumDetails)
+			return
+		}
+	}
+
+	if _, err := setAlbumDetails(c.GetString("username"), album, details); err != nil {
+		if albumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(albumStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, escapedPath("/albums", album))
+}
+
+func apiSetAlbumDetails(c *gin.Context) {
+
+	var req apiSetDetailsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "invalid album details")
+		return
+	}
+
+	album, err := setAlbumDetails(c.GetString("username"), c.GetString("album"), albumDetails{
+		Title:       req.Title,
+		Description: req.Description,
+		StartDate:   req.StartDate,
+		EndDate:     req.EndDate,
+		Position:    req.Position,
+	})
+	if err != nil {
+		if albumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, albumStatus(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, newAPIAlbum(*album))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAlbumDetails(t *testing.T) {
+	r, _ := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	w := doRequest(r, http.MethodPost, "/albums/summer/details", url.Values{
+		"title":       {"Summer 2021"},
+		"description": {"A **hot** week <script>alert(1)</script>"},
+		"startDate":   {"2021-06-01"},
+		"endDate":     {"2021-06-14"},
+		"position":    {"2"},
+	}, cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/albums/summer" {
+		t.Fatalf("expected redirect to the album, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	var album apiAlbum
+	apiRequest(t, r, http.MethodGet, "/api/v1/albums/summer", token, nil, &album)
+	if album.Title != "Summer 2021" || album.StartDate != "2021-06-01" || album.EndDate != "2021-06-14" || album.Position != 2 {
+		t.Errorf("unexpected album %+v", album)
+	}
+
+	w = doRequest(r, http.MethodGet, "/albums/summer", nil, cookie)
+	for _, s := range []string{
+		`<h2>Summer 2021</h2>`,
+		`<p>A <strong>hot</strong> week`,
+		`1 Jun 2021 – 14 Jun 2021`,
+		`name="startDate" value="2021-06-01"`,
+		`name="position" value="2"`,
+	} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("album page does not contain %s", s)
+		}
+	}
+	if strings.Contains(w.Body.String(), "<script>alert") {
+		t.Errorf("raw HTML of the description rendered")
+	}
+
+	var winter apiAlbum
+	if status := apiRequest(t, r, http.MethodPut, "/api/v1/albums/winter/details", token, apiSetDetailsRequest{
+		StartDate: "2021-12-20",
+		Position:  1,
+	}, &winter); status != http.StatusOK || winter.Position != 1 || winter.StartDate != "2021-12-20" {
+		t.Fatalf("set details: got status %d, album %+v", status, winter)
+	}
+
+	// Index page in the sort orders, albums are shown with their titles
+	for sort, expected := range map[string][]string{
+		"":       {`href="/albums/winter"`, `href="/albums/summer"`},
+		"manual": {`href="/albums/winter"`, `href="/albums/summer"`},
+		"date":   {`href="/albums/winter"`, `href="/albums/summer"`},
+		"name":   {`href="/albums/summer"`, `href="/albums/winter"`},
+	} {
+		body := doRequest(r, http.MethodGet, "/?sort="+sort, nil, cookie).Body.String()
+		first, second := strings.Index(body, expected[0]), strings.Index(body, expected[1])
+		if first < 0 || second < 0 || first > second {
+			t.Errorf("sort %q: expected %s before %s", sort, expected[0], expected[1])
+		}
+		if !strings.Contains(body, `<div class="album-cover-overlay">Summer 2021</div>`) {
+			t.Errorf("sort %q: title not shown on the index page", sort)
+		}
+	}
+
+	// The details are kept when renaming the album
+	var job apiJob
+	if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/summer", token, apiUpdateAlbumRequest{Name: "2021/summer"}, &job); status != http.StatusAccepted {
+		t.Fatalf("rename: expected status %d, got %d", http.StatusAccepted, status)
+	}
+	jobs.get("alice", job.ID).wait()
+	var renamed apiAlbum
+	apiRequest(t, r, http.MethodGet, "/api/v1/albums/2021/summer", token, nil, &renamed)
+	if renamed.Title != "Summer 2021" || renamed.Description != album.Description || renamed.EndDate != "2021-06-14" || renamed.Position != 2 {
+		t.Errorf("details not kept: %+v", renamed)
+	}
+
+	for name, tt := range map[string]struct {
+		album  string
+		req    apiSetDetailsRequest
+		status int
+	}{
+		"invalid date":   {"winter", apiSetDetailsRequest{StartDate: "20.12.2021"}, http.StatusBadRequest},
+		"ends too early": {"winter", apiSetDetailsRequest{StartDate: "2021-12-20", EndDate: "2021-12-01"}, http.StatusBadRequest},
+		"missing album":  {"nope", apiSetDetailsRequest{Title: "Nope"}, http.StatusNotFound},
+		"other user":     {"party", apiSetDetailsRequest{Title: "Party"}, http.StatusNotFound},
+	} {
+		if status := apiRequest(t, r, http.MethodPut, "/api/v1/albums/"+tt.album+"/details", token, tt.req, nil); status != tt.status {
+			t.Errorf("%s: expected status %d, got %d", name, tt.status, status)
+		}
+	}
+	if w := doRequest(r, http.MethodPost, "/albums/winter/details", url.Values{"position": {"first"}}, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid position: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
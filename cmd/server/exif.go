@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"s3photoalbum/internal"
+	"strings"
+	"time"
+)
+
+// exifField is a line of the info panel in the image view
+type exifField struct {
+	Label string
+	Value string
+}
+
+// exifInfo returns the metadata of the item to show in the info panel,
+// leaving out what is unknown
+func exifInfo(item s3photoalbum.MediaItem) []exifField {
+
+	var fields []exifField
+	add := func(label, format string, args ...interface{}) {
+		fields = append(fields, exifField{Label: label, Value: fmt.Sprintf(format, args...)})
+	}
+
+	if item.CaptureTime != nil {
+		add("Taken", "%s", item.CaptureTime.Format("2 Jan 2006 15:04"))
+	}
+	if item.CameraModel != "" {
+		add("Camera", "%s", item.CameraModel)
+	}
+	if item.LensModel != "" {
+		add("Lens", "%s", item.LensModel)
+	}
+	if item.ExposureTime > 0 {
+		add("Exposure", "%s", formatExposure(item.ExposureTime))
+	}
+	if item.FNumber > 0 {
+		add("Aperture", "f/%g", item.FNumber)
+	}
+	if item.ISO > 0 {
+		add("ISO", "%d", item.ISO)
+	}
+	if item.FocalLength > 0 {
+		add("Focal length", "%g mm", item.FocalLength)
+	}
+	if item.Width > 0 && item.Height > 0 {
+		add("Dimensions", "%d × %d", item.Width, item.Height)
+	}
+	if item.Duration > 0 {
+		add("Duration", "%s", formatDuration(item.Duration))
+	}
+	if place := formatPlace(item); place != "" {
+		add("Place", "%s", place)
+	}
+	if item.Latitude != nil && item.Longitude != nil {
+		add("Location", "%.5f, %.5f", *item.Latitude, *item.Longitude)
+	}
+	if item.Altitude != nil {
+		add("Altitude", "%.0f m", *item.Altitude)
+	}
+	return fields
+}
+
+// formatPlace joins the names of the place of the item, leaving out regions
+// named like their city, e.g. "Lisbon, Portugal"
+func formatPlace(item s3photoalbum.MediaItem) string {
+	var names []string
+	for _, name := range []string{item.City, item.Region, item.Country} {
+		if name != "" && (len(names) == 0 || names[len(names)-1] != name) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// formatExposure formats an exposure time in seconds the way cameras show it,
+// e.g. "1/250 s" or "2 s"
+func formatExposure(seconds float64) string {
+	if seconds < 1 {
+		return fmt.Sprintf("1/%.0f s", math.Round(1/seconds))
+	}
+	return fmt.Sprintf("%g s", seconds)
+}
+
+// formatDuration formats the duration of a video, e.g. "1:05" or "1:02:05"
+func formatDuration(seconds float64) string {
+	d := time.Duration(math.Round(seconds)) * time.Second
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
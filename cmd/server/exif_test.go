@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"s3photoalbum/internal"
+)
+
+func TestExifInfo(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	if err := s3.PutObjectWithMetadata(testThumbBucket, "alice/summer/beach.jpg.jpg", []byte("thumb"), "image/jpeg", map[string]string{
+		s3photoalbum.MetadataCaptureTime:  "2021-06-01T12:00:00",
+		s3photoalbum.MetadataWidth:        "4000",
+		s3photoalbum.MetadataHeight:       "3000",
+		s3photoalbum.MetadataCameraModel:  "Canon+EOS+R6",
+		s3photoalbum.MetadataExposureTime: "0.004",
+		s3photoalbum.MetadataFNumber:      "2.8",
+		s3photoalbum.MetadataISO:          "200",
+		s3photoalbum.MetadataFocalLength:  "35",
+		s3photoalbum.MetadataLatitude:     "-33.8568",
+		s3photoalbum.MetadataLongitude:    "151.2153",
+		s3photoalbum.MetadataCity:         "Sydney",
+		s3photoalbum.MetadataRegion:       "New+South+Wales",
+		s3photoalbum.MetadataCountry:      "Australia",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3.PutObjectWithMetadata(testThumbBucket, "alice/summer/video.mp4.jpg", []byte("thumb"), "image/jpeg", map[string]string{
+		s3photoalbum.MetadataDuration: "65.2",
+		// Positions need both coordinates
+		s3photoalbum.MetadataLatitude: "10",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var item apiMediaItem
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/albums/summer/items/beach.jpg", token, nil, &item); status != http.StatusOK {
+		t.Fatalf("get item: got status %d", status)
+	}
+	if item.CaptureTime == nil || item.Width != 4000 || item.Height != 3000 || item.ExposureTime != 0.004 || item.FNumber != 2.8 ||
+		item.ISO != 200 || item.FocalLength != 35 || item.Latitude == nil || *item.Latitude != -33.8568 || item.Longitude == nil || item.Altitude != nil ||
+		item.City != "Sydney" || item.Region != "New South Wales" || item.Country != "Australia" {
+		t.Errorf("unexpected item %+v", item)
+	}
+	item = apiMediaItem{}
+	if apiRequest(t, r, http.MethodGet, "/api/v1/albums/summer/items/video.mp4", token, nil, &item); item.Duration != 65.2 || item.Latitude != nil {
+		t.Errorf("unexpected video %+v", item)
+	}
+
+	w := doRequest(r, http.MethodGet, "/albums/summer", nil, cookie)
+	for _, s := range []string{
+		"<dt>Taken</dt><dd>1 Jun 2021 12:00</dd>",
+		"<dt>Camera</dt><dd>Canon EOS R6</dd>",
+		"<dt>Exposure</dt><dd>1/250 s</dd>",
+		"<dt>Aperture</dt><dd>f/2.8</dd>",
+		"<dt>ISO</dt><dd>200</dd>",
+		"<dt>Focal length</dt><dd>35 mm</dd>",
+		"<dt>Dimensions</dt><dd>4000 × 3000</dd>",
+		"<dt>Place</dt><dd>Sydney, New South Wales, Australia</dd>",
+		"<dt>Location</dt><dd>-33.85680, 151.21530</dd>",
+		"<dt>Duration</dt><dd>1:05</dd>",
+	} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("album page does not contain %s", s)
+		}
+	}
+}
+
+func TestFormatPlace(t *testing.T) {
+	for _, tt := range []struct {
+		item     s3photoalbum.MediaItem
+		expected string
+	}{
+		{s3photoalbum.MediaItem{City: "Lisbon", Region: "Lisbon", Country: "Portugal"}, "Lisbon, Portugal"},
+		{s3photoalbum.MediaItem{City: "Faro", Country: "Portugal"}, "Faro, Portugal"},
+		{s3photoalbum.MediaItem{}, ""},
+	} {
+		if s := formatPlace(tt.item); s != tt.expected {
+			t.Errorf("formatPlace(%+v): expected %q, got %q", tt.item, tt.expected, s)
+		}
+	}
+}
+
+func TestFormatExposure(t *testing.T) {
+	for seconds, expected := range map[float64]string{
+		0.004:     "1/250 s",
+		1.0 / 3.0: "1/3 s",
+		2:         "2 s",
+		2.5:       "2.5 s",
+	} {
+		if s := formatExposure(seconds); s != expected {
+			t.Errorf("formatExposure(%g): expected %q, got %q", seconds, expected, s)
+		}
+	}
+}
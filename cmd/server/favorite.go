@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"path"
+	"s3photoalbum/internal"
+	"time"
+)
+
+// Favorite is a media item starred by a user. Favorites are stored by object
+// key and follow the items when they are moved, e.g. by renaming their album.
+type Favorite struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	Username  string `gorm:"uniqueIndex:idx_favorites_username_key;not null"`
+	Key       string `gorm:"uniqueIndex:idx_favorites_username_key;index;not null"`
+}
+
+// findFavorites returns which of the media items with the keys the user has
+// starred
+func findFavorites(username string, keys []string) (map[string]bool, error) {
+
+	ret := map[string]bool{}
+	if len(keys) == 0 {
+		return ret, nil
+	}
+
+	var favorites []string
+	if err := DB.Model(&Favorite{}).Where("username = ? AND key IN ?", username, keys).Pluck("key", &favorites).Error; err != nil {
+		return nil, err
+	}
+	for _, key := range favorites {
+		ret[key] = true
+	}
+	return ret, nil
+}
+
+// listFavoriteItems returns the media items starred by the user, most recently
+// starred first, up to maxPageSize
+func listFavoriteItems(username string) ([]s3photoalbum.MediaItem, error) {
+	var items []s3photoalbum.MediaItem
+	err := DB.Select("media_items.*").
+		Joins("JOIN favorites ON favorites.key = media_items.key AND favorites.username = ?", username).
+		Order("favorites.id DESC").Limit(maxPageSize).Find(&items).Error
+	return items, err
+}
+
+// favoritesCover returns the thumbnail of the item the user starred last,
+// empty if there is none
+func favoritesCover(username string) (string, error) {
+	var items []s3photoalbum.MediaItem
+	err := DB.Select("media_items.*").
+		Joins("JOIN favorites ON favorites.key = media_items.key AND favorites.username = ?", username).
+		Order("favorites.id DESC").Limit(1).Find(&items).Error
+	if err != nil || len(items) == 0 {
+		return "", err
+	}
+	return escapedPath("/thumbnails", items[0].Album, items[0].Name+".jpg"), nil
+}
+
+// setFavorite stars or unstars the item in the album of the owner for the
+// user
+func setFavorite(username, owner, album, item string, favorite bool) error {
+
+	if !validAlbumPath(album) || !validPathElement(item) {
+		return errAlbumName
+	}
+
+	key := path.Join(owner, album, item)
+	mediaItem, err := findMediaItem(key)
+	if err != nil {
+		return err
+	}
+	if mediaItem == nil {
+		return fmt.Errorf("%w: %s", errItemNotFound, item)
+	}
+
+	if !favorite {
+		return DB.Where("username = ? AND key = ?", username, key).Delete(&Favorite{}).Error
+	}
+	return DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&Favorite{Username: username, Key: key}).Error
+}
+
+// moveFavorites changes the key of the favorites of a moved media item
+func moveFavorites(key, newKey string) error {
+	return DB.Model(&Favorite{}).Where("key = ?", key).Update("key", newKey).Error
+}
+
+// deleteFavorites deletes the favorites of a deleted media item
+func deleteFavorites(key string) error {
+	return DB.Where("key = ?", key).Delete(&Favorite{}).Error
+}
+
+// favoriteHandler stars or unstars an item from the button on the album page
+func favoriteHandler(c *gin.Context) {
+
+	username, album := c.GetString("username"), c.GetString("album")
+	if err := setFavorite(username, username, album, c.PostForm("item"), c.PostForm("favorite") == "true"); err != nil {
+		if transferStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(transferStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, escapedPath("/albums", album))
+}
+
+// favoritesHandler shows the media starred by the user across all albums
+func favoritesHandler(c *gin.Context) {
+
+	username := c.GetString("username")
+	items, err := listFavoriteItems(username)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	info, err := findItemInfo(username, keys)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.HTML(http.StatusOK, "favorites.html", gin.H{
+		"context": c,
+		"title":   "Favorites",
+		"images":  items,
+		"info":    info,
+	})
+}
+
+func apiListFavorites(c *gin.Context) {
+
+	username := c.GetString("username")
+	items, err := listFavoriteItems(username)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list favorites")
+		return
+	}
+
+	ret, err := newAPIMediaItems(username, items)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list favorites")
+		return
+	}
+	c.JSON(http.StatusOK, ret)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"s3photoalbum/internal"
+	"strings"
+	"testing"
+)
+
+func TestFavorites(t *testing.T) {
+	r, _ := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	w := doRequest(r, http.MethodPost, "/albums/summer/favorite", url.Values{"item": {"sunset.jpg"}, "favorite": {"true"}}, cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/albums/summer" {
+		t.Fatalf("expected redirect to the album, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	favorite := true
+	var item apiMediaItem
+	if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/winter/items/snow.jpg", token, apiUpdateItemRequest{Favorite: &favorite}, &item); status != http.StatusOK || !item.Favorite {
+		t.Fatalf("star: got status %d, item %+v", status, item)
+	}
+	// Starring twice keeps a single favorite
+	apiRequest(t, r, http.MethodPatch, "/api/v1/albums/winter/items/snow.jpg", token, apiUpdateItemRequest{Favorite: &favorite}, nil)
+
+	favorites := func() []string {
+		t.Helper()
+		var items []apiMediaItem
+		if status := apiRequest(t, r, http.MethodGet, "/api/v1/favorites", token, nil, &items); status != http.StatusOK {
+			t.Fatalf("favorites: got status %d", status)
+		}
+		names := []string{}
+		for _, item := range items {
+			if !item.Favorite {
+				t.Errorf("item %s not marked as favorite", item.Key)
+			}
+			names = append(names, item.Key)
+		}
+		return names
+	}
+	if names := favorites(); !reflect.DeepEqual(names, []string{"alice/winter/snow.jpg", "alice/summer/sunset.jpg"}) {
+		t.Errorf("unexpected favorites %v", names)
+	}
+
+	w = doRequest(r, http.MethodGet, "/", nil, cookie)
+	if !strings.Contains(w.Body.String(), `<a href="/favorites">`) || !strings.Contains(w.Body.String(), `<img src="/thumbnails/winter/snow.jpg.jpg" alt="Favorites"`) {
+		t.Errorf("favorites album not shown on the index page")
+	}
+	w = doRequest(r, http.MethodGet, "/albums/summer", nil, cookie)
+	if !strings.Contains(w.Body.String(), `value="false" class="star chosen"`) || !strings.Contains(w.Body.String(), `value="true" class="star"`) {
+		t.Errorf("favorites not shown on the album page")
+	}
+	if w := doRequest(r, http.MethodGet, "/favorites", nil, cookie); !strings.Contains(w.Body.String(), `<img src="/thumbnails/summer/sunset.jpg.jpg"`) {
+		t.Errorf("favorite not shown on the favorites page")
+	}
+
+	// Favorites are per user
+	var items []apiMediaItem
+	if apiRequest(t, r, http.MethodGet, "/api/v1/favorites", apiLoginAs(t, r, "bob"), nil, &items); len(items) != 0 {
+		t.Errorf("unexpected favorites of bob %+v", items)
+	}
+
+	// Favorites follow renamed albums and are removed with their items
+	var job apiJob
+	if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/summer", token, apiUpdateAlbumRequest{Name: "holiday"}, &job); status != http.StatusAccepted {
+		t.Fatalf("rename: expected status %d, got %d", http.StatusAccepted, status)
+	}
+	jobs.get("alice", job.ID).wait()
+	if names := favorites(); !reflect.DeepEqual(names, []string{"alice/winter/snow.jpg", "alice/holiday/sunset.jpg"}) {
+		t.Errorf("favorites not moved: %v", names)
+	}
+	if status := apiRequest(t, r, http.MethodDelete, "/api/v1/albums/winter", token, nil, &job); status != http.StatusAccepted {
+		t.Fatalf("delete: expected status %d, got %d", http.StatusAccepted, status)
+	}
+	jobs.get("alice", job.ID).wait()
+	var count int64
+	if err := DB.Model(&Favorite{}).Where("key = ?", "alice/winter/snow.jpg").Count(&count).Error; err != nil || count != 0 {
+		t.Errorf("favorite of deleted item kept: %d %v", count, err)
+	}
+
+	w = doRequest(r, http.MethodPost, "/albums/holiday/favorite", url.Values{"item": {"sunset.jpg"}, "favorite": {"false"}}, cookie)
+	if names := favorites(); w.Code != http.StatusSeeOther || len(names) != 0 {
+		t.Errorf("unstar: got status %d, favorites %v", w.Code, names)
+	}
+
+	for name, tt := range map[string]struct {
+		path   string
+		status int
+	}{
+		"missing item": {"/albums/holiday/favorite", http.StatusNotFound},
+		"other user":   {"/albums/party/favorite", http.StatusNotFound},
+	} {
+		if w := doRequest(r, http.MethodPost, tt.path, url.Values{"item": {"cake.jpg"}, "favorite": {"true"}}, cookie); w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", name, tt.status, w.Code)
+		}
+	}
+
+	// The cover is escaped like the other thumbnail URLs
+	if err := DB.Create(&s3photoalbum.MediaItem{Key: "alice/trip #1/what?.jpg", Owner: "alice", Album: "trip #1", Name: "what?.jpg"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := setFavorite("alice", "alice", "trip #1", "what?.jpg", true); err != nil {
+		t.Fatal(err)
+	}
+	if cover, err := favoritesCover("alice"); err != nil || cover != "/thumbnails/trip%20%231/what%3F.jpg.jpg" {
+		t.Errorf("unexpected cover %q %v", cover, err)
+	}
+}
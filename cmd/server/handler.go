@@ -1,11 +1,31 @@
 package main
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
 )
 
+// checkCredentials returns the user if the password matches
+func checkCredentials(username, password string) (*User, error) {
+
+	user, err := findUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if user.ID == 0 {
+		return nil, errors.New("user not found")
+	}
+
+	// Comparing the password with the hash
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
 func login(c *gin.Context) {
 
 	formUser := c.PostForm("username")
@@ -17,18 +37,9 @@ func login(c *gin.Context) {
 			"error": "Authentication failed",
 	}
 
-	user, err := findUserByUsername(formUser)
+	user, err := checkCredentials(formUser, formPass)
 	if err != nil {
-		// User not found
-		log.Warn("User not found", err)
-		c.HTML(http.StatusOK, "login.html", td)
-		c.Abort()
-		return
-	}
-
-	// Comparing the password with the hash
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(formPass)); err != nil {
-		log.Warn("Invalid password", err)
+		log.Warn("Invalid credentials", err)
 		c.HTML(http.StatusOK, "login.html", td)
 		c.Abort()
 		return
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Operations of album jobs
+const (
+	jobRename = "rename"
+	jobDelete = "delete"
+)
+
+// Finished jobs are kept this long for their status to be queried
+const jobExpiry = time.Hour
+
+var errAlbumBusy = errors.New("album is being renamed or deleted")
+
+// albumJob is an operation on all objects of an album that runs in the
+// background, as it may take a while for large albums
+type albumJob struct {
+	ID        string
+	Owner     string
+	Operation string
+	Album     string
+	// New name of a renamed album
+	Target string
+
+	mu       sync.Mutex
+	total    int
+	done     int
+	finished time.Time
+	err      error
+	// Closed when the job finished
+	finishedCh chan struct{}
+}
+
+type albumJobStatus struct {
+	Total int
+	Done  int
+	// Zero while the job is running
+	FinishedAt time.Time
+	Err        error
+}
+
+func (s albumJobStatus) Finished() bool {
+	return !s.FinishedAt.IsZero()
+}
+
+func (j *albumJob) status() albumJobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return albumJobStatus{
+		Total:      j.total,
+		Done:       j.done,
+		FinishedAt: j.finished,
+		Err:        j.err,
+	}
+}
+
+// setTotal sets the number of objects to process
+func (j *albumJob) setTotal(total int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.total = total
+}
+
+// advance counts a processed object
+func (j *albumJob) advance() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done++
+}
+
+// wait blocks until the job finished
+func (j *albumJob) wait() {
+	<-j.finishedCh
+}
+
+// jobRegistry tracks the jobs of all users in memory, they are lost on
+// restart. Only one job at a time may change an album.
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*albumJob
+}
+
+var jobs = &jobRegistry{jobs: make(map[string]*albumJob)}
+
+// start runs the job in the background. Returns errAlbumBusy if another job
+// changes the album or the target album.
+func (r *jobRegistry) start(job *albumJob, run func(*albumJob) error) error {
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.isBusy(job.Owner, job.Album, job.Target) {
+		return errAlbumBusy
+	}
+
+	job.ID = hex.EncodeToString(id)
+	job.finishedCh = make(chan struct{})
+	r.jobs[job.ID] = job
+
+	go func() {
+		err := run(job)
+		if err != nil {
+			log.Errorf("Failed to %s album %s/%s: %v", job.Operation, job.Owner, job.Album, err)
+		}
+
+		job.mu.Lock()
+		job.err = err
+		job.finished = time.Now()
+		job.mu.Unlock()
+		close(job.finishedCh)
+	}()
+	return nil
+}
+
+// busy reports whether a running job changes one of the albums of the owner,
+// or an album containing them or contained in them
+func (r *jobRegistry) busy(owner string, albums ...string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.isBusy(owner, albums...)
+}
+
+// isBusy implements busy, r.mu must be held. Removes expired jobs.
+func (r *jobRegistry) isBusy(owner string, albums ...string) bool {
+
+	busy := false
+	for id, job := range r.jobs {
+		status := job.status()
+		if status.Finished() {
+			if time.Since(status.FinishedAt) > jobExpiry {
+				delete(r.jobs, id)
+			}
+			continue
+		}
+		if job.Owner != owner {
+			continue
+		}
+		for _, album := range albums {
+			if album != "" && (albumsOverlap(album, job.Album) || job.Target != "" && albumsOverlap(album, job.Target)) {
+				busy = true
+			}
+		}
+	}
+	return busy
+}
+
+// get returns the job of the owner with the id, nil if there is none
+func (r *jobRegistry) get(owner, id string) *albumJob {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if job, ok := r.jobs[id]; ok && job.Owner == owner {
+		return job
+	}
+	return nil
+}
+
+// jobResultURL returns the page to show after the job finished
+func jobResultURL(job *albumJob) string {
+	if job.Operation == jobRename {
+		return escapedPath("/albums", job.Target)
+	}
+	return "/"
+}
+
+// jobHandler shows the progress of a job, reloading until it finished
+func jobHandler(c *gin.Context) {
+
+	job := jobs.get(c.GetString("username"), c.Param("id"))
+	if job == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	status := job.status()
+	var errMessage string
+	if status.Err != nil {
+		errMessage = status.Err.Error()
+	}
+
+	c.HTML(http.StatusOK, "job.html", gin.H{
+		"context":   c,
+		"title":     "Album " + job.Operation,
+		"job":       job,
+		"status":    status,
+		"error":     errMessage,
+		"albumURL":  escapedPath("/albums", job.Album),
+		"resultURL": jobResultURL(job),
+	})
+}
+
+func apiGetJob(c *gin.Context) {
+
+	job := jobs.get(c.GetString("username"), c.Param("id"))
+	if job == nil {
+		apiError(c, http.StatusNotFound, "job not found")
+		return
+	}
+	c.JSON(http.StatusOK, newAPIJob(job))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"path/filepath"
 	"s3photoalbum/internal"
 
@@ -9,20 +10,19 @@ import (
 	"html/template"
 	"net/http"
 	"path"
-
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
 var (
-	minioClient *minio.Client
-	config      s3photoalbum.ServerConfig
-	DB          *gorm.DB
-	log         *zap.SugaredLogger
+	store    s3photoalbum.MediaStore
+	index    *s3photoalbum.Index
+	urlCache *presignCache
+	config   s3photoalbum.ServerConfig
+	DB       *gorm.DB
+	log      *zap.SugaredLogger
 )
 
 func loadTemplates(templatesDir string) multitemplate.Renderer {
@@ -33,6 +33,14 @@ func loadTemplates(templatesDir string) multitemplate.Renderer {
 		"isLoggedIn":  func(c *gin.Context) bool { return c.GetString("username") != "" },
 		"getUsername": func(c *gin.Context) string { return c.GetString("username") },
 		"isAdmin":     func(c *gin.Context) bool { return c.GetBool("isadmin") },
+		"base":        path.Base,
+		"albumTitle":  albumDisplayTitle,
+		"dateRange":   albumDateRange,
+		"formatDate":  formatDate,
+		"markdown":    markdown,
+		"join":        strings.Join,
+		"formatMonth": formatMonth,
+		"exifInfo":    exifInfo,
 	}
 
 	// Read all partials, they will be appended to all templates
@@ -57,45 +65,29 @@ func loadTemplates(templatesDir string) multitemplate.Renderer {
 	return r
 }
 
-func main() {
-
-	var err error
-
-	config = s3photoalbum.LoadServerConfig()
-	log = s3photoalbum.NewLogger(config.ModeDevelop)
-
-	var db *gorm.DB
-
-	// Setup database
-	// db, err = gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	db, err = gorm.Open(sqlite.Open("data.db"), &gorm.Config{})
+func setupDatabase(dsn string) (*gorm.DB, error) {
+	db, err := s3photoalbum.OpenDatabase(dsn, &User{}, &Upload{}, &ItemCaption{}, &ItemCaptionEdit{}, &SmartAlbum{}, &Favorite{}, &ShareLink{}, &AlbumAccess{}, &GroupMember{})
 	if err != nil {
-		log.Fatal(err)
-	}
-	if err := db.AutoMigrate(&User{}); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	DB = db
+	return db, setupSearch(db)
+}
 
-	// TODO improve intial user creation, check for existing
-	initialPassHash, err := hashAndSalt(config.InitialPass)
-	if err != nil {
-		log.Fatal(err)
+// setupIndex creates the media index on DB and store
+func setupIndex() *s3photoalbum.Index {
+	return &s3photoalbum.Index{
+		DB:              DB,
+		Store:           store,
+		MediaBucket:     config.S3MediaBucket,
+		ThumbnailBucket: config.S3ThumbnailBucket,
+		CoverStrategy:   config.CoverStrategy,
 	}
+}
 
-	_, _ = insertUser(config.InitialUser, initialPassHash, true)
-
-	// Initialize minio client object.
-	log.Infof("CONFIG: %+v", config)
-	minioClient, err = minio.New(config.S3Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(config.S3AccessKey, config.S3SecretKey, ""),
-		Secure: config.S3UseSsl,
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
+// setupRouter creates the gin engine with all routes. config, DB, store and
+// index have to be initialized before.
+func setupRouter() *gin.Engine {
 
-	// Setup router
 	r := gin.Default()
 
 	// Load templates with custom renderer
@@ -113,12 +105,60 @@ func main() {
 	r.POST("/login", login)
 	r.Static("/static", path.Join(config.ResourcesDir, "static"))
 
+	// Presigned URLs of the filesystem backend, authenticated by signature
+	if fsStore, ok := store.(*s3photoalbum.FilesystemStore); ok {
+		r.GET(s3photoalbum.FilesystemPresignPath+"/:bucket/*key", presignedFileHandler(fsStore))
+	}
+
+	// JSON API, with its own authentication middleware
+	setupAPIRoutes(r)
+	r.GET("/api/openapi.json", openAPIHandler(r))
+
+	// Albums shared by link with visitors without account
+	r.GET("/s/:token", shareHandler)
+	r.POST("/s/:token", sharePasswordHandler)
+	r.GET("/s/:token/thumbnails/:item", shareThumbnailHandler)
+	r.GET("/s/:token/media/:item", shareMediaHandler)
+	r.GET("/s/:token/download/:item", shareDownloadHandler)
+
 	// Routes accessible to logged in users
 	r.Use(verifyToken)
 	r.GET("/", indexHandler)
-	r.GET("/albums/:album", albumHandler)
-	r.GET("/albums/:album/:image", imageHandler)
-	r.GET("/thumbnails/:album/:image", thumbnailHandler)
+	r.POST("/albums", createAlbumHandler)
+	r.GET("/albums/*album", albumPageRoute)
+	r.POST("/albums/*album", albumActionRoute(map[string]gin.HandlerFunc{
+		"upload":   uploadHandler,
+		"rename":   renameAlbumHandler,
+		"cover":    coverHandler,
+		"details":  detailsHandler,
+		"caption":  captionHandler,
+		"favorite": favoriteHandler,
+		"copy":     transferHandler(transferCopy),
+		"move":     transferHandler(transferMove),
+		"delete":   deleteAlbumHandler,
+		"share":    createShareLinkHandler,
+		"access":   albumAccessHandler,
+	}, func(c *gin.Context) { c.AbortWithStatus(http.StatusNotFound) }))
+	// Albums of other users shared with the user
+	r.GET("/shared/:owner/albums/*album", sharedAlbumRoute(albumPageRoute))
+	r.POST("/shared/:owner/albums/*album", sharedAlbumRoute(albumActionRoute(map[string]gin.HandlerFunc{
+		"upload":  uploadHandler,
+		"caption": captionHandler,
+	}, func(c *gin.Context) { c.AbortWithStatus(http.StatusNotFound) })))
+	r.GET("/shared/:owner/thumbnails/*album", sharedAlbumRoute(thumbnailHandler))
+	r.GET("/jobs/:id", jobHandler)
+	r.GET("/thumbnails/*album", thumbnailHandler)
+	r.GET("/tags", tagsHandler)
+	r.GET("/tags/:tag", tagHandler)
+	r.POST("/smart", createSmartAlbumHandler)
+	r.GET("/smart/:name", smartAlbumHandler)
+	r.POST("/smart/:name/delete", deleteSmartAlbumHandler)
+	r.GET("/search", searchHandler)
+	r.GET("/favorites", favoritesHandler)
+	r.GET("/timeline", timelineHandler)
+	r.GET("/map", mapHandler)
+	r.GET("/shares", sharesHandler)
+	r.POST("/shares/:token/delete", revokeShareLinkHandler)
 
 	// Routes accessible to admins only
 	r.Use(verifyAdmin)
@@ -126,6 +166,51 @@ func main() {
 	r.GET("/users", getUsers)
 	r.POST("/users", createUser)
 	r.GET("/users/:user/delete", deleteUser)
+	r.POST("/groups", groupHandler)
+
+	return r
+}
+
+func main() {
+
+	var err error
+
+	config = s3photoalbum.LoadServerConfig()
+	log = s3photoalbum.NewLogger(config.ModeDevelop)
+
+	// Setup database
+	// DB, err = setupDatabase(":memory:")
+	DB, err = setupDatabase(config.DatabasePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// TODO improve intial user creation, check for existing
+	initialPassHash, err := hashAndSalt(config.InitialPass)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, _ = insertUser(config.InitialUser, initialPassHash, true)
+
+	// Initialize storage backend
+	log.Infof("CONFIG: %+v", config)
+	store, err = s3photoalbum.NewMediaStore(config.CommonConfig, derivedKey("presign"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	urlCache = newPresignCache(config.PresignCacheSize)
+
+	// Keep the media index in sync with the buckets. The thumbnailer updates
+	// it too as soon as media is uploaded.
+	index = setupIndex()
+	go index.RunReconciler(context.Background(), config.ReconcileInterval, func(err error) {
+		log.Error("Failed to reconcile media index: ", err)
+	})
+
+	// Setup router
+	r := setupRouter()
 
 	log.Info("starting gin")
 	if err := r.Run(config.ListenAddress + ":" + config.ListenPort); err != nil {
@@ -135,14 +220,55 @@ func main() {
 
 func indexHandler(c *gin.Context) {
 
-	albums, err := getAlbumsByUsername(c.GetString("username"))
+	sort := c.Query("sort")
+	if _, ok := albumSortColumns[sort]; !ok {
+		sort = albumSortManual
+	}
+
+	albums, err := getSubAlbums(c.GetString("username"), "", sort)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	favorites, err := favoritesCover(c.GetString("username"))
 	if err != nil {
+		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	shared, err := listSharedAlbums(c.GetString("username"))
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	smartAlbums, err := getSmartAlbums(c.GetString("username"))
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	smartCovers := map[string]string{}
+	for _, album := range smartAlbums {
+		if smartCovers[album.Name], err = smartAlbumCover(album); err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
 	}
 
 	c.HTML(http.StatusOK, "index.html", gin.H{
-		"title":   "Albums",
-		"albums":  albums,
-		"context": c,
+		"title":          "Albums",
+		"albums":         albums,
+		"favoritesCover": favorites,
+		"sharedAlbums":   shared,
+		"smartAlbums":    smartAlbums,
+		"smartCovers":    smartCovers,
+		"sort":           sort,
+		"context":        c,
 	})
 }
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"s3photoalbum/internal"
+	"s3photoalbum/internal/s3test"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	testMediaBucket = "media"
+	testThumbBucket = "thumbnails"
+	testPassword    = "secret"
+)
+
+// fixtures are the objects in the media bucket, all of them except
+// missingThumbnail have a thumbnail
+var fixtures = []string{
+	"alice/summer/beach.jpg",
+	"alice/summer/sunset.jpg",
+	"alice/summer/video.mp4",
+	"alice/winter/snow.jpg",
+	"bob/party/cake.jpg",
+}
+
+const missingThumbnail = "alice/summer/video.mp4"
+
+// setupTestServer boots the router against a fake S3 server seeded with the
+// fixtures and a fresh database containing the users alice (admin) and bob
+func setupTestServer(t *testing.T) (*gin.Engine, *s3test.Server) {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	log = zap.NewNop().Sugar()
+
+	s3 := s3test.NewServer()
+	t.Cleanup(s3.Close)
+
+	s3.CreateBucket(testMediaBucket)
+	s3.CreateBucket(testThumbBucket)
+	for _, key := range fixtures {
+		if err := s3.PutObject(testMediaBucket, key, []byte("media "+key), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+		if key == missingThumbnail {
+			continue
+		}
+		if err := s3.PutObject(testThumbBucket, key+".jpg", []byte("thumb "+key), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config = s3photoalbum.ServerConfig{
+		CommonConfig: s3photoalbum.CommonConfig{
+			StorageBackend:    "s3",
+			S3Endpoint:        s3.Endpoint,
+			S3AccessKey:       "access",
+			S3SecretKey:       "secretkey",
+			S3MediaBucket:     testMediaBucket,
+			S3ThumbnailBucket: testThumbBucket,
+			S3UseSsl:          false,
+		},
+		ResourcesDir:  filepath.Join("..", ".."),
+		JwtKey:        "testkey",
+		Host:          "localhost",
+		PageSize:      100,
+		MediaDelivery: s3photoalbum.MediaDeliveryRedirect,
+		UploadDir:     t.TempDir(),
+		TileURL:       "https://tiles.example.com/{z}/{x}/{y}.png",
+	}
+
+	var err error
+	if store, err = s3photoalbum.NewMediaStore(config.CommonConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if DB, err = setupDatabase(filepath.Join(t.TempDir(), "data.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	index = setupIndex()
+	if err := index.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	urlCache = newPresignCache(1000)
+
+	hash, err := hashAndSalt(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insertUser("alice", hash, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insertUser("bob", hash, false); err != nil {
+		t.Fatal(err)
+	}
+
+	return setupRouter(), s3
+}
+
+// loginAs logs in through the login form and returns the token cookie
+func loginAs(t *testing.T, r *gin.Engine, username string) *http.Cookie {
+	t.Helper()
+
+	w := doRequest(r, http.MethodPost, "/login", url.Values{
+		"username": {username},
+		"password": {testPassword},
+	}, nil)
+
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("login as %s: expected status %d, got %d", username, http.StatusSeeOther, w.Code)
+	}
+
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "token" {
+			return c
+		}
+	}
+	t.Fatalf("login as %s: no token cookie set", username)
+	return nil
+}
+
+func doRequest(r *gin.Engine, method, target string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestLogin(t *testing.T) {
+	r, _ := setupTestServer(t)
+
+	t.Run("redirects without token", func(t *testing.T) {
+		w := doRequest(r, http.MethodGet, "/", nil, nil)
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+			t.Errorf("expected redirect to /login, got %d %q", w.Code, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("rejects invalid token", func(t *testing.T) {
+		w := doRequest(r, http.MethodGet, "/", nil, &http.Cookie{Name: "token", Value: "invalid"})
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+			t.Errorf("expected redirect to /login, got %d %q", w.Code, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("rejects wrong password", func(t *testing.T) {
+		w := doRequest(r, http.MethodPost, "/login", url.Values{
+			"username": {"alice"},
+			"password": {"wrong"},
+		}, nil)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Authentication failed") {
+			t.Errorf("expected login page with error, got %d", w.Code)
+		}
+	})
+
+	t.Run("accepts valid credentials", func(t *testing.T) {
+		cookie := loginAs(t, r, "alice")
+		w := doRequest(r, http.MethodGet, "/", nil, cookie)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+	})
+
+	t.Run("admin pages need admin", func(t *testing.T) {
+		w := doRequest(r, http.MethodGet, "/users", nil, loginAs(t, r, "bob"))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+
+		w = doRequest(r, http.MethodGet, "/users", nil, loginAs(t, r, "alice"))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "bob") {
+			t.Errorf("expected user list, got %d", w.Code)
+		}
+	})
+}
+
+func TestAlbumListing(t *testing.T) {
+	r, _ := setupTestServer(t)
+
+	w := doRequest(r, http.MethodGet, "/", nil, loginAs(t, r, "alice"))
+	body := w.Body.String()
+
+	for _, album := range []string{"summer", "winter"} {
+		if !strings.Contains(body, `href="/albums/`+album+`"`) {
+			t.Errorf("album %s not listed", album)
+		}
+	}
+	if !strings.Contains(body, "/thumbnails/summer/beach.jpg.jpg") {
+		t.Error("cover of album summer not shown")
+	}
+
+	// Albums of other users must not be visible
+	if strings.Contains(body, "party") {
+		t.Error("album of bob listed for alice")
+	}
+}
+
+func TestAlbumContent(t *testing.T) {
+	r, _ := setupTestServer(t)
+
+	w := doRequest(r, http.MethodGet, "/albums/summer", nil, loginAs(t, r, "alice"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	for _, img := range []string{"beach.jpg", "sunset.jpg", "video.mp4"} {
+		if !strings.Contains(w.Body.String(), "/thumbnails/summer/"+img+".jpg") {
+			t.Errorf("image %s not listed", img)
+		}
+	}
+}
+
+// thumbnailRe matches the thumbnails of the images listed on an album page
+var thumbnailRe = regexp.MustCompile(`<img src="/thumbnails/[^/]+/([^"]+)\.jpg"`)
+
+// albumPageLink returns the target of the prev or next link on an album page
+func albumPageLink(body, rel string) string {
+	match := regexp.MustCompile(`href="([^"]*)" rel="` + rel + `"`).FindStringSubmatch(body)
+	if match == nil {
+		return ""
+	}
+	return html.UnescapeString(match[1])
+}
+
+func TestAlbumPagination(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+
+	// video.mp4 has no thumbnail, it is sorted by its upload time
+	for key, captureTime := range map[string]string{
+		"alice/summer/beach.jpg.jpg":  "2022-01-01T10:00:00",
+		"alice/summer/sunset.jpg.jpg": "2020-01-01T10:00:00",
+	} {
+		if err := s3.PutObjectWithMetadata(testThumbBucket, key, []byte("thumb"), "image/jpeg", map[string]string{
+			s3photoalbum.MetadataCaptureTime: captureTime,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	getPage := func(target string) (images []string, prev, next string) {
+		t.Helper()
+		w := doRequest(r, http.MethodGet, target, nil, cookie)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", target, http.StatusOK, w.Code)
+		}
+		for _, match := range thumbnailRe.FindAllStringSubmatch(w.Body.String(), -1) {
+			images = append(images, match[1])
+		}
+		return images, albumPageLink(w.Body.String(), "prev"), albumPageLink(w.Body.String(), "next")
+	}
+
+	images, prev, next := getPage("/albums/summer?limit=2")
+	if expected := []string{"beach.jpg", "sunset.jpg"}; !reflect.DeepEqual(images, expected) || prev != "" || next == "" {
+		t.Fatalf("first page: expected %v, got %v (prev %q, next %q)", expected, images, prev, next)
+	}
+
+	images, prev, next = getPage("/albums/summer" + next)
+	if expected := []string{"video.mp4"}; !reflect.DeepEqual(images, expected) || prev == "" || next != "" {
+		t.Fatalf("second page: expected %v, got %v (prev %q, next %q)", expected, images, prev, next)
+	}
+
+	images, _, _ = getPage("/albums/summer" + prev)
+	if expected := []string{"beach.jpg", "sunset.jpg"}; !reflect.DeepEqual(images, expected) {
+		t.Errorf("previous page: expected %v, got %v", expected, images)
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"sort=name&order=desc", []string{"video.mp4", "sunset.jpg", "beach.jpg"}},
+		{"sort=taken", []string{"sunset.jpg", "beach.jpg", "video.mp4"}},
+		{"sort=taken&order=desc", []string{"video.mp4", "beach.jpg", "sunset.jpg"}},
+		{"sort=size", []string{"beach.jpg", "video.mp4", "sunset.jpg"}},
+		{"sort=size&order=desc&limit=1&after=sunset.jpg", []string{"video.mp4"}},
+		{"sort=modified&before=beach.jpg", []string{"beach.jpg", "sunset.jpg", "video.mp4"}},
+		{"sort=invalid&limit=invalid", []string{"beach.jpg", "sunset.jpg", "video.mp4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if images, _, _ := getPage("/albums/summer?" + tt.query); !reflect.DeepEqual(images, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, images)
+			}
+		})
+	}
+}
+
+func TestMediaRedirects(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+
+	tests := []struct {
+		name     string
+		path     string
+		location string
+	}{
+		{"thumbnail", "/thumbnails/summer/beach.jpg.jpg", s3.URL + "/" + testThumbBucket + "/alice/summer/beach.jpg.jpg?"},
+		{"full resolution", "/albums/summer/beach.jpg", s3.URL + "/" + testMediaBucket + "/alice/summer/beach.jpg?"},
+		{"missing thumbnail", "/thumbnails/summer/video.mp4.jpg", "/static/missing.png"},
+		{"missing image", "/albums/summer/nope.jpg", "/static/missing.png"},
+		{"other users image", "/albums/party/cake.jpg", "/static/missing.png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(r, http.MethodGet, tt.path, nil, cookie)
+			if w.Code != http.StatusSeeOther {
+				t.Fatalf("expected status %d, got %d", http.StatusSeeOther, w.Code)
+			}
+			if location := w.Header().Get("Location"); !strings.HasPrefix(location, tt.location) {
+				t.Errorf("expected redirect to %s, got %s", tt.location, location)
+			}
+		})
+	}
+
+	t.Run("presigned URL is valid", func(t *testing.T) {
+		w := doRequest(r, http.MethodGet, "/thumbnails/summer/beach.jpg.jpg", nil, cookie)
+		resp, err := http.Get(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	})
+}
+
+func TestMediaProxy(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	config.MediaDelivery = s3photoalbum.MediaDeliveryProxy
+	cookie := loginAs(t, r, "alice")
+
+	request := func(target string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.AddCookie(cookie)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	content := "media alice/summer/beach.jpg"
+	w := request("/albums/summer/beach.jpg", nil)
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Fatalf("expected status %d and content %q, got %d %q", http.StatusOK, content, w.Code, w.Body.String())
+	}
+
+	etag := `"` + s3.GetObject(testMediaBucket, "alice/summer/beach.jpg").ETag + `"`
+	for header, expected := range map[string]string{
+		"Content-Type":   "image/jpeg",
+		"Content-Length": strconv.Itoa(len(content)),
+		"ETag":           etag,
+		"Accept-Ranges":  "bytes",
+	} {
+		if value := w.Header().Get(header); value != expected {
+			t.Errorf("expected %s %q, got %q", header, expected, value)
+		}
+	}
+	if w.Header().Get("Last-Modified") == "" {
+		t.Error("Last-Modified missing")
+	}
+
+	if w := request("/albums/summer/beach.jpg", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: expected status %d, got %d", http.StatusNotModified, w.Code)
+	}
+
+	w = request("/albums/summer/beach.jpg", map[string]string{"Range": "bytes=6-10"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "alice" {
+		t.Errorf("Range: expected status %d and content %q, got %d %q", http.StatusPartialContent, "alice", w.Code, w.Body.String())
+	}
+	if contentRange := w.Header().Get("Content-Range"); contentRange != "bytes 6-10/"+strconv.Itoa(len(content)) {
+		t.Errorf("unexpected Content-Range %q", contentRange)
+	}
+
+	if w := request("/thumbnails/summer/beach.jpg.jpg", nil); w.Code != http.StatusOK || w.Body.String() != "thumb alice/summer/beach.jpg" {
+		t.Errorf("thumbnail: got %d %q", w.Code, w.Body.String())
+	}
+
+	for _, target := range []string{
+		"/thumbnails/summer/video.mp4.jpg",
+		"/albums/summer/nope.jpg",
+		"/albums/party/cake.jpg",
+	} {
+		if w := request(target, nil); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/static/missing.png" {
+			t.Errorf("%s: expected redirect to /static/missing.png, got %d %q", target, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"s3photoalbum/internal"
+)
+
+// listGeotaggedItems returns the geotagged media of the owner, newest first by
+// the date taken. If album is set, only the media directly in the album is
+// returned.
+func listGeotaggedItems(owner, album string) ([]s3photoalbum.MediaItem, error) {
+
+	query := DB.Where("owner = ? AND latitude IS NOT NULL AND longitude IS NOT NULL", owner)
+	if album != "" {
+		query = query.Where("album = ?", album)
+	}
+
+	var items []s3photoalbum.MediaItem
+	err := query.Order(timelineOrder).Find(&items).Error
+	return items, err
+}
+
+// mapAlbum returns the album selected by the album query parameter of the
+// map, empty for all media of the user
+func mapAlbum(c *gin.Context) (string, error) {
+
+	album := c.Query("album")
+	if album == "" {
+		return "", nil
+	}
+	if !validAlbumPath(album) {
+		return "", errAlbumName
+	}
+	existing, err := findAlbum(c.GetString("username"), album)
+	if err != nil {
+		return "", err
+	}
+	if existing == nil {
+		return "", errAlbumNotFound
+	}
+	return album, nil
+}
+
+// newGeoJSON converts the geotagged items to points of a GeoJSON feature
+// collection
+func newGeoJSON(items []s3photoalbum.MediaItem) apiGeoJSON {
+
+	ret := apiGeoJSON{Type: "FeatureCollection", Features: []apiGeoFeature{}}
+	for _, item := range items {
+		if item.Latitude == nil || item.Longitude == nil {
+			continue
+		}
+		// GeoJSON positions are longitude first
+		coordinates := []float64{*item.Longitude, *item.Latitude}
+		if item.Altitude != nil {
+			coordinates = append(coordinates, *item.Altitude)
+		}
+		ret.Features = append(ret.Features, apiGeoFeature{
+			Type:     "Feature",
+			Geometry: apiGeoPoint{Type: "Point", Coordinates: coordinates},
+			Properties: apiGeoProperties{
+				Key:          item.Key,
+				Name:         item.Name,
+				Album:        item.Album,
+				CaptureTime:  item.CaptureTime,
+				ThumbnailURL: escapedPath("/thumbnails", item.Album, item.Name+".jpg"),
+				URL:          escapedPath("/albums", item.Album, item.Name),
+			},
+		})
+	}
+	return ret
+}
+
+// mapHandler shows the geotagged media of the user, or of a single album, on a
+// map. The points are embedded into the page as GeoJSON.
+func mapHandler(c *gin.Context) {
+
+	owner := c.GetString("username")
+	album, err := mapAlbum(c)
+	if err != nil {
+		if albumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(albumStatus(err), "%s", err)
+		return
+	}
+
+	items, err := listGeotaggedItems(owner, album)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	title := "Map"
+	if album != "" {
+		title = "Map of " + album
+	}
+	c.HTML(http.StatusOK, "map.html", gin.H{
+		"context":         c,
+		"title":           title,
+		"album":           album,
+		"geojson":         newGeoJSON(items),
+		"tileURL":         config.TileURL,
+		"tileAttribution": config.TileAttribution,
+	})
+}
+
+func apiGetMap(c *gin.Context) {
+
+	album, err := mapAlbum(c)
+	if err != nil {
+		if albumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, albumStatus(err), err.Error())
+		return
+	}
+
+	items, err := listGeotaggedItems(c.GetString("username"), album)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list geotagged items")
+		return
+	}
+
+	c.Header("Content-Type", "application/geo+json")
+	c.JSON(http.StatusOK, newGeoJSON(items))
+}
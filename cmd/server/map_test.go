@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"s3photoalbum/internal"
+)
+
+func TestMap(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	for key, metadata := range map[string]map[string]string{
+		"alice/summer/beach.jpg.jpg": {
+			s3photoalbum.MetadataCaptureTime: "2021-06-01T12:00:00",
+			s3photoalbum.MetadataLatitude:    "38.7139",
+			s3photoalbum.MetadataLongitude:   "-9.1394",
+			s3photoalbum.MetadataAltitude:    "12.5",
+		},
+		"alice/winter/snow.jpg.jpg": {
+			s3photoalbum.MetadataLatitude:  "46.5",
+			s3photoalbum.MetadataLongitude: "8.25",
+		},
+		"bob/party/cake.jpg.jpg": {
+			s3photoalbum.MetadataLatitude:  "52.52",
+			s3photoalbum.MetadataLongitude: "13.405",
+		},
+	} {
+		if err := s3.PutObjectWithMetadata(testThumbBucket, key, []byte("thumb"), "image/jpeg", metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	geoJSON := func(query string) apiGeoJSON {
+		t.Helper()
+		var ret apiGeoJSON
+		if status := apiRequest(t, r, http.MethodGet, "/api/v1/map"+query, token, nil, &ret); status != http.StatusOK || ret.Type != "FeatureCollection" {
+			t.Fatalf("map %s: got status %d, %+v", query, status, ret)
+		}
+		return ret
+	}
+
+	// Only the geotagged media of alice is listed, snow.jpg is sorted by its
+	// upload time
+	var keys []string
+	for _, feature := range geoJSON("").Features {
+		keys = append(keys, feature.Properties.Key)
+	}
+	if expected := []string{"alice/winter/snow.jpg", "alice/summer/beach.jpg"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected features %v, got %v", expected, keys)
+	}
+
+	features := geoJSON("?album=summer").Features
+	if len(features) != 1 {
+		t.Fatalf("expected a single feature in the album, got %+v", features)
+	}
+	if feature := features[0]; feature.Type != "Feature" || feature.Geometry.Type != "Point" ||
+		!reflect.DeepEqual(feature.Geometry.Coordinates, []float64{-9.1394, 38.7139, 12.5}) ||
+		feature.Properties.URL != "/albums/summer/beach.jpg" || feature.Properties.ThumbnailURL != "/thumbnails/summer/beach.jpg.jpg" {
+		t.Errorf("unexpected feature %+v", feature)
+	}
+
+	w := doRequest(r, http.MethodGet, "/map?album=summer", nil, cookie)
+	for _, s := range []string{
+		`data-tiles="https://tiles.example.com/{z}/{x}/{y}.png"`,
+		`<script type="application/json" id="map-data">`,
+	} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("map page does not contain %s", s)
+		}
+	}
+	body := w.Body.String()
+	start := strings.Index(body, `id="map-data">`) + len(`id="map-data">`)
+	var embedded apiGeoJSON
+	if err := json.Unmarshal([]byte(body[start:start+strings.Index(body[start:], "</script>")]), &embedded); err != nil || len(embedded.Features) != 1 {
+		t.Errorf("invalid embedded GeoJSON: %v %+v", err, embedded)
+	}
+	if w := doRequest(r, http.MethodGet, "/albums/summer", nil, cookie); !strings.Contains(w.Body.String(), `<a href="/map?album=summer">`) {
+		t.Errorf("map not linked on the album page")
+	}
+
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/map?album=party", token, nil, nil); status != http.StatusNotFound {
+		t.Errorf("album of other user: expected status %d, got %d", http.StatusNotFound, status)
+	}
+	if w := doRequest(r, http.MethodGet, "/map?album=..", nil, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid album: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"s3photoalbum/internal"
+	"strings"
+)
+
+// presignedFileHandler serves the files of the filesystem backend for the
+// URLs it generates instead of S3 presigned URLs
+func presignedFileHandler(fsStore *s3photoalbum.FilesystemStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		bucket := c.Param("bucket")
+		key := strings.TrimPrefix(c.Param("key"), "/")
+
+		// Only the configured buckets may be served
+		if bucket != config.S3MediaBucket && bucket != config.S3ThumbnailBucket {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		if err := fsStore.VerifyPresigned(bucket, key, c.Request.URL.Query()); err != nil {
+			log.Info("Rejected presigned URL: ", err)
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		filePath, err := fsStore.FilePath(bucket, key)
+		if err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		// Set for downloads, it is covered by the signature
+		if disposition := c.Query(s3photoalbum.PresignDispositionParam); disposition != "" {
+			c.Header("Content-Disposition", disposition)
+		}
+		c.File(filePath)
+	}
+}
+
+// proxyObject streams an object of the media or thumbnail bucket through the
+// server, for storage that is not reachable by the browsers. Conditional and
+// range requests are supported, the latter are needed to seek in videos.
+func proxyObject(c *gin.Context, bucket, key string) {
+
+	if lookupObject(bucket, key) == nil {
+		c.Redirect(http.StatusSeeOther, "/static/missing.png")
+		return
+	}
+
+	obj, info, err := store.Get(c.Request.Context(), bucket, key)
+	if errors.Is(err, s3photoalbum.ErrNotExist) {
+		urlCache.addMissing(bucket, key)
+		c.Redirect(http.StatusSeeOther, "/static/missing.png")
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	header := c.Writer.Header()
+	if info.ContentType != "" {
+		header.Set("Content-Type", info.ContentType)
+	}
+	if info.ETag != "" {
+		header.Set("ETag", `"`+strings.Trim(info.ETag, `"`)+`"`)
+	}
+	// Browsers have to revalidate, so that changed media is shown at once
+	header.Set("Cache-Control", "private, no-cache")
+
+	if content, ok := obj.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, "", info.LastModified, content)
+		return
+	}
+
+	// Stores without seeking support can only deliver the whole object
+	c.DataFromReader(http.StatusOK, info.Size, info.ContentType, obj, map[string]string{
+		"Last-Modified": info.LastModified.UTC().Format(http.TimeFormat),
+	})
+}
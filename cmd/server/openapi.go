@@ -0,0 +1,1615 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The OpenAPI document is generated from the operations described below and
+// the types used by the handlers, so it can't drift from the code. Only the
+// operations of routes actually registered in the router are included, every
+// registered route must have a description (checked in the tests).
+
+type authLevel int
+
+const (
+	authNone authLevel = iota
+	authUser
+	authAdmin
+	// Authenticated by the signature in the query string
+	authSignature
+)
+
+type openAPIParameter struct {
+	Name        string
+	In          string
+	Description string
+	Required    bool
+}
+
+type openAPIResponse struct {
+	Description string
+	// Value of the type returned as JSON, or nil for none
+	JSON interface{}
+	// Set for non-JSON responses, e.g. "text/html", or JSON of another media
+	// type
+	ContentType string
+	// Set for redirects
+	Location string
+}
+
+type openAPIOperation struct {
+	Summary     string
+	Tags        []string
+	Auth        authLevel
+	Parameters  []openAPIParameter
+	RequestBody interface{}
+	// Content type of the request body if it is not JSON
+	RequestContentType string
+	Responses          map[int]openAPIResponse
+}
+
+// Names of the types in components/schemas
+var openAPISchemaNames = map[reflect.Type]string{
+	reflect.TypeOf(apiErrorResponse{}):           "Error",
+	reflect.TypeOf(apiToken{}):                   "Token",
+	reflect.TypeOf(apiAlbum{}):                   "Album",
+	reflect.TypeOf(apiMediaItem{}):               "MediaItem",
+	reflect.TypeOf(apiCaptionEdit{}):             "CaptionEdit",
+	reflect.TypeOf(apiTag{}):                     "Tag",
+	reflect.TypeOf(apiSmartAlbum{}):              "SmartAlbum",
+	reflect.TypeOf(apiTimelinePage{}):            "TimelinePage",
+	reflect.TypeOf(apiTimelineMonth{}):           "TimelineMonth",
+	reflect.TypeOf(apiGeoJSON{}):                 "GeoJSON",
+	reflect.TypeOf(apiGeoFeature{}):              "GeoFeature",
+	reflect.TypeOf(apiGeoPoint{}):                "GeoPoint",
+	reflect.TypeOf(apiGeoProperties{}):           "GeoProperties",
+	reflect.TypeOf(apiShareLink{}):               "ShareLink",
+	reflect.TypeOf(apiAlbumAccess{}):             "AlbumAccess",
+	reflect.TypeOf(apiSharedAlbum{}):             "SharedAlbum",
+	reflect.TypeOf(apiGroup{}):                   "Group",
+	reflect.TypeOf(apiUser{}):                    "User",
+	reflect.TypeOf(apiUpload{}):                  "Upload",
+	reflect.TypeOf(apiMetrics{}):                 "Metrics",
+	reflect.TypeOf(apiCacheMetrics{}):            "CacheMetrics",
+	reflect.TypeOf(apiLoginRequest{}):            "LoginRequest",
+	reflect.TypeOf(apiCreateUserRequest{}):       "CreateUserRequest",
+	reflect.TypeOf(apiCreateUploadRequest{}):     "CreateUploadRequest",
+	reflect.TypeOf(apiCreateAlbumRequest{}):      "CreateAlbumRequest",
+	reflect.TypeOf(apiUpdateAlbumRequest{}):      "UpdateAlbumRequest",
+	reflect.TypeOf(apiTransferItemsRequest{}):    "TransferItemsRequest",
+	reflect.TypeOf(apiSetCoverRequest{}):         "SetCoverRequest",
+	reflect.TypeOf(apiSetDetailsRequest{}):       "SetDetailsRequest",
+	reflect.TypeOf(apiUpdateItemRequest{}):       "UpdateItemRequest",
+	reflect.TypeOf(apiCreateSmartAlbumRequest{}): "CreateSmartAlbumRequest",
+	reflect.TypeOf(apiCreateShareLinkRequest{}):  "CreateShareLinkRequest",
+	reflect.TypeOf(apiSetAlbumAccessRequest{}):   "SetAlbumAccessRequest",
+	reflect.TypeOf(apiSetGroupRequest{}):         "SetGroupRequest",
+	reflect.TypeOf(loginForm{}):                  "LoginForm",
+	reflect.TypeOf(createUserForm{}):             "CreateUserForm",
+	reflect.TypeOf(uploadForm{}):                 "UploadForm",
+	reflect.TypeOf(coverForm{}):                  "CoverForm",
+	reflect.TypeOf(detailsForm{}):                "DetailsForm",
+	reflect.TypeOf(captionForm{}):                "CaptionForm",
+	reflect.TypeOf(smartAlbumForm{}):             "SmartAlbumForm",
+	reflect.TypeOf(favoriteForm{}):               "FavoriteForm",
+	reflect.TypeOf(shareForm{}):                  "ShareForm",
+	reflect.TypeOf(sharePasswordForm{}):          "SharePasswordForm",
+	reflect.TypeOf(accessForm{}):                 "AccessForm",
+	reflect.TypeOf(groupForm{}):                  "GroupForm",
+}
+
+// Form bodies of the HTML pages, only used for the documentation
+type loginForm struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type createUserForm struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	IsAdmin  string `json:"isadmin,omitempty"`
+}
+
+type albumNameForm struct {
+	Name string `json:"name"`
+}
+
+type transferForm struct {
+	// Names of the selected items, repeated for every item
+	Items  []string `json:"items"`
+	Target string   `json:"target"`
+}
+
+type coverForm struct {
+	// Name of an item in the album, empty to pick the cover automatically
+	Item string `json:"item"`
+}
+
+type detailsForm struct {
+	Title string `json:"title"`
+	// Markdown text
+	Description string `json:"description"`
+	// Dates formatted as YYYY-MM-DD, empty if not set
+	StartDate string `json:"startDate"`
+	EndDate   string `json:"endDate"`
+	Position  string `json:"position"`
+}
+
+type captionForm struct {
+	// Name of an item in the album
+	Item    string `json:"item"`
+	Title   string `json:"title"`
+	Caption string `json:"caption"`
+	Notes   string `json:"notes"`
+	// Tags set by the users separated by commas, kept if left out
+	Tags string `json:"tags,omitempty"`
+}
+
+type favoriteForm struct {
+	// Name of an item in the album
+	Item string `json:"item"`
+	// "true" to star the item, anything else to unstar it
+	Favorite string `json:"favorite"`
+}
+
+type shareForm struct {
+	// Last day on which the link works as YYYY-MM-DD, empty for links that
+	// don't expire
+	Expires string `json:"expires,omitempty"`
+	// Empty for links without password
+	Password string `json:"password,omitempty"`
+	// "true" to let the visitors download the originals
+	Download string `json:"download,omitempty"`
+}
+
+type sharePasswordForm struct {
+	Password string `json:"password"`
+}
+
+type accessForm struct {
+	// Either the user or the group to share the album with
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+	// "view" or "contribute", empty to remove the access
+	Access string `json:"access"`
+}
+
+type groupForm struct {
+	Name string `json:"name"`
+	// Usernames separated by commas, empty to delete the group
+	Members string `json:"members"`
+}
+
+type smartAlbumForm struct {
+	Name string `json:"name"`
+	// Tags separated by commas, those prefixed with a minus are excluded
+	Query string `json:"query"`
+}
+
+type uploadForm struct {
+	// Contents of the files, their names are used as names in the album
+	Files []string `json:"files"`
+}
+
+var (
+	errNotAuthenticated = openAPIResponse{Description: "Not authenticated", JSON: apiErrorResponse{}}
+	errForbidden        = openAPIResponse{Description: "Not an admin", JSON: apiErrorResponse{}}
+	errBadRequest       = openAPIResponse{Description: "Invalid request", JSON: apiErrorResponse{}}
+	errNotFound         = openAPIResponse{Description: "Not found", JSON: apiErrorResponse{}}
+	errInternal         = openAPIResponse{Description: "Internal error", JSON: apiErrorResponse{}}
+	htmlPage            = openAPIResponse{Description: "HTML page", ContentType: "text/html"}
+	loginRedirect       = openAPIResponse{Description: "Not authenticated, redirect to the login page", Location: "/login"}
+)
+
+// Request headers supported when media is streamed through the server
+var proxiedMediaParameters = []openAPIParameter{
+	{Name: "Range", In: "header", Description: "Byte range to return, in proxy delivery mode"},
+	{Name: "If-None-Match", In: "header", Description: "ETag of a cached version, in proxy delivery mode"},
+	{Name: "If-Modified-Since", In: "header", Description: "Modification time of a cached version, in proxy delivery mode"},
+}
+
+// openAPIOperations describes all routes, keyed by "<method> <gin path>". The
+// wildcard album routes dispatch to several operations, these are described
+// with the path following the wildcard, e.g. "GET /api/v1/albums/*album/items".
+var openAPIOperations = map[string]openAPIOperation{
+
+	// JSON API
+	"GET /api/openapi.json": {
+		Summary: "This OpenAPI document",
+		Tags:    []string{"api"},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "OpenAPI 3 document", ContentType: "application/json"},
+		},
+	},
+	"POST /api/v1/login": {
+		Summary:     "Get a token to authenticate further requests",
+		Tags:        []string{"api"},
+		RequestBody: apiLoginRequest{},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Token to send as bearer token", JSON: apiToken{}},
+			400: errBadRequest,
+			401: {Description: "Invalid credentials", JSON: apiErrorResponse{}},
+		},
+	},
+	"GET /api/v1/me": {
+		Summary: "Get the current user",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Current user", JSON: apiUser{}},
+			401: errNotAuthenticated,
+			404: errNotFound,
+		},
+	},
+	"GET /api/v1/albums": {
+		Summary: "List the albums of the current user, including all nested albums",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Albums", JSON: []apiAlbum{}},
+			401: errNotAuthenticated,
+			500: errInternal,
+		},
+	},
+	"POST /api/v1/albums": {
+		Summary:     "Create an empty album, it is kept until it is deleted. Enclosing albums are created as needed.",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiCreateAlbumRequest{},
+		Responses: map[int]openAPIResponse{
+			201: {Description: "Created album", JSON: apiAlbum{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			409: {Description: "Album already exists", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"PATCH /api/v1/albums/*album": {
+		Summary:     "Rename or move an album with its sub-albums, moving all media and thumbnails in the background",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiUpdateAlbumRequest{},
+		Responses: map[int]openAPIResponse{
+			202: {Description: "Job renaming the album", JSON: apiJob{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			409: {Description: "Album with the new name exists or the album is being changed", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"DELETE /api/v1/albums/*album": {
+		Summary: "Delete an album with its sub-albums and all media and thumbnails in the background",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			202: {Description: "Job deleting the album", JSON: apiJob{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			409: {Description: "Album is being changed", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"PUT /api/v1/albums/*album/cover": {
+		Summary:     "Choose the cover of an album, instead of the one picked by the configured strategy",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiSetCoverRequest{},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Album with the new cover", JSON: apiAlbum{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: {Description: "Album or item not found", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"PATCH /api/v1/albums/*album/items/:item": {
+		Summary:     "Change the title, caption, notes or tags of a media item, recording the edits, or star it",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiUpdateItemRequest{},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Item with the changes", JSON: apiMediaItem{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/albums/*album/items/:item/history": {
+		Summary: "List the edits of the title, caption and notes of a media item, oldest first",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Edits", JSON: []apiCaptionEdit{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"PUT /api/v1/albums/*album/details": {
+		Summary:     "Set the title, description, dates and manual sort position of an album",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiSetDetailsRequest{},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Album with the new details", JSON: apiAlbum{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/jobs/:id": {
+		Summary: "Get the progress of an album rename or delete",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Job", JSON: apiJob{}},
+			401: errNotAuthenticated,
+			404: errNotFound,
+		},
+	},
+	"GET /api/v1/albums/*album": {
+		Summary: "Get a single album",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Album", JSON: apiAlbum{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/albums/*album/items": {
+		Summary: "List the media in an album",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Media items", JSON: []apiMediaItem{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/albums/*album/items/:item": {
+		Summary: "Get the metadata of a single media item",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Media item", JSON: apiMediaItem{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"POST /api/v1/albums/*album/copy": {
+		Summary:     "Copy items with their thumbnails to another album of the user",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiTransferItemsRequest{},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Copies in the target album", JSON: []apiMediaItem{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: {Description: "Item or target album not found", JSON: apiErrorResponse{}},
+			409: {Description: "Item exists in the target album or an album is being changed", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"POST /api/v1/albums/*album/move": {
+		Summary:     "Move items with their thumbnails to another album of the user",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiTransferItemsRequest{},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Moved items in the target album", JSON: []apiMediaItem{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: {Description: "Item or target album not found", JSON: apiErrorResponse{}},
+			409: {Description: "Item exists in the target album or an album is being changed", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"POST /api/v1/albums/*album/uploads": {
+		Summary:     "Start a resumable upload of a file to the album, the album is created if needed",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiCreateUploadRequest{},
+		Responses: map[int]openAPIResponse{
+			201: {Description: "Upload to send the file content to", JSON: apiUpload{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			409: {Description: "File already exists", JSON: apiErrorResponse{}},
+			413: {Description: "File too large", JSON: apiErrorResponse{}},
+			415: {Description: "Not a supported image or video type", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"POST /api/v1/albums/*album/shares": {
+		Summary:     "Create a link showing the album read-only to visitors without account",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiCreateShareLinkRequest{},
+		Responses: map[int]openAPIResponse{
+			201: {Description: "Created share link", JSON: apiShareLink{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/shares": {
+		Summary: "List the share links of the current user, newest first",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Share links, including expired ones", JSON: []apiShareLink{}},
+			401: errNotAuthenticated,
+			500: errInternal,
+		},
+	},
+	"DELETE /api/v1/shares/:token": {
+		Summary: "Revoke a share link",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			204: {Description: "Share link revoked"},
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/albums/*album/access": {
+		Summary: "List the users and groups an album is shared with, users first",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Access given to users and groups", JSON: []apiAlbumAccess{}},
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"PUT /api/v1/albums/*album/access": {
+		Summary:     "Share an album and the albums below it with a user or group, or remove the access",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiSetAlbumAccessRequest{},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Access given to users and groups", JSON: []apiAlbumAccess{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: {Description: "Album, user or group not found", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/shared": {
+		Summary: "List the albums of other users shared with the current user or their groups",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Shared albums by owner and name", JSON: []apiSharedAlbum{}},
+			401: errNotAuthenticated,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/shared/:owner/albums/*album": {
+		Summary: "Get a shared album of another user",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Album", JSON: apiAlbum{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: {Description: "Album not found or not shared with the user", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/shared/:owner/albums/*album/items": {
+		Summary: "List the media in a shared album of another user",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Media items", JSON: []apiMediaItem{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: {Description: "Album not found or not shared with the user", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/shared/:owner/albums/*album/items/:item": {
+		Summary: "Get a media item in a shared album of another user",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Media item", JSON: apiMediaItem{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/shared/:owner/albums/*album/items/:item/history": {
+		Summary: "List the edits of a media item in a shared album of another user, oldest first",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Edits", JSON: []apiCaptionEdit{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"PATCH /api/v1/shared/:owner/albums/*album/items/:item": {
+		Summary:     "Change the title, caption or tags of a media item in a shared album of another user, if the user may contribute",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiUpdateItemRequest{},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Item with the changes", JSON: apiMediaItem{}},
+			400: {Description: "Invalid request, or a favorite or notes, which only the owner sets", JSON: apiErrorResponse{}},
+			401: errNotAuthenticated,
+			404: {Description: "Item not found or album not shared with the user to contribute", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"POST /api/v1/shared/:owner/albums/*album/uploads": {
+		Summary:     "Start a resumable upload of a file to a shared album of another user, if the user may contribute",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiCreateUploadRequest{},
+		Responses: map[int]openAPIResponse{
+			201: {Description: "Upload to send the file content to", JSON: apiUpload{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: {Description: "Album not shared with the user to contribute", JSON: apiErrorResponse{}},
+			409: {Description: "File already exists", JSON: apiErrorResponse{}},
+			413: {Description: "File too large", JSON: apiErrorResponse{}},
+			415: {Description: "Not a supported image or video type", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/groups": {
+		Summary: "List the groups albums can be shared with",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Groups by name", JSON: []apiGroup{}},
+			401: errNotAuthenticated,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/uploads/:id": {
+		Summary: "Get the state of an upload, to resume it at its offset",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Upload", JSON: apiUpload{}},
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"PATCH /api/v1/uploads/:id": {
+		Summary: "Append a chunk to an upload, the file is stored in the album once it is complete",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Parameters: []openAPIParameter{
+			{Name: "Upload-Offset", In: "header", Description: "Offset of the chunk, has to match the offset of the upload", Required: true},
+		},
+		RequestBody:        "",
+		RequestContentType: "application/octet-stream",
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Chunk received, the upload is not complete yet", JSON: apiUpload{}},
+			201: {Description: "Upload complete, the created media item", JSON: apiMediaItem{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			409: {Description: "Wrong offset or file already exists, the Upload-Offset response header contains the offset", JSON: apiErrorResponse{}},
+			415: {Description: "Content is not a supported image or video type", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/tags": {
+		Summary: "List the tags of the media of the current user",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Tags", JSON: []apiTag{}},
+			401: errNotAuthenticated,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/tags/:tag/items": {
+		Summary: "List the newest 1000 media items with the tag across all albums",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Media items", JSON: []apiMediaItem{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/search": {
+		Summary: "Search the newest 1000 media items of the current user",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Parameters: []openAPIParameter{
+			{Name: "q", In: "query", Description: "Words matching file names, album names and titles, captions, tags, camera and lens"},
+			{Name: "from", In: "query", Description: "First day taken as YYYY-MM-DD"},
+			{Name: "to", In: "query", Description: "Last day taken as YYYY-MM-DD"},
+		},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Media items", JSON: []apiMediaItem{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/favorites": {
+		Summary: "List the media items starred by the current user, the 1000 starred last first",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Media items", JSON: []apiMediaItem{}},
+			401: errNotAuthenticated,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/timeline": {
+		Summary: "List a page of the media of the current user, newest first by the date taken",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Parameters: []openAPIParameter{
+			{Name: "after", In: "query", Description: "Cursor of the page, the next cursor of the previous page"},
+			{Name: "date", In: "query", Description: "Start with the media taken before the end of the year, month or day, as YYYY, YYYY-MM or YYYY-MM-DD"},
+			{Name: "limit", In: "query", Description: "Number of items per page, up to 1000"},
+		},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Page of the timeline", JSON: apiTimelinePage{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/timeline/months": {
+		Summary: "List the months in which the media of the current user was taken, newest first",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Months with the number of media items", JSON: []apiTimelineMonth{}},
+			401: errNotAuthenticated,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/map": {
+		Summary: "List the geotagged media of the current user as GeoJSON points, newest first by the date taken",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Parameters: []openAPIParameter{
+			{Name: "album", In: "query", Description: "Only list the media directly in the album"},
+		},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "GeoJSON feature collection", JSON: apiGeoJSON{}, ContentType: "application/geo+json"},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/smart-albums": {
+		Summary: "List the smart albums of the current user",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Smart albums", JSON: []apiSmartAlbum{}},
+			401: errNotAuthenticated,
+			500: errInternal,
+		},
+	},
+	"POST /api/v1/smart-albums": {
+		Summary:     "Save a tag query as smart album",
+		Tags:        []string{"api"},
+		Auth:        authUser,
+		RequestBody: apiCreateSmartAlbumRequest{},
+		Responses: map[int]openAPIResponse{
+			201: {Description: "Created smart album", JSON: apiSmartAlbum{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			409: {Description: "Smart album already exists", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/smart-albums/:name/items": {
+		Summary: "List the newest 1000 media items matching a smart album",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Media items", JSON: []apiMediaItem{}},
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"DELETE /api/v1/smart-albums/:name": {
+		Summary: "Delete a smart album, the media is kept",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			204: {Description: "Smart album deleted"},
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"DELETE /api/v1/uploads/:id": {
+		Summary: "Cancel an upload",
+		Tags:    []string{"api"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			204: {Description: "Upload canceled"},
+			401: errNotAuthenticated,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"PUT /api/v1/groups/:name": {
+		Summary:     "Create a group or replace its members",
+		Tags:        []string{"api"},
+		Auth:        authAdmin,
+		RequestBody: apiSetGroupRequest{},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Group with its members", JSON: apiGroup{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			403: errForbidden,
+			404: {Description: "User not found", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"DELETE /api/v1/groups/:name": {
+		Summary: "Delete a group and the access given to it",
+		Tags:    []string{"api"},
+		Auth:    authAdmin,
+		Responses: map[int]openAPIResponse{
+			204: {Description: "Group deleted"},
+			401: errNotAuthenticated,
+			403: errForbidden,
+			404: errNotFound,
+			500: errInternal,
+		},
+	},
+	"GET /api/v1/metrics": {
+		Summary: "Get the metrics of the presigned URL cache",
+		Tags:    []string{"api"},
+		Auth:    authAdmin,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Metrics", JSON: apiMetrics{}},
+			401: errNotAuthenticated,
+			403: errForbidden,
+		},
+	},
+	"GET /api/v1/users": {
+		Summary: "List all users",
+		Tags:    []string{"api"},
+		Auth:    authAdmin,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Users", JSON: []apiUser{}},
+			401: errNotAuthenticated,
+			403: errForbidden,
+			500: errInternal,
+		},
+	},
+	"POST /api/v1/users": {
+		Summary:     "Create a user",
+		Tags:        []string{"api"},
+		Auth:        authAdmin,
+		RequestBody: apiCreateUserRequest{},
+		Responses: map[int]openAPIResponse{
+			201: {Description: "Created user", JSON: apiUser{}},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			403: errForbidden,
+			409: {Description: "User already exists", JSON: apiErrorResponse{}},
+			500: errInternal,
+		},
+	},
+	"DELETE /api/v1/users/:id": {
+		Summary: "Delete a user",
+		Tags:    []string{"api"},
+		Auth:    authAdmin,
+		Responses: map[int]openAPIResponse{
+			204: {Description: "User deleted"},
+			400: errBadRequest,
+			401: errNotAuthenticated,
+			403: errForbidden,
+			404: errNotFound,
+			409: {Description: "Last user can't be deleted", JSON: apiErrorResponse{}},
+		},
+	},
+
+	// HTML pages and media redirects
+	"GET /login": {
+		Summary:   "Login page",
+		Tags:      []string{"html"},
+		Responses: map[int]openAPIResponse{200: htmlPage},
+	},
+	"POST /login": {
+		Summary:            "Log in, setting the token cookie",
+		Tags:               []string{"html"},
+		RequestBody:        loginForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Login page with error message", ContentType: "text/html"},
+			303: {Description: "Logged in, redirect to the index page", Location: "/"},
+		},
+	},
+	"GET /s/:token": {
+		Summary: "Album of a share link, read-only",
+		Tags:    []string{"html"},
+		Responses: map[int]openAPIResponse{
+			200: htmlPage,
+			401: {Description: "Page asking for the password of the link", ContentType: "text/html"},
+			404: {Description: "Share link not found", ContentType: "text/plain"},
+			410: {Description: "Share link expired", ContentType: "text/plain"},
+		},
+	},
+	"POST /s/:token": {
+		Summary:            "Enter the password of a share link, setting a cookie for the link",
+		Tags:               []string{"html"},
+		RequestBody:        sharePasswordForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the album of the link"},
+			401: {Description: "Page asking for the password again", ContentType: "text/html"},
+			404: {Description: "Share link not found", ContentType: "text/plain"},
+			410: {Description: "Share link expired", ContentType: "text/plain"},
+		},
+	},
+	"GET /s/:token/thumbnails/:item": {
+		Summary:    "Thumbnail of a media item in the album of a share link, the item is the media name with .jpg appended",
+		Tags:       []string{"media"},
+		Parameters: proxiedMediaParameters,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Thumbnail, in proxy delivery mode", ContentType: "image/jpeg"},
+			304: {Description: "Not modified, in proxy delivery mode"},
+			303: {Description: "Redirect to the thumbnail or /static/missing.png if it does not exist"},
+			401: {Description: "Password of the link not entered"},
+			404: {Description: "Share link or item not found"},
+			410: {Description: "Share link expired", ContentType: "text/plain"},
+		},
+	},
+	"GET /s/:token/media/:item": {
+		Summary:    "Media item in the album of a share link, only videos are streamed through the server for links without downloads",
+		Tags:       []string{"media"},
+		Parameters: proxiedMediaParameters,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Media content, for videos and in proxy delivery mode", ContentType: "application/octet-stream"},
+			206: {Description: "Requested range of the media, for videos and in proxy delivery mode", ContentType: "application/octet-stream"},
+			304: {Description: "Not modified, for videos and in proxy delivery mode"},
+			303: {Description: "Redirect to the media or /static/missing.png if it does not exist"},
+			401: {Description: "Password of the link not entered"},
+			404: {Description: "Share link or item not found, or a photo of a link without downloads"},
+			410: {Description: "Share link expired", ContentType: "text/plain"},
+		},
+	},
+	"GET /s/:token/download/:item": {
+		Summary:    "Download a media item in the album of a share link that allows downloads",
+		Tags:       []string{"media"},
+		Parameters: proxiedMediaParameters,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Media content as attachment, in proxy delivery mode", ContentType: "application/octet-stream"},
+			206: {Description: "Requested range of the media, in proxy delivery mode", ContentType: "application/octet-stream"},
+			304: {Description: "Not modified, in proxy delivery mode"},
+			303: {Description: "Redirect to the media as attachment or /static/missing.png if it does not exist"},
+			401: {Description: "Password of the link not entered"},
+			404: {Description: "Share link or item not found, or the link does not allow downloads"},
+			410: {Description: "Share link expired", ContentType: "text/plain"},
+		},
+	},
+	"GET /static/*filepath": {
+		Summary: "Static resources",
+		Tags:    []string{"html"},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "File content", ContentType: "application/octet-stream"},
+			404: {Description: "Not found"},
+		},
+	},
+	"GET /media/:bucket/*key": {
+		Summary: "Presigned URLs of the filesystem storage backend",
+		Tags:    []string{"media"},
+		Auth:    authSignature,
+		Parameters: []openAPIParameter{
+			{Name: "expires", In: "query", Description: "Expiry as unix timestamp", Required: true},
+			{Name: "signature", In: "query", Description: "Signature of the URL", Required: true},
+		},
+		Responses: map[int]openAPIResponse{
+			200: {Description: "File content", ContentType: "application/octet-stream"},
+			403: {Description: "Invalid or expired signature"},
+			404: {Description: "Not found"},
+		},
+	},
+	"GET /": {
+		Summary: "Index page listing the albums",
+		Tags:    []string{"html"},
+		Auth:    authUser,
+		Parameters: []openAPIParameter{
+			{Name: "sort", In: "query", Description: "Sort order of the albums: manual (default), date or name"},
+		},
+		Responses: map[int]openAPIResponse{200: htmlPage, 303: loginRedirect},
+	},
+	"POST /albums": {
+		Summary:            "Create an empty album",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        albumNameForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the new album or to /login if not authenticated"},
+			400: {Description: "Invalid album name", ContentType: "text/plain"},
+			409: {Description: "Album already exists", ContentType: "text/plain"},
+		},
+	},
+	"POST /albums/*album/rename": {
+		Summary:            "Rename or move an album with its sub-albums",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        albumNameForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the progress page of the rename or to /login if not authenticated"},
+			400: {Description: "Invalid album name", ContentType: "text/plain"},
+			404: {Description: "Album not found", ContentType: "text/plain"},
+			409: {Description: "Album with the new name exists or the album is being changed", ContentType: "text/plain"},
+		},
+	},
+	"POST /albums/*album/cover": {
+		Summary:            "Choose the cover of an album",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        coverForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the album page or to /login if not authenticated"},
+			400: {Description: "Invalid item name", ContentType: "text/plain"},
+			404: {Description: "Album or item not found", ContentType: "text/plain"},
+		},
+	},
+	"POST /albums/*album/caption": {
+		Summary:            "Set the title, caption and notes of a media item",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        captionForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the album page or to /login if not authenticated"},
+			400: {Description: "Invalid item name or too long text", ContentType: "text/plain"},
+			404: {Description: "Item not found", ContentType: "text/plain"},
+		},
+	},
+	"POST /albums/*album/favorite": {
+		Summary:            "Star or unstar a media item for the current user",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        favoriteForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the album page or to /login if not authenticated"},
+			400: {Description: "Invalid item name", ContentType: "text/plain"},
+			404: {Description: "Item not found", ContentType: "text/plain"},
+		},
+	},
+	"POST /albums/*album/share": {
+		Summary:            "Create a link showing the album read-only to visitors without account",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        shareForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the share links or to /login if not authenticated", Location: "/shares"},
+			400: {Description: "Invalid album name or expiry", ContentType: "text/plain"},
+			404: {Description: "Album not found", ContentType: "text/plain"},
+		},
+	},
+	"POST /albums/*album/access": {
+		Summary:            "Share an album and the albums below it with a user or group, or remove the access",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        accessForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the album page or to /login if not authenticated"},
+			400: {Description: "Invalid access or album name", ContentType: "text/plain"},
+			404: {Description: "Album, user or group not found", ContentType: "text/plain"},
+		},
+	},
+	"GET /shared/:owner/albums/*album": {
+		Summary: "Page of an album of another user shared with the user",
+		Tags:    []string{"html"},
+		Auth:    authUser,
+		Parameters: []openAPIParameter{
+			{Name: "sort", In: "query", Description: "Sort order: name (default), taken, modified or size"},
+			{Name: "order", In: "query", Description: "asc (default) or desc"},
+			{Name: "limit", In: "query", Description: "Number of items per page, defaults to the configured page size"},
+			{Name: "after", In: "query", Description: "Show the page after the item with this name"},
+			{Name: "before", In: "query", Description: "Show the page before the item with this name"},
+		},
+		Responses: map[int]openAPIResponse{
+			200: htmlPage,
+			303: loginRedirect,
+			404: {Description: "Album not shared with the user"},
+		},
+	},
+	"GET /shared/:owner/albums/*album/:image": {
+		Summary:    "Full resolution media of a shared album",
+		Tags:       []string{"media"},
+		Auth:       authUser,
+		Parameters: proxiedMediaParameters,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Media content, in proxy delivery mode", ContentType: "application/octet-stream"},
+			206: {Description: "Requested range of the media, in proxy delivery mode", ContentType: "application/octet-stream"},
+			304: {Description: "Not modified, in proxy delivery mode"},
+			303: {Description: "Redirect to the media, /static/missing.png if it does not exist or to /login if not authenticated"},
+			404: {Description: "Album not shared with the user"},
+		},
+	},
+	"POST /shared/:owner/albums/*album/upload": {
+		Summary:            "Upload files to a shared album, if the user may contribute",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        uploadForm{},
+		RequestContentType: "multipart/form-data",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the album page or to /login if not authenticated"},
+			400: {Description: "Invalid form or file name", ContentType: "text/plain"},
+			404: {Description: "Album not shared with the user to contribute"},
+			409: {Description: "File already exists", ContentType: "text/plain"},
+			413: {Description: "File too large", ContentType: "text/plain"},
+			415: {Description: "Not a supported image or video type", ContentType: "text/plain"},
+		},
+	},
+	"POST /shared/:owner/albums/*album/caption": {
+		Summary:            "Set the title, caption and tags of a media item in a shared album, if the user may contribute",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        captionForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the album page or to /login if not authenticated"},
+			400: {Description: "Invalid item name or too long text", ContentType: "text/plain"},
+			404: {Description: "Item not found or album not shared with the user to contribute"},
+		},
+	},
+	"GET /shared/:owner/thumbnails/*album/:image": {
+		Summary:    "Thumbnail of a media item in a shared album, the image is the media name with .jpg appended",
+		Tags:       []string{"media"},
+		Auth:       authUser,
+		Parameters: proxiedMediaParameters,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Thumbnail, in proxy delivery mode", ContentType: "image/jpeg"},
+			304: {Description: "Not modified, in proxy delivery mode"},
+			303: {Description: "Redirect to the thumbnail, /static/missing.png if it does not exist or to /login if not authenticated"},
+			404: {Description: "Album not shared with the user"},
+		},
+	},
+	"GET /shares": {
+		Summary:   "Page with the share links of the user and buttons to revoke them",
+		Tags:      []string{"html"},
+		Auth:      authUser,
+		Responses: map[int]openAPIResponse{200: htmlPage, 303: loginRedirect},
+	},
+	"POST /shares/:token/delete": {
+		Summary: "Revoke a share link",
+		Tags:    []string{"html"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the share links or to /login if not authenticated", Location: "/shares"},
+			404: {Description: "Share link not found", ContentType: "text/plain"},
+		},
+	},
+	"GET /timeline": {
+		Summary: "Page with the media of the user grouped by the day taken, newest first",
+		Tags:    []string{"html"},
+		Auth:    authUser,
+		Parameters: []openAPIParameter{
+			{Name: "after", In: "query", Description: "Key of the last item of the previous page"},
+			{Name: "date", In: "query", Description: "Start with the media taken before the end of the year, month or day, as YYYY, YYYY-MM or YYYY-MM-DD"},
+			{Name: "limit", In: "query", Description: "Number of items per page, defaults to S3G_PAGE_SIZE"},
+		},
+		Responses: map[int]openAPIResponse{200: htmlPage, 303: loginRedirect, 400: {Description: "Invalid date", ContentType: "text/plain"}},
+	},
+	"GET /favorites": {
+		Summary:   "Page with the newest 1000 media items starred by the user",
+		Tags:      []string{"html"},
+		Auth:      authUser,
+		Responses: map[int]openAPIResponse{200: htmlPage, 303: loginRedirect},
+	},
+	"GET /map": {
+		Summary: "Page with the geotagged media of the user on a map",
+		Tags:    []string{"html"},
+		Auth:    authUser,
+		Parameters: []openAPIParameter{
+			{Name: "album", In: "query", Description: "Only show the media directly in the album"},
+		},
+		Responses: map[int]openAPIResponse{
+			200: htmlPage,
+			303: loginRedirect,
+			400: {Description: "Invalid album name", ContentType: "text/plain"},
+			404: {Description: "Album not found", ContentType: "text/plain"},
+		},
+	},
+	"POST /albums/*album/details": {
+		Summary:            "Set the title, description, dates and manual sort position of an album",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        detailsForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the album page or to /login if not authenticated"},
+			400: {Description: "Invalid dates or position", ContentType: "text/plain"},
+			404: {Description: "Album not found", ContentType: "text/plain"},
+		},
+	},
+	"POST /albums/*album/copy": {
+		Summary:            "Copy items with their thumbnails to another album of the user",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        transferForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the album page or to /login if not authenticated"},
+			400: {Description: "No items selected or invalid target", ContentType: "text/plain"},
+			404: {Description: "Item or target album not found", ContentType: "text/plain"},
+			409: {Description: "Item exists in the target album or an album is being changed", ContentType: "text/plain"},
+		},
+	},
+	"POST /albums/*album/move": {
+		Summary:            "Move items with their thumbnails to another album of the user",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        transferForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the album page or to /login if not authenticated"},
+			400: {Description: "No items selected or invalid target", ContentType: "text/plain"},
+			404: {Description: "Item or target album not found", ContentType: "text/plain"},
+			409: {Description: "Item exists in the target album or an album is being changed", ContentType: "text/plain"},
+		},
+	},
+	"GET /albums/*album/delete": {
+		Summary: "Confirmation page for deleting an album",
+		Tags:    []string{"html"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: htmlPage,
+			303: loginRedirect,
+			404: {Description: "Album not found"},
+		},
+	},
+	"POST /albums/*album/delete": {
+		Summary: "Delete an album with all media",
+		Tags:    []string{"html"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the progress page of the deletion or to /login if not authenticated"},
+			404: {Description: "Album not found", ContentType: "text/plain"},
+			409: {Description: "Album is being changed", ContentType: "text/plain"},
+		},
+	},
+	"GET /tags": {
+		Summary:   "Page listing the tags of the user's media",
+		Tags:      []string{"html"},
+		Auth:      authUser,
+		Responses: map[int]openAPIResponse{200: htmlPage, 303: loginRedirect},
+	},
+	"GET /tags/:tag": {
+		Summary:   "Page with the newest 1000 media items with the tag across all albums",
+		Tags:      []string{"html"},
+		Auth:      authUser,
+		Responses: map[int]openAPIResponse{200: htmlPage, 303: loginRedirect, 404: {Description: "Invalid tag"}},
+	},
+	"GET /search": {
+		Summary: "Page with the search form and the newest 1000 matching media items",
+		Tags:    []string{"html"},
+		Auth:    authUser,
+		Parameters: []openAPIParameter{
+			{Name: "q", In: "query", Description: "Words matching file names, album names and titles, captions, tags, camera and lens"},
+			{Name: "from", In: "query", Description: "First day taken as YYYY-MM-DD"},
+			{Name: "to", In: "query", Description: "Last day taken as YYYY-MM-DD"},
+		},
+		Responses: map[int]openAPIResponse{200: htmlPage, 303: loginRedirect, 400: {Description: "Invalid dates", ContentType: "text/plain"}},
+	},
+	"POST /smart": {
+		Summary:            "Save a tag query as smart album",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        smartAlbumForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the smart album or to /login if not authenticated"},
+			400: {Description: "Invalid name or tag query", ContentType: "text/plain"},
+			409: {Description: "Smart album already exists", ContentType: "text/plain"},
+		},
+	},
+	"GET /smart/:name": {
+		Summary:   "Page with the newest 1000 media items matching a smart album",
+		Tags:      []string{"html"},
+		Auth:      authUser,
+		Responses: map[int]openAPIResponse{200: htmlPage, 303: loginRedirect, 404: {Description: "Smart album not found"}},
+	},
+	"POST /smart/:name/delete": {
+		Summary: "Delete a smart album, the media is kept",
+		Tags:    []string{"html"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the index page or to /login if not authenticated"},
+			404: {Description: "Smart album not found", ContentType: "text/plain"},
+		},
+	},
+	"GET /jobs/:id": {
+		Summary: "Progress of an album rename or delete, reloading until it finished",
+		Tags:    []string{"html"},
+		Auth:    authUser,
+		Responses: map[int]openAPIResponse{
+			200: htmlPage,
+			303: loginRedirect,
+			404: {Description: "Job not found"},
+		},
+	},
+	"GET /albums/*album": {
+		Summary: "Album page with the sub-albums and media of the album",
+		Tags:    []string{"html"},
+		Auth:    authUser,
+		Parameters: []openAPIParameter{
+			{Name: "sort", In: "query", Description: "Sort order: name (default), taken, modified or size"},
+			{Name: "order", In: "query", Description: "asc (default) or desc"},
+			{Name: "limit", In: "query", Description: "Number of items per page, defaults to the configured page size"},
+			{Name: "after", In: "query", Description: "Show the page after the item with this name"},
+			{Name: "before", In: "query", Description: "Show the page before the item with this name"},
+		},
+		Responses: map[int]openAPIResponse{200: htmlPage, 303: loginRedirect},
+	},
+	"GET /albums/*album/:image": {
+		Summary:    "Full resolution media",
+		Tags:       []string{"media"},
+		Auth:       authUser,
+		Parameters: proxiedMediaParameters,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Media content, in proxy delivery mode", ContentType: "application/octet-stream"},
+			206: {Description: "Requested range of the media, in proxy delivery mode", ContentType: "application/octet-stream"},
+			304: {Description: "Not modified, in proxy delivery mode"},
+			303: {Description: "Redirect to the media, /static/missing.png if it does not exist or to /login if not authenticated"},
+		},
+	},
+	"POST /albums/*album/upload": {
+		Summary:            "Upload files to the album, the album is created if needed",
+		Tags:               []string{"html"},
+		Auth:               authUser,
+		RequestBody:        uploadForm{},
+		RequestContentType: "multipart/form-data",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the album page or to /login if not authenticated"},
+			400: {Description: "Invalid form or file name", ContentType: "text/plain"},
+			409: {Description: "File already exists", ContentType: "text/plain"},
+			413: {Description: "File too large", ContentType: "text/plain"},
+			415: {Description: "Not a supported image or video type", ContentType: "text/plain"},
+			500: {Description: "Internal error", ContentType: "text/plain"},
+		},
+	},
+	"GET /thumbnails/*album/:image": {
+		Summary:    "Thumbnail of a media item, the image is the media name with .jpg appended",
+		Tags:       []string{"media"},
+		Auth:       authUser,
+		Parameters: proxiedMediaParameters,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Thumbnail, in proxy delivery mode", ContentType: "image/jpeg"},
+			304: {Description: "Not modified, in proxy delivery mode"},
+			303: {Description: "Redirect to the thumbnail, /static/missing.png if it does not exist or to /login if not authenticated"},
+		},
+	},
+	"GET /me": {
+		Summary: "Current user",
+		Tags:    []string{"html"},
+		Auth:    authAdmin,
+		Responses: map[int]openAPIResponse{
+			200: {Description: "Current user, including the password hash"},
+			303: loginRedirect,
+		},
+	},
+	"GET /users": {
+		Summary:   "User management page",
+		Tags:      []string{"html"},
+		Auth:      authAdmin,
+		Responses: map[int]openAPIResponse{200: htmlPage, 303: loginRedirect},
+	},
+	"POST /users": {
+		Summary:            "Create a user",
+		Tags:               []string{"html"},
+		Auth:               authAdmin,
+		RequestBody:        createUserForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the user management page", Location: "/users"},
+		},
+	},
+	"POST /groups": {
+		Summary:            "Create a group or replace its members",
+		Tags:               []string{"html"},
+		Auth:               authAdmin,
+		RequestBody:        groupForm{},
+		RequestContentType: "application/x-www-form-urlencoded",
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the user management page", Location: "/users"},
+			400: {Description: "Invalid group name", ContentType: "text/plain"},
+			404: {Description: "User not found", ContentType: "text/plain"},
+		},
+	},
+	"GET /users/:user/delete": {
+		Summary: "Delete a user",
+		Tags:    []string{"html"},
+		Auth:    authAdmin,
+		Responses: map[int]openAPIResponse{
+			303: {Description: "Redirect to the user management page", Location: "/users"},
+		},
+	},
+}
+
+var ginPathParam = regexp.MustCompile(`[:*]([^/]+)`)
+
+// openAPIPath converts a gin path to an OpenAPI path template
+func openAPIPath(ginPath string) string {
+	return ginPathParam.ReplaceAllString(ginPath, "{$1}")
+}
+
+// routeOperations returns the operations of the route by their gin path
+func routeOperations(method, ginPath string) map[string]openAPIOperation {
+	ops := map[string]openAPIOperation{}
+	for key, op := range openAPIOperations {
+		parts := strings.SplitN(key, " ", 2)
+		if parts[0] != method {
+			continue
+		}
+		if parts[1] == ginPath || strings.Contains(ginPath, "*") && strings.HasPrefix(parts[1], ginPath+"/") {
+			ops[parts[1]] = op
+		}
+	}
+	return ops
+}
+
+// openAPIOperationID derives a unique identifier from the route, e.g.
+// getApiV1AlbumsAlbumItems for GET /api/v1/albums/*album/items
+func openAPIOperationID(method, ginPath string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(ginPath, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// openAPISchema returns the JSON schema of t, referencing named types
+func openAPISchema(t reflect.Type) gin.H {
+
+	if name, ok := openAPISchemaNames[t]; ok {
+		return gin.H{"$ref": "#/components/schemas/" + name}
+	}
+	return openAPIInlineSchema(t)
+}
+
+func openAPIInlineSchema(t reflect.Type) gin.H {
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return gin.H{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return openAPISchema(t.Elem())
+	case reflect.String:
+		return gin.H{"type": "string"}
+	case reflect.Bool:
+		return gin.H{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return gin.H{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return gin.H{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return gin.H{"type": "array", "items": openAPISchema(t.Elem())}
+	case reflect.Map:
+		return gin.H{"type": "object", "additionalProperties": openAPISchema(t.Elem())}
+	case reflect.Struct:
+		properties := gin.H{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := strings.Split(field.Tag.Get("json"), ",")
+			if tag[0] == "-" || !field.IsExported() {
+				continue
+			}
+			name := tag[0]
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = openAPISchema(field.Type)
+			if !strings.Contains(field.Tag.Get("json"), ",omitempty") {
+				required = append(required, name)
+			}
+		}
+		schema := gin.H{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+
+	return gin.H{}
+}
+
+func openAPIContent(contentType string, value interface{}) gin.H {
+	if value == nil {
+		return gin.H{contentType: gin.H{}}
+	}
+	return gin.H{contentType: gin.H{"schema": openAPISchema(reflect.TypeOf(value))}}
+}
+
+func (op openAPIOperation) document(method, ginPath string) gin.H {
+
+	doc := gin.H{
+		"operationId": openAPIOperationID(method, ginPath),
+		"summary":     op.Summary,
+		"tags":        op.Tags,
+	}
+
+	parameters := []gin.H{}
+	for _, match := range ginPathParam.FindAllStringSubmatch(ginPath, -1) {
+		parameter := gin.H{
+			"name":     match[1],
+			"in":       "path",
+			"required": true,
+			"schema":   gin.H{"type": "string"},
+		}
+		if strings.HasPrefix(match[0], "*") {
+			parameter["description"] = "Path of nested albums, may contain slashes"
+		}
+		parameters = append(parameters, parameter)
+	}
+	for _, p := range op.Parameters {
+		parameters = append(parameters, gin.H{
+			"name":        p.Name,
+			"in":          p.In,
+			"description": p.Description,
+			"required":    p.Required,
+			"schema":      gin.H{"type": "string"},
+		})
+	}
+	if len(parameters) > 0 {
+		doc["parameters"] = parameters
+	}
+
+	switch op.Auth {
+	case authNone, authSignature:
+		doc["security"] = []gin.H{}
+	case authUser, authAdmin:
+		doc["security"] = []gin.H{
+			{"bearerAuth": []string{}},
+			{"cookieAuth": []string{}},
+		}
+	}
+	if op.Auth == authAdmin {
+		doc["description"] = "Requires a user with admin privileges."
+	}
+
+	if op.RequestBody != nil {
+		contentType := op.RequestContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		doc["requestBody"] = gin.H{
+			"required": true,
+			"content":  openAPIContent(contentType, op.RequestBody),
+		}
+	}
+
+	responses := gin.H{}
+	for status, resp := range op.Responses {
+		r := gin.H{"description": resp.Description}
+		switch {
+		case resp.JSON != nil && resp.ContentType != "":
+			r["content"] = openAPIContent(resp.ContentType, resp.JSON)
+		case resp.JSON != nil:
+			r["content"] = openAPIContent("application/json", resp.JSON)
+		case resp.ContentType != "":
+			r["content"] = openAPIContent(resp.ContentType, nil)
+		}
+		if status >= 300 && status < 400 {
+			location := gin.H{"schema": gin.H{"type": "string"}}
+			if resp.Location != "" {
+				location["example"] = resp.Location
+			}
+			r["headers"] = gin.H{"Location": location}
+		}
+		responses[strconv.Itoa(status)] = r
+	}
+	doc["responses"] = responses
+
+	return doc
+}
+
+// generateOpenAPI builds the OpenAPI document for the given routes
+func generateOpenAPI(routes gin.RoutesInfo) gin.H {
+
+	paths := gin.H{}
+	for _, route := range routes {
+		// HEAD routes are registered implicitly, e.g. by r.Static()
+		if route.Method == http.MethodHead {
+			continue
+		}
+
+		ops := routeOperations(route.Method, route.Path)
+		if len(ops) == 0 {
+			log.Warnf("Route %s %s is missing in the OpenAPI document", route.Method, route.Path)
+			continue
+		}
+
+		for ginPath, op := range ops {
+			p := openAPIPath(ginPath)
+			if _, ok := paths[p]; !ok {
+				paths[p] = gin.H{}
+			}
+			paths[p].(gin.H)[strings.ToLower(route.Method)] = op.document(route.Method, ginPath)
+		}
+	}
+
+	schemas := gin.H{}
+	for t, name := range openAPISchemaNames {
+		schemas[name] = openAPIInlineSchema(t)
+	}
+
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":       "s3photoalbum",
+			"description": "Photo albums from S3-compatible buckets",
+			"version":     "1",
+		},
+		"paths": paths,
+		"components": gin.H{
+			"schemas": schemas,
+			"securitySchemes": gin.H{
+				"bearerAuth": gin.H{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+				},
+				"cookieAuth": gin.H{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": "token",
+				},
+			},
+		},
+	}
+}
+
+// openAPIHandler serves the OpenAPI document of the routes of r
+func openAPIHandler(r *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, generateOpenAPI(r.Routes()))
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"s3photoalbum/internal"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getOpenAPI fetches and decodes the served OpenAPI document
+func getOpenAPI(t *testing.T, r *gin.Engine) map[string]interface{} {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	return doc
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	setupTestServer(t)
+
+	// Use the filesystem backend, so that all optional routes are registered
+	fsStore, err := s3photoalbum.NewFilesystemStore(t.TempDir(), []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = fsStore
+	r := setupRouter()
+
+	registered := map[string]bool{}
+	for _, route := range r.Routes() {
+		if route.Method == http.MethodHead {
+			continue
+		}
+		ops := routeOperations(route.Method, route.Path)
+		if len(ops) == 0 {
+			t.Errorf("route %s %s is not described in openAPIOperations", route.Method, route.Path)
+		}
+		for ginPath := range ops {
+			registered[route.Method+" "+ginPath] = true
+		}
+	}
+
+	for key := range openAPIOperations {
+		if !registered[key] {
+			t.Errorf("operation %s is described but not registered", key)
+		}
+	}
+
+	paths := getOpenAPI(t, r)["paths"].(map[string]interface{})
+	for key := range registered {
+		parts := strings.SplitN(key, " ", 2)
+		if _, ok := paths[openAPIPath(parts[1])].(map[string]interface{})[strings.ToLower(parts[0])]; !ok {
+			t.Errorf("route %s missing in the served document", key)
+		}
+	}
+}
+
+// collectRefs returns all $ref values in the document
+func collectRefs(v interface{}) []string {
+	var refs []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if ref, ok := child.(string); ok && k == "$ref" {
+				refs = append(refs, ref)
+			}
+			refs = append(refs, collectRefs(child)...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			refs = append(refs, collectRefs(child)...)
+		}
+	}
+	return refs
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	r, _ := setupTestServer(t)
+	doc := getOpenAPI(t, r)
+
+	if version, _ := doc["openapi"].(string); !strings.HasPrefix(version, "3.") {
+		t.Errorf("unexpected OpenAPI version %q", version)
+	}
+
+	info, _ := doc["info"].(map[string]interface{})
+	if info["title"] == "" || info["version"] == "" {
+		t.Error("info.title and info.version are required")
+	}
+
+	components := doc["components"].(map[string]interface{})
+	schemas := components["schemas"].(map[string]interface{})
+	for _, name := range []string{"Album", "User", "MediaItem", "Error"} {
+		if _, ok := schemas[name]; !ok {
+			t.Errorf("schema %s missing", name)
+		}
+	}
+
+	for _, ref := range collectRefs(doc) {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		if _, ok := schemas[name]; !ok || name == ref {
+			t.Errorf("unresolvable reference %s", ref)
+		}
+	}
+
+	securitySchemes := components["securitySchemes"].(map[string]interface{})
+	operationIDs := map[string]bool{}
+
+	for p, item := range doc["paths"].(map[string]interface{}) {
+		for method, op := range item.(map[string]interface{}) {
+			op := op.(map[string]interface{})
+
+			id, _ := op["operationId"].(string)
+			if id == "" || operationIDs[id] {
+				t.Errorf("%s %s: missing or duplicate operationId %q", method, p, id)
+			}
+			operationIDs[id] = true
+
+			// Every path template parameter has to be declared
+			declared := map[string]bool{}
+			params, _ := op["parameters"].([]interface{})
+			for _, param := range params {
+				param := param.(map[string]interface{})
+				if param["in"] == "path" {
+					declared[param["name"].(string)] = true
+				}
+			}
+			for _, match := range strings.Split(p, "{")[1:] {
+				name := strings.SplitN(match, "}", 2)[0]
+				if !declared[name] {
+					t.Errorf("%s %s: path parameter %s not declared", method, p, name)
+				}
+			}
+
+			if responses, _ := op["responses"].(map[string]interface{}); len(responses) == 0 {
+				t.Errorf("%s %s: no responses", method, p)
+			}
+
+			security, _ := op["security"].([]interface{})
+			for _, requirement := range security {
+				for scheme := range requirement.(map[string]interface{}) {
+					if _, ok := securitySchemes[scheme]; !ok {
+						t.Errorf("%s %s: unknown security scheme %s", method, p, scheme)
+					}
+				}
+			}
+		}
+	}
+}
+
+// validateSchema checks a decoded JSON value against a schema of the
+// document. Only the subset of JSON schema generated by openAPISchema is
+// supported.
+func validateSchema(schemas map[string]interface{}, schema map[string]interface{}, value interface{}, where string) error {
+
+	if ref, ok := schema["$ref"].(string); ok {
+		return validateSchema(schemas, schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{}), value, where)
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected object, got %T", where, value)
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				return fmt.Errorf("%s: required property %s missing", where, name)
+			}
+		}
+		for name, v := range obj {
+			propSchema, ok := properties[name].(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s: undocumented property %s", where, name)
+			}
+			if err := validateSchema(schemas, propSchema, v, where+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected array, got %T", where, value)
+		}
+		for i, v := range arr {
+			if err := validateSchema(schemas, schema["items"].(map[string]interface{}), v, fmt.Sprintf("%s[%d]", where, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected string, got %T", where, value)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				return fmt.Errorf("%s: invalid date-time %q", where, s)
+			}
+		}
+	case "integer", "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: expected number, got %T", where, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected boolean, got %T", where, value)
+		}
+	}
+	return nil
+}
+
+func TestOpenAPIResponsesMatchSchema(t *testing.T) {
+	r, _ := setupTestServer(t)
+	doc := getOpenAPI(t, r)
+	paths := doc["paths"].(map[string]interface{})
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+
+	token := apiLoginAs(t, r, "alice")
+
+	tests := []struct {
+		method string
+		path   string
+		target string
+		token  string
+		status int
+	}{
+		{http.MethodGet, "/api/v1/me", "/api/v1/me", token, http.StatusOK},
+		{http.MethodGet, "/api/v1/albums", "/api/v1/albums", token, http.StatusOK},
+		{http.MethodGet, "/api/v1/albums", "/api/v1/albums", "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/v1/albums/{album}", "/api/v1/albums/summer", token, http.StatusOK},
+		{http.MethodGet, "/api/v1/albums/{album}", "/api/v1/albums/nope", token, http.StatusNotFound},
+		{http.MethodGet, "/api/v1/albums/{album}/items", "/api/v1/albums/summer/items", token, http.StatusOK},
+		{http.MethodGet, "/api/v1/albums/{album}/items/{item}", "/api/v1/albums/summer/items/beach.jpg", token, http.StatusOK},
+		{http.MethodGet, "/api/v1/users", "/api/v1/users", token, http.StatusOK},
+		{http.MethodGet, "/api/v1/metrics", "/api/v1/metrics", token, http.StatusOK},
+		{http.MethodPost, "/api/v1/albums/{album}/uploads", "/api/v1/albums/summer/uploads", token, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/uploads/{id}", "/api/v1/uploads/nope", token, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			var body interface{}
+			if status := apiRequest(t, r, tt.method, tt.target, tt.token, nil, &body); status != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, status)
+			}
+
+			op := paths[tt.path].(map[string]interface{})[strings.ToLower(tt.method)].(map[string]interface{})
+			resp, ok := op["responses"].(map[string]interface{})[fmt.Sprint(tt.status)].(map[string]interface{})
+			if !ok {
+				t.Fatalf("status %d not documented", tt.status)
+			}
+
+			schema := resp["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+			if err := validateSchema(schemas, schema, body, "response"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/url"
+	"path"
+	"s3photoalbum/internal"
+	"strconv"
+)
+
+// Sort orders of the album page, passed as "sort" query parameter
+const (
+	sortName     = "name"
+	sortModified = "modified"
+	sortTaken    = "taken"
+	sortSize     = "size"
+)
+
+// Upper limit for the "limit" query parameter
+const maxPageSize = 1000
+
+// sortColumns are the SQL expressions of the sort orders. Media without
+// capture time is sorted by its upload time.
+var sortColumns = map[string]string{
+	sortName:     "name",
+	sortModified: "last_modified",
+	sortTaken:    "COALESCE(capture_time, last_modified)",
+	sortSize:     "size",
+}
+
+// albumQuery selects a page of an album. The cursors are item names, After
+// selects the page following the item, Before the one preceding it.
+type albumQuery struct {
+	Sort   string
+	Desc   bool
+	After  string
+	Before string
+	Limit  int
+}
+
+type albumPage struct {
+	Items []s3photoalbum.MediaItem
+	// Cursors for the adjacent pages, empty if there is none
+	Prev string
+	Next string
+}
+
+// parseAlbumQuery reads the query parameters of the album page, invalid
+// values are replaced by the defaults
+func parseAlbumQuery(c *gin.Context) albumQuery {
+
+	q := albumQuery{
+		Sort:   c.Query("sort"),
+		Desc:   c.Query("order") == "desc",
+		After:  c.Query("after"),
+		Before: c.Query("before"),
+		Limit:  config.PageSize,
+	}
+
+	if _, ok := sortColumns[q.Sort]; !ok {
+		q.Sort = sortName
+	}
+
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit > 0 {
+		q.Limit = limit
+	}
+	if q.Limit <= 0 || q.Limit > maxPageSize {
+		q.Limit = maxPageSize
+	}
+
+	// Only one direction at a time
+	if q.After != "" {
+		q.Before = ""
+	}
+	return q
+}
+
+// url returns the link to the page before or after the cursor with the same
+// sorting. An empty cursor links to the first page.
+func (q albumQuery) url(direction, cursor string) string {
+
+	values := url.Values{}
+	values.Set("sort", q.Sort)
+	if q.Desc {
+		values.Set("order", "desc")
+	}
+	if q.Limit != config.PageSize {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if cursor != "" {
+		values.Set(direction, cursor)
+	}
+	return "?" + values.Encode()
+}
+
+// listAlbumPage returns the items of the page selected by q from the album
+// of the owner. Equal items are sorted by name, so that the names can be used
+// as cursors.
+func listAlbumPage(owner, album string, q albumQuery) (albumPage, error) {
+
+	firstPage := albumQuery{Sort: q.Sort, Desc: q.Desc, Limit: q.Limit}
+	column := sortColumns[q.Sort]
+
+	// Pages before the cursor are read in reverse order
+	cursor, backwards := q.After, false
+	if q.Before != "" {
+		cursor, backwards = q.Before, true
+	}
+
+	// Unknown cursors, e.g. of deleted items, select the first page
+	var cursorItem *s3photoalbum.MediaItem
+	if cursor != "" {
+		var err error
+		if cursorItem, err = findMediaItem(path.Join(owner, album, cursor)); err != nil {
+			return albumPage{}, err
+		}
+		if cursorItem == nil || cursorItem.Owner != owner || cursorItem.Album != album || cursorItem.Name != cursor {
+			return listAlbumPage(owner, album, firstPage)
+		}
+	}
+
+	comparison, direction := ">", "ASC"
+	if q.Desc != backwards {
+		comparison, direction = "<", "DESC"
+	}
+
+	query := DB.Where("owner = ? AND album = ?", owner, album)
+	if cursorItem != nil {
+		query = query.Where(fmt.Sprintf("(%s, name) %s (SELECT %s, name FROM media_items WHERE id = ?)", column, comparison, column), cursorItem.ID)
+	}
+
+	var items []s3photoalbum.MediaItem
+	if err := query.Order(fmt.Sprintf("%s %s, name %s", column, direction, direction)).Limit(q.Limit + 1).Find(&items).Error; err != nil {
+		return albumPage{}, err
+	}
+
+	more := len(items) > q.Limit
+	if more {
+		items = items[:q.Limit]
+	}
+
+	if !backwards {
+		page := albumPage{Items: items}
+		if more {
+			page.Next = items[len(items)-1].Name
+		}
+		if cursorItem != nil && len(items) > 0 {
+			page.Prev = items[0].Name
+		}
+		return page, nil
+	}
+
+	// Show a full first page instead of a partial one when reaching the
+	// start
+	if !more {
+		return listAlbumPage(owner, album, firstPage)
+	}
+
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return albumPage{
+		Items: items,
+		Prev:  items[0].Name,
+		Next:  items[len(items)-1].Name,
+	}, nil
+}
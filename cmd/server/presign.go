@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Lifetime of the presigned URLs. They are cached for slightly less, so that
+// a cached URL is always valid for at least presignMargin.
+const (
+	presignExpiry = time.Hour
+	presignMargin = 5 * time.Minute
+)
+
+// Time for which missing objects are cached. Kept short, as thumbnails appear
+// shortly after the upload of the media.
+const presignNegativeTTL = time.Minute
+
+// presignCacheStats are the counters of a presignCache
+type presignCacheStats struct {
+	// Lookups answered with a cached URL
+	Hits uint64
+	// Lookups answered with a cached "missing"
+	NegativeHits uint64
+	// Lookups that were not cached or expired
+	Misses uint64
+	// Entries removed to make room for new ones, before they expired
+	Evictions uint64
+	// Current number of entries
+	Size int
+}
+
+type presignCacheEntry struct {
+	url     string
+	missing bool
+	expires time.Time
+}
+
+// presignCache is a TTL cache of presigned URLs. Positive entries are keyed
+// by bucket, key and ETag of the object, so that a changed object gets a new
+// URL. Missing objects are cached by bucket and key only.
+type presignCache struct {
+	// Maximum number of entries
+	size int
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]presignCacheEntry
+	stats   presignCacheStats
+}
+
+func newPresignCache(size int) *presignCache {
+	return &presignCache{
+		size:    size,
+		now:     time.Now,
+		entries: make(map[string]presignCacheEntry),
+	}
+}
+
+func presignCacheKey(bucket, key, etag string) string {
+	return bucket + "\x00" + key + "\x00" + etag
+}
+
+// lookup returns the entry for the cache key if it did not expire
+func (c *presignCache) lookup(cacheKey string) (presignCacheEntry, bool) {
+	entry, ok := c.entries[cacheKey]
+	if ok && !c.now().Before(entry.expires) {
+		delete(c.entries, cacheKey)
+		return entry, false
+	}
+	return entry, ok
+}
+
+// isMissing reports whether the object was recently found to be missing
+func (c *presignCache) isMissing(bucket, key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.lookup(presignCacheKey(bucket, key, "")); ok {
+		c.stats.NegativeHits++
+		return true
+	}
+	return false
+}
+
+// get returns the cached URL of the object version
+func (c *presignCache) get(bucket, key, etag string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.lookup(presignCacheKey(bucket, key, etag))
+	if !ok {
+		c.stats.Misses++
+		return "", false
+	}
+	c.stats.Hits++
+	return entry.url, true
+}
+
+// add caches the URL of the object version, presigned with presignExpiry
+func (c *presignCache) add(bucket, key, etag, url string) {
+	c.insert(presignCacheKey(bucket, key, etag), presignCacheEntry{
+		url:     url,
+		expires: c.now().Add(presignExpiry - presignMargin),
+	})
+}
+
+// addMissing caches that the object does not exist
+func (c *presignCache) addMissing(bucket, key string) {
+	c.insert(presignCacheKey(bucket, key, ""), presignCacheEntry{
+		missing: true,
+		expires: c.now().Add(presignNegativeTTL),
+	})
+}
+
+// forget removes the cached "missing" of an object that was just created
+func (c *presignCache) forget(bucket, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, presignCacheKey(bucket, key, ""))
+}
+
+func (c *presignCache) insert(cacheKey string, entry presignCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size <= 0 {
+		return
+	}
+
+	if _, ok := c.entries[cacheKey]; !ok && len(c.entries) >= c.size {
+		// Drop expired entries first, then arbitrary ones
+		now := c.now()
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+			c.stats.Evictions++
+		}
+	}
+
+	c.entries[cacheKey] = entry
+}
+
+// statistics returns a snapshot of the counters
+func (c *presignCache) statistics() presignCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Size = len(c.entries)
+	return stats
+}
+
+// presign returns a cached presigned URL for the version etag of the object,
+// creating it if needed
+func presign(bucket, key, etag string) (string, error) {
+
+	if url, ok := urlCache.get(bucket, key, etag); ok {
+		return url, nil
+	}
+
+	presignedURL, err := store.Presign(context.Background(), bucket, key, presignExpiry, make(url.Values))
+	if err != nil {
+		return "", err
+	}
+
+	urlCache.add(bucket, key, etag, presignedURL.String())
+	return presignedURL.String(), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPresignCache(t *testing.T) {
+	now := time.Now()
+	c := newPresignCache(2)
+	c.now = func() time.Time { return now }
+
+	if _, ok := c.get("media", "a.jpg", "1"); ok {
+		t.Error("empty cache returned an URL")
+	}
+
+	c.add("media", "a.jpg", "1", "http://a1")
+	if url, ok := c.get("media", "a.jpg", "1"); !ok || url != "http://a1" {
+		t.Errorf("expected cached URL, got %q", url)
+	}
+	if _, ok := c.get("media", "a.jpg", "2"); ok {
+		t.Error("changed object returned the URL of the old version")
+	}
+
+	c.addMissing("media", "b.jpg")
+	if !c.isMissing("media", "b.jpg") || c.isMissing("media", "a.jpg") {
+		t.Error("unexpected negative cache state")
+	}
+
+	// Missing objects expire first
+	now = now.Add(presignNegativeTTL)
+	if c.isMissing("media", "b.jpg") {
+		t.Error("negative entry did not expire")
+	}
+
+	// URLs expire before the presigned URL does
+	now = now.Add(presignExpiry - presignMargin - presignNegativeTTL)
+	if _, ok := c.get("media", "a.jpg", "1"); ok {
+		t.Error("entry did not expire")
+	}
+
+	c.add("media", "a.jpg", "1", "http://a1")
+	c.add("media", "b.jpg", "1", "http://b1")
+	c.add("media", "c.jpg", "1", "http://c1")
+
+	expected := presignCacheStats{Hits: 1, NegativeHits: 1, Misses: 3, Evictions: 1, Size: 2}
+	if stats := c.statistics(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestMediaRedirectsCached(t *testing.T) {
+	r, _ := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+
+	var locations []string
+	for _, target := range []string{
+		"/thumbnails/summer/beach.jpg.jpg",
+		"/thumbnails/summer/beach.jpg.jpg",
+		"/thumbnails/summer/video.mp4.jpg",
+		"/thumbnails/summer/video.mp4.jpg",
+	} {
+		w := doRequest(r, http.MethodGet, target, nil, cookie)
+		locations = append(locations, w.Header().Get("Location"))
+	}
+
+	if locations[0] != locations[1] {
+		t.Errorf("expected the same URL twice, got %v", locations)
+	}
+
+	expected := presignCacheStats{Hits: 1, NegativeHits: 1, Misses: 1, Size: 2}
+	if stats := urlCache.statistics(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"s3photoalbum/internal"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var errSearchQuery = errors.New("invalid search")
+
+// Upper limit for the number of words of a search
+const maxSearchTerms = 20
+
+// The search index is a full-text table with a row for every media item, the
+// rowid is the ID of the item. FTS5 needs the sqlite_fts5 build tag of
+// go-sqlite3, without it FTS4 is used which is always compiled in.
+const (
+	searchTableFTS5 = `CREATE VIRTUAL TABLE media_search USING fts5(name, album, caption, tags, camera, place, tokenize = 'unicode61 remove_diacritics 2')`
+	searchTableFTS4 = `CREATE VIRTUAL TABLE media_search USING fts4(name, album, caption, tags, camera, place, tokenize=unicode61 "remove_diacritics=2")`
+)
+
+// searchRows inserts the search rows of the media items matching the
+// condition, with the album title, the caption and the tags of the items
+const searchRows = `INSERT INTO media_search (rowid, name, album, caption, tags, camera, place)
+	SELECT m.id, m.name, m.album || ' ' || COALESCE(a.title, ''),
+		COALESCE(c.title, '') || ' ' || COALESCE(c.caption, '') || ' ' || COALESCE(c.notes, ''),
+		COALESCE((SELECT group_concat(t.name, ' ') FROM tags t WHERE t.key = m.key), ''),
+		m.camera_model || ' ' || m.lens_model,
+		m.city || ' ' || m.region || ' ' || m.country
+	FROM media_items m
+	LEFT JOIN albums a ON a.owner = m.owner AND a.name = m.album AND a.deleted_at IS NULL
+	LEFT JOIN item_captions c ON c.key = m.key
+	WHERE m.deleted_at IS NULL AND %s;`
+
+// refreshSearchRows replaces the search rows of the media items matching
+// the condition
+func refreshSearchRows(condition string) string {
+	return "DELETE FROM media_search WHERE rowid IN (SELECT id FROM media_items m WHERE " + condition + "); " +
+		fmt.Sprintf(searchRows, condition)
+}
+
+// The triggers keep the search index in sync with the media items, captions,
+// tags and album titles. They also run for changes of the thumbnailer, which
+// writes to the same database.
+var searchTriggers = map[string]string{
+	"media_search_item_insert": `AFTER INSERT ON media_items BEGIN ` + fmt.Sprintf(searchRows, "m.id = NEW.id") + ` END`,
+	"media_search_item_update": `AFTER UPDATE ON media_items
+		WHEN OLD.owner IS NOT NEW.owner OR OLD.album IS NOT NEW.album OR OLD.name IS NOT NEW.name OR
+			OLD.camera_model IS NOT NEW.camera_model OR OLD.lens_model IS NOT NEW.lens_model OR
+			OLD.city IS NOT NEW.city OR OLD.region IS NOT NEW.region OR OLD.country IS NOT NEW.country OR OLD.deleted_at IS NOT NEW.deleted_at
+		BEGIN DELETE FROM media_search WHERE rowid = OLD.id; ` + fmt.Sprintf(searchRows, "m.id = NEW.id") + ` END`,
+	"media_search_item_delete":    `AFTER DELETE ON media_items BEGIN DELETE FROM media_search WHERE rowid = OLD.id; END`,
+	"media_search_caption_insert": `AFTER INSERT ON item_captions BEGIN ` + refreshSearchRows("m.key = NEW.key") + ` END`,
+	"media_search_caption_update": `AFTER UPDATE ON item_captions BEGIN ` + refreshSearchRows("m.key = NEW.key") + ` END`,
+	"media_search_caption_delete": `AFTER DELETE ON item_captions BEGIN ` + refreshSearchRows("m.key = OLD.key") + ` END`,
+	"media_search_tag_insert":     `AFTER INSERT ON tags BEGIN ` + refreshSearchRows("m.key = NEW.key") + ` END`,
+	"media_search_tag_delete":     `AFTER DELETE ON tags BEGIN ` + refreshSearchRows("m.key = OLD.key") + ` END`,
+	"media_search_album_insert":   `AFTER INSERT ON albums BEGIN ` + refreshSearchRows("m.owner = NEW.owner AND m.album = NEW.name") + ` END`,
+	"media_search_album_update":   `AFTER UPDATE OF title ON albums BEGIN ` + refreshSearchRows("m.owner = NEW.owner AND m.album = NEW.name") + ` END`,
+	"media_search_album_delete":   `AFTER DELETE ON albums BEGIN ` + refreshSearchRows("m.owner = OLD.owner AND m.album = OLD.name") + ` END`,
+}
+
+// setupSearch recreates the search index and its triggers. The index is
+// derived from the other tables, so it is rebuilt on every start.
+func setupSearch(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+
+		for name := range searchTriggers {
+			if err := tx.Exec("DROP TRIGGER IF EXISTS " + name).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("DROP TABLE IF EXISTS media_search").Error; err != nil {
+			return err
+		}
+
+		var fts5 bool
+		if err := tx.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5).Error; err != nil {
+			return err
+		}
+		table := searchTableFTS4
+		if fts5 {
+			table = searchTableFTS5
+		}
+		if err := tx.Exec(table).Error; err != nil {
+			return err
+		}
+
+		for name, trigger := range searchTriggers {
+			if err := tx.Exec("CREATE TRIGGER " + name + " " + trigger).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Exec(fmt.Sprintf(searchRows, "1")).Error
+	})
+}
+
+// searchQuery is a search of the media of a user. All words of the text have
+// to match the file name, album name or title, caption, tags, camera or place
+// of an item, as word prefixes. The dates limit the capture time, falling back
+// to the upload time, and include the whole day.
+type searchQuery struct {
+	Text string
+	From *time.Time
+	To   *time.Time
+}
+
+// parseSearchQuery parses a search from the search form
+func parseSearchQuery(text, from, to string) (searchQuery, error) {
+
+	q := searchQuery{Text: strings.TrimSpace(text)}
+	var err error
+	if q.From, err = parseDate(from); err != nil {
+		return q, fmt.Errorf("%w: dates have to be formatted as YYYY-MM-DD", errSearchQuery)
+	}
+	if q.To, err = parseDate(to); err != nil {
+		return q, fmt.Errorf("%w: dates have to be formatted as YYYY-MM-DD", errSearchQuery)
+	}
+	if q.From != nil && q.To != nil && q.To.Before(*q.From) {
+		return q, fmt.Errorf("%w: the end date is before the start date", errSearchQuery)
+	}
+	if len(q.terms()) > maxSearchTerms {
+		return q, fmt.Errorf("%w: at most %d words are allowed", errSearchQuery, maxSearchTerms)
+	}
+	return q, nil
+}
+
+// terms returns the words of the text in lower case, as the full-text
+// operators are upper case
+func (q searchQuery) terms() []string {
+	return strings.FieldsFunc(strings.ToLower(q.Text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.IsMark(r)
+	})
+}
+
+// empty returns if the search has neither words nor dates
+func (q searchQuery) empty() bool {
+	return len(q.terms()) == 0 && q.From == nil && q.To == nil
+}
+
+// searchItems returns the newest media items of the owner matching the
+// search, up to maxPageSize. Only the own items are searched, as the index
+// contains the private notes.
+func searchItems(owner string, q searchQuery) ([]s3photoalbum.MediaItem, error) {
+
+	query := DB.Where("owner = ?", owner)
+	if terms := q.terms(); len(terms) > 0 {
+		match := strings.Join(terms, "* ") + "*"
+		query = query.Where("id IN (SELECT rowid FROM media_search WHERE media_search MATCH ?)", match)
+	}
+	if q.From != nil {
+		query = query.Where("COALESCE(capture_time, last_modified) >= ?", *q.From)
+	}
+	if q.To != nil {
+		query = query.Where("COALESCE(capture_time, last_modified) < ?", q.To.AddDate(0, 0, 1))
+	}
+
+	var items []s3photoalbum.MediaItem
+	err := query.Order(taggedItemsOrder).Limit(maxPageSize).Find(&items).Error
+	return items, err
+}
+
+// searchHandler shows the search form and the matching media of the user
+func searchHandler(c *gin.Context) {
+
+	q, err := parseSearchQuery(c.Query("q"), c.Query("from"), c.Query("to"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	var items []s3photoalbum.MediaItem
+	if !q.empty() {
+		if items, err = searchItems(c.GetString("username"), q); err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	info, err := findItemInfo(c.GetString("username"), keys)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.HTML(http.StatusOK, "search.html", gin.H{
+		"context":  c,
+		"title":    "Search",
+		"query":    q,
+		"searched": !q.empty(),
+		"images":   items,
+		"info":     info,
+	})
+}
+
+func apiSearch(c *gin.Context) {
+
+	q, err := parseSearchQuery(c.Query("q"), c.Query("from"), c.Query("to"))
+	if err == nil && q.empty() {
+		err = fmt.Errorf("%w: words or dates are required", errSearchQuery)
+	}
+	if err != nil {
+		apiError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	items, err := searchItems(c.GetString("username"), q)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to search")
+		return
+	}
+
+	ret, err := newAPIMediaItems(c.GetString("username"), items)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to search")
+		return
+	}
+	c.JSON(http.StatusOK, ret)
+}
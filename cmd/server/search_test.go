@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"s3photoalbum/internal"
+)
+
+func TestSearch(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	if err := s3.PutObjectWithMetadata(testThumbBucket, "alice/summer/beach.jpg.jpg", []byte("thumb"), "image/jpeg", map[string]string{
+		s3photoalbum.MetadataCaptureTime: "2021-06-01T12:00:00",
+		s3photoalbum.MetadataCameraModel: "Canon+EOS+R6",
+		s3photoalbum.MetadataLensModel:   "RF24-105mm",
+		s3photoalbum.MetadataKeywords:    "Sea",
+		s3photoalbum.MetadataCity:        "Lisbon",
+		s3photoalbum.MetadataCountry:     "Portugal",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Captions, tags and album titles changed after the start are found
+	caption, tags := "Waves and sand", []string{"vacation"}
+	apiRequest(t, r, http.MethodPatch, "/api/v1/albums/summer/items/sunset.jpg", token, apiUpdateItemRequest{Caption: &caption, Tags: &tags}, nil)
+	apiRequest(t, r, http.MethodPut, "/api/v1/albums/winter/details", token, apiSetDetailsRequest{Title: "Alps"}, nil)
+
+	search := func(query url.Values) []string {
+		t.Helper()
+		var items []apiMediaItem
+		if status := apiRequest(t, r, http.MethodGet, "/api/v1/search?"+query.Encode(), token, nil, &items); status != http.StatusOK {
+			t.Fatalf("search %v: got status %d", query, status)
+		}
+		names := []string{}
+		for _, item := range items {
+			names = append(names, item.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	for _, tt := range []struct {
+		query    url.Values
+		expected []string
+	}{
+		{url.Values{"q": {"beach"}}, []string{"beach.jpg"}},
+		{url.Values{"q": {"summer"}}, []string{"beach.jpg", "sunset.jpg", "video.mp4"}},
+		{url.Values{"q": {"alps"}}, []string{"snow.jpg"}},
+		{url.Values{"q": {"wav"}}, []string{"sunset.jpg"}},
+		{url.Values{"q": {"Vacation"}}, []string{"sunset.jpg"}},
+		{url.Values{"q": {"sea"}}, []string{"beach.jpg"}},
+		{url.Values{"q": {"canon rf24"}}, []string{"beach.jpg"}},
+		{url.Values{"q": {"canon snow"}}, []string{}},
+		{url.Values{"q": {"lisbon"}}, []string{"beach.jpg"}},
+		{url.Values{"q": {"lisbon portugal"}}, []string{"beach.jpg"}},
+		{url.Values{"q": {"cake"}}, []string{}},
+		{url.Values{"q": {"AND OR"}}, []string{}},
+		{url.Values{"from": {"2021-06-01"}, "to": {"2021-06-01"}}, []string{"beach.jpg"}},
+		{url.Values{"q": {"summer"}, "to": {"2021-05-31"}}, []string{}},
+	} {
+		if names := search(tt.query); !reflect.DeepEqual(names, tt.expected) {
+			t.Errorf("search %v: expected %v, got %v", tt.query, tt.expected, names)
+		}
+	}
+
+	// The index follows renamed and removed items
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums/summer/move", token, apiTransferItemsRequest{
+		Items:  []string{"beach.jpg"},
+		Target: "winter",
+	}, nil); status != http.StatusOK {
+		t.Fatalf("move: got status %d", status)
+	}
+	if names := search(url.Values{"q": {"alps canon"}}); !reflect.DeepEqual(names, []string{"beach.jpg"}) {
+		t.Errorf("moved item not found: %v", names)
+	}
+	if names := search(url.Values{"q": {"summer canon"}}); len(names) != 0 {
+		t.Errorf("moved item found in the old album: %v", names)
+	}
+
+	w := doRequest(r, http.MethodGet, "/search?q=alps", nil, cookie)
+	for _, s := range []string{
+		`<input type="search" placeholder="Names, captions, tags, camera, places" name="q" value="alps">`,
+		`<img src="/thumbnails/winter/snow.jpg.jpg"`,
+		`<img src="/thumbnails/winter/beach.jpg.jpg"`,
+	} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("search page does not contain %s", s)
+		}
+	}
+	if w := doRequest(r, http.MethodGet, "/search", nil, cookie); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "No Images") {
+		t.Errorf("empty search: got status %d", w.Code)
+	}
+
+	for name, query := range map[string]string{
+		"empty":        "q=+",
+		"invalid date": "q=beach&from=june",
+		"date order":   "from=2021-06-02&to=2021-06-01",
+	} {
+		if status := apiRequest(t, r, http.MethodGet, "/api/v1/search?"+query, token, nil, nil); status != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", name, http.StatusBadRequest, status)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"s3photoalbum/internal"
+	"strings"
+	"time"
+)
+
+var (
+	errShareLink         = errors.New("invalid share link")
+	errShareLinkNotFound = errors.New("share link not found")
+	errShareLinkExpired  = errors.New("share link expired")
+)
+
+// Name of the cookie of visitors who entered the password of a share link,
+// it is only sent to the pages of the link
+const shareCookie = "share"
+
+// ShareLink gives visitors without account read-only access to an album of
+// the owner. The links follow the album when it is renamed and are deleted
+// with it.
+type ShareLink struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	// Random, the link is /s/<token>
+	Token string `gorm:"uniqueIndex;not null"`
+	Owner string `gorm:"index:idx_share_links_album;not null"`
+	Album string `gorm:"index:idx_share_links_album;not null"`
+	// Nil for links that don't expire
+	ExpiresAt *time.Time
+	// bcrypt hash, empty for links without password
+	PasswordHash string `gorm:"not null;default:''"`
+	// Whether the visitors get links to download the originals
+	AllowDownload bool `gorm:"not null;default:false"`
+}
+
+// shareURLs are the URLs of a media item shown to visitors. They are below
+// the link, so that every request is checked like the album page.
+type shareURLs struct {
+	Thumbnail string
+	// The thumbnail for photos of links without downloads
+	Media string
+	// Empty unless the link allows downloads
+	Download string
+}
+
+// shareStatus returns the HTTP status for errors of the share links
+func shareStatus(err error) int {
+	switch {
+	case errors.Is(err, errShareLink):
+		return http.StatusBadRequest
+	case errors.Is(err, errShareLinkNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errShareLinkExpired):
+		return http.StatusGone
+	}
+	return albumStatus(err)
+}
+
+// URL returns the path of the shared album page
+func (link ShareLink) URL() string {
+	return "/s/" + link.Token
+}
+
+// Expired returns whether visitors can no longer use the link
+func (link ShareLink) Expired() bool {
+	return link.ExpiresAt != nil && !time.Now().Before(*link.ExpiresAt)
+}
+
+// createShareLink creates a link to the album of the owner. Empty passwords
+// create links without password.
+func createShareLink(owner, album string, expiresAt *time.Time, password string, allowDownload bool) (*ShareLink, error) {
+
+	if !validAlbumPath(album) {
+		return nil, errAlbumName
+	}
+	existing, err := findAlbum(owner, album)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, errAlbumNotFound
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("%w: the expiry is in the past", errShareLink)
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	link := ShareLink{
+		Token:         hex.EncodeToString(token),
+		Owner:         owner,
+		Album:         album,
+		ExpiresAt:     expiresAt,
+		AllowDownload: allowDownload,
+	}
+	if password != "" {
+		if link.PasswordHash, err = hashAndSalt(password); err != nil {
+			return nil, err
+		}
+	}
+	return &link, DB.Create(&link).Error
+}
+
+// findShareLink returns the link with the token, nil if there is none
+func findShareLink(token string) (*ShareLink, error) {
+	var links []ShareLink
+	if err := DB.Where("token = ?", token).Limit(1).Find(&links).Error; err != nil {
+		return nil, err
+	}
+	if len(links) == 0 {
+		return nil, nil
+	}
+	return &links[0], nil
+}
+
+// listShareLinks returns the links of the owner, newest first
+func listShareLinks(owner string) ([]ShareLink, error) {
+	var links []ShareLink
+	err := DB.Where("owner = ?", owner).Order("id DESC").Find(&links).Error
+	return links, err
+}
+
+// deleteShareLink revokes the link of the owner
+func deleteShareLink(owner, token string) error {
+	result := DB.Where("owner = ? AND token = ?", owner, token).Delete(&ShareLink{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errShareLinkNotFound
+	}
+	return nil
+}
+
+// moveShareLinks changes the album of the links to a renamed album and the
+// albums below it
+func moveShareLinks(owner, album, target string) error {
+	var links []ShareLink
+	if err := inAlbum(DB.Where("owner = ?", owner), "album", album).Find(&links).Error; err != nil {
+		return err
+	}
+	for _, link := range links {
+		if err := DB.Model(&link).Update("album", target+strings.TrimPrefix(link.Album, album)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteShareLinks deletes the links to a deleted album and the albums below
+// it
+func deleteShareLinks(owner, album string) error {
+	return inAlbum(DB.Where("owner = ?", owner), "album", album).Delete(&ShareLink{}).Error
+}
+
+// shareSecret is the value of the cookie of visitors who entered the password
+// of the link. It is derived from the password hash, so that it is only valid
+// for the link.
+func shareSecret(link ShareLink) string {
+	mac := hmac.New(sha256.New, []byte(config.JwtKey))
+	mac.Write([]byte(link.Token + "\n" + link.PasswordHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// shareUnlocked returns if the visitor may see the album of the link
+func shareUnlocked(c *gin.Context, link ShareLink) bool {
+	if link.PasswordHash == "" {
+		return true
+	}
+	secret, err := c.Cookie(shareCookie)
+	return err == nil && hmac.Equal([]byte(secret), []byte(shareSecret(link)))
+}
+
+// shareItemURLs returns the URLs of the items for the visitors of the link.
+// The download URLs are only set if the link allows downloads.
+func shareItemURLs(link ShareLink, items []s3photoalbum.MediaItem) map[string]shareURLs {
+
+	ret := map[string]shareURLs{}
+	for _, item := range items {
+		urls := shareURLs{
+			Thumbnail: escapedPath(link.URL(), "thumbnails", item.Name+".jpg"),
+			Media:     escapedPath(link.URL(), "media", item.Name),
+		}
+		if link.AllowDownload {
+			urls.Download = escapedPath(link.URL(), "download", item.Name)
+		}
+		ret[item.Key] = urls
+	}
+	return ret
+}
+
+// visitShareLink returns the link of the request, or the error to show to
+// the visitor
+func visitShareLink(c *gin.Context) (*ShareLink, error) {
+	link, err := findShareLink(c.Param("token"))
+	if err != nil {
+		return nil, err
+	}
+	if link == nil {
+		return nil, errShareLinkNotFound
+	}
+	if link.Expired() {
+		return nil, errShareLinkExpired
+	}
+	return link, nil
+}
+
+// shareHandler shows the album of a share link read-only to visitors without
+// account. Links with password ask for it first.
+func shareHandler(c *gin.Context) {
+
+	link, err := visitShareLink(c)
+	if err != nil {
+		if shareStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(shareStatus(err), "%s", err)
+		return
+	}
+	if !shareUnlocked(c, *link) {
+		c.HTML(http.StatusUnauthorized, "share_password.html", gin.H{"context": c, "title": "Password required"})
+		return
+	}
+
+	query := parseAlbumQuery(c)
+	page, err := listAlbumPage(link.Owner, link.Album, query)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	keys := make([]string, len(page.Items))
+	for i, item := range page.Items {
+		keys[i] = item.Key
+	}
+	// The favorites of the owner are private, visitors have none
+	info, err := findItemInfo("", keys)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	album, err := findAlbum(link.Owner, link.Album)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	title := path.Base(link.Album)
+	if album != nil {
+		title = albumDisplayTitle(*album)
+	}
+
+	var prevURL, nextURL string
+	if page.Prev != "" {
+		prevURL = query.url("before", page.Prev)
+	}
+	if page.Next != "" {
+		nextURL = query.url("after", page.Next)
+	}
+
+	c.HTML(http.StatusOK, "album.html", gin.H{
+		"context":    c,
+		"share":      true,
+		"albumTitle": title,
+		"album":      album,
+		"images":     page.Items,
+		"info":       info,
+		"urls":       shareItemURLs(*link, page.Items),
+		"sort":       query.Sort,
+		"desc":       query.Desc,
+		"limit":      query.Limit,
+		"prevURL":    prevURL,
+		"nextURL":    nextURL,
+	})
+}
+
+// shareItem returns the link of the request and its media item with the
+// name, directly in the album of the link. Errors are written to the
+// response.
+func shareItem(c *gin.Context, name string) (*ShareLink, *s3photoalbum.MediaItem, bool) {
+
+	link, err := visitShareLink(c)
+	if err != nil {
+		if shareStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(shareStatus(err), "%s", err)
+		return nil, nil, false
+	}
+	if !shareUnlocked(c, *link) {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	if !validPathElement(name) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	item, err := findMediaItem(path.Join(link.Owner, link.Album, name))
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	if item == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, nil, false
+	}
+	return link, item, true
+}
+
+// shareThumbnailHandler serves the thumbnail of a media item of a share link
+func shareThumbnailHandler(c *gin.Context) {
+
+	name := c.Param("item")
+	if !strings.HasSuffix(name, ".jpg") {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	_, item, ok := shareItem(c, strings.TrimSuffix(name, ".jpg"))
+	if !ok {
+		return
+	}
+	serveObject(c, config.S3ThumbnailBucket, item.Key+".jpg")
+}
+
+// shareMediaHandler serves a media item of a share link in full resolution
+// to be viewed in the browser
+func shareMediaHandler(c *gin.Context) {
+
+	_, item, ok := shareItem(c, c.Param("item"))
+	if !ok {
+		return
+	}
+	serveObject(c, config.S3MediaBucket, item.Key)
+}
+
+// shareDownloadHandler serves a media item of a share link that allows
+// downloads as attachment
+func shareDownloadHandler(c *gin.Context) {
+
+	link, item, ok := shareItem(c, c.Param("item"))
+	if !ok {
+		return
+	}
+	if !link.AllowDownload {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": item.Name})
+	if config.MediaDelivery == s3photoalbum.MediaDeliveryProxy {
+		c.Header("Content-Disposition", disposition)
+		proxyObject(c, config.S3MediaBucket, item.Key)
+		return
+	}
+
+	// Not cached, as the parameters differ from the other URLs
+	downloadURL, err := store.Presign(c.Request.Context(), config.S3MediaBucket, item.Key, presignExpiry, url.Values{
+		s3photoalbum.PresignDispositionParam: {disposition},
+	})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, downloadURL.String())
+}
+
+// sharePasswordHandler checks the password entered by a visitor and lets
+// them see the album
+func sharePasswordHandler(c *gin.Context) {
+
+	link, err := visitShareLink(c)
+	if err != nil {
+		if shareStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(shareStatus(err), "%s", err)
+		return
+	}
+
+	if link.PasswordHash != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(c.PostForm("password"))); err != nil {
+			c.HTML(http.StatusUnauthorized, "share_password.html", gin.H{
+				"context": c,
+				"title":   "Password required",
+				"error":   "Wrong password",
+			})
+			return
+		}
+		c.SetCookie(shareCookie, shareSecret(*link), int((24 * time.Hour).Seconds()), link.URL(), config.Host, true, true)
+	}
+
+	c.Redirect(http.StatusSeeOther, link.URL())
+}
+
+// createShareLinkHandler creates a link from the form on the album page
+func createShareLinkHandler(c *gin.Context) {
+
+	username, album := c.GetString("username"), c.GetString("album")
+
+	// Links expire at the end of the chosen day
+	expires, err := parseDate(c.PostForm("expires"))
+	if err == nil && expires != nil {
+		*expires = expires.AddDate(0, 0, 1)
+	}
+	if err == nil {
+		_, err = createShareLink(username, album, expires, c.PostForm("password"), c.PostForm("download") == "true")
+	}
+	if err != nil {
+		if shareStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(shareStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/shares")
+}
+
+// sharesHandler lists the share links of the user
+func sharesHandler(c *gin.Context) {
+
+	links, err := listShareLinks(c.GetString("username"))
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.HTML(http.StatusOK, "shares.html", gin.H{
+		"context": c,
+		"title":   "Share links",
+		"links":   links,
+	})
+}
+
+// revokeShareLinkHandler deletes a share link from the list of links
+func revokeShareLinkHandler(c *gin.Context) {
+
+	if err := deleteShareLink(c.GetString("username"), c.Param("token")); err != nil {
+		if shareStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(shareStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/shares")
+}
+
+func newAPIShareLink(link ShareLink) apiShareLink {
+	return apiShareLink{
+		Token:         link.Token,
+		URL:           link.URL(),
+		Album:         link.Album,
+		CreatedAt:     link.CreatedAt,
+		ExpiresAt:     link.ExpiresAt,
+		Expired:       link.Expired(),
+		Password:      link.PasswordHash != "",
+		AllowDownload: link.AllowDownload,
+	}
+}
+
+func apiListShareLinks(c *gin.Context) {
+
+	links, err := listShareLinks(c.GetString("username"))
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list share links")
+		return
+	}
+
+	ret := []apiShareLink{}
+	for _, link := range links {
+		ret = append(ret, newAPIShareLink(link))
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+func apiCreateShareLink(c *gin.Context) {
+
+	var req apiCreateShareLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	link, err := createShareLink(c.GetString("username"), c.GetString("album"), req.ExpiresAt, req.Password, req.AllowDownload)
+	if err != nil {
+		if shareStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, shareStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusCreated, newAPIShareLink(*link))
+}
+
+func apiDeleteShareLink(c *gin.Context) {
+
+	if err := deleteShareLink(c.GetString("username"), c.Param("token")); err != nil {
+		if shareStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, shareStatus(err), err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"s3photoalbum/internal"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareLinks(t *testing.T) {
+	r, _ := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	var open apiShareLink
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums/summer/shares", token, apiCreateShareLinkRequest{AllowDownload: true}, &open); status != http.StatusCreated || open.URL != "/s/"+open.Token || open.Password {
+		t.Fatalf("create link: got status %d, link %+v", status, open)
+	}
+
+	// Visitors without account see the album read-only, loading the media
+	// through the link
+	w := doRequest(r, http.MethodGet, open.URL, nil, nil)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, `src="`+open.URL+`/thumbnails/beach.jpg.jpg"`) || !strings.Contains(body, `href="`+open.URL+`/media/beach.jpg"`) {
+		t.Fatalf("shared album: got status %d, body %s", w.Code, body)
+	}
+	if !strings.Contains(body, `class="download"`) || !strings.Contains(body, `href="`+open.URL+`/download/beach.jpg"`) {
+		t.Errorf("shared album without download links")
+	}
+	for _, s := range []string{`class="upload"`, `action="/albums/summer`, `href="/albums`, testMediaBucket + "/alice"} {
+		if strings.Contains(body, s) {
+			t.Errorf("shared album contains %q", s)
+		}
+	}
+	for target, location := range map[string]string{
+		open.URL + "/thumbnails/beach.jpg.jpg": testThumbBucket + "/alice/summer/beach.jpg.jpg?",
+		open.URL + "/media/beach.jpg":          testMediaBucket + "/alice/summer/beach.jpg?",
+		open.URL + "/download/beach.jpg":       "response-content-disposition=attachment",
+	} {
+		if w := doRequest(r, http.MethodGet, target, nil, nil); w.Code != http.StatusSeeOther || !strings.Contains(w.Header().Get("Location"), location) {
+			t.Errorf("%s: got %d %q", target, w.Code, w.Header().Get("Location"))
+		}
+	}
+	for _, target := range []string{open.URL + "/media/missing.jpg", open.URL + "/thumbnails/beach.jpg", "/s/unknown/media/beach.jpg"} {
+		if w := doRequest(r, http.MethodGet, target, nil, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got %d", target, http.StatusNotFound, w.Code)
+		}
+	}
+
+	w = doRequest(r, http.MethodPost, "/albums/winter/share", url.Values{
+		"expires":  {"2099-12-31"},
+		"password": {"secret"},
+	}, cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/shares" {
+		t.Fatalf("create link from form: got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	var links []apiShareLink
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/shares", token, nil, &links); status != http.StatusOK || len(links) != 2 {
+		t.Fatalf("list links: got status %d, links %+v", status, links)
+	}
+	locked := links[0]
+	if locked.Album != "winter" || !locked.Password || locked.AllowDownload || locked.ExpiresAt == nil || !locked.ExpiresAt.Equal(time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected link %+v", locked)
+	}
+	if w := doRequest(r, http.MethodGet, "/shares", nil, cookie); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), locked.URL) {
+		t.Errorf("shares page: got status %d without the link", w.Code)
+	}
+
+	t.Run("password", func(t *testing.T) {
+		if w := doRequest(r, http.MethodGet, locked.URL, nil, nil); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), `type="password"`) {
+			t.Errorf("expected password form, got %d", w.Code)
+		}
+		if w := doRequest(r, http.MethodPost, locked.URL, url.Values{"password": {"wrong"}}, nil); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "Wrong password") {
+			t.Errorf("wrong password: got %d", w.Code)
+		}
+
+		w := doRequest(r, http.MethodPost, locked.URL, url.Values{"password": {"secret"}}, nil)
+		cookies := w.Result().Cookies()
+		if w.Code != http.StatusSeeOther || len(cookies) != 1 || cookies[0].Name != shareCookie {
+			t.Fatalf("password: got %d, cookies %v", w.Code, cookies)
+		}
+		if w := doRequest(r, http.MethodGet, locked.URL+"/thumbnails/snow.jpg.jpg", nil, nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("thumbnail without password: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+		w = doRequest(r, http.MethodGet, locked.URL, nil, cookies[0])
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `class="download"`) {
+			t.Errorf("unlocked album: got %d", w.Code)
+		}
+		if w := doRequest(r, http.MethodGet, locked.URL+"/thumbnails/snow.jpg.jpg", nil, cookies[0]); w.Code != http.StatusSeeOther {
+			t.Errorf("thumbnail with password: expected status %d, got %d", http.StatusSeeOther, w.Code)
+		}
+
+		// The cookie of one link does not unlock the others
+		other, err := createShareLink("alice", "winter", nil, "secret", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := doRequest(r, http.MethodGet, other.URL(), nil, cookies[0]); w.Code != http.StatusUnauthorized {
+			t.Errorf("other link: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums/summer/shares", token, apiCreateShareLinkRequest{ExpiresAt: &time.Time{}}, nil); status != http.StatusBadRequest {
+			t.Errorf("expired link: expected status %d, got %d", http.StatusBadRequest, status)
+		}
+
+		link, err := createShareLink("alice", "summer", nil, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expiresAt := time.Now().Add(-time.Minute)
+		if err := DB.Model(link).Update("expires_at", expiresAt).Error; err != nil {
+			t.Fatal(err)
+		}
+		if w := doRequest(r, http.MethodGet, link.URL(), nil, nil); w.Code != http.StatusGone {
+			t.Errorf("expired link: expected status %d, got %d", http.StatusGone, w.Code)
+		}
+		if w := doRequest(r, http.MethodGet, "/s/unknown", nil, nil); w.Code != http.StatusNotFound {
+			t.Errorf("unknown link: expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+
+	t.Run("without downloads", func(t *testing.T) {
+		link, err := createShareLink("alice", "summer", nil, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The media is shown in full resolution, only the download links are
+		// left out
+		body := doRequest(r, http.MethodGet, link.URL(), nil, nil).Body.String()
+		if !strings.Contains(body, `href="`+link.URL()+`/media/beach.jpg"`) || !strings.Contains(body, `href="`+link.URL()+`/media/video.mp4"`) ||
+			strings.Contains(body, `class="download"`) {
+			t.Errorf("unexpected media links in %s", body)
+		}
+		for target, status := range map[string]int{
+			link.URL() + "/media/beach.jpg":    http.StatusSeeOther,
+			link.URL() + "/download/beach.jpg": http.StatusNotFound,
+			link.URL() + "/media/video.mp4":    http.StatusSeeOther,
+		} {
+			if w := doRequest(r, http.MethodGet, target, nil, nil); w.Code != status {
+				t.Errorf("%s: expected status %d, got %d", target, status, w.Code)
+			}
+		}
+	})
+
+	t.Run("proxy delivery", func(t *testing.T) {
+		defer func(delivery string) { config.MediaDelivery = delivery }(config.MediaDelivery)
+		config.MediaDelivery = s3photoalbum.MediaDeliveryProxy
+
+		if w := doRequest(r, http.MethodGet, open.URL+"/thumbnails/beach.jpg.jpg", nil, nil); w.Code != http.StatusOK || w.Body.String() != "thumb alice/summer/beach.jpg" {
+			t.Errorf("proxied thumbnail: got %d %q", w.Code, w.Body.String())
+		}
+		w := doRequest(r, http.MethodGet, open.URL+"/download/beach.jpg", nil, nil)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != `attachment; filename=beach.jpg` || w.Body.String() != "media alice/summer/beach.jpg" {
+			t.Errorf("proxied download: got %d %q", w.Code, w.Header().Get("Content-Disposition"))
+		}
+	})
+
+	t.Run("filesystem store", func(t *testing.T) {
+		defer func(s s3photoalbum.MediaStore) { store = s }(store)
+		fsStore, err := s3photoalbum.NewFilesystemStore(t.TempDir(), []byte("key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fsStore.Put(context.Background(), testMediaBucket, "alice/summer/beach.jpg", strings.NewReader("media"), 5, s3photoalbum.PutOptions{ContentType: "image/jpeg"}); err != nil {
+			t.Fatal(err)
+		}
+		store = fsStore
+		r := setupRouter()
+
+		// The presigned URL sets the Content-Disposition like S3 does
+		w := doRequest(r, http.MethodGet, open.URL+"/download/beach.jpg", nil, nil)
+		location := w.Header().Get("Location")
+		if w.Code != http.StatusSeeOther || !strings.HasPrefix(location, s3photoalbum.FilesystemPresignPath+"/") {
+			t.Fatalf("download: got %d %q", w.Code, location)
+		}
+		w = doRequest(r, http.MethodGet, location, nil, nil)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != `attachment; filename=beach.jpg` || w.Body.String() != "media" {
+			t.Errorf("filesystem download: got %d %q", w.Code, w.Header().Get("Content-Disposition"))
+		}
+
+		tampered := strings.Replace(location, "attachment", "inline", 1)
+		if w := doRequest(r, http.MethodGet, tampered, nil, nil); w.Code != http.StatusForbidden {
+			t.Errorf("changed disposition: expected status %d, got %d", http.StatusForbidden, w.Code)
+		}
+	})
+
+	t.Run("other users", func(t *testing.T) {
+		bob := apiLoginAs(t, r, "bob")
+		if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums/summer/shares", bob, apiCreateShareLinkRequest{}, nil); status != http.StatusNotFound {
+			t.Errorf("album of other user: expected status %d, got %d", http.StatusNotFound, status)
+		}
+		if status := apiRequest(t, r, http.MethodDelete, "/api/v1/shares/"+open.Token, bob, nil, nil); status != http.StatusNotFound {
+			t.Errorf("link of other user: expected status %d, got %d", http.StatusNotFound, status)
+		}
+	})
+
+	t.Run("rename and delete", func(t *testing.T) {
+		var job apiJob
+		if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/summer", token, apiUpdateAlbumRequest{Name: "holiday"}, &job); status != http.StatusAccepted {
+			t.Fatalf("rename: expected status %d, got %d", http.StatusAccepted, status)
+		}
+		jobs.get("alice", job.ID).wait()
+		if link, err := findShareLink(open.Token); err != nil || link == nil || link.Album != "holiday" {
+			t.Errorf("link not moved: %+v, %v", link, err)
+		}
+		if w := doRequest(r, http.MethodGet, open.URL+"/thumbnails/beach.jpg.jpg", nil, nil); w.Code != http.StatusSeeOther || !strings.Contains(w.Header().Get("Location"), "/alice/holiday/beach.jpg.jpg?") {
+			t.Errorf("moved link: got %d %q", w.Code, w.Header().Get("Location"))
+		}
+
+		if status := apiRequest(t, r, http.MethodDelete, "/api/v1/albums/holiday", token, nil, &job); status != http.StatusAccepted {
+			t.Fatalf("delete: expected status %d, got %d", http.StatusAccepted, status)
+		}
+		jobs.get("alice", job.ID).wait()
+		if w := doRequest(r, http.MethodGet, open.URL, nil, nil); w.Code != http.StatusNotFound {
+			t.Errorf("link of deleted album: expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		if status := apiRequest(t, r, http.MethodDelete, "/api/v1/shares/"+locked.Token, token, nil, nil); status != http.StatusNoContent {
+			t.Errorf("revoke: expected status %d, got %d", http.StatusNoContent, status)
+		}
+		if w := doRequest(r, http.MethodGet, locked.URL, nil, nil); w.Code != http.StatusNotFound {
+			t.Errorf("revoked link: expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+		if status := apiRequest(t, r, http.MethodDelete, "/api/v1/shares/"+locked.Token, token, nil, nil); status != http.StatusNotFound {
+			t.Errorf("revoke again: expected status %d, got %d", http.StatusNotFound, status)
+		}
+	})
+}
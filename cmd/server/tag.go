@@ -0,0 +1,534 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"path"
+	"reflect"
+	"s3photoalbum/internal"
+	"sort"
+	"strings"
+)
+
+var (
+	errTagName            = errors.New("invalid tag")
+	errTagsLength         = fmt.Errorf("too many tags, they are limited to %d characters together", s3photoalbum.MaxKeywordsLength)
+	errTagQuery           = errors.New(`invalid tag query, expected tags separated by commas, e.g. "beach, sunset, -night"`)
+	errSmartAlbumName     = errors.New("invalid smart album name")
+	errSmartAlbumExists   = errors.New("smart album already exists")
+	errSmartAlbumNotFound = errors.New("smart album not found")
+)
+
+// smartAlbumStatus returns the HTTP status for errors of the smart album
+// functions
+func smartAlbumStatus(err error) int {
+	switch {
+	case errors.Is(err, errSmartAlbumName), errors.Is(err, errTagQuery):
+		return http.StatusBadRequest
+	case errors.Is(err, errSmartAlbumNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errSmartAlbumExists):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// SmartAlbum is a saved tag query of a user. It is shown like an album with
+// the matching media of all albums of the user.
+type SmartAlbum struct {
+	gorm.Model
+	Owner string `gorm:"uniqueIndex:idx_smart_albums_owner_name;not null"`
+	Name  string `gorm:"uniqueIndex:idx_smart_albums_owner_name;not null"`
+	Query string `gorm:"not null"`
+}
+
+// Tag and smart album pages show the newest media first
+const taggedItemsOrder = "COALESCE(capture_time, last_modified) DESC, key"
+
+// tagQuery selects media items by their tags. It is written as tags
+// separated by commas, the items need all of them except for those prefixed
+// with a minus, which they must not have, e.g. "beach, sunset, -night".
+type tagQuery struct {
+	Include []string
+	Exclude []string
+}
+
+func parseTagQuery(s string) (tagQuery, error) {
+
+	var q tagQuery
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		tag := s3photoalbum.NormalizeTag(strings.TrimPrefix(term, "-"))
+		if tag == "" {
+			return tagQuery{}, fmt.Errorf("%w: %q is not a tag", errTagQuery, term)
+		}
+		if strings.HasPrefix(term, "-") {
+			q.Exclude = append(q.Exclude, tag)
+		} else {
+			q.Include = append(q.Include, tag)
+		}
+	}
+
+	if len(q.Include) == 0 {
+		return tagQuery{}, fmt.Errorf("%w: at least one tag is required", errTagQuery)
+	}
+	return q, nil
+}
+
+// String returns the normalized query
+func (q tagQuery) String() string {
+	terms := append([]string{}, q.Include...)
+	for _, tag := range q.Exclude {
+		terms = append(terms, "-"+tag)
+	}
+	return strings.Join(terms, ", ")
+}
+
+// where restricts a query of media items to those of the owner matching the
+// tag query
+func (q tagQuery) where(query *gorm.DB, owner string) *gorm.DB {
+	query = query.Where("owner = ?", owner)
+	for _, tag := range q.Include {
+		query = query.Where("key IN (SELECT key FROM tags WHERE owner = ? AND name = ?)", owner, tag)
+	}
+	for _, tag := range q.Exclude {
+		query = query.Where("key NOT IN (SELECT key FROM tags WHERE owner = ? AND name = ?)", owner, tag)
+	}
+	return query
+}
+
+// listTaggedItems returns the newest media items of the owner matching the
+// tag query, up to maxPageSize
+func listTaggedItems(owner string, q tagQuery) ([]s3photoalbum.MediaItem, error) {
+	var items []s3photoalbum.MediaItem
+	err := q.where(DB, owner).Order(taggedItemsOrder).Limit(maxPageSize).Find(&items).Error
+	return items, err
+}
+
+// tagCount is a tag with the number of media items having it
+type tagCount struct {
+	Name  string
+	Count int
+}
+
+// listTags returns the tags of the media of the owner, by name
+func listTags(owner string) ([]tagCount, error) {
+	var tags []tagCount
+	err := DB.Model(&s3photoalbum.Tag{}).Select("name, COUNT(DISTINCT key) AS count").
+		Where("owner = ?", owner).Group("name").Order("name").Scan(&tags).Error
+	return tags, err
+}
+
+// findTags returns the tags of the media items with the keys by key, sorted
+// by name. manual contains only the tags set by the users.
+func findTags(keys []string) (all, manual map[string][]string, err error) {
+
+	all, manual = map[string][]string{}, map[string][]string{}
+	if len(keys) == 0 {
+		return all, manual, nil
+	}
+
+	var tags []s3photoalbum.Tag
+	if err := DB.Where("key IN ?", keys).Order("name, exif").Find(&tags).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, tag := range tags {
+		// Tags set by the users and from EXIF keywords sort next to each other
+		if n := len(all[tag.Key]); n == 0 || all[tag.Key][n-1] != tag.Name {
+			all[tag.Key] = append(all[tag.Key], tag.Name)
+		}
+		if !tag.Exif {
+			manual[tag.Key] = append(manual[tag.Key], tag.Name)
+		}
+	}
+	return all, manual, nil
+}
+
+// setItemTags replaces the tags the users set on the item in the album of the
+// owner and records the change as edit by the user. Tags from the EXIF
+// keywords of the media can't be removed.
+func setItemTags(username, owner, album, item string, tags []string) error {
+
+	if !validAlbumPath(album) || !validPathElement(item) {
+		return errAlbumName
+	}
+
+	names := []string{}
+	seen := map[string]bool{}
+	for _, s := range tags {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		name := s3photoalbum.NormalizeTag(s)
+		if name == "" {
+			return fmt.Errorf("%w: %q", errTagName, s)
+		}
+		if !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}
+	sort.Strings(names)
+	if !s3photoalbum.KeywordsFit(names) {
+		return errTagsLength
+	}
+
+	key := path.Join(owner, album, item)
+	mediaItem, err := findMediaItem(key)
+	if err != nil {
+		return err
+	}
+	if mediaItem == nil {
+		return fmt.Errorf("%w: %s", errItemNotFound, item)
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+
+		current := []string{}
+		if err := tx.Model(&s3photoalbum.Tag{}).Where("key = ? AND NOT exif", key).Order("name").Pluck("name", &current).Error; err != nil {
+			return err
+		}
+		if reflect.DeepEqual(current, names) {
+			return nil
+		}
+
+		if err := tx.Where("key = ? AND NOT exif", key).Delete(&s3photoalbum.Tag{}).Error; err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := tx.Create(&s3photoalbum.Tag{Key: key, Owner: owner, Name: name}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(&ItemCaptionEdit{
+			Key:      key,
+			Username: username,
+			Field:    "tags",
+			OldValue: strings.Join(current, ", "),
+			NewValue: strings.Join(names, ", "),
+		}).Error
+	})
+}
+
+// copyTags copies the tags the users set on the media item with the key to
+// newKey of the same owner. The EXIF tags are created by the index.
+func copyTags(key, newKey string) error {
+
+	var tags []s3photoalbum.Tag
+	if err := DB.Where("key = ? AND NOT exif", key).Find(&tags).Error; err != nil || len(tags) == 0 {
+		return err
+	}
+	for i := range tags {
+		tags[i].ID = 0
+		tags[i].Key = newKey
+	}
+	return DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&tags).Error
+}
+
+func getSmartAlbums(owner string) ([]SmartAlbum, error) {
+	var albums []SmartAlbum
+	err := DB.Where("owner = ?", owner).Order("name").Find(&albums).Error
+	return albums, err
+}
+
+// findSmartAlbum returns the smart album of the owner, nil if there is none
+func findSmartAlbum(owner, name string) (*SmartAlbum, error) {
+	var albums []SmartAlbum
+	if err := DB.Where("owner = ? AND name = ?", owner, name).Limit(1).Find(&albums).Error; err != nil || len(albums) == 0 {
+		return nil, err
+	}
+	return &albums[0], nil
+}
+
+// smartAlbumCover returns the thumbnail URL of the newest media matching the
+// smart album, empty if none matches
+func smartAlbumCover(album SmartAlbum) (string, error) {
+
+	q, err := parseTagQuery(album.Query)
+	if err != nil {
+		return "", err
+	}
+
+	var items []s3photoalbum.MediaItem
+	if err := q.where(DB, album.Owner).Where("thumbnail_status = ?", s3photoalbum.ThumbnailReady).
+		Order(taggedItemsOrder).Limit(1).Find(&items).Error; err != nil || len(items) == 0 {
+		return "", err
+	}
+	return escapedPath("/thumbnails", items[0].Album, items[0].Name+".jpg"), nil
+}
+
+func createSmartAlbum(owner, name, query string) (*SmartAlbum, error) {
+
+	if !validPathElement(name) {
+		return nil, errSmartAlbumName
+	}
+	q, err := parseTagQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := findSmartAlbum(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, errSmartAlbumExists
+	}
+
+	album := SmartAlbum{Owner: owner, Name: name, Query: q.String()}
+	if err := DB.Create(&album).Error; err != nil {
+		return nil, err
+	}
+	return &album, nil
+}
+
+func deleteSmartAlbum(owner, name string) error {
+	res := DB.Unscoped().Where("owner = ? AND name = ?", owner, name).Delete(&SmartAlbum{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errSmartAlbumNotFound
+	}
+	return nil
+}
+
+// taggedItemsPage renders the media items of a tag or smart album
+func taggedItemsPage(c *gin.Context, title string, items []s3photoalbum.MediaItem, smartAlbum *SmartAlbum) {
+
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	info, err := findItemInfo(c.GetString("username"), keys)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.HTML(http.StatusOK, "tagged.html", gin.H{
+		"context":    c,
+		"title":      title,
+		"images":     items,
+		"info":       info,
+		"smartAlbum": smartAlbum,
+	})
+}
+
+// tagsHandler lists the tags of the user's media
+func tagsHandler(c *gin.Context) {
+
+	tags, err := listTags(c.GetString("username"))
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.HTML(http.StatusOK, "tags.html", gin.H{
+		"context": c,
+		"title":   "Tags",
+		"tags":    tags,
+	})
+}
+
+// tagHandler shows the media with the tag across all albums of the user
+func tagHandler(c *gin.Context) {
+
+	tag := s3photoalbum.NormalizeTag(c.Param("tag"))
+	if tag == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	items, err := listTaggedItems(c.GetString("username"), tagQuery{Include: []string{tag}})
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	taggedItemsPage(c, tag, items, nil)
+}
+
+func smartAlbumHandler(c *gin.Context) {
+
+	owner := c.GetString("username")
+	album, err := findSmartAlbum(owner, c.Param("name"))
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if album == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	// Saved queries are valid
+	q, _ := parseTagQuery(album.Query)
+	items, err := listTaggedItems(owner, q)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	taggedItemsPage(c, album.Name, items, album)
+}
+
+// createSmartAlbumHandler saves a smart album from the form on the index
+// page
+func createSmartAlbumHandler(c *gin.Context) {
+
+	album, err := createSmartAlbum(c.GetString("username"), c.PostForm("name"), c.PostForm("query"))
+	if err != nil {
+		if smartAlbumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(smartAlbumStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, escapedPath("/smart", album.Name))
+}
+
+func deleteSmartAlbumHandler(c *gin.Context) {
+
+	if err := deleteSmartAlbum(c.GetString("username"), c.Param("name")); err != nil {
+		if smartAlbumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		c.String(smartAlbumStatus(err), "%s", err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/")
+}
+
+func apiListTags(c *gin.Context) {
+
+	tags, err := listTags(c.GetString("username"))
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list tags")
+		return
+	}
+
+	ret := []apiTag{}
+	for _, tag := range tags {
+		ret = append(ret, apiTag{Name: tag.Name, Count: tag.Count})
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+// apiListTaggedItems responds with the media items matching the tag query
+func apiListTaggedItems(c *gin.Context, q tagQuery) {
+
+	items, err := listTaggedItems(c.GetString("username"), q)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list items")
+		return
+	}
+
+	ret, err := newAPIMediaItems(c.GetString("username"), items)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list items")
+		return
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+func apiListTagItems(c *gin.Context) {
+
+	tag := s3photoalbum.NormalizeTag(c.Param("tag"))
+	if tag == "" {
+		apiError(c, http.StatusBadRequest, errTagName.Error())
+		return
+	}
+	apiListTaggedItems(c, tagQuery{Include: []string{tag}})
+}
+
+func apiListSmartAlbums(c *gin.Context) {
+
+	albums, err := getSmartAlbums(c.GetString("username"))
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list smart albums")
+		return
+	}
+
+	ret := []apiSmartAlbum{}
+	for _, album := range albums {
+		cover, err := smartAlbumCover(album)
+		if err != nil {
+			log.Error(err)
+			apiError(c, http.StatusInternalServerError, "failed to list smart albums")
+			return
+		}
+		ret = append(ret, newAPISmartAlbum(album, cover))
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+func apiCreateSmartAlbum(c *gin.Context) {
+
+	var req apiCreateSmartAlbumRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "name and query are required")
+		return
+	}
+
+	album, err := createSmartAlbum(c.GetString("username"), req.Name, req.Query)
+	if err != nil {
+		if smartAlbumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, smartAlbumStatus(err), err.Error())
+		return
+	}
+
+	cover, err := smartAlbumCover(*album)
+	if err != nil {
+		log.Error(err)
+	}
+	c.JSON(http.StatusCreated, newAPISmartAlbum(*album, cover))
+}
+
+func apiListSmartAlbumItems(c *gin.Context) {
+
+	album, err := findSmartAlbum(c.GetString("username"), c.Param("name"))
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to get smart album")
+		return
+	}
+	if album == nil {
+		apiError(c, http.StatusNotFound, errSmartAlbumNotFound.Error())
+		return
+	}
+
+	q, _ := parseTagQuery(album.Query)
+	apiListTaggedItems(c, q)
+}
+
+func apiDeleteSmartAlbum(c *gin.Context) {
+
+	if err := deleteSmartAlbum(c.GetString("username"), c.Param("name")); err != nil {
+		if smartAlbumStatus(err) == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		apiError(c, smartAlbumStatus(err), err.Error())
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
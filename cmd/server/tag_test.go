@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"s3photoalbum/internal"
+)
+
+func TestTags(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	// EXIF keywords from the thumbnailer
+	for key, keywords := range map[string][]string{
+		"alice/summer/beach.jpg.jpg": {"Beach", "Sea"},
+		"bob/party/cake.jpg.jpg":     {"Holiday"},
+	} {
+		if err := s3.PutObjectWithMetadata(testThumbBucket, key, []byte("thumb"), "image/jpeg", map[string]string{
+			s3photoalbum.MetadataKeywords: s3photoalbum.EncodeKeywords(keywords),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tags := []string{"Holiday", "sea"}
+	var item apiMediaItem
+	if status := apiRequest(t, r, http.MethodPatch, "/api/v1/albums/summer/items/beach.jpg", token, apiUpdateItemRequest{Tags: &tags}, &item); status != http.StatusOK ||
+		!reflect.DeepEqual(item.Tags, []string{"beach", "holiday", "sea"}) {
+		t.Fatalf("set tags: got status %d, item %+v", status, item)
+	}
+	if w := doRequest(r, http.MethodPost, "/albums/winter/caption", url.Values{
+		"item": {"snow.jpg"},
+		"tags": {"holiday, Cold"},
+	}, cookie); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect, got %d", w.Code)
+	}
+
+	var history []apiCaptionEdit
+	if apiRequest(t, r, http.MethodGet, "/api/v1/albums/winter/items/snow.jpg/history", token, nil, &history); len(history) != 1 ||
+		history[0].Field != "tags" || history[0].NewValue != "cold, holiday" {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	// Only the tags of the user's media are listed
+	var tagList []apiTag
+	apiRequest(t, r, http.MethodGet, "/api/v1/tags", token, nil, &tagList)
+	if expected := []apiTag{{"beach", 1}, {"cold", 1}, {"holiday", 2}, {"sea", 1}}; !reflect.DeepEqual(tagList, expected) {
+		t.Errorf("expected tags %v, got %v", expected, tagList)
+	}
+
+	var items []apiMediaItem
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/tags/Holiday/items", token, nil, &items); status != http.StatusOK || len(items) != 2 {
+		t.Fatalf("tag items: got status %d, items %+v", status, items)
+	}
+
+	w := doRequest(r, http.MethodGet, "/tags/holiday", nil, cookie)
+	for _, s := range []string{
+		`<img src="/thumbnails/summer/beach.jpg.jpg"`,
+		`<img src="/thumbnails/winter/snow.jpg.jpg"`,
+		`<a href="/albums/winter">winter</a>`,
+	} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("tag page does not contain %s", s)
+		}
+	}
+	if w := doRequest(r, http.MethodGet, "/tags", nil, cookie); !strings.Contains(w.Body.String(), `<a href="/tags/holiday">#holiday</a> (2)`) {
+		t.Errorf("tag not listed on the tags page")
+	}
+	w = doRequest(r, http.MethodGet, "/albums/summer", nil, cookie)
+	if !strings.Contains(w.Body.String(), `<a href="/tags/beach">#beach</a>`) || !strings.Contains(w.Body.String(), `name="tags" value="holiday, sea"`) {
+		t.Errorf("tags not shown on the album page")
+	}
+
+	// Smart albums
+	w = doRequest(r, http.MethodPost, "/smart", url.Values{"name": {"Holidays"}, "query": {"Holiday, -cold"}}, cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/smart/Holidays" {
+		t.Fatalf("expected redirect to the smart album, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	var smartAlbums []apiSmartAlbum
+	apiRequest(t, r, http.MethodGet, "/api/v1/smart-albums", token, nil, &smartAlbums)
+	if expected := []apiSmartAlbum{{Name: "Holidays", Query: "holiday, -cold", Cover: "/thumbnails/summer/beach.jpg.jpg"}}; !reflect.DeepEqual(smartAlbums, expected) {
+		t.Errorf("expected smart albums %v, got %v", expected, smartAlbums)
+	}
+	if apiRequest(t, r, http.MethodGet, "/api/v1/smart-albums/Holidays/items", token, nil, &items); len(items) != 1 || items[0].Name != "beach.jpg" {
+		t.Errorf("unexpected smart album items %+v", items)
+	}
+	w = doRequest(r, http.MethodGet, "/", nil, cookie)
+	if !strings.Contains(w.Body.String(), `<a href="/smart/Holidays">`) {
+		t.Errorf("smart album not shown on the index page")
+	}
+	if w := doRequest(r, http.MethodGet, "/smart/Holidays", nil, cookie); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<img src="/thumbnails/summer/beach.jpg.jpg"`) {
+		t.Errorf("smart album page: got status %d", w.Code)
+	}
+
+	// Tags set by the users follow the items
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums/summer/move", token, apiTransferItemsRequest{
+		Items:  []string{"beach.jpg"},
+		Target: "winter",
+	}, &items); status != http.StatusOK || len(items) != 1 || !reflect.DeepEqual(items[0].Tags, []string{"beach", "holiday", "sea"}) {
+		t.Fatalf("move: got status %d, items %+v", status, items)
+	}
+
+	// The tags fit into the metadata of the thumbnails like EXIF keywords
+	var manyTags []string
+	for i := 0; i < 100; i++ {
+		manyTags = append(manyTags, fmt.Sprintf("tag number %d", i))
+	}
+	for name, tt := range map[string]struct {
+		method, path string
+		body         interface{}
+		status       int
+	}{
+		"invalid tag":    {http.MethodPatch, "/api/v1/albums/winter/items/snow.jpg", apiUpdateItemRequest{Tags: &[]string{"a/b"}}, http.StatusBadRequest},
+		"too many tags":  {http.MethodPatch, "/api/v1/albums/winter/items/snow.jpg", apiUpdateItemRequest{Tags: &manyTags}, http.StatusBadRequest},
+		"exclude only":   {http.MethodPost, "/api/v1/smart-albums", apiCreateSmartAlbumRequest{Name: "Cold", Query: "-cold"}, http.StatusBadRequest},
+		"existing album": {http.MethodPost, "/api/v1/smart-albums", apiCreateSmartAlbumRequest{Name: "Holidays", Query: "sea"}, http.StatusConflict},
+		"invalid name":   {http.MethodPost, "/api/v1/smart-albums", apiCreateSmartAlbumRequest{Name: "a/b", Query: "sea"}, http.StatusBadRequest},
+	} {
+		if status := apiRequest(t, r, tt.method, tt.path, token, tt.body, nil); status != tt.status {
+			t.Errorf("%s: expected status %d, got %d", name, tt.status, status)
+		}
+	}
+
+	if status := apiRequest(t, r, http.MethodDelete, "/api/v1/smart-albums/Holidays", token, nil, nil); status != http.StatusNoContent {
+		t.Errorf("delete: expected status %d, got %d", http.StatusNoContent, status)
+	}
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/smart-albums/Holidays/items", token, nil, nil); status != http.StatusNotFound {
+		t.Errorf("deleted smart album: expected status %d, got %d", http.StatusNotFound, status)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"s3photoalbum/internal"
+	"strconv"
+	"time"
+)
+
+var errTimelineDate = errors.New("invalid date, expected YYYY, YYYY-MM or YYYY-MM-DD")
+
+// The timeline sorts the media by the date taken, newest first. Equal dates
+// are sorted by key, so that the keys can be used as cursors.
+const timelineOrder = "COALESCE(capture_time, last_modified) DESC, key DESC"
+
+// Formats of the date to jump to in the timeline, with the period they
+// cover
+var timelineDateFormats = []struct {
+	layout              string
+	years, months, days int
+}{
+	{"2006-01-02", 0, 0, 1},
+	{"2006-01", 0, 1, 0},
+	{"2006", 1, 0, 0},
+}
+
+// timelineQuery selects a page of the timeline. After is the key of the last
+// item of the previous page, Until excludes the media taken from then on,
+// e.g. to jump to a month.
+type timelineQuery struct {
+	After string
+	Until *time.Time
+	Limit int
+}
+
+type timelinePage struct {
+	Items []s3photoalbum.MediaItem
+	// Cursor of the next page, empty if there is none
+	Next string
+}
+
+// timelineDay is the media taken on a day
+type timelineDay struct {
+	Date time.Time
+	// Set for the first day of a month on the page
+	NewMonth bool
+	Items    []s3photoalbum.MediaItem
+}
+
+// timelineMonth is the number of media items taken in a month
+type timelineMonth struct {
+	// Formatted as YYYY-MM
+	Month string
+	Count int
+}
+
+type timelineYear struct {
+	Year   string
+	Months []timelineMonth
+}
+
+// parseTimelineQuery reads the query parameters of the timeline. The date is
+// the period to jump to, the page starts with the last media taken in it.
+func parseTimelineQuery(c *gin.Context) (timelineQuery, error) {
+
+	q := timelineQuery{After: c.Query("after"), Limit: config.PageSize}
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit > 0 {
+		q.Limit = limit
+	}
+	if q.Limit <= 0 || q.Limit > maxPageSize {
+		q.Limit = maxPageSize
+	}
+
+	if date := c.Query("date"); date != "" {
+		for _, format := range timelineDateFormats {
+			if t, err := time.Parse(format.layout, date); err == nil {
+				until := t.AddDate(format.years, format.months, format.days)
+				q.Until = &until
+				return q, nil
+			}
+		}
+		return q, errTimelineDate
+	}
+	return q, nil
+}
+
+// url returns the link to the page after the cursor
+func (q timelineQuery) url(cursor string) string {
+	values := url.Values{}
+	values.Set("after", cursor)
+	if q.Limit != config.PageSize {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return "/timeline?" + values.Encode()
+}
+
+// takenTime returns when the media was taken, falling back to the upload time
+func takenTime(item s3photoalbum.MediaItem) time.Time {
+	if item.CaptureTime != nil {
+		return *item.CaptureTime
+	}
+	return item.LastModified
+}
+
+// listTimeline returns the page of the timeline of the owner selected by q.
+// Unknown cursors select the first page.
+func listTimeline(owner string, q timelineQuery) (timelinePage, error) {
+
+	query := DB.Where("owner = ?", owner)
+	if q.After != "" {
+		cursor, err := findMediaItem(q.After)
+		if err != nil {
+			return timelinePage{}, err
+		}
+		if cursor != nil && cursor.Owner == owner {
+			query = query.Where("(COALESCE(capture_time, last_modified), key) < (SELECT COALESCE(capture_time, last_modified), key FROM media_items WHERE id = ?)", cursor.ID)
+		}
+	} else if q.Until != nil {
+		query = query.Where("COALESCE(capture_time, last_modified) < ?", *q.Until)
+	}
+
+	var items []s3photoalbum.MediaItem
+	if err := query.Order(timelineOrder).Limit(q.Limit + 1).Find(&items).Error; err != nil {
+		return timelinePage{}, err
+	}
+
+	page := timelinePage{Items: items}
+	if len(items) > q.Limit {
+		page.Items = items[:q.Limit]
+		page.Next = page.Items[q.Limit-1].Key
+	}
+	return page, nil
+}
+
+// groupByDay groups the items sorted by the date taken by day
+func groupByDay(items []s3photoalbum.MediaItem) []timelineDay {
+	var days []timelineDay
+	for _, item := range items {
+		taken := takenTime(item)
+		date := time.Date(taken.Year(), taken.Month(), taken.Day(), 0, 0, 0, 0, time.UTC)
+		if len(days) == 0 || !days[len(days)-1].Date.Equal(date) {
+			newMonth := len(days) == 0 || days[len(days)-1].Date.Month() != date.Month() || days[len(days)-1].Date.Year() != date.Year()
+			days = append(days, timelineDay{Date: date, NewMonth: newMonth})
+		}
+		days[len(days)-1].Items = append(days[len(days)-1].Items, item)
+	}
+	return days
+}
+
+// listTimelineMonths returns the months in which the owner's media was taken,
+// newest first. Times are stored as text starting with YYYY-MM.
+func listTimelineMonths(owner string) ([]timelineMonth, error) {
+	var months []timelineMonth
+	err := DB.Model(&s3photoalbum.MediaItem{}).
+		Select("substr(COALESCE(capture_time, last_modified), 1, 7) AS month, COUNT(*) AS count").
+		Where("owner = ?", owner).Group("month").Order("month DESC").Scan(&months).Error
+	return months, err
+}
+
+// timelineYears groups the months by year for the jump bar
+func timelineYears(months []timelineMonth) []timelineYear {
+	var years []timelineYear
+	for _, month := range months {
+		if year := month.Month[:4]; len(years) == 0 || years[len(years)-1].Year != year {
+			years = append(years, timelineYear{Year: year})
+		}
+		years[len(years)-1].Months = append(years[len(years)-1].Months, month)
+	}
+	return years
+}
+
+// formatMonth formats a month of the timeline jump bar, e.g. "Jun"
+func formatMonth(month string) string {
+	t, err := time.Parse("2006-01", month)
+	if err != nil {
+		return month
+	}
+	return t.Format("Jan")
+}
+
+// timelineHandler shows a page of the timeline. Further pages are appended by
+// the page when scrolling, or linked without JavaScript.
+func timelineHandler(c *gin.Context) {
+
+	owner := c.GetString("username")
+	q, err := parseTimelineQuery(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	page, err := listTimeline(owner, q)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	months, err := listTimelineMonths(owner)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	keys := make([]string, len(page.Items))
+	for i, item := range page.Items {
+		keys[i] = item.Key
+	}
+	info, err := findItemInfo(owner, keys)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var nextURL string
+	if page.Next != "" {
+		nextURL = q.url(page.Next)
+	}
+
+	c.HTML(http.StatusOK, "timeline.html", gin.H{
+		"context": c,
+		"title":   "Timeline",
+		"days":    groupByDay(page.Items),
+		"years":   timelineYears(months),
+		"info":    info,
+		"nextURL": nextURL,
+	})
+}
+
+func apiGetTimeline(c *gin.Context) {
+
+	q, err := parseTimelineQuery(c)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := listTimeline(c.GetString("username"), q)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list timeline")
+		return
+	}
+
+	items, err := newAPIMediaItems(c.GetString("username"), page.Items)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list timeline")
+		return
+	}
+	c.JSON(http.StatusOK, apiTimelinePage{Items: items, Next: page.Next})
+}
+
+func apiListTimelineMonths(c *gin.Context) {
+
+	months, err := listTimelineMonths(c.GetString("username"))
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to list months")
+		return
+	}
+
+	ret := []apiTimelineMonth{}
+	for _, month := range months {
+		ret = append(ret, apiTimelineMonth{Month: month.Month, Count: month.Count})
+	}
+	c.JSON(http.StatusOK, ret)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"s3photoalbum/internal"
+)
+
+func TestTimeline(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	for key, captureTime := range map[string]string{
+		"alice/summer/beach.jpg.jpg":  "2021-06-01T12:00:00",
+		"alice/summer/sunset.jpg.jpg": "2021-06-01T19:00:00",
+		"alice/winter/snow.jpg.jpg":   "2020-12-24T10:00:00",
+	} {
+		if err := s3.PutObjectWithMetadata(testThumbBucket, key, []byte("thumb"), "image/jpeg", map[string]string{
+			s3photoalbum.MetadataCaptureTime: captureTime,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The video has no capture time and is sorted by its upload time
+	var keys []string
+	for target := "/api/v1/timeline?limit=2"; ; {
+		var page apiTimelinePage
+		if status := apiRequest(t, r, http.MethodGet, target, token, nil, &page); status != http.StatusOK || len(page.Items) > 2 {
+			t.Fatalf("timeline: got status %d, page %+v", status, page)
+		}
+		for _, item := range page.Items {
+			keys = append(keys, item.Key)
+		}
+		if page.Next == "" {
+			break
+		}
+		target = "/api/v1/timeline?limit=2&after=" + page.Next
+	}
+	if expected := []string{"alice/summer/video.mp4", "alice/summer/sunset.jpg", "alice/summer/beach.jpg", "alice/winter/snow.jpg"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected timeline %v, got %v", expected, keys)
+	}
+
+	var page apiTimelinePage
+	if apiRequest(t, r, http.MethodGet, "/api/v1/timeline?date=2021-05", token, nil, &page); len(page.Items) != 1 || page.Items[0].Name != "snow.jpg" {
+		t.Errorf("jump to date: unexpected items %+v", page.Items)
+	}
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/timeline?date=June", token, nil, nil); status != http.StatusBadRequest {
+		t.Errorf("invalid date: expected status %d, got %d", http.StatusBadRequest, status)
+	}
+
+	var months []apiTimelineMonth
+	apiRequest(t, r, http.MethodGet, "/api/v1/timeline/months", token, nil, &months)
+	if len(months) != 3 || months[1] != (apiTimelineMonth{"2021-06", 2}) || months[2] != (apiTimelineMonth{"2020-12", 1}) {
+		t.Errorf("unexpected months %+v", months)
+	}
+
+	w := doRequest(r, http.MethodGet, "/timeline?date=2021&limit=1", nil, cookie)
+	for _, s := range []string{
+		`<a href="/timeline?date=2020-12" title="1">Dec</a>`,
+		`<h3 class="timeline-month" data-month="2021-06">June 2021</h3>`,
+		`<h4>Tuesday, 1 June 2021</h4>`,
+		`<img src="/thumbnails/summer/sunset.jpg.jpg"`,
+		`<a href="/timeline?after=alice%2Fsummer%2Fsunset.jpg&amp;limit=1" rel="next" class="timeline-next">`,
+	} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("timeline page does not contain %s", s)
+		}
+	}
+	if strings.Contains(w.Body.String(), "beach.jpg.jpg") {
+		t.Errorf("timeline page contains more items than the limit")
+	}
+}
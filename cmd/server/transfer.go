@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path"
+	"s3photoalbum/internal"
+)
+
+// Operations of transferItems
+const (
+	transferCopy = "copy"
+	transferMove = "move"
+)
+
+var (
+	errItemNotFound = errors.New("item not found")
+	errItemExists   = errors.New("item already exists in the target album")
+	errSameAlbum    = errors.New("target is the album of the items")
+)
+
+// transferStatus returns the HTTP status for errors of transferItems
+func transferStatus(err error) int {
+	switch {
+	case errors.Is(err, errSameAlbum):
+		return http.StatusBadRequest
+	case errors.Is(err, errItemNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errItemExists):
+		return http.StatusConflict
+	}
+	return albumStatus(err)
+}
+
+// transferItems copies or moves the media items with the names from the album
+// to the target album of the owner, together with their thumbnails. All items
+// are checked before any is changed. Returns the new items.
+func transferItems(operation, owner, album, target string, names []string) ([]s3photoalbum.MediaItem, error) {
+
+	if !validAlbumPath(album) || !validAlbumPath(target) {
+		return nil, errAlbumName
+	}
+	if album == target {
+		return nil, errSameAlbum
+	}
+
+	targetAlbum, err := findAlbum(owner, target)
+	if err != nil {
+		return nil, err
+	}
+	if targetAlbum == nil {
+		return nil, fmt.Errorf("target %w", errAlbumNotFound)
+	}
+
+	if jobs.busy(owner, album, target) {
+		return nil, errAlbumBusy
+	}
+
+	ctx := context.Background()
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !validPathElement(name) || seen[name] {
+			return nil, fmt.Errorf("%w: %s", errItemNotFound, name)
+		}
+		seen[name] = true
+
+		item, err := findMediaItem(path.Join(owner, album, name))
+		if err != nil {
+			return nil, err
+		}
+		if item == nil {
+			return nil, fmt.Errorf("%w: %s", errItemNotFound, name)
+		}
+
+		_, err = store.Stat(ctx, config.S3MediaBucket, path.Join(owner, target, name))
+		if err == nil {
+			return nil, fmt.Errorf("%w: %s", errItemExists, name)
+		}
+		if !errors.Is(err, s3photoalbum.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	ret := []s3photoalbum.MediaItem{}
+	for _, name := range names {
+		key, newKey := path.Join(owner, album, name), path.Join(owner, target, name)
+
+		if operation == transferMove {
+			err = moveObject(ctx, key, newKey)
+		} else {
+			err = copyObject(ctx, key, newKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		item, err := findMediaItem(newKey)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			ret = append(ret, *item)
+		}
+	}
+
+	log.Infof("%s %d items from %s/%s to %s", operation, len(names), owner, album, target)
+	return ret, nil
+}
+
+// transferHandler copies or moves the items selected on the album page
+func transferHandler(operation string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		names := c.PostFormArray("items")
+		if len(names) == 0 {
+			c.String(http.StatusBadRequest, "no items selected")
+			return
+		}
+
+		album := c.GetString("album")
+		if _, err := transferItems(operation, c.GetString("username"), album, c.PostForm("target"), names); err != nil {
+			if transferStatus(err) == http.StatusInternalServerError {
+				log.Error(err)
+			}
+			c.String(transferStatus(err), "%s", err)
+			return
+		}
+
+		c.Redirect(http.StatusSeeOther, escapedPath("/albums", album))
+	}
+}
+
+// apiTransferItems copies or moves items to another album of the user
+func apiTransferItems(operation string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		var req apiTransferItemsRequest
+		if err := c.ShouldBindJSON(&req); err != nil || len(req.Items) == 0 {
+			apiError(c, http.StatusBadRequest, "items and target are required")
+			return
+		}
+
+		items, err := transferItems(operation, c.GetString("username"), c.GetString("album"), req.Target, req.Items)
+		if err != nil {
+			if transferStatus(err) == http.StatusInternalServerError {
+				log.Error(err)
+			}
+			apiError(c, transferStatus(err), err.Error())
+			return
+		}
+
+		ret, err := newAPIMediaItems(c.GetString("username"), items)
+		if err != nil {
+			log.Error(err)
+			apiError(c, http.StatusInternalServerError, "failed to get items")
+			return
+		}
+		c.JSON(http.StatusOK, ret)
+	}
+}
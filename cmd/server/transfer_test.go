@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"s3photoalbum/internal"
+)
+
+func TestMoveItems(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	cookie := loginAs(t, r, "alice")
+	token := apiLoginAs(t, r, "alice")
+
+	metadata := map[string]string{s3photoalbum.MetadataCaptureTime: "2021-06-01T12:00:00"}
+	if err := s3.PutObjectWithMetadata(testThumbBucket, "alice/summer/beach.jpg.jpg", []byte("thumb"), "image/jpeg", metadata); err != nil {
+		t.Fatal(err)
+	}
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums", token, apiCreateAlbumRequest{Name: "holiday"}, nil); status != http.StatusCreated {
+		t.Fatalf("create album: expected status %d, got %d", http.StatusCreated, status)
+	}
+
+	w := doRequest(r, http.MethodGet, "/albums/summer", nil, cookie)
+	for _, s := range []string{`<option value="holiday">`, `<option value="winter">`, `name="items" value="beach.jpg"`} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("album page does not contain %s", s)
+		}
+	}
+
+	w = doRequest(r, http.MethodPost, "/albums/summer/move", url.Values{
+		"items":  {"beach.jpg", "video.mp4"},
+		"target": {"holiday"},
+	}, cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/albums/summer" {
+		t.Fatalf("expected redirect to the album, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	for _, name := range []string{"beach.jpg", "video.mp4"} {
+		if s3.GetObject(testMediaBucket, "alice/summer/"+name) != nil {
+			t.Errorf("%s not removed from the album", name)
+		}
+		if obj := s3.GetObject(testMediaBucket, "alice/holiday/"+name); obj == nil || !bytes.Equal(obj.Data, []byte("media alice/summer/"+name)) {
+			t.Errorf("%s not moved: %+v", name, obj)
+		}
+	}
+
+	// The thumbnail is copied with its metadata instead of being recreated
+	thumb := s3.GetObject(testThumbBucket, "alice/holiday/beach.jpg.jpg")
+	if thumb == nil || !reflect.DeepEqual(thumb.Metadata, metadata) || s3.GetObject(testThumbBucket, "alice/summer/beach.jpg.jpg") != nil {
+		t.Errorf("thumbnail not moved: %+v", thumb)
+	}
+	item, err := findMediaItem("alice/holiday/beach.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil || item.ThumbnailStatus != s3photoalbum.ThumbnailReady || item.CaptureTime == nil {
+		t.Errorf("moved item not indexed with its thumbnail: %+v", item)
+	}
+
+	var summer, holiday apiAlbum
+	apiRequest(t, r, http.MethodGet, "/api/v1/albums/summer", token, nil, &summer)
+	apiRequest(t, r, http.MethodGet, "/api/v1/albums/holiday", token, nil, &holiday)
+	if summer.ItemCount != 1 || holiday.ItemCount != 2 {
+		t.Errorf("expected 1 and 2 items, got %+v and %+v", summer, holiday)
+	}
+
+	// Moving the last item keeps albums that were not created empty
+	if w := doRequest(r, http.MethodPost, "/albums/winter/move", url.Values{
+		"items":  {"snow.jpg"},
+		"target": {"holiday"},
+	}, cookie); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect, got %d", w.Code)
+	}
+	if names, expected := albumNames(t, r, token), []string{"holiday", "summer"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected albums %v, got %v", expected, names)
+	}
+}
+
+func TestCopyItems(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	token := apiLoginAs(t, r, "alice")
+
+	var items []apiMediaItem
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums/summer/copy", token, apiTransferItemsRequest{
+		Items:  []string{"sunset.jpg"},
+		Target: "winter",
+	}, &items); status != http.StatusOK {
+		t.Fatalf("copy: expected status %d, got %d", http.StatusOK, status)
+	}
+	if len(items) != 1 || items[0].Key != "alice/winter/sunset.jpg" || items[0].URL != "/albums/winter/sunset.jpg" {
+		t.Errorf("unexpected items %+v", items)
+	}
+
+	for _, key := range []string{"alice/summer/sunset.jpg", "alice/winter/sunset.jpg"} {
+		if s3.GetObject(testMediaBucket, key) == nil || s3.GetObject(testThumbBucket, key+".jpg") == nil {
+			t.Errorf("%s or its thumbnail missing", key)
+		}
+	}
+
+	keys := s3.Keys(testMediaBucket)
+	for name, tt := range map[string]struct {
+		album  string
+		req    apiTransferItemsRequest
+		status int
+	}{
+		"existing item":   {"summer", apiTransferItemsRequest{Items: []string{"beach.jpg", "sunset.jpg"}, Target: "winter"}, http.StatusConflict},
+		"missing item":    {"summer", apiTransferItemsRequest{Items: []string{"beach.jpg", "nope.jpg"}, Target: "winter"}, http.StatusNotFound},
+		"other user":      {"summer", apiTransferItemsRequest{Items: []string{"beach.jpg"}, Target: "party"}, http.StatusNotFound},
+		"other user item": {"party", apiTransferItemsRequest{Items: []string{"cake.jpg"}, Target: "winter"}, http.StatusNotFound},
+		"same album":      {"summer", apiTransferItemsRequest{Items: []string{"beach.jpg"}, Target: "summer"}, http.StatusBadRequest},
+		"no items":        {"summer", apiTransferItemsRequest{Target: "winter"}, http.StatusBadRequest},
+		"invalid name":    {"summer", apiTransferItemsRequest{Items: []string{"../winter/snow.jpg"}, Target: "winter"}, http.StatusNotFound},
+	} {
+		if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums/"+tt.album+"/copy", token, tt.req, nil); status != tt.status {
+			t.Errorf("%s: expected status %d, got %d", name, tt.status, status)
+		}
+	}
+
+	// Nothing is copied if any item fails
+	if after := s3.Keys(testMediaBucket); !reflect.DeepEqual(after, keys) {
+		t.Errorf("expected keys %v, got %v", keys, after)
+	}
+
+	if err := index.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var winter apiAlbum
+	if apiRequest(t, r, http.MethodGet, "/api/v1/albums/winter", token, nil, &winter); winter.ItemCount != 2 {
+		t.Errorf("expected 2 items, got %+v", winter)
+	}
+}
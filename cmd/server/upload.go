@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"s3photoalbum/internal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content types of the media that can be uploaded by file extension. Only
+// the extension is trusted, as the browsers don't know many of the types.
+var uploadContentTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".avi":  "video/x-msvideo",
+	".3gp":  "video/3gpp",
+}
+
+// Chunked uploads that were not continued for this long are removed
+const uploadExpiry = 24 * time.Hour
+
+// Upload is a resumable upload in progress. The data received so far is
+// stored in a file named by the ID in the upload directory.
+type Upload struct {
+	ID          string `gorm:"primaryKey"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Owner       string `gorm:"index;not null"`
+	Album       string `gorm:"not null"`
+	Name        string `gorm:"not null"`
+	ContentType string `gorm:"not null"`
+	Size        int64  `gorm:"not null"`
+	Offset      int64  `gorm:"not null"`
+	// The uploading user, the owner or a user the album is shared with to
+	// contribute
+	Username string `gorm:"index;not null;default:''"`
+}
+
+var (
+	errUploadName   = errors.New("invalid file or album name")
+	errUploadType   = errors.New("unsupported file type")
+	errUploadExists = errors.New("file already exists")
+	errUploadSize   = errors.New("file too large")
+)
+
+// Allowance for the multipart headers of an upload form beyond the size of
+// its files
+const uploadFormOverhead = 1 << 20
+
+// uploadStatus returns the HTTP status for errors of the upload functions
+func uploadStatus(err error) int {
+	switch {
+	case errors.Is(err, errUploadName):
+		return http.StatusBadRequest
+	case errors.Is(err, errUploadType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errUploadExists):
+		return http.StatusConflict
+	case errors.Is(err, errUploadSize):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// uploadDir returns the directory for the data of chunked uploads
+func uploadDir() string {
+	if config.UploadDir != "" {
+		return config.UploadDir
+	}
+	return filepath.Join(os.TempDir(), "s3photoalbum-uploads")
+}
+
+// checkUpload validates the name and size of a new file and returns its
+// content type
+func checkUpload(owner, album, name string, size int64) (string, error) {
+
+	if !validNewAlbumPath(album) || !validPathElement(name) || strings.HasPrefix(name, ".") {
+		return "", errUploadName
+	}
+
+	contentType, ok := uploadContentTypes[strings.ToLower(path.Ext(name))]
+	if !ok {
+		return "", errUploadType
+	}
+
+	if size < 0 || (config.MaxUploadSize > 0 && size > config.MaxUploadSize) {
+		return "", errUploadSize
+	}
+
+	_, err := store.Stat(context.Background(), config.S3MediaBucket, path.Join(owner, album, name))
+	if err == nil {
+		return "", errUploadExists
+	}
+	if !errors.Is(err, s3photoalbum.ErrNotExist) {
+		return "", err
+	}
+	return contentType, nil
+}
+
+// checkContent makes sure the content is not of a different type than the
+// extension promises, e.g. HTML disguised as image. Types unknown to the
+// sniffer are accepted.
+func checkContent(r io.ReadSeeker) error {
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	sniffed := http.DetectContentType(head[:n])
+	if strings.HasPrefix(sniffed, "image/") || strings.HasPrefix(sniffed, "video/") || sniffed == "application/octet-stream" {
+		return nil
+	}
+	return fmt.Errorf("%w: content is %s", errUploadType, sniffed)
+}
+
+// storeUpload checks the content and writes it to the media bucket. The new
+// object is indexed at once, the thumbnailer is notified by the storage.
+func storeUpload(owner, album, name, contentType string, r io.ReadSeeker, size int64) (*s3photoalbum.MediaItem, error) {
+
+	if err := checkContent(r); err != nil {
+		return nil, err
+	}
+
+	key := path.Join(owner, album, name)
+	if _, err := store.Put(context.Background(), config.S3MediaBucket, key, r, size, s3photoalbum.PutOptions{
+		ContentType: contentType,
+	}); err != nil {
+		return nil, err
+	}
+	log.Infof("Uploaded %s", key)
+
+	if err := index.Update(context.Background(), key); err != nil {
+		return nil, err
+	}
+	urlCache.forget(config.S3MediaBucket, key)
+
+	item, err := findMediaItem(key)
+	if err == nil && item == nil {
+		err = fmt.Errorf("uploaded media %s not indexed", key)
+	}
+	return item, err
+}
+
+// uploadHandler stores the files of a multipart form in the album, of the
+// user or shared with them to contribute
+func uploadHandler(c *gin.Context) {
+
+	owner := albumOwner(c)
+	album := c.GetString("album")
+
+	ok, err := hasAlbumAccess(c, album, accessContribute)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	// The files of the form are limited together, before they are spooled to
+	// disk
+	if config.MaxUploadSize > 0 {
+		limit := config.MaxUploadSize + uploadFormOverhead
+		if c.Request.ContentLength > limit {
+			c.String(uploadStatus(errUploadSize), "%s", errUploadSize)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	for _, file := range form.File["files"] {
+
+		contentType, err := checkUpload(owner, album, file.Filename, file.Size)
+		if err != nil {
+			log.Warn("Rejected upload of ", file.Filename, ": ", err)
+			c.String(uploadStatus(err), "%s: %s", file.Filename, err)
+			return
+		}
+
+		f, err := file.Open()
+		if err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		_, err = storeUpload(owner, album, file.Filename, contentType, f, file.Size)
+		f.Close()
+		if err != nil {
+			log.Error("Failed to upload ", file.Filename, ": ", err)
+			c.String(uploadStatus(err), "%s: %s", file.Filename, err)
+			return
+		}
+	}
+
+	c.Redirect(http.StatusSeeOther, escapedPath(albumsPath(c.GetString("username"), owner), album))
+}
+
+// removeUpload deletes the upload and its data
+func removeUpload(upload Upload) error {
+	if err := os.Remove(filepath.Join(uploadDir(), upload.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return DB.Delete(&upload).Error
+}
+
+// removeExpiredUploads deletes the uploads that were abandoned
+func removeExpiredUploads() {
+	var uploads []Upload
+	if err := DB.Where("updated_at < ?", time.Now().Add(-uploadExpiry)).Find(&uploads).Error; err != nil {
+		log.Error(err)
+		return
+	}
+	for _, upload := range uploads {
+		if err := removeUpload(upload); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// findUpload returns the upload of the current user from the id parameter
+func findUpload(c *gin.Context) (*Upload, bool) {
+	var upload Upload
+	res := DB.Where("id = ? AND username = ?", c.Param("id"), c.GetString("username")).Limit(1).Find(&upload)
+	if res.Error != nil {
+		log.Error(res.Error)
+		apiError(c, http.StatusInternalServerError, "failed to get upload")
+		return nil, false
+	}
+	if res.RowsAffected == 0 {
+		apiError(c, http.StatusNotFound, "upload not found")
+		return nil, false
+	}
+	return &upload, true
+}
+
+func apiCreateUpload(c *gin.Context) {
+
+	var req apiCreateUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, "name and size are required")
+		return
+	}
+
+	owner := albumOwner(c)
+	album := c.GetString("album")
+
+	ok, err := hasAlbumAccess(c, album, accessContribute)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+	if !ok {
+		apiError(c, http.StatusNotFound, "album not found")
+		return
+	}
+
+	contentType, err := checkUpload(owner, album, req.Name, req.Size)
+	if err != nil {
+		apiError(c, uploadStatus(err), err.Error())
+		return
+	}
+
+	removeExpiredUploads()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+
+	upload := Upload{
+		ID:          hex.EncodeToString(id),
+		Owner:       owner,
+		Album:       album,
+		Username:    c.GetString("username"),
+		Name:        req.Name,
+		ContentType: contentType,
+		Size:        req.Size,
+	}
+
+	if err := os.MkdirAll(uploadDir(), 0700); err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(uploadDir(), upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+	f.Close()
+
+	if err := DB.Create(&upload).Error; err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+
+	c.JSON(http.StatusCreated, newAPIUpload(upload))
+}
+
+func apiGetUpload(c *gin.Context) {
+	if upload, ok := findUpload(c); ok {
+		c.JSON(http.StatusOK, newAPIUpload(*upload))
+	}
+}
+
+func apiDeleteUpload(c *gin.Context) {
+
+	upload, ok := findUpload(c)
+	if !ok {
+		return
+	}
+
+	if err := removeUpload(*upload); err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to delete upload")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// apiPatchUpload appends the request body to the upload. The Upload-Offset
+// header has to match the size received so far. Once the upload is complete
+// the file is stored in the album.
+func apiPatchUpload(c *gin.Context) {
+
+	upload, ok := findUpload(c)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "invalid Upload-Offset header")
+		return
+	}
+	if offset != upload.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		apiError(c, http.StatusConflict, fmt.Sprintf("upload is at offset %d", upload.Offset))
+		return
+	}
+
+	dataPath := filepath.Join(uploadDir(), upload.ID)
+	f, err := os.OpenFile(dataPath, os.O_WRONLY, 0600)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to write upload")
+		return
+	}
+
+	// Continue after the last complete chunk, interrupted requests may
+	// have left partial data behind
+	written, err := f.Seek(upload.Offset, io.SeekStart)
+	if err == nil {
+		if err = f.Truncate(upload.Offset); err == nil {
+			var n int64
+			n, err = io.Copy(f, http.MaxBytesReader(c.Writer, c.Request.Body, upload.Size-upload.Offset))
+			written += n
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusBadRequest, "failed to write upload")
+		return
+	}
+
+	upload.Offset = written
+	if err := DB.Model(upload).Update("offset", upload.Offset).Error; err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to write upload")
+		return
+	}
+
+	if upload.Offset < upload.Size {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.JSON(http.StatusOK, newAPIUpload(*upload))
+		return
+	}
+
+	// Complete, check again as the access may have been removed or another
+	// file uploaded since
+	access, err := albumAccess(upload.Username, upload.Owner, upload.Album)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	if accessRanks[access] < accessRanks[accessContribute] {
+		if err := removeUpload(*upload); err != nil {
+			log.Error(err)
+		}
+		apiError(c, http.StatusNotFound, "album not found")
+		return
+	}
+	if _, err := checkUpload(upload.Owner, upload.Album, upload.Name, upload.Size); err != nil {
+		if err := removeUpload(*upload); err != nil {
+			log.Error(err)
+		}
+		apiError(c, uploadStatus(err), err.Error())
+		return
+	}
+
+	f, err = os.Open(dataPath)
+	if err != nil {
+		log.Error(err)
+		apiError(c, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	item, err := storeUpload(upload.Owner, upload.Album, upload.Name, upload.ContentType, f, upload.Size)
+	f.Close()
+
+	if removeErr := removeUpload(*upload); removeErr != nil {
+		log.Error(removeErr)
+	}
+	if err != nil {
+		log.Error(err)
+		apiError(c, uploadStatus(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, newAPIMediaItem(c.GetString("username"), *item, itemInfo{}))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	testJPEG = append([]byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), bytes.Repeat([]byte{1}, 100)...)
+	testMP4  = append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), bytes.Repeat([]byte{2}, 100)...)
+)
+
+// uploadFiles posts the files as multipart form to the upload route
+func uploadFiles(t *testing.T, r *gin.Engine, album string, files map[string][]byte, cookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, data := range files {
+		fw, err := mw.CreateFormFile("files", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/albums/"+album+"/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestUpload(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	cookie := loginAs(t, r, "bob")
+
+	w := uploadFiles(t, r, "holiday", map[string][]byte{
+		"photo.jpg": testJPEG,
+		"clip.mp4":  testMP4,
+	}, cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/albums/holiday" {
+		t.Fatalf("expected redirect to the album, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	for key, contentType := range map[string]string{
+		"bob/holiday/photo.jpg": "image/jpeg",
+		"bob/holiday/clip.mp4":  "video/mp4",
+	} {
+		obj := s3.GetObject(testMediaBucket, key)
+		if obj == nil {
+			t.Errorf("%s not uploaded", key)
+			continue
+		}
+		if obj.ContentType != contentType {
+			t.Errorf("%s: expected content type %s, got %s", key, contentType, obj.ContentType)
+		}
+	}
+
+	// Uploaded media is listed at once, before the thumbnailer ran
+	w = doRequest(r, http.MethodGet, "/albums/holiday", nil, cookie)
+	if names := thumbnailRe.FindAllStringSubmatch(w.Body.String(), -1); len(names) != 2 {
+		t.Errorf("expected 2 items on the album page, got %v", names)
+	}
+
+	config.MaxUploadSize = 50
+	for name, tt := range map[string]struct {
+		files  map[string][]byte
+		status int
+	}{
+		"unsupported extension": {map[string][]byte{"notes.txt": []byte("hello")}, http.StatusUnsupportedMediaType},
+		"disguised html":        {map[string][]byte{"evil.jpg": []byte("<html><script>alert(1)</script></html>")}, http.StatusUnsupportedMediaType},
+		"hidden file":           {map[string][]byte{".hidden.jpg": testJPEG[:20]}, http.StatusBadRequest},
+		"existing file":         {map[string][]byte{"photo.jpg": testJPEG[:20]}, http.StatusConflict},
+		"too large":             {map[string][]byte{"large.jpg": testJPEG}, http.StatusRequestEntityTooLarge},
+		"too large form":        {map[string][]byte{"large.txt": make([]byte, uploadFormOverhead+100)}, http.StatusRequestEntityTooLarge},
+	} {
+		if w := uploadFiles(t, r, "holiday", tt.files, cookie); w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", name, tt.status, w.Code)
+		}
+	}
+
+	if keys := s3.Keys(testMediaBucket); len(keys) != len(fixtures)+2 {
+		t.Errorf("rejected uploads were stored: %v", keys)
+	}
+
+	if w := uploadFiles(t, r, "holiday", map[string][]byte{"photo2.jpg": testJPEG[:20]}, nil); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Errorf("unauthenticated: expected redirect to login, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// patchUpload sends a chunk of a resumable upload
+func patchUpload(t *testing.T, r *gin.Engine, id, token string, offset int, chunk []byte, out interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/v1/uploads/"+id, bytes.NewReader(chunk))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("invalid JSON response %q: %v", w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+func TestChunkedUpload(t *testing.T) {
+	r, s3 := setupTestServer(t)
+	token := apiLoginAs(t, r, "alice")
+
+	var upload apiUpload
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums/summer/uploads", token, apiCreateUploadRequest{
+		Name: "movie.mp4",
+		Size: int64(len(testMP4)),
+	}, &upload); status != http.StatusCreated {
+		t.Fatalf("create upload: expected status %d, got %d", http.StatusCreated, status)
+	}
+	if upload.ID == "" || upload.Offset != 0 || upload.Album != "summer" || upload.Name != "movie.mp4" {
+		t.Fatalf("unexpected upload %+v", upload)
+	}
+
+	if w := patchUpload(t, r, upload.ID, token, 0, testMP4[:40], &upload); w.Code != http.StatusOK || upload.Offset != 40 {
+		t.Fatalf("first chunk: got status %d, upload %+v", w.Code, upload)
+	}
+
+	// A repeated chunk, e.g. after a lost response, reports the offset
+	if w := patchUpload(t, r, upload.ID, token, 0, testMP4[:40], nil); w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "40" {
+		t.Errorf("wrong offset: got status %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	// Resuming reads the offset
+	var resumed apiUpload
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/uploads/"+upload.ID, token, nil, &resumed); status != http.StatusOK || resumed != upload {
+		t.Errorf("get upload: got status %d, upload %+v", status, resumed)
+	}
+
+	// Uploads of other users are not visible
+	bobToken := apiLoginAs(t, r, "bob")
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/uploads/"+upload.ID, bobToken, nil, nil); status != http.StatusNotFound {
+		t.Errorf("upload of other user: expected status %d, got %d", http.StatusNotFound, status)
+	}
+
+	// Data beyond the announced size is rejected
+	if w := patchUpload(t, r, upload.ID, token, 40, append(testMP4[40:], 0), nil); w.Code != http.StatusBadRequest {
+		t.Errorf("too much data: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	var item apiMediaItem
+	if w := patchUpload(t, r, upload.ID, token, 40, testMP4[40:], &item); w.Code != http.StatusCreated {
+		t.Fatalf("last chunk: expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	if item.Key != "alice/summer/movie.mp4" || item.Size != int64(len(testMP4)) || item.ContentType != "video/mp4" {
+		t.Errorf("unexpected item %+v", item)
+	}
+
+	if obj := s3.GetObject(testMediaBucket, "alice/summer/movie.mp4"); obj == nil || !bytes.Equal(obj.Data, testMP4) {
+		t.Errorf("uploaded object differs: %+v", obj)
+	}
+
+	// Completed uploads are removed
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/uploads/"+upload.ID, token, nil, nil); status != http.StatusNotFound {
+		t.Errorf("completed upload: expected status %d, got %d", http.StatusNotFound, status)
+	}
+
+	// Rejected before any data is sent
+	for name, req := range map[string]apiCreateUploadRequest{
+		"existing": {Name: "beach.jpg", Size: 10},
+		"type":     {Name: "notes.txt", Size: 10},
+		"name":     {Name: "../x.jpg", Size: 10},
+		"negative": {Name: "x.jpg", Size: -1},
+		"no name":  {Size: 10},
+	} {
+		if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums/summer/uploads", token, req, nil); status < 400 {
+			t.Errorf("%s: expected error, got status %d", name, status)
+		}
+	}
+
+	// Canceled uploads are removed
+	if status := apiRequest(t, r, http.MethodPost, "/api/v1/albums/summer/uploads", token, apiCreateUploadRequest{
+		Name: "other.jpg",
+		Size: 10,
+	}, &upload); status != http.StatusCreated {
+		t.Fatalf("create upload: expected status %d, got %d", http.StatusCreated, status)
+	}
+	if status := apiRequest(t, r, http.MethodDelete, "/api/v1/uploads/"+upload.ID, token, nil, nil); status != http.StatusNoContent {
+		t.Errorf("delete upload: expected status %d, got %d", http.StatusNoContent, status)
+	}
+	if status := apiRequest(t, r, http.MethodGet, "/api/v1/uploads/"+upload.ID, token, nil, nil); status != http.StatusNotFound {
+		t.Errorf("deleted upload: expected status %d, got %d", http.StatusNotFound, status)
+	}
+}
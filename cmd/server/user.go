@@ -70,9 +70,16 @@ func getSession(c *gin.Context) (uint, string, bool) {
 func deleteUser(c *gin.Context) {
 	formUser := c.Param("user")
 
+	var user User
+	if res := DB.Find(&user, formUser); res.Error != nil {
+		log.Error(res.Error)
+	}
+
 	result := DB.Unscoped().Delete(&User{}, formUser)
 	if result.Error != nil {
 		log.Error(result.Error)
+	} else if err := deleteUserAccess(user.Username); err != nil {
+		log.Error(err)
 	}
 
 	log.Info("User deleted. Redirecting to /users")
@@ -111,8 +118,16 @@ func getUsers(c *gin.Context) {
 		log.Fatal(result.Error)
 	}
 
+	groups, err := listGroups()
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
 	c.HTML(http.StatusOK, "users.html", gin.H{
 			"context": c,
 			"users": users,
+			"groups": groups,
 	})
 }
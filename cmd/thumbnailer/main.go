@@ -3,24 +3,29 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
+	"io"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
 	"strings"
-
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+	"time"
 
 	"s3photoalbum/internal"
 )
 
 var (
-	minioClient *minio.Client
-	config      s3photoalbum.ThumbnailerConfig
-	log         *zap.SugaredLogger
+	store  s3photoalbum.MediaStore
+	index  *s3photoalbum.Index
+	config s3photoalbum.ThumbnailerConfig
+	log    *zap.SugaredLogger
+	// Nil if the GeoNames data is not configured
+	gazetteer *s3photoalbum.Gazetteer
 )
 
 func runCmd(cmd *exec.Cmd) (stdout, stderr string, err error) {
@@ -88,6 +93,229 @@ func getExifOrientation(pathIn string) (string, error) {
 
 }
 
+// getExifMetadata returns the metadata to store with the thumbnail. Tags
+// missing in the file are omitted.
+func getExifMetadata(pathIn string) (map[string]string, error) {
+
+	// Tags with # are printed as plain numbers, the composite GPS tags are
+	// signed
+	//
+	// shell ❯ exiftool -json -d %Y-%m-%dT%H:%M:%S -DateTimeOriginal -CreateDate -ImageWidth -ImageHeight -Keywords -Subject -Model -LensModel -ExposureTime# -FNumber# -ISO# -FocalLength# -Composite:GPSLatitude# -Composite:GPSLongitude# -Composite:GPSAltitude# -Duration# test.jpg
+	// [{
+	//   "SourceFile": "test.jpg",
+	//   "DateTimeOriginal": "2021-06-01T12:00:00",
+	//   "ImageWidth": 4000,
+	//   "Keywords": ["beach","summer"],
+	//   "Model": "Canon EOS R6",
+	//   "ExposureTime": 0.004,
+	//   "GPSLatitude": 38.7139,
+	//   ...
+	// }]
+
+	cmdExiftool := exec.Command(
+		config.ExifToolPath,
+		"-json",
+		"-d",
+		"%Y-%m-%dT%H:%M:%S",
+		"-DateTimeOriginal",
+		"-CreateDate",
+		"-ImageWidth",
+		"-ImageHeight",
+		"-Keywords",
+		"-Subject",
+		"-Model",
+		"-LensModel",
+		"-ExposureTime#",
+		"-FNumber#",
+		"-ISO#",
+		"-FocalLength#",
+		"-Composite:GPSLatitude#",
+		"-Composite:GPSLongitude#",
+		"-Composite:GPSAltitude#",
+		"-Duration#",
+		pathIn)
+
+	stdOut, _, err := runCmd(cmdExiftool)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(stdOut))
+	decoder.UseNumber()
+	if err := decoder.Decode(&files); err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return map[string]string{}, nil
+	}
+	tags := files[0]
+
+	metadata := map[string]string{}
+
+	// Use the first tag that is set and valid, cameras without clock write
+	// zero dates
+	for _, tag := range []string{"DateTimeOriginal", "CreateDate"} {
+		if t, err := time.Parse(s3photoalbum.CaptureTimeFormat, exifString(tags[tag])); err == nil && t.Year() > 1 {
+			metadata[s3photoalbum.MetadataCaptureTime] = exifString(tags[tag])
+			break
+		}
+	}
+
+	for tag, key := range map[string]string{
+		"ImageWidth":  s3photoalbum.MetadataWidth,
+		"ImageHeight": s3photoalbum.MetadataHeight,
+		"ISO":         s3photoalbum.MetadataISO,
+	} {
+		if n, ok := exifNumber(tags[tag]); ok && n > 0 {
+			metadata[key] = strconv.Itoa(int(n))
+		}
+	}
+
+	for tag, key := range map[string]string{
+		"ExposureTime": s3photoalbum.MetadataExposureTime,
+		"FNumber":      s3photoalbum.MetadataFNumber,
+		"FocalLength":  s3photoalbum.MetadataFocalLength,
+		"Duration":     s3photoalbum.MetadataDuration,
+	} {
+		if n, ok := exifNumber(tags[tag]); ok && n > 0 {
+			metadata[key] = strconv.FormatFloat(n, 'f', -1, 64)
+		}
+	}
+
+	// Positions without both coordinates are left out
+	lat, okLat := exifNumber(tags["GPSLatitude"])
+	lon, okLon := exifNumber(tags["GPSLongitude"])
+	if okLat && okLon {
+		metadata[s3photoalbum.MetadataLatitude] = strconv.FormatFloat(lat, 'f', -1, 64)
+		metadata[s3photoalbum.MetadataLongitude] = strconv.FormatFloat(lon, 'f', -1, 64)
+		if alt, ok := exifNumber(tags["GPSAltitude"]); ok {
+			metadata[s3photoalbum.MetadataAltitude] = strconv.FormatFloat(alt, 'f', -1, 64)
+		}
+	}
+
+	// Metadata is sent as HTTP headers, text is escaped to ASCII
+	for tag, key := range map[string]string{
+		"Model":     s3photoalbum.MetadataCameraModel,
+		"LensModel": s3photoalbum.MetadataLensModel,
+	} {
+		if value := strings.TrimSpace(exifString(tags[tag])); value != "" {
+			metadata[key] = url.QueryEscape(value)
+		}
+	}
+
+	// IPTC and XMP keywords, the index removes duplicates
+	keywords := append(exifStrings(tags["Keywords"]), exifStrings(tags["Subject"])...)
+	if len(keywords) > 0 {
+		if !s3photoalbum.KeywordsFit(keywords) {
+			log.Warn("Too many keywords, left out some of: ", pathIn)
+		}
+		if encoded := s3photoalbum.EncodeKeywords(keywords); encoded != "" {
+			metadata[s3photoalbum.MetadataKeywords] = encoded
+		}
+	}
+
+	return metadata, nil
+}
+
+// setPlaceMetadata adds the names of the place to the metadata of geotagged
+// media and returns whether one was found. The place is looked up offline in
+// the gazetteer.
+func setPlaceMetadata(metadata map[string]string) bool {
+
+	lat, errLat := strconv.ParseFloat(metadata[s3photoalbum.MetadataLatitude], 64)
+	lon, errLon := strconv.ParseFloat(metadata[s3photoalbum.MetadataLongitude], 64)
+	if gazetteer == nil || errLat != nil || errLon != nil {
+		return false
+	}
+
+	place, ok := gazetteer.Lookup(lat, lon)
+	if !ok {
+		return false
+	}
+	for key, value := range map[string]string{
+		s3photoalbum.MetadataCity:    place.City,
+		s3photoalbum.MetadataRegion:  place.Region,
+		s3photoalbum.MetadataCountry: place.Country,
+	} {
+		if value != "" {
+			metadata[key] = url.QueryEscape(value)
+		}
+	}
+	return true
+}
+
+// missingPlaceMetadata returns whether the metadata is of geotagged media
+// without the names of the place
+func missingPlaceMetadata(metadata map[string]string) bool {
+	for _, key := range []string{s3photoalbum.MetadataCity, s3photoalbum.MetadataRegion, s3photoalbum.MetadataCountry} {
+		if metadata[key] != "" {
+			return false
+		}
+	}
+	return metadata[s3photoalbum.MetadataLatitude] != "" && metadata[s3photoalbum.MetadataLongitude] != ""
+}
+
+// Metadata left out, in this order, if the metadata of a thumbnail exceeds
+// the limit of S3. Only the text fields can be long.
+var optionalMetadata = []string{
+	s3photoalbum.MetadataLensModel,
+	s3photoalbum.MetadataCameraModel,
+	s3photoalbum.MetadataKeywords,
+	s3photoalbum.MetadataRegion,
+	s3photoalbum.MetadataCity,
+	s3photoalbum.MetadataCountry,
+}
+
+// limitMetadata removes metadata until it fits the limit of S3, the upload
+// of the thumbnail fails otherwise
+func limitMetadata(metadata map[string]string) {
+	for _, key := range optionalMetadata {
+		if s3photoalbum.MetadataSize(metadata) <= s3photoalbum.MaxMetadataSize {
+			return
+		}
+		if _, ok := metadata[key]; ok {
+			log.Warn("Metadata too large, leaving out: ", key)
+			delete(metadata, key)
+		}
+	}
+}
+
+// exifString returns a value of the exiftool JSON output as text, empty if it
+// is missing
+func exifString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+// exifStrings returns a value of the exiftool JSON output that may be a list,
+// e.g. keywords
+func exifStrings(v interface{}) []string {
+	var ret []string
+	if list, ok := v.([]interface{}); ok {
+		for _, elem := range list {
+			if s := exifString(elem); s != "" {
+				ret = append(ret, s)
+			}
+		}
+	} else if s := exifString(v); s != "" {
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// exifNumber returns a value of the exiftool JSON output as number, some file
+// types have numbers as strings
+func exifNumber(v interface{}) (float64, bool) {
+	n, err := strconv.ParseFloat(exifString(v), 64)
+	return n, err == nil
+}
+
 func getThumbJPEG(pathIn, pathOut string) error {
 
 	// Usage: ffmpegthumbnailer [options]
@@ -139,7 +367,7 @@ func getThumbJPEG(pathIn, pathOut string) error {
 
 func makeThumbnailByKey(key string) error {
 
-	objInfo, err := minioClient.StatObject(context.Background(), config.S3MediaBucket, key, minio.StatObjectOptions{})
+	objInfo, err := store.Stat(context.Background(), config.S3MediaBucket, key)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -151,23 +379,14 @@ func makeThumbnailByKey(key string) error {
 func makeThumbnail(key, etag string) (err error) {
 
 	log.Debug("Making thumbnail for:", key, "etag:", etag)
-	tmpInFileName := etag + path.Ext(key)
-	tmpOutFileName := etag + path.Ext(key) + ".jpg"
+	tmpInFileName := path.Join(os.TempDir(), etag+path.Ext(key))
+	tmpOutFileName := path.Join(os.TempDir(), etag+path.Ext(key)+".jpg")
 	newKey := key + ".jpg"
 
-	err = minioClient.FGetObject(
-		context.Background(),
-		config.S3MediaBucket,
-		key,
-		tmpInFileName,
-		minio.GetObjectOptions{},
-	)
+	err = getObjectToFile(config.S3MediaBucket, key, tmpInFileName)
 
-	defer func() {
-		if err = os.Remove(tmpInFileName); err != nil {
-			return
-		}
-	}()
+	// Removal errors must not replace the result
+	defer os.Remove(tmpInFileName)
 
 	if err != nil {
 		log.Error("Failed to retrieve original media:", key)
@@ -175,6 +394,18 @@ func makeThumbnail(key, etag string) (err error) {
 		return err
 	}
 
+	// The EXIF data is stored with the thumbnail, so that the index can be
+	// rebuilt without downloading the originals
+	metadata, errExif := getExifMetadata(tmpInFileName)
+	if errExif != nil {
+		log.Warn("Failed to read EXIF data of:", key, errExif)
+		metadata = map[string]string{}
+	} else {
+		setPlaceMetadata(metadata)
+		limitMetadata(metadata)
+	}
+	metadata[s3photoalbum.MetadataVersion] = s3photoalbum.MetadataVersionCurrent
+
 	err = getThumbJPEG(tmpInFileName, tmpOutFileName)
 	if err != nil {
 		log.Error("Failed to extrat JPEG for:", key)
@@ -182,25 +413,55 @@ func makeThumbnail(key, etag string) (err error) {
 	}
 
 	// Make sure thumbnail file is deleted
-	defer func() {
-		if err = os.Remove(tmpOutFileName); err != nil {
-			return
-		}
-	}()
-
-	if info, err := minioClient.FPutObject(
-		context.Background(),
-		config.S3ThumbnailBucket,
-		newKey,
-		tmpOutFileName,
-		minio.PutObjectOptions{ContentType: "image/jpeg"},
-	); err == nil {
+	defer os.Remove(tmpOutFileName)
+
+	info, err := putObjectFromFile(config.S3ThumbnailBucket, newKey, tmpOutFileName, "image/jpeg", metadata)
+	if err == nil {
 		log.Info("Successfully uploaded bytes: ", info)
 	}
 
 	return err
 }
 
+// getObjectToFile downloads an object from the store into a local file
+func getObjectToFile(bucket, key, filePath string) error {
+
+	obj, _, err := store.Get(context.Background(), bucket, key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, obj)
+	return err
+}
+
+// putObjectFromFile uploads a local file to the store
+func putObjectFromFile(bucket, key, filePath, contentType string, metadata map[string]string) (s3photoalbum.ObjectInfo, error) {
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return s3photoalbum.ObjectInfo{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return s3photoalbum.ObjectInfo{}, err
+	}
+
+	return store.Put(context.Background(), bucket, key, file, stat.Size(), s3photoalbum.PutOptions{
+		ContentType: contentType,
+		Metadata:    metadata,
+	})
+}
+
 // difference returns the elements in `a` that aren't in `b`.
 func difference(a, b []string) []string {
 	mb := make(map[string]struct{}, len(b))
@@ -222,8 +483,8 @@ func getMissingThumbnails() []string {
 
 	defer cancel()
 
-	thumbsCh := minioClient.ListObjects(ctx, config.S3ThumbnailBucket, minio.ListObjectsOptions{Recursive: true})
-	mediaCh := minioClient.ListObjects(ctx, config.S3MediaBucket, minio.ListObjectsOptions{Recursive: true})
+	thumbsCh := store.List(ctx, config.S3ThumbnailBucket, s3photoalbum.ListOptions{Recursive: true})
+	mediaCh := store.List(ctx, config.S3MediaBucket, s3photoalbum.ListOptions{Recursive: true})
 
 	var mediaKeys []string
 	var thumbKeys []string
@@ -248,23 +509,9 @@ func getMissingThumbnails() []string {
 
 }
 
-func main() {
-
-	config = s3photoalbum.LoadThumbnailerConfig()
-	log = s3photoalbum.NewLogger(config.ModeDevelop)
-
-	useSSL := true
-
-	var err error
-
-	// Initialize minio client object.
-	minioClient, err = minio.New(config.S3Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(config.S3AccessKey, config.S3SecretKey, ""),
-		Secure: useSSL,
-	})
-	if err != nil {
-		panic(err)
-	}
+// backfillThumbnails creates the thumbnails for all media that doesn't have
+// one yet
+func backfillThumbnails() {
 
 	log.Info("Checking for missing thumbnails")
 	missingThumbs := getMissingThumbnails()
@@ -272,40 +519,210 @@ func main() {
 
 	for _, v := range missingThumbs {
 		log.Info("Creating thumbnail for: %s\n", v)
+		err := makeThumbnailByKey(v)
+		if err != nil {
+			log.Error("Error making thumbnail for: ", v)
+		}
+		updateIndex(v, err)
+	}
+}
+
+// getOutdatedThumbnails returns the keys of the media whose thumbnails have
+// metadata of an older version of the thumbnailer. If the gazetteer is
+// configured, the metadata of geotagged thumbnails without place is returned
+// too by media key, e.g. of those made before configuring it.
+func getOutdatedThumbnails() (outdated []string, unnamed map[string]map[string]string) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	defer cancel()
+
+	media := map[string]bool{}
+	for object := range store.List(ctx, config.S3MediaBucket, s3photoalbum.ListOptions{Recursive: true}) {
+		if object.Err != nil {
+			log.Error(object.Err)
+			return nil, nil
+		}
+		media[object.Key] = true
+	}
+
+	unnamed = map[string]map[string]string{}
+	for object := range store.List(ctx, config.S3ThumbnailBucket, s3photoalbum.ListOptions{Recursive: true, WithMetadata: true}) {
+		if object.Err != nil {
+			log.Error(object.Err)
+			break
+		}
+		key := strings.TrimSuffix(object.Key, ".jpg")
+		if !media[key] {
+			continue
+		}
+
+		// Listings of S3 other than MinIO have no metadata
+		metadata := object.Metadata
+		if len(metadata) == 0 {
+			info, err := store.Stat(ctx, config.S3ThumbnailBucket, object.Key)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			metadata = info.Metadata
+		}
+		if metadata[s3photoalbum.MetadataVersion] != s3photoalbum.MetadataVersionCurrent {
+			outdated = append(outdated, key)
+		} else if gazetteer != nil && missingPlaceMetadata(metadata) {
+			unnamed[key] = metadata
+		}
+	}
+	return outdated, unnamed
+}
+
+// backfillMetadata makes the thumbnails with outdated metadata again, so
+// that media thumbnailed before e.g. the capture time or the position were
+// extracted gets them too. The places of geotagged thumbnails without one
+// are looked up and only their metadata is replaced.
+func backfillMetadata() {
+
+	log.Info("Checking for outdated thumbnail metadata")
+	outdated, unnamed := getOutdatedThumbnails()
+	log.Info(len(outdated), " thumbnails with outdated metadata, ", len(unnamed), " without place")
+
+	for _, v := range outdated {
+		log.Info("Extracting metadata again for: ", v)
+
+		// The old thumbnail is kept if it fails
 		if err := makeThumbnailByKey(v); err != nil {
 			log.Error("Error making thumbnail for: ", v)
+			continue
 		}
+		updateIndex(v, nil)
 	}
 
-	// Listen for bucket notifications
-	for notificationInfo := range minioClient.ListenBucketNotification(context.Background(), config.S3MediaBucket, "", "", []string{
-		"s3:ObjectCreated:*",
-		// "s3:ObjectAccessed:*",
-		// "s3:ObjectRemoved:*",
-	}) {
-		if notificationInfo.Err != nil {
-			log.Error(notificationInfo.Err)
+	for v, metadata := range unnamed {
+		if !setPlaceMetadata(metadata) {
+			continue
 		}
+		limitMetadata(metadata)
+		log.Info("Naming the place of: ", v)
 
-		for _, k := range notificationInfo.Records {
+		if err := replaceMetadata(config.S3ThumbnailBucket, v+".jpg", metadata); err != nil {
+			log.Error("Error replacing the metadata of: ", v, err)
+			continue
+		}
+		updateIndex(v, nil)
+	}
+}
 
-			if !checkBucketKeyExists(k.S3.Object.Key+".jpg", config.S3ThumbnailBucket) {
+// replaceMetadata uploads the object again with the metadata. It is read
+// into memory, so it must be small, e.g. a thumbnail.
+func replaceMetadata(bucket, key string, metadata map[string]string) error {
 
-				// No thumbnails exists yet, generate and upload
-				if err = makeThumbnail(k.S3.Object.Key, k.S3.Object.ETag); err != nil {
-					// Something happened while generating or uploading the thumbnail
-					log.Error(err)
-					continue
-				}
+	obj, info, err := store.Get(context.Background(), bucket, key)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		return err
+	}
+
+	_, err = store.Put(context.Background(), bucket, key, bytes.NewReader(data), int64(len(data)), s3photoalbum.PutOptions{
+		ContentType: info.ContentType,
+		Metadata:    metadata,
+	})
+	return err
+}
+
+// updateIndex indexes the media with the key after trying to create its
+// thumbnail, thumbErr is the error that occurred doing so
+func updateIndex(key string, thumbErr error) {
+
+	if err := index.Update(context.Background(), key); err != nil {
+		log.Error("Failed to index: ", key, err)
+		return
+	}
+
+	if thumbErr != nil {
+		if err := index.SetThumbnailFailed(key); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// watchMedia listens for bucket notifications and creates thumbnails for new
+// media until ctx is canceled
+func watchMedia(ctx context.Context) {
+
+	for notification := range store.Watch(ctx, config.S3MediaBucket) {
+		if notification.Err != nil {
+			log.Error(notification.Err)
+			continue
+		}
+
+		if notification.Event == s3photoalbum.EventRemoved {
+			if err := index.Remove(notification.Key); err != nil {
+				log.Error(err)
+			}
+			continue
+		}
+
+		var err error
+		if !checkBucketKeyExists(notification.Key+".jpg", config.S3ThumbnailBucket) {
+
+			// No thumbnails exists yet, generate and upload
+			if err = makeThumbnail(notification.Key, notification.ETag); err != nil {
+				// Something happened while generating or uploading the thumbnail
+				log.Error(err)
 			}
 		}
+		updateIndex(notification.Key, err)
 	}
 }
 
+func main() {
+
+	config = s3photoalbum.LoadThumbnailerConfig()
+	log = s3photoalbum.NewLogger(config.ModeDevelop)
+
+	var err error
+
+	// Initialize storage backend
+	store, err = s3photoalbum.NewMediaStore(config.CommonConfig, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	if config.GeonamesCities != "" {
+		gazetteer, err = s3photoalbum.LoadGazetteer(config.GeonamesCities, config.GeonamesAdmin1, config.GeonamesCountries)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// The media index shared with the server
+	db, err := s3photoalbum.OpenDatabase(config.DatabasePath)
+	if err != nil {
+		panic(err)
+	}
+	index = &s3photoalbum.Index{
+		DB:              db,
+		Store:           store,
+		MediaBucket:     config.S3MediaBucket,
+		ThumbnailBucket: config.S3ThumbnailBucket,
+		CoverStrategy:   config.CoverStrategy,
+	}
+
+	backfillThumbnails()
+	backfillMetadata()
+
+	// Listen for bucket notifications
+	watchMedia(context.Background())
+}
+
 func checkBucketKeyExists(key, bucket string) bool {
-	_, err := minioClient.StatObject(context.Background(), bucket, key, minio.StatObjectOptions{})
+	_, err := store.Stat(context.Background(), bucket, key)
 
-	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+	if err != nil && !errors.Is(err, s3photoalbum.ErrNotExist) {
 		log.Error(err)
 	}
 	return err == nil
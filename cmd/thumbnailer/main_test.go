@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"s3photoalbum/internal"
+	"s3photoalbum/internal/s3test"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	testMediaBucket = "media"
+	testThumbBucket = "thumbnails"
+)
+
+// fakeFfmpegThumbnailer "generates" a thumbnail by copying the input file,
+// prefixed with "thumb:". Files containing "broken" fail.
+const fakeFfmpegThumbnailer = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+		-i) in="$2"; shift ;;
+		-o) out="$2"; shift ;;
+	esac
+	shift
+done
+grep -q broken "$in" && exit 1
+{ printf 'thumb:'; cat "$in"; } > "$out"
+`
+
+// fakeExiftool reports orientation 1 for every file and accepts writes. The
+// EXIF metadata is only reported for files containing "exif", files
+// containing "long" report more than fits into the metadata of S3.
+const fakeExiftool = `#!/bin/sh
+case "$*" in
+	*-Orientation=*) exit 0 ;;
+	*-DateTimeOriginal*)
+		for last; do :; done
+		if grep -q exif "$last"; then
+			cat <<JSON
+[{
+  "SourceFile": "$last",
+  "DateTimeOriginal": "0000-00-00T00:00:00",
+  "CreateDate": "2021-06-01T12:30:00",
+  "ImageWidth": 4000,
+  "ImageHeight": 3000,
+  "Keywords": ["Beach","Summer"],
+  "Subject": "Sea",
+  "Model": "Canon EOS R6",
+  "LensModel": "RF24-105mm F4 L IS USM",
+  "ExposureTime": 0.004,
+  "FNumber": 4.0,
+  "ISO": 200,
+  "FocalLength": 24.0,
+  "GPSLatitude": -33.8568,
+  "GPSLongitude": 151.2153,
+  "GPSAltitude": 12.5
+}]
+JSON
+		elif grep -q long "$last"; then
+			printf '[{"SourceFile": "%s", "Keywords": [' "$last"
+			i=0
+			while [ $i -lt 100 ]; do printf '"Schlüsselwort %d",' $i; i=$((i+1)); done
+			printf '"Ende"], "Model": "%0700d", "LensModel": "%0700d"}]' 0 0
+		else
+			echo "[{\"SourceFile\": \"$last\"}]"
+		fi ;;
+	*) echo 1 ;;
+esac
+`
+
+func writeScript(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// setupTestThumbnailer configures the thumbnailer to use a fake S3 server
+// with the given media objects and fake thumbnailing tools
+func setupTestThumbnailer(t *testing.T, media map[string]string, thumbs []string) *s3test.Server {
+	t.Helper()
+
+	log = zap.NewNop().Sugar()
+
+	s3 := s3test.NewServer()
+	t.Cleanup(s3.Close)
+
+	s3.CreateBucket(testMediaBucket)
+	s3.CreateBucket(testThumbBucket)
+	for key, content := range media {
+		if err := s3.PutObject(testMediaBucket, key, []byte(content), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range thumbs {
+		if err := s3.PutObject(testThumbBucket, key, []byte("existing"), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	toolsDir := t.TempDir()
+	config = s3photoalbum.ThumbnailerConfig{
+		CommonConfig: s3photoalbum.CommonConfig{
+			StorageBackend:    "s3",
+			S3Endpoint:        s3.Endpoint,
+			S3AccessKey:       "access",
+			S3SecretKey:       "secretkey",
+			S3MediaBucket:     testMediaBucket,
+			S3ThumbnailBucket: testThumbBucket,
+			S3UseSsl:          false,
+		},
+		ThumbnailSize:         "300",
+		FfmpegThumbnailerPath: writeScript(t, toolsDir, "ffmpegthumbnailer", fakeFfmpegThumbnailer),
+		ExifToolPath:          writeScript(t, toolsDir, "exiftool", fakeExiftool),
+	}
+
+	var err error
+	if store, err = s3photoalbum.NewMediaStore(config.CommonConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := s3photoalbum.OpenDatabase(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index = &s3photoalbum.Index{
+		DB:              db,
+		Store:           store,
+		MediaBucket:     testMediaBucket,
+		ThumbnailBucket: testThumbBucket,
+	}
+
+	return s3
+}
+
+func TestGetMissingThumbnails(t *testing.T) {
+	setupTestThumbnailer(t, map[string]string{
+		"alice/summer/a.jpg": "a",
+		"alice/summer/b.jpg": "b",
+		"alice/winter/c.mp4": "c",
+	}, []string{
+		"alice/summer/a.jpg.jpg",
+		"alice/deleted/d.jpg.jpg",
+	})
+
+	missing := getMissingThumbnails()
+	sort.Strings(missing)
+
+	expected := []string{"alice/summer/b.jpg", "alice/winter/c.mp4"}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Errorf("expected %v, got %v", expected, missing)
+	}
+}
+
+func TestBackfillThumbnails(t *testing.T) {
+	s3 := setupTestThumbnailer(t, map[string]string{
+		"alice/summer/a.jpg":       "a",
+		"alice/summer/b.jpg":       "b",
+		"alice/summer/space s.jpg": "s",
+		"alice/summer/exif.jpg":    "exif",
+		"alice/summer/broken.jpg":  "broken",
+		"alice/summer/long.jpg":    "long",
+	}, []string{
+		"alice/summer/a.jpg.jpg",
+	})
+
+	// Without region and country names the codes are stored
+	cities := filepath.Join(t.TempDir(), "cities1000.txt")
+	if err := os.WriteFile(cities, []byte("2147714\tSydney\tSydney\t\t-33.86785\t151.20732\tP\tPPLA\tAU\t\t02\t\t\t\t4627345\t\t58\tAustralia/Sydney\t2021-01-01\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if gazetteer, err = s3photoalbum.LoadGazetteer(cities, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gazetteer = nil })
+
+	backfillThumbnails()
+
+	expected := map[string]string{
+		"alice/summer/a.jpg.jpg":       "existing",
+		"alice/summer/b.jpg.jpg":       "thumb:b",
+		"alice/summer/space s.jpg.jpg": "thumb:s",
+		"alice/summer/exif.jpg.jpg":    "thumb:exif",
+		"alice/summer/long.jpg.jpg":    "thumb:long",
+	}
+
+	if keys := s3.Keys(testThumbBucket); len(keys) != len(expected) {
+		t.Errorf("expected %d thumbnails, got %v", len(expected), keys)
+	}
+
+	for key, content := range expected {
+		obj := s3.GetObject(testThumbBucket, key)
+		if obj == nil {
+			t.Errorf("thumbnail %s missing", key)
+			continue
+		}
+		if string(obj.Data) != content {
+			t.Errorf("thumbnail %s: expected content %q, got %q", key, content, obj.Data)
+		}
+		if obj.ContentType != "image/jpeg" {
+			t.Errorf("thumbnail %s: unexpected content type %s", key, obj.ContentType)
+		}
+	}
+
+	if metadata := s3.GetObject(testThumbBucket, "alice/summer/exif.jpg.jpg").Metadata; !reflect.DeepEqual(metadata, map[string]string{
+		s3photoalbum.MetadataCaptureTime:  "2021-06-01T12:30:00",
+		s3photoalbum.MetadataWidth:        "4000",
+		s3photoalbum.MetadataHeight:       "3000",
+		s3photoalbum.MetadataKeywords:     "Beach,Summer,Sea",
+		s3photoalbum.MetadataCameraModel:  "Canon+EOS+R6",
+		s3photoalbum.MetadataLensModel:    "RF24-105mm+F4+L+IS+USM",
+		s3photoalbum.MetadataExposureTime: "0.004",
+		s3photoalbum.MetadataFNumber:      "4",
+		s3photoalbum.MetadataISO:          "200",
+		s3photoalbum.MetadataFocalLength:  "24",
+		s3photoalbum.MetadataLatitude:     "-33.8568",
+		s3photoalbum.MetadataLongitude:    "151.2153",
+		s3photoalbum.MetadataAltitude:     "12.5",
+		s3photoalbum.MetadataCity:         "Sydney",
+		s3photoalbum.MetadataRegion:       "02",
+		s3photoalbum.MetadataCountry:      "AU",
+		s3photoalbum.MetadataVersion:      s3photoalbum.MetadataVersionCurrent,
+	}) {
+		t.Errorf("unexpected metadata %v", metadata)
+	}
+	if metadata := s3.GetObject(testThumbBucket, "alice/summer/b.jpg.jpg").Metadata; !reflect.DeepEqual(metadata, map[string]string{
+		s3photoalbum.MetadataVersion: s3photoalbum.MetadataVersionCurrent,
+	}) {
+		t.Errorf("unexpected metadata %v", metadata)
+	}
+
+	// Metadata exceeding the limit is left out, starting with the lens
+	metadata := s3.GetObject(testThumbBucket, "alice/summer/long.jpg.jpg").Metadata
+	if _, ok := metadata[s3photoalbum.MetadataLensModel]; ok || metadata[s3photoalbum.MetadataCameraModel] == "" ||
+		!strings.HasPrefix(metadata[s3photoalbum.MetadataKeywords], "Schl%C3%BCsselwort+0,") ||
+		s3photoalbum.MetadataSize(metadata) > s3photoalbum.MaxMetadataSize {
+		t.Errorf("unexpected metadata %v", metadata)
+	}
+
+	// Only the media with a new thumbnail is indexed
+	var items []s3photoalbum.MediaItem
+	if err := index.DB.Order("key").Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	status := map[string]string{}
+	for _, item := range items {
+		status[item.Name] = item.ThumbnailStatus
+	}
+	if expected := map[string]string{
+		"b.jpg":       s3photoalbum.ThumbnailReady,
+		"space s.jpg": s3photoalbum.ThumbnailReady,
+		"exif.jpg":    s3photoalbum.ThumbnailReady,
+		"broken.jpg":  s3photoalbum.ThumbnailFailed,
+		"long.jpg":    s3photoalbum.ThumbnailReady,
+	}; !reflect.DeepEqual(status, expected) {
+		t.Errorf("expected index %v, got %v", expected, status)
+	}
+
+	var exif s3photoalbum.MediaItem
+	if err := index.DB.Where("key = ?", "alice/summer/exif.jpg").First(&exif).Error; err != nil {
+		t.Fatal(err)
+	}
+	if exif.CaptureTime == nil || exif.CaptureTime.Format(s3photoalbum.CaptureTimeFormat) != "2021-06-01T12:30:00" ||
+		exif.Width != 4000 || exif.Height != 3000 || exif.Owner != "alice" || exif.Album != "summer" ||
+		exif.CameraModel != "Canon EOS R6" || exif.LensModel != "RF24-105mm F4 L IS USM" ||
+		exif.ExposureTime != 0.004 || exif.FNumber != 4 || exif.ISO != 200 || exif.FocalLength != 24 ||
+		exif.Latitude == nil || *exif.Latitude != -33.8568 || exif.Longitude == nil || *exif.Longitude != 151.2153 ||
+		exif.City != "Sydney" || exif.Country != "AU" {
+		t.Errorf("unexpected item %+v", exif)
+	}
+}
+
+func TestBackfillMetadata(t *testing.T) {
+	s3 := setupTestThumbnailer(t, map[string]string{
+		"alice/summer/old.jpg":     "exif",
+		"alice/summer/current.jpg": "exif",
+	}, []string{
+		"alice/summer/old.jpg.jpg",
+		"alice/deleted/orphan.jpg.jpg",
+	})
+	if err := s3.PutObjectWithMetadata(testThumbBucket, "alice/summer/current.jpg.jpg", []byte("existing"), "image/jpeg", map[string]string{
+		s3photoalbum.MetadataVersion: s3photoalbum.MetadataVersionCurrent,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if outdated, unnamed := getOutdatedThumbnails(); !reflect.DeepEqual(outdated, []string{"alice/summer/old.jpg"}) || len(unnamed) != 0 {
+		t.Errorf("unexpected outdated thumbnails %v, %v", outdated, unnamed)
+	}
+
+	backfillMetadata()
+
+	old := s3.GetObject(testThumbBucket, "alice/summer/old.jpg.jpg")
+	if string(old.Data) != "thumb:exif" || old.Metadata[s3photoalbum.MetadataCaptureTime] != "2021-06-01T12:30:00" ||
+		old.Metadata[s3photoalbum.MetadataVersion] != s3photoalbum.MetadataVersionCurrent {
+		t.Errorf("thumbnail not made again: %q %v", old.Data, old.Metadata)
+	}
+	for _, key := range []string{"alice/summer/current.jpg.jpg", "alice/deleted/orphan.jpg.jpg"} {
+		if obj := s3.GetObject(testThumbBucket, key); string(obj.Data) != "existing" {
+			t.Errorf("thumbnail %s made again", key)
+		}
+	}
+
+	var items []s3photoalbum.MediaItem
+	if err := index.DB.Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Name != "old.jpg" || items[0].CaptureTime == nil || items[0].ThumbnailStatus != s3photoalbum.ThumbnailReady {
+		t.Errorf("unexpected index %+v", items)
+	}
+}
+
+func TestBackfillPlaces(t *testing.T) {
+	s3 := setupTestThumbnailer(t, map[string]string{
+		"alice/summer/sydney.jpg": "sydney",
+		"alice/summer/ocean.jpg":  "ocean",
+	}, nil)
+	for key, position := range map[string][2]string{
+		"alice/summer/sydney.jpg.jpg": {"-33.8568", "151.2153"},
+		"alice/summer/ocean.jpg.jpg":  {"-40", "170"},
+	} {
+		if err := s3.PutObjectWithMetadata(testThumbBucket, key, []byte("existing"), "image/jpeg", map[string]string{
+			s3photoalbum.MetadataLatitude:  position[0],
+			s3photoalbum.MetadataLongitude: position[1],
+			s3photoalbum.MetadataVersion:   s3photoalbum.MetadataVersionCurrent,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without the gazetteer the places are left alone
+	if outdated, unnamed := getOutdatedThumbnails(); len(outdated) != 0 || len(unnamed) != 0 {
+		t.Errorf("unexpected outdated thumbnails %v, %v", outdated, unnamed)
+	}
+
+	cities := filepath.Join(t.TempDir(), "cities1000.txt")
+	if err := os.WriteFile(cities, []byte("2147714\tSydney\tSydney\t\t-33.86785\t151.20732\tP\tPPLA\tAU\t\t02\t\t\t\t4627345\t\t58\tAustralia/Sydney\t2021-01-01\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if gazetteer, err = s3photoalbum.LoadGazetteer(cities, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gazetteer = nil })
+
+	backfillMetadata()
+
+	sydney := s3.GetObject(testThumbBucket, "alice/summer/sydney.jpg.jpg")
+	if string(sydney.Data) != "existing" || sydney.ContentType != "image/jpeg" || sydney.Metadata[s3photoalbum.MetadataCity] != "Sydney" ||
+		sydney.Metadata[s3photoalbum.MetadataLatitude] != "-33.8568" {
+		t.Errorf("place not named: %q %v", sydney.Data, sydney.Metadata)
+	}
+	if ocean := s3.GetObject(testThumbBucket, "alice/summer/ocean.jpg.jpg"); ocean.Metadata[s3photoalbum.MetadataCity] != "" {
+		t.Errorf("unexpected place %v", ocean.Metadata)
+	}
+
+	var item s3photoalbum.MediaItem
+	if err := index.DB.Where("key = ?", "alice/summer/sydney.jpg").First(&item).Error; err != nil {
+		t.Fatal(err)
+	}
+	if item.City != "Sydney" || item.Country != "AU" {
+		t.Errorf("unexpected item %+v", item)
+	}
+}
+
+func TestWatchMedia(t *testing.T) {
+	s3 := setupTestThumbnailer(t, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchMedia(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if err := s3.WaitForListener(testMediaBucket, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s3.PutObject(testMediaBucket, "alice/new/upload.jpg", []byte("new"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := s3.WaitForObject(testThumbBucket, "alice/new/upload.jpg.jpg", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(obj.Data) != "thumb:new" {
+		t.Errorf("unexpected thumbnail content %q", obj.Data)
+	}
+
+	// The item is indexed after the upload of the thumbnail
+	waitForIndex := func(expected int64) {
+		t.Helper()
+		var count int64
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if err := index.DB.Model(&s3photoalbum.MediaItem{}).Count(&count).Error; err != nil {
+				t.Fatal(err)
+			}
+			if count == expected {
+				return
+			}
+		}
+		t.Fatalf("expected %d indexed items, got %d", expected, count)
+	}
+	waitForIndex(1)
+
+	s3.RemoveObject(testMediaBucket, "alice/new/upload.jpg")
+	waitForIndex(0)
+}
@@ -39,8 +39,10 @@
             version = "0.1";
 
             src = ./.;
-            vendorHash = "sha256-cMqP+GeHrLNr61lmGC7//qlYbyV15Qoo1c4Rw2VCRjY=";
+            vendorHash = "sha256-qD03T96dH+XRfqU2rUgeYIJsa2T4gsUVT3qQ2lgQwg4=";
             subPackages = [ "cmd/server" "cmd/thumbnailer" ];
+            # Full-text search of the server
+            tags = [ "sqlite_fts5" ];
             installPhase = ''
               mkdir -p $out/share
               cp -r /build/go/bin $out
@@ -2,18 +2,53 @@ package s3photoalbum
 
 import (
 	"github.com/kelseyhightower/envconfig"
+	"time"
 )
 
 type CommonConfig struct {
-	S3Endpoint        string `split_words:"true" required:"true"`
-	S3AccessKey       string `split_words:"true" required:"true"`
-	S3SecretKey       string `split_words:"true" required:"true"`
+	StorageBackend    string `split_words:"true" default:"s3"`
+	StorageDir        string `split_words:"true" default:"."`
+	DatabasePath      string `split_words:"true" default:"data.db"`
+	S3Endpoint        string `split_words:"true"`
+	S3AccessKey       string `split_words:"true"`
+	S3SecretKey       string `split_words:"true"`
 	S3MediaBucket     string `split_words:"true" required:"true"`
 	S3ThumbnailBucket string `split_words:"true" required:"true"`
 	S3UseSsl          bool   `split_words:"true" default:"true"`
 	ModeDevelop       bool   `split_words:"true" default:"false"`
+
+	// How the cover of albums without a cover chosen by the user is picked,
+	// CoverFirst, CoverNewest or CoverRandomDaily
+	CoverStrategy string `split_words:"true" default:"first"`
+}
+
+// Values of CommonConfig.CoverStrategy
+const (
+	// The first media by name
+	CoverFirst = "first"
+	// The media taken or uploaded last
+	CoverNewest = "newest"
+	// A random media, changing every day
+	CoverRandomDaily = "random-daily"
+)
+
+// checkCommonConfig panics for invalid values
+func checkCommonConfig(config CommonConfig) {
+	switch config.CoverStrategy {
+	case CoverFirst, CoverNewest, CoverRandomDaily:
+	default:
+		panic("invalid cover strategy " + config.CoverStrategy)
+	}
 }
 
+// Values of ServerConfig.MediaDelivery
+const (
+	// Redirect the browsers to presigned URLs of the storage
+	MediaDeliveryRedirect = "redirect"
+	// Stream the media through the server
+	MediaDeliveryProxy = "proxy"
+)
+
 type ServerConfig struct {
 	CommonConfig
 
@@ -24,6 +59,29 @@ type ServerConfig struct {
 	Host          string `split_words:"true" default:"localhost"`
 	ListenAddress string `split_words:"true" default:"127.0.0.1"`
 	ListenPort    string `split_words:"true" default:"7788"`
+	PageSize      int    `split_words:"true" default:"100"`
+
+	// How media is delivered to the browsers, MediaDeliveryRedirect or
+	// MediaDeliveryProxy
+	MediaDelivery string `split_words:"true" default:"redirect"`
+
+	// Maximum number of cached presigned URLs
+	PresignCacheSize int `split_words:"true" default:"10000"`
+
+	// Interval in which the media index is compared to the buckets
+	ReconcileInterval time.Duration `split_words:"true" default:"5m"`
+
+	// Directory for the data of chunked uploads, defaults to a directory in
+	// the system's temporary directory
+	UploadDir string `split_words:"true"`
+
+	// Maximum size of uploaded files in bytes, 0 for no limit
+	MaxUploadSize int64 `split_words:"true" default:"10737418240"`
+
+	// Tiles of the map pages, with {z}, {x} and {y} replaced by Leaflet, and
+	// the attribution shown on the map as HTML
+	TileURL         string `split_words:"true" default:"https://tile.openstreetmap.org/{z}/{x}/{y}.png"`
+	TileAttribution string `split_words:"true" default:"&copy; <a href=\"https://www.openstreetmap.org/copyright\">OpenStreetMap</a> contributors"`
 }
 
 type ThumbnailerConfig struct {
@@ -31,6 +89,12 @@ type ThumbnailerConfig struct {
 	ThumbnailSize         string `split_words:"true" default:"300"`
 	FfmpegThumbnailerPath string `split_words:"true" required:"true"`
 	ExifToolPath          string `split_words:"true" required:"true"`
+
+	// GeoNames files to name the places of geotagged media, see
+	// LoadGazetteer. Places are not named without the cities file.
+	GeonamesCities    string `split_words:"true"`
+	GeonamesAdmin1    string `split_words:"true"`
+	GeonamesCountries string `split_words:"true"`
 }
 
 func LoadServerConfig() (config ServerConfig) {
@@ -38,6 +102,10 @@ func LoadServerConfig() (config ServerConfig) {
 	if err != nil {
 		panic(err.Error())
 	}
+	if config.MediaDelivery != MediaDeliveryRedirect && config.MediaDelivery != MediaDeliveryProxy {
+		panic("invalid media delivery " + config.MediaDelivery)
+	}
+	checkCommonConfig(config.CommonConfig)
 	return
 }
 
@@ -46,5 +114,6 @@ func LoadThumbnailerConfig() (config ThumbnailerConfig) {
 	if err != nil {
 		panic(err.Error())
 	}
+	checkCommonConfig(config.CommonConfig)
 	return
 }
@@ -0,0 +1,482 @@
+package s3photoalbum
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PresignDispositionParam is the parameter of presigned URLs that sets the
+// Content-Disposition of the response, like S3 does
+const PresignDispositionParam = "response-content-disposition"
+
+// FilesystemPresignPath is the path under which the server serves the URLs
+// created by FilesystemStore.Presign
+const FilesystemPresignPath = "/media"
+
+// FilesystemStore is a MediaStore backed by a local directory tree. Every
+// bucket is a directory below Root, the keys are the relative file paths
+// within it.
+type FilesystemStore struct {
+	Root string
+
+	// Key used to sign the URLs returned by Presign. Only needed if the
+	// store is used to generate URLs.
+	SigningKey []byte
+
+	// Interval in which the directory tree is scanned for changes by Watch
+	WatchInterval time.Duration
+}
+
+func NewFilesystemStore(root string, signingKey []byte) (*FilesystemStore, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &FilesystemStore{
+		Root:          root,
+		SigningKey:    signingKey,
+		WatchInterval: 10 * time.Second,
+	}, nil
+}
+
+func checkBucketName(bucket string) error {
+	if bucket == "" || strings.ContainsAny(bucket, "/\\") || bucket == "." || bucket == ".." {
+		return fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	return nil
+}
+
+// filePath returns the location of key in bucket on disk. Keys trying to
+// escape the bucket directory are rejected.
+func (s *FilesystemStore) filePath(bucket, key string) (string, error) {
+	if err := checkBucketName(bucket); err != nil {
+		return "", err
+	}
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || cleaned != "/"+strings.TrimSuffix(key, "/") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(s.Root, bucket, filepath.FromSlash(cleaned)), nil
+}
+
+// FilePath returns the location of an existing object on disk
+func (s *FilesystemStore) FilePath(bucket, key string) (string, error) {
+	p, err := s.filePath(bucket, key)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(p)
+	if err != nil || info.IsDir() {
+		return "", ErrNotExist
+	}
+	return p, nil
+}
+
+func (s *FilesystemStore) objectInfo(key string, info fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		ETag:         fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size()),
+		ContentType:  mime.TypeByExtension(path.Ext(key)),
+		LastModified: info.ModTime(),
+	}
+}
+
+// metadataPath returns the location of the hidden file storing the
+// user-defined metadata of the object at p
+func metadataPath(p string) string {
+	return filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".meta")
+}
+
+func readMetadata(p string) (map[string]string, error) {
+	data, err := os.ReadFile(metadataPath(p))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var metadata map[string]string
+	return metadata, json.Unmarshal(data, &metadata)
+}
+
+// writeMetadata replaces the metadata of the object at p, removing the file
+// if there is none
+func writeMetadata(p string, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		if err := os.Remove(metadataPath(p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	lower := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		lower[strings.ToLower(k)] = v
+	}
+	data, err := json.Marshal(lower)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metadataPath(p), data, 0644)
+}
+
+// listKeys returns all objects below prefix in lexical order, as S3 would
+func (s *FilesystemStore) listKeys(bucket string, opts ListOptions) ([]ObjectInfo, error) {
+
+	if err := checkBucketName(bucket); err != nil {
+		return nil, err
+	}
+	if opts.Prefix != "" && path.Clean("/"+opts.Prefix) != "/"+strings.TrimSuffix(opts.Prefix, "/") {
+		return nil, fmt.Errorf("invalid prefix %q", opts.Prefix)
+	}
+
+	// Start walking in the directory in which the prefix ends, the rest of
+	// it is matched against the names in there
+	bucketDir := filepath.Join(s.Root, bucket)
+	start := filepath.Join(bucketDir, filepath.FromSlash(path.Dir("/"+opts.Prefix+"x")))
+
+	var ret []ObjectInfo
+
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if p == start {
+			return nil
+		}
+
+		// Hidden files are used for in-progress uploads
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(bucketDir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			key += "/"
+			// Only descend into directories that can contain matches
+			if !strings.HasPrefix(key, opts.Prefix) && !strings.HasPrefix(opts.Prefix, key) {
+				return filepath.SkipDir
+			}
+			if !opts.Recursive && strings.HasPrefix(key, opts.Prefix) {
+				ret = append(ret, ObjectInfo{Key: key, IsPrefix: true})
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasPrefix(key, opts.Prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		object := s.objectInfo(key, info)
+		if opts.WithMetadata {
+			if object.Metadata, err = readMetadata(p); err != nil {
+				return err
+			}
+		}
+		ret = append(ret, object)
+		return nil
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+
+	if opts.StartAfter != "" {
+		i := sort.Search(len(ret), func(i int) bool { return ret[i].Key > opts.StartAfter })
+		ret = ret[i:]
+	}
+	return ret, err
+}
+
+func (s *FilesystemStore) List(ctx context.Context, bucket string, opts ListOptions) <-chan ObjectInfo {
+
+	ret := make(chan ObjectInfo)
+
+	go func() {
+		defer close(ret)
+
+		objects, err := s.listKeys(bucket, opts)
+		if err != nil {
+			objects = []ObjectInfo{{Err: err}}
+		}
+
+		for _, object := range objects {
+			select {
+			case ret <- object:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ret
+}
+
+func (s *FilesystemStore) Stat(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	p, err := s.FilePath(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	object := s.objectInfo(key, info)
+	object.Metadata, err = readMetadata(p)
+	return object, err
+}
+
+func (s *FilesystemStore) Get(ctx context.Context, bucket, key string) (io.ReadCloser, ObjectInfo, error) {
+	p, err := s.FilePath(bucket, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, err
+	}
+	object := s.objectInfo(key, info)
+	if object.Metadata, err = readMetadata(p); err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return file, object, nil
+}
+
+func (s *FilesystemStore) Put(ctx context.Context, bucket, key string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	p, err := s.filePath(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// Write to a hidden temporary file first, so that partial uploads never
+	// show up in listings
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return ObjectInfo{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := writeMetadata(p, opts.Metadata); err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return s.Stat(ctx, bucket, key)
+}
+
+func (s *FilesystemStore) Copy(ctx context.Context, bucket, srcKey, dstKey string) (ObjectInfo, error) {
+	r, object, err := s.Get(ctx, bucket, srcKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer r.Close()
+
+	return s.Put(ctx, bucket, dstKey, r, object.Size, PutOptions{
+		ContentType: object.ContentType,
+		Metadata:    object.Metadata,
+	})
+}
+
+// presignSignature computes the signature for an URL created by Presign.
+// The Content-Disposition to respond with is signed too, if set.
+func (s *FilesystemStore) presignSignature(bucket, key, expires, disposition string) string {
+	mac := hmac.New(sha256.New, s.SigningKey)
+	mac.Write([]byte(bucket + "\n" + key + "\n" + expires))
+	if disposition != "" {
+		mac.Write([]byte("\n" + disposition))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Presign returns an URL relative to the server. The server has to handle
+// requests to FilesystemPresignPath and check them with VerifyPresigned.
+func (s *FilesystemStore) Presign(ctx context.Context, bucket, key string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	if len(s.SigningKey) == 0 {
+		return nil, errors.New("no signing key configured")
+	}
+	if _, err := s.FilePath(bucket, key); err != nil {
+		return nil, err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	query.Set("expires", expires)
+	query.Set("signature", s.presignSignature(bucket, key, expires, query.Get(PresignDispositionParam)))
+
+	return &url.URL{
+		Path:     path.Join(FilesystemPresignPath, bucket, key),
+		RawQuery: query.Encode(),
+	}, nil
+}
+
+// VerifyPresigned checks the query parameters of a request to an URL
+// returned by Presign
+func (s *FilesystemStore) VerifyPresigned(bucket, key string, query url.Values) error {
+	if len(s.SigningKey) == 0 {
+		return errors.New("no signing key configured")
+	}
+
+	expires := query.Get("expires")
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errors.New("invalid expiry")
+	}
+	if time.Now().Unix() > expiresAt {
+		return errors.New("URL expired")
+	}
+
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return errors.New("invalid signature")
+	}
+	expected, _ := hex.DecodeString(s.presignSignature(bucket, key, expires, query.Get(PresignDispositionParam)))
+	if !hmac.Equal(signature, expected) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func (s *FilesystemStore) Delete(ctx context.Context, bucket, key string) error {
+	p, err := s.filePath(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := writeMetadata(p, nil); err != nil {
+		return err
+	}
+
+	// Remove directories that became empty, S3 has no empty prefixes either
+	bucketDir := filepath.Join(s.Root, bucket)
+	for dir := filepath.Dir(p); dir != bucketDir && strings.HasPrefix(dir, bucketDir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Watch polls the bucket directory every WatchInterval, there is no portable
+// way to get notified about changes on network filesystems.
+func (s *FilesystemStore) Watch(ctx context.Context, bucket string) <-chan Notification {
+
+	ret := make(chan Notification)
+
+	go func() {
+		defer close(ret)
+
+		snapshot := func() (map[string]string, error) {
+			objects, err := s.listKeys(bucket, ListOptions{Recursive: true})
+			state := make(map[string]string, len(objects))
+			for _, o := range objects {
+				state[o.Key] = o.ETag
+			}
+			return state, err
+		}
+
+		send := func(n Notification) bool {
+			select {
+			case ret <- n:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		last, err := snapshot()
+		if err != nil && !send(Notification{Err: err}) {
+			return
+		}
+
+		ticker := time.NewTicker(s.WatchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current, err := snapshot()
+			if err != nil {
+				if !send(Notification{Err: err}) {
+					return
+				}
+				continue
+			}
+
+			for key, etag := range current {
+				if last[key] != etag && !send(Notification{Event: EventCreated, Key: key, ETag: etag}) {
+					return
+				}
+			}
+			for key, etag := range last {
+				if _, ok := current[key]; !ok && !send(Notification{Event: EventRemoved, Key: key, ETag: etag}) {
+					return
+				}
+			}
+			last = current
+		}
+	}()
+
+	return ret
+}
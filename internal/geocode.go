@@ -0,0 +1,153 @@
+package s3photoalbum
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Places farther away from the nearest city of the gazetteer are not named,
+// e.g. photos taken at sea
+const maxPlaceDistance = 50.0 // km
+
+const earthRadius = 6371.0 // km
+
+// Place is the named location of geotagged media, found by reverse geocoding
+type Place struct {
+	City    string
+	Region  string
+	Country string
+}
+
+type gazetteerCity struct {
+	Latitude  float64
+	Longitude float64
+	Place     Place
+}
+
+// Gazetteer finds the nearest city of coordinates offline, in the GeoNames
+// cities data from https://download.geonames.org/export/dump/
+type Gazetteer struct {
+	// Sorted by latitude
+	cities []gazetteerCity
+}
+
+// LoadGazetteer reads a GeoNames cities file, e.g. cities1000.txt. The names
+// of the regions and countries are read from admin1CodesASCII.txt and
+// countryInfo.txt, without them the codes are used instead.
+func LoadGazetteer(citiesPath, admin1Path, countriesPath string) (*Gazetteer, error) {
+
+	// admin1CodesASCII.txt: <country>.<admin1 code>, name, ASCII name,
+	// geonameid
+	regions := map[string]string{}
+	if admin1Path != "" {
+		if err := readGeoNames(admin1Path, 2, func(fields []string) {
+			regions[fields[0]] = fields[1]
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// countryInfo.txt: ISO code, ISO3 code, ISO numeric, FIPS, name, ...
+	countries := map[string]string{}
+	if countriesPath != "" {
+		if err := readGeoNames(countriesPath, 5, func(fields []string) {
+			countries[fields[0]] = fields[4]
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// cities*.txt: geonameid, name, ASCII name, alternate names, latitude,
+	// longitude, feature class, feature code, country code, cc2, admin1 code,
+	// ...
+	g := &Gazetteer{}
+	var parseErr error
+	if err := readGeoNames(citiesPath, 11, func(fields []string) {
+		lat, errLat := strconv.ParseFloat(fields[4], 64)
+		lon, errLon := strconv.ParseFloat(fields[5], 64)
+		if errLat != nil || errLon != nil {
+			if parseErr == nil {
+				parseErr = fmt.Errorf("invalid coordinates of %s in %s", fields[1], citiesPath)
+			}
+			return
+		}
+
+		country := fields[8]
+		place := Place{City: fields[1], Region: fields[10], Country: country}
+		if name, ok := regions[country+"."+fields[10]]; ok {
+			place.Region = name
+		}
+		if name, ok := countries[country]; ok {
+			place.Country = name
+		}
+		g.cities = append(g.cities, gazetteerCity{Latitude: lat, Longitude: lon, Place: place})
+	}); err != nil {
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	sort.Slice(g.cities, func(i, j int) bool { return g.cities[i].Latitude < g.cities[j].Latitude })
+	return g, nil
+}
+
+// readGeoNames calls fn for every line of the tab-separated GeoNames file
+// with at least the number of fields, skipping comments
+func readGeoNames(path string, minFields int, fn func(fields []string)) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// The alternate names of large cities are long
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields := strings.Split(line, "\t"); len(fields) >= minFields {
+			fn(fields)
+		}
+	}
+	return scanner.Err()
+}
+
+// Lookup returns the place of the city nearest to the coordinates in degrees,
+// false if there is none within maxPlaceDistance
+func (g *Gazetteer) Lookup(latitude, longitude float64) (Place, bool) {
+
+	// Only cities within the distance in latitude can be near enough
+	band := maxPlaceDistance / earthRadius * 180 / math.Pi
+	i := sort.Search(len(g.cities), func(i int) bool { return g.cities[i].Latitude >= latitude-band })
+
+	var nearest *gazetteerCity
+	best := maxPlaceDistance
+	for ; i < len(g.cities) && g.cities[i].Latitude <= latitude+band; i++ {
+		if d := distance(latitude, longitude, g.cities[i].Latitude, g.cities[i].Longitude); d <= best {
+			nearest, best = &g.cities[i], d
+		}
+	}
+	if nearest == nil {
+		return Place{}, false
+	}
+	return nearest.Place, true
+}
+
+// distance returns the great-circle distance between two coordinates in km
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,61 @@
+package s3photoalbum
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// geoNamesCity returns a line of a GeoNames cities file
+func geoNamesCity(id, name, lat, lon, country, admin1 string) string {
+	return strings.Join([]string{id, name, name, "", lat, lon, "P", "PPL", country, "", admin1, "", "", "", "1000", "", "0", "", "2021-01-01"}, "\t") + "\n"
+}
+
+func TestGazetteer(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"cities1000.txt": geoNamesCity("2267057", "Lisbon", "38.71667", "-9.13333", "PT", "14") +
+			geoNamesCity("2268339", "Faro", "37.01869", "-7.92716", "PT", "09") +
+			geoNamesCity("3448439", "São Paulo", "-23.5475", "-46.63611", "BR", "27") +
+			geoNamesCity("4030939", "Apia", "-13.83333", "-171.76666", "WS", "11"),
+		"admin1CodesASCII.txt": "PT.14\tLisbon\tLisbon\t2267056\nBR.27\tSão Paulo\tSao Paulo\t3448433\n",
+		"countryInfo.txt":      "#ISO\tISO3\tISO-Numeric\tfips\tCountry\n#comment\nPT\tPRT\t620\tPO\tPortugal\tLisbon\nBR\tBRA\t076\tBR\tBrazil\tBrasilia\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, err := LoadGazetteer(filepath.Join(dir, "cities1000.txt"), filepath.Join(dir, "admin1CodesASCII.txt"), filepath.Join(dir, "countryInfo.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tt := range map[string]struct {
+		lat, lon float64
+		place    Place
+		ok       bool
+	}{
+		"Belém":               {38.6916, -9.2160, Place{"Lisbon", "Lisbon", "Portugal"}, true},
+		"Faro without region": {37.05, -7.9, Place{"Faro", "09", "Portugal"}, true},
+		"São Paulo":           {-23.55, -46.6, Place{"São Paulo", "São Paulo", "Brazil"}, true},
+		"without country":     {-13.8, -171.8, Place{"Apia", "11", "WS"}, true},
+		"Atlantic":            {38.7, -10.5, Place{}, false},
+	} {
+		if place, ok := g.Lookup(tt.lat, tt.lon); place != tt.place || ok != tt.ok {
+			t.Errorf("%s: expected %+v %v, got %+v %v", name, tt.place, tt.ok, place, ok)
+		}
+	}
+
+	if _, err := LoadGazetteer(filepath.Join(dir, "missing.txt"), "", ""); err == nil {
+		t.Errorf("expected error for a missing cities file")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "invalid.txt"), []byte(geoNamesCity("1", "Nowhere", "north", "0", "PT", "")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadGazetteer(filepath.Join(dir, "invalid.txt"), "", ""); err == nil {
+		t.Errorf("expected error for invalid coordinates")
+	}
+}
@@ -0,0 +1,615 @@
+package s3photoalbum
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Thumbnail states of a MediaItem
+const (
+	ThumbnailPending = "pending"
+	ThumbnailReady   = "ready"
+	ThumbnailFailed  = "failed"
+)
+
+// Metadata set by the thumbnailer on the thumbnails, in addition to
+// MetadataCaptureTime. The dimensions of the original media in pixels and
+// the camera and lens models, escaped by url.QueryEscape.
+const (
+	MetadataWidth       = "width"
+	MetadataHeight      = "height"
+	MetadataCameraModel = "camera-model"
+	MetadataLensModel   = "lens-model"
+)
+
+// Metadata set by the thumbnailer as decimal numbers: the exposure
+// time in seconds, the focal length in millimeters, the GPS position in
+// degrees (negative south and west) and meters above sea level and the
+// duration of videos in seconds
+const (
+	MetadataExposureTime = "exposure-time"
+	MetadataFNumber      = "f-number"
+	MetadataISO          = "iso"
+	MetadataFocalLength  = "focal-length"
+	MetadataLatitude     = "gps-latitude"
+	MetadataLongitude    = "gps-longitude"
+	MetadataAltitude     = "gps-altitude"
+	MetadataDuration     = "duration"
+)
+
+// Names of the place of geotagged media, found by the thumbnailer with a
+// Gazetteer and escaped by url.QueryEscape
+const (
+	MetadataCity    = "place-city"
+	MetadataRegion  = "place-region"
+	MetadataCountry = "place-country"
+)
+
+// MetadataVersion is set by the thumbnailer to MetadataVersionCurrent on the
+// thumbnails it makes, also if the EXIF data can't be read. The metadata of
+// thumbnails without it, made by older versions, is extracted again.
+const (
+	MetadataVersion        = "metadata-version"
+	MetadataVersionCurrent = "1"
+)
+
+// MediaItem is the indexed state of an object in the media bucket with a key
+// of the form <owner>/<album>/<name>
+type MediaItem struct {
+	gorm.Model
+	Key          string `gorm:"uniqueIndex;not null"`
+	Owner        string `gorm:"index:idx_media_items_album;not null"`
+	Album        string `gorm:"index:idx_media_items_album;not null"`
+	Name         string `gorm:"not null"`
+	ETag         string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+	// Nil if the media has no EXIF capture time
+	CaptureTime     *time.Time
+	Width           int
+	Height          int
+	ThumbnailStatus string `gorm:"not null;default:pending"`
+	CameraModel     string `gorm:"not null;default:''"`
+	LensModel       string `gorm:"not null;default:''"`
+	// Zero if unknown, see MetadataExposureTime for the units
+	ExposureTime float64 `gorm:"not null;default:0"`
+	FNumber      float64 `gorm:"not null;default:0"`
+	ISO          int     `gorm:"not null;default:0"`
+	FocalLength  float64 `gorm:"not null;default:0"`
+	Duration     float64 `gorm:"not null;default:0"`
+	// Nil if the media is not geotagged
+	Latitude  *float64
+	Longitude *float64
+	Altitude  *float64
+	// Empty if unknown, e.g. the GeoNames data is not configured
+	City    string `gorm:"not null;default:''"`
+	Region  string `gorm:"not null;default:''"`
+	Country string `gorm:"not null;default:''"`
+	// Tags from the EXIF keywords in the thumbnail metadata, stored as Tag
+	Keywords []string `gorm:"-"`
+}
+
+// Album is a directory of media items of a user. Albums are nested, the name
+// is the path below the user's prefix, e.g. "2021/summer". The albums are
+// derived from the media items by Index.UpdateAlbums.
+type Album struct {
+	gorm.Model
+	Owner string `gorm:"uniqueIndex:idx_albums_owner_name;index:idx_albums_owner_parent;not null"`
+	Name  string `gorm:"uniqueIndex:idx_albums_owner_name;not null"`
+	// Name of the enclosing album, empty for top-level albums
+	Parent string `gorm:"index:idx_albums_owner_parent;not null;default:''"`
+	Cover  string `gorm:"not null"`
+	// Name of the media item in the album chosen as cover by the user, empty
+	// to pick one by the configured strategy
+	CoverName string `gorm:"not null;default:''"`
+	// Shown instead of the name if set
+	Title string `gorm:"not null;default:''"`
+	// Markdown text shown on the album page
+	Description string `gorm:"not null;default:''"`
+	// Dates the media of the album was taken, nil if not set
+	StartDate *time.Time
+	EndDate   *time.Time
+	// Position in the manual order of the albums, lower first
+	Position int `gorm:"not null;default:0"`
+	// Number of media items directly in the album
+	ItemCount int
+	// Number of albums directly in the album
+	AlbumCount int
+	// Set for albums created by the users, they are kept without media. All
+	// other albums only exist as long as they or their sub-albums contain
+	// media, as S3 has no empty prefixes.
+	KeepEmpty bool `gorm:"not null;default:false"`
+}
+
+// OpenDatabase opens the sqlite database at dsn and migrates the index
+// tables. Further models of the caller can be passed to be migrated too.
+func OpenDatabase(dsn string, models ...interface{}) (*gorm.DB, error) {
+
+	// The server and the thumbnailer may write concurrently
+	if !strings.Contains(dsn, "?") {
+		dsn += "?_busy_timeout=5000"
+	}
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(append([]interface{}{&MediaItem{}, &Album{}, &Tag{}}, models...)...); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Index keeps the MediaItem and Album tables in sync with the buckets
+type Index struct {
+	DB              *gorm.DB
+	Store           MediaStore
+	MediaBucket     string
+	ThumbnailBucket string
+	// How covers are picked, see CommonConfig. Defaults to CoverFirst.
+	CoverStrategy string
+}
+
+// splitKey returns the owner, album and name of a media key. ok is false for
+// keys that are not inside an album.
+func splitKey(key string) (owner, album, name string, ok bool) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return "", "", "", false
+	}
+	album, name = path.Split(parts[1])
+	album = strings.TrimSuffix(album, "/")
+	return parts[0], album, name, album != "" && name != ""
+}
+
+// newMediaItem creates the item for an object of the media bucket. thumbnail
+// is the object of its thumbnail, nil if there is none.
+func newMediaItem(object ObjectInfo, thumbnail *ObjectInfo) (MediaItem, bool) {
+
+	owner, album, name, ok := splitKey(object.Key)
+	if !ok {
+		return MediaItem{}, false
+	}
+
+	item := MediaItem{
+		Key:             object.Key,
+		Owner:           owner,
+		Album:           album,
+		Name:            name,
+		ETag:            object.ETag,
+		Size:            object.Size,
+		ContentType:     object.ContentType,
+		LastModified:    object.LastModified.UTC(),
+		ThumbnailStatus: ThumbnailPending,
+	}
+
+	// Listings of S3 do not contain the content type
+	if item.ContentType == "" {
+		item.ContentType = mime.TypeByExtension(path.Ext(name))
+	}
+
+	if thumbnail != nil {
+		item.ThumbnailStatus = ThumbnailReady
+		setThumbnailMetadata(&item, thumbnail.Metadata)
+	}
+	return item, true
+}
+
+// setThumbnailMetadata sets the fields extracted by the thumbnailer
+func setThumbnailMetadata(item *MediaItem, metadata map[string]string) {
+	if t, err := time.Parse(CaptureTimeFormat, metadata[MetadataCaptureTime]); err == nil {
+		item.CaptureTime = &t
+	}
+	item.Width, _ = strconv.Atoi(metadata[MetadataWidth])
+	item.Height, _ = strconv.Atoi(metadata[MetadataHeight])
+	item.CameraModel, _ = url.QueryUnescape(metadata[MetadataCameraModel])
+	item.LensModel, _ = url.QueryUnescape(metadata[MetadataLensModel])
+	item.ExposureTime, _ = strconv.ParseFloat(metadata[MetadataExposureTime], 64)
+	item.FNumber, _ = strconv.ParseFloat(metadata[MetadataFNumber], 64)
+	item.ISO, _ = strconv.Atoi(metadata[MetadataISO])
+	item.FocalLength, _ = strconv.ParseFloat(metadata[MetadataFocalLength], 64)
+	item.Duration, _ = strconv.ParseFloat(metadata[MetadataDuration], 64)
+	item.Latitude = metadataFloat(metadata[MetadataLatitude])
+	item.Longitude = metadataFloat(metadata[MetadataLongitude])
+	item.Altitude = metadataFloat(metadata[MetadataAltitude])
+	// A position needs both coordinates
+	if item.Latitude == nil || item.Longitude == nil {
+		item.Latitude, item.Longitude, item.Altitude = nil, nil, nil
+	}
+	item.City, _ = url.QueryUnescape(metadata[MetadataCity])
+	item.Region, _ = url.QueryUnescape(metadata[MetadataRegion])
+	item.Country, _ = url.QueryUnescape(metadata[MetadataCountry])
+	item.Keywords = keywordTags(metadata[MetadataKeywords])
+}
+
+// metadataFloat parses a number of the thumbnail metadata, nil if it is
+// missing or invalid
+func metadataFloat(s string) *float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+
+// saveMediaItem inserts the item or updates the existing one with the same
+// key, together with its EXIF tags
+func saveMediaItem(db *gorm.DB, item MediaItem) error {
+	if err := db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"updated_at", "deleted_at", "owner", "album", "name", "e_tag", "size", "content_type",
+			"last_modified", "capture_time", "width", "height", "thumbnail_status", "camera_model", "lens_model",
+			"exposure_time", "f_number", "iso", "focal_length", "duration", "latitude", "longitude", "altitude",
+			"city", "region", "country",
+		}),
+	}).Create(&item).Error; err != nil {
+		return err
+	}
+	return saveExifTags(db, item)
+}
+
+// touchMediaItem updates the fields of an indexed item known from listing the
+// media bucket, keeping the metadata from its thumbnail and its tags
+func touchMediaItem(db *gorm.DB, item MediaItem) error {
+	return db.Model(&MediaItem{}).Where("key = ?", item.Key).Updates(map[string]interface{}{
+		"updated_at":    time.Now(),
+		"e_tag":         item.ETag,
+		"size":          item.Size,
+		"last_modified": item.LastModified,
+	}).Error
+}
+
+// Update indexes the media object with the key, with the thumbnail status
+// and metadata from its thumbnail. Removed objects are removed from the
+// index.
+func (i *Index) Update(ctx context.Context, key string) error {
+
+	object, err := i.Store.Stat(ctx, i.MediaBucket, key)
+	if errors.Is(err, ErrNotExist) {
+		return i.Remove(key)
+	}
+	if err != nil {
+		return err
+	}
+
+	var thumbnail *ObjectInfo
+	if info, err := i.Store.Stat(ctx, i.ThumbnailBucket, key+".jpg"); err == nil {
+		thumbnail = &info
+	} else if !errors.Is(err, ErrNotExist) {
+		return err
+	}
+
+	item, ok := newMediaItem(object, thumbnail)
+	if !ok {
+		return nil
+	}
+
+	// Keep the failure state until the media changes, the thumbnailer will
+	// not retry it before
+	var existing MediaItem
+	if thumbnail == nil && i.DB.Where("key = ?", key).Limit(1).Find(&existing).Error == nil &&
+		existing.ETag == item.ETag && existing.ThumbnailStatus == ThumbnailFailed {
+		item.ThumbnailStatus = ThumbnailFailed
+	}
+
+	if err := saveMediaItem(i.DB, item); err != nil {
+		return err
+	}
+	return i.UpdateAlbums(item.Owner)
+}
+
+// SetThumbnailFailed marks the thumbnail of the media item as failed
+func (i *Index) SetThumbnailFailed(key string) error {
+	return i.DB.Model(&MediaItem{}).Where("key = ?", key).Update("thumbnail_status", ThumbnailFailed).Error
+}
+
+// Remove deletes the media item with the key and its tags from the index
+func (i *Index) Remove(key string) error {
+	owner, _, _, ok := splitKey(key)
+	if !ok {
+		return nil
+	}
+	if err := i.DB.Unscoped().Where("key = ?", key).Delete(&MediaItem{}).Error; err != nil {
+		return err
+	}
+	if err := i.DB.Where("key = ?", key).Delete(&Tag{}).Error; err != nil {
+		return err
+	}
+	return i.UpdateAlbums(owner)
+}
+
+// thumbnailPath returns the path the server serves the thumbnail of the
+// media item at, used as cover. The names are escaped, as they may contain
+// e.g. "#" or "?".
+func thumbnailPath(album, name string) string {
+	return (&url.URL{Path: path.Join("/thumbnails", album, name+".jpg")}).EscapedPath()
+}
+
+// coverAggregate returns the aggregate selecting the cover of each album by
+// the cover strategy. SQLite takes the other columns from the row matching
+// a single MIN or MAX aggregate.
+func (i *Index) coverAggregate() (string, []interface{}) {
+	switch i.CoverStrategy {
+	case CoverNewest:
+		return "MAX(COALESCE(capture_time, last_modified))", nil
+	case CoverRandomDaily:
+		// Multiplying the IDs with a seed modulo a prime shuffles them, the
+		// seed changes every day
+		day := time.Now().UTC().Unix() / (24 * 60 * 60)
+		return "MIN((id * ?) % 2147483647)", []interface{}{day*2654435761%2147483646 + 1}
+	}
+	return "MIN(name)", nil
+}
+
+// UpdateAlbums recreates the albums of the owner from the media items,
+// including all enclosing albums. The cover of an album is the thumbnail of
+// the item chosen by the user, of the item picked by the cover strategy, or
+// the cover of its first sub-album that has one.
+func (i *Index) UpdateAlbums(owner string) error {
+
+	var rows []struct {
+		Album     string
+		Cover     string
+		ItemCount int
+	}
+	aggregate, args := i.coverAggregate()
+	if err := i.DB.Model(&MediaItem{}).
+		Select("album, name AS cover, "+aggregate+" AS cover_order, COUNT(*) AS item_count", args...).
+		Where("owner = ?", owner).
+		Group("album").
+		Scan(&rows).Error; err != nil {
+		return err
+	}
+
+	var keep []string
+	if err := i.DB.Model(&Album{}).Where("owner = ? AND keep_empty", owner).Pluck("name", &keep).Error; err != nil {
+		return err
+	}
+
+	albums := map[string]*Album{}
+	covers := map[string]string{}
+	for _, row := range rows {
+		covers[row.Album] = thumbnailPath(row.Album, row.Cover)
+		keep = append(keep, row.Album)
+	}
+
+	// Covers chosen by the user, as long as the item exists
+	var chosen []Album
+	if err := i.DB.Where("owner = ? AND cover_name != ''", owner).Find(&chosen).Error; err != nil {
+		return err
+	}
+	if len(chosen) > 0 {
+		keys := []string{}
+		for _, album := range chosen {
+			keys = append(keys, path.Join(owner, album.Name, album.CoverName))
+		}
+		var existing []string
+		if err := i.DB.Model(&MediaItem{}).Where("key IN ?", keys).Pluck("key", &existing).Error; err != nil {
+			return err
+		}
+		for _, key := range existing {
+			_, album, name, _ := splitKey(key)
+			covers[album] = thumbnailPath(album, name)
+		}
+	}
+	for _, name := range keep {
+		// Add the album and all enclosing ones
+		for ; name != "." && albums[name] == nil; name = path.Dir(name) {
+			albums[name] = &Album{Owner: owner, Name: name}
+			if parent := path.Dir(name); parent != "." {
+				albums[name].Parent = parent
+			}
+		}
+	}
+	for _, row := range rows {
+		albums[row.Album].ItemCount = row.ItemCount
+	}
+
+	names := make([]string, 0, len(albums))
+	for name := range albums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	children := map[string][]string{}
+	for _, name := range names {
+		if parent := albums[name].Parent; parent != "" {
+			children[parent] = append(children[parent], name)
+			albums[parent].AlbumCount++
+		}
+	}
+
+	var cover func(name string) string
+	cover = func(name string) string {
+		if c, ok := covers[name]; ok {
+			return c
+		}
+		for _, child := range children[name] {
+			if c := cover(child); c != "" {
+				return c
+			}
+		}
+		return ""
+	}
+
+	return i.DB.Transaction(func(tx *gorm.DB) error {
+		for _, name := range names {
+			album := albums[name]
+			album.Cover = cover(name)
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "owner"}, {Name: "name"}},
+				DoUpdates: clause.AssignmentColumns([]string{"updated_at", "deleted_at", "parent", "cover", "item_count", "album_count"}),
+			}).Create(album).Error; err != nil {
+				return err
+			}
+		}
+
+		query := tx.Unscoped().Where("owner = ?", owner)
+		if len(names) > 0 {
+			query = query.Where("name NOT IN ?", names)
+		}
+		return query.Delete(&Album{}).Error
+	})
+}
+
+// Number of items Reconcile writes per transaction
+var reconcileBatchSize = 500
+
+// Reconcile lists both buckets and brings the index in sync with them
+func (i *Index) Reconcile(ctx context.Context) error {
+
+	// Every item saved below gets a newer update time, all older ones have
+	// been removed from the bucket
+	start := time.Now()
+
+	thumbnails := map[string]ObjectInfo{}
+	for object := range i.Store.List(ctx, i.ThumbnailBucket, ListOptions{Recursive: true, WithMetadata: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		thumbnails[strings.TrimSuffix(object.Key, ".jpg")] = object
+	}
+
+	var indexed []MediaItem
+	if err := i.DB.Select("key", "e_tag", "thumbnail_status").Find(&indexed).Error; err != nil {
+		return err
+	}
+	existing := map[string]MediaItem{}
+	for _, item := range indexed {
+		existing[item.Key] = item
+	}
+
+	// The items are written in batches, so the thumbnailer is not blocked
+	// while listing large buckets. Unchanged items with metadata missing in
+	// the listing are only touched.
+	var saved, touched []MediaItem
+	flush := func() error {
+		err := i.DB.Transaction(func(tx *gorm.DB) error {
+			for _, item := range touched {
+				if err := touchMediaItem(tx, item); err != nil {
+					return err
+				}
+			}
+			for _, item := range saved {
+				if err := saveMediaItem(tx, item); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		saved, touched = saved[:0], touched[:0]
+		return err
+	}
+
+	for object := range i.Store.List(ctx, i.MediaBucket, ListOptions{Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+
+		var thumbnail *ObjectInfo
+		if info, ok := thumbnails[object.Key]; ok {
+			thumbnail = &info
+		}
+
+		item, ok := newMediaItem(object, thumbnail)
+		if !ok {
+			continue
+		}
+		prev, indexed := existing[item.Key]
+		unchanged := indexed && prev.ETag == item.ETag
+		if unchanged && thumbnail == nil && prev.ThumbnailStatus == ThumbnailFailed {
+			item.ThumbnailStatus = ThumbnailFailed
+		}
+
+		// Listings of S3 other than MinIO have no metadata. The metadata of
+		// unchanged items is kept, the others get it from the thumbnail
+		// itself.
+		switch {
+		case thumbnail == nil || len(thumbnail.Metadata) > 0:
+			saved = append(saved, item)
+		case unchanged && prev.ThumbnailStatus == ThumbnailReady:
+			touched = append(touched, item)
+		default:
+			info, err := i.Store.Stat(ctx, i.ThumbnailBucket, object.Key+".jpg")
+			if err != nil && !errors.Is(err, ErrNotExist) {
+				return err
+			}
+			setThumbnailMetadata(&item, info.Metadata)
+			saved = append(saved, item)
+		}
+
+		if len(saved)+len(touched) >= reconcileBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	err := i.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("updated_at < ?", start).Delete(&MediaItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("key NOT IN (?)", tx.Model(&MediaItem{}).Select("key")).Delete(&Tag{}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	// Includes the owners that have no media left
+	var owners []string
+	if err := i.DB.Model(&MediaItem{}).Distinct().Pluck("owner", &owners).Error; err != nil {
+		return err
+	}
+	var albumOwners []string
+	if err := i.DB.Model(&Album{}).Distinct().Pluck("owner", &albumOwners).Error; err != nil {
+		return err
+	}
+
+	updated := map[string]bool{}
+	for _, owner := range append(owners, albumOwners...) {
+		if updated[owner] {
+			continue
+		}
+		if err := i.UpdateAlbums(owner); err != nil {
+			return err
+		}
+		updated[owner] = true
+	}
+	return nil
+}
+
+// RunReconciler calls Reconcile every interval until ctx is canceled. Errors
+// are passed to onError.
+func (i *Index) RunReconciler(ctx context.Context, interval time.Duration, onError func(error)) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := i.Reconcile(ctx); err != nil && ctx.Err() == nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,511 @@
+package s3photoalbum
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setupTestIndex creates an index on a temporary database and filesystem
+// store with the media and thumbnail objects
+func setupTestIndex(t *testing.T, media []string, thumbnails map[string]map[string]string) *Index {
+	t.Helper()
+
+	store, err := NewFilesystemStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := &Index{DB: db, Store: store, MediaBucket: "media", ThumbnailBucket: "thumbnails"}
+	for _, key := range media {
+		putTestObject(t, index, "media", key, nil)
+	}
+	for key, metadata := range thumbnails {
+		putTestObject(t, index, "thumbnails", key, metadata)
+	}
+	return index
+}
+
+func putTestObject(t *testing.T, index *Index, bucket, key string, metadata map[string]string) {
+	t.Helper()
+	if _, err := index.Store.Put(context.Background(), bucket, key, strings.NewReader(key), int64(len(key)), PutOptions{
+		Metadata: metadata,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// indexedItems returns the thumbnail status of all indexed items by key
+func indexedItems(t *testing.T, index *Index) map[string]string {
+	t.Helper()
+	var items []MediaItem
+	if err := index.DB.Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	ret := map[string]string{}
+	for _, item := range items {
+		ret[item.Key] = item.ThumbnailStatus
+	}
+	return ret
+}
+
+// indexedAlbums returns the item count of all albums by owner/name
+func indexedAlbums(t *testing.T, index *Index) map[string]int {
+	t.Helper()
+	var albums []Album
+	if err := index.DB.Find(&albums).Error; err != nil {
+		t.Fatal(err)
+	}
+	ret := map[string]int{}
+	for _, album := range albums {
+		ret[album.Owner+"/"+album.Name] = album.ItemCount
+	}
+	return ret
+}
+
+func TestReconcile(t *testing.T) {
+	index := setupTestIndex(t, []string{
+		"alice/summer/a.jpg",
+		"alice/summer/b.jpg",
+		"alice/winter/c.jpg",
+		"bob/party/d.jpg",
+		"toplevel.jpg",
+	}, map[string]map[string]string{
+		"alice/summer/a.jpg.jpg": {MetadataCaptureTime: "2021-06-01T12:30:00", MetadataWidth: "40", MetadataHeight: "30"},
+	})
+	ctx := context.Background()
+
+	// Write the items in several batches
+	defer func(size int) { reconcileBatchSize = size }(reconcileBatchSize)
+	reconcileBatchSize = 2
+
+	if err := index.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if items, expected := indexedItems(t, index), map[string]string{
+		"alice/summer/a.jpg": ThumbnailReady,
+		"alice/summer/b.jpg": ThumbnailPending,
+		"alice/winter/c.jpg": ThumbnailPending,
+		"bob/party/d.jpg":    ThumbnailPending,
+	}; !reflect.DeepEqual(items, expected) {
+		t.Errorf("expected items %v, got %v", expected, items)
+	}
+
+	if albums, expected := indexedAlbums(t, index), map[string]int{
+		"alice/summer": 2,
+		"alice/winter": 1,
+		"bob/party":    1,
+	}; !reflect.DeepEqual(albums, expected) {
+		t.Errorf("expected albums %v, got %v", expected, albums)
+	}
+
+	var a MediaItem
+	if err := index.DB.Where("key = ?", "alice/summer/a.jpg").First(&a).Error; err != nil {
+		t.Fatal(err)
+	}
+	if a.Owner != "alice" || a.Album != "summer" || a.Name != "a.jpg" || a.ContentType != "image/jpeg" ||
+		a.CaptureTime == nil || a.CaptureTime.Format(CaptureTimeFormat) != "2021-06-01T12:30:00" ||
+		a.Width != 40 || a.Height != 30 {
+		t.Errorf("unexpected item %+v", a)
+	}
+
+	// Failed thumbnails stay failed until the media changes
+	if err := index.SetThumbnailFailed("alice/summer/b.jpg"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes made while the index was not running
+	for _, key := range []string{"alice/winter/c.jpg", "bob/party/d.jpg"} {
+		if err := index.Store.Delete(ctx, "media", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putTestObject(t, index, "media", "alice/spring/e.jpg", nil)
+
+	if err := index.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if items, expected := indexedItems(t, index), map[string]string{
+		"alice/summer/a.jpg": ThumbnailReady,
+		"alice/summer/b.jpg": ThumbnailFailed,
+		"alice/spring/e.jpg": ThumbnailPending,
+	}; !reflect.DeepEqual(items, expected) {
+		t.Errorf("expected items %v, got %v", expected, items)
+	}
+
+	if albums, expected := indexedAlbums(t, index), map[string]int{
+		"alice/summer": 2,
+		"alice/spring": 1,
+	}; !reflect.DeepEqual(albums, expected) {
+		t.Errorf("expected albums %v, got %v", expected, albums)
+	}
+}
+
+// listingWithoutMetadata lists objects without their metadata, like S3
+// other than MinIO
+type listingWithoutMetadata struct {
+	MediaStore
+}
+
+func (s listingWithoutMetadata) List(ctx context.Context, bucket string, opts ListOptions) <-chan ObjectInfo {
+	ch := make(chan ObjectInfo)
+	go func() {
+		defer close(ch)
+		for object := range s.MediaStore.List(ctx, bucket, opts) {
+			object.Metadata = nil
+			ch <- object
+		}
+	}()
+	return ch
+}
+
+func TestReconcileWithoutListedMetadata(t *testing.T) {
+	index := setupTestIndex(t, []string{"alice/summer/a.jpg"}, map[string]map[string]string{
+		"alice/summer/a.jpg.jpg": {MetadataWidth: "40", MetadataCameraModel: "Canon", MetadataKeywords: EncodeKeywords([]string{"beach"})},
+	})
+	ctx := context.Background()
+
+	if err := index.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	index.Store = listingWithoutMetadata{index.Store}
+	putTestObject(t, index, "media", "alice/summer/b.jpg", nil)
+	putTestObject(t, index, "thumbnails", "alice/summer/b.jpg.jpg", map[string]string{MetadataWidth: "50", MetadataKeywords: EncodeKeywords([]string{"sea"})})
+	if err := index.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged items keep their metadata, new ones get it from the thumbnail
+	for key, expected := range map[string]struct {
+		width int
+		tag   string
+	}{
+		"alice/summer/a.jpg": {40, "beach"},
+		"alice/summer/b.jpg": {50, "sea"},
+	} {
+		var item MediaItem
+		if err := index.DB.Where("key = ?", key).First(&item).Error; err != nil {
+			t.Fatal(err)
+		}
+		if item.Width != expected.width || item.ThumbnailStatus != ThumbnailReady {
+			t.Errorf("%s: unexpected item %+v", key, item)
+		}
+		var tags []string
+		if err := index.DB.Model(&Tag{}).Where("key = ?", key).Pluck("name", &tags).Error; err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tags, []string{expected.tag}) {
+			t.Errorf("%s: expected tags [%s], got %v", key, expected.tag, tags)
+		}
+	}
+	var a MediaItem
+	if err := index.DB.Where("key = ?", "alice/summer/a.jpg").First(&a).Error; err != nil {
+		t.Fatal(err)
+	}
+	if a.CameraModel != "Canon" {
+		t.Errorf("camera model not kept: %+v", a)
+	}
+}
+
+func TestEmptyAlbums(t *testing.T) {
+	index := setupTestIndex(t, []string{"alice/summer/a.jpg"}, nil)
+	ctx := context.Background()
+
+	if err := index.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.DB.Create(&Album{Owner: "alice", Name: "empty", KeepEmpty: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := index.DB.Model(&Album{}).Where("name = ?", "summer").Update("keep_empty", true).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := index.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if albums, expected := indexedAlbums(t, index), map[string]int{
+		"alice/summer": 1,
+		"alice/empty":  0,
+	}; !reflect.DeepEqual(albums, expected) {
+		t.Errorf("expected albums %v, got %v", expected, albums)
+	}
+
+	// Albums to keep lose their cover with the last item
+	if err := index.Store.Delete(ctx, "media", "alice/summer/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Update(ctx, "alice/summer/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	var summer Album
+	if err := index.DB.Where("name = ?", "summer").First(&summer).Error; err != nil {
+		t.Fatal(err)
+	}
+	if summer.ItemCount != 0 || summer.Cover != "" || !summer.KeepEmpty {
+		t.Errorf("unexpected album %+v", summer)
+	}
+}
+
+func TestNestedAlbums(t *testing.T) {
+	index := setupTestIndex(t, []string{
+		"alice/2021/summer/b.jpg",
+		"alice/2021/summer/a.jpg",
+		"alice/2021/winter/c.jpg",
+		"alice/2021/z.jpg",
+		"alice/2022/spring/beach/d.jpg",
+	}, nil)
+	ctx := context.Background()
+
+	if err := index.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.DB.Create(&Album{Owner: "alice", Name: "2023/empty", Parent: "2023", KeepEmpty: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := index.UpdateAlbums("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	var albums []Album
+	if err := index.DB.Order("name").Find(&albums).Error; err != nil {
+		t.Fatal(err)
+	}
+	type album struct {
+		Name, Parent, Cover   string
+		ItemCount, AlbumCount int
+	}
+	got := []album{}
+	for _, a := range albums {
+		got = append(got, album{a.Name, a.Parent, a.Cover, a.ItemCount, a.AlbumCount})
+	}
+	expected := []album{
+		{"2021", "", "/thumbnails/2021/z.jpg.jpg", 1, 2},
+		{"2021/summer", "2021", "/thumbnails/2021/summer/a.jpg.jpg", 2, 0},
+		{"2021/winter", "2021", "/thumbnails/2021/winter/c.jpg.jpg", 1, 0},
+		{"2022", "", "/thumbnails/2022/spring/beach/d.jpg.jpg", 0, 1},
+		{"2022/spring", "2022", "/thumbnails/2022/spring/beach/d.jpg.jpg", 0, 1},
+		{"2022/spring/beach", "2022/spring", "/thumbnails/2022/spring/beach/d.jpg.jpg", 1, 0},
+		{"2023", "", "", 0, 1},
+		{"2023/empty", "2023", "", 0, 0},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected albums\n%v, got\n%v", expected, got)
+	}
+
+	// Enclosing albums disappear with the last media below them
+	if err := index.Store.Delete(ctx, "media", "alice/2022/spring/beach/d.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Update(ctx, "alice/2022/spring/beach/d.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if albums, expected := indexedAlbums(t, index), map[string]int{
+		"alice/2021":        1,
+		"alice/2021/summer": 2,
+		"alice/2021/winter": 1,
+		"alice/2023":        0,
+		"alice/2023/empty":  0,
+	}; !reflect.DeepEqual(albums, expected) {
+		t.Errorf("expected albums %v, got %v", expected, albums)
+	}
+}
+
+func TestAlbumCovers(t *testing.T) {
+	index := setupTestIndex(t, []string{"alice/summer/a.jpg", "alice/summer/b.jpg", "alice/summer/c #1.jpg"}, map[string]map[string]string{
+		"alice/summer/a.jpg.jpg":    {MetadataCaptureTime: "2021-06-01T12:00:00"},
+		"alice/summer/b.jpg.jpg":    {MetadataCaptureTime: "2021-06-03T12:00:00"},
+		"alice/summer/c #1.jpg.jpg": {MetadataCaptureTime: "2021-06-02T12:00:00"},
+	})
+	ctx := context.Background()
+
+	cover := func() string {
+		t.Helper()
+		if err := index.Reconcile(ctx); err != nil {
+			t.Fatal(err)
+		}
+		var album Album
+		if err := index.DB.Where("name = ?", "summer").First(&album).Error; err != nil {
+			t.Fatal(err)
+		}
+		return album.Cover
+	}
+
+	for strategy, expected := range map[string]string{
+		"":          "/thumbnails/summer/a.jpg.jpg",
+		CoverFirst:  "/thumbnails/summer/a.jpg.jpg",
+		CoverNewest: "/thumbnails/summer/b.jpg.jpg",
+	} {
+		index.CoverStrategy = strategy
+		if got := cover(); got != expected {
+			t.Errorf("%s: expected cover %s, got %s", strategy, expected, got)
+		}
+	}
+
+	// Random covers only change with the day
+	index.CoverStrategy = CoverRandomDaily
+	random := cover()
+	if !strings.HasPrefix(random, "/thumbnails/summer/") || cover() != random {
+		t.Errorf("unexpected random cover %s", random)
+	}
+
+	// Chosen covers take precedence as long as the item exists, their names
+	// are escaped
+	if err := index.DB.Model(&Album{}).Where("name = ?", "summer").Update("cover_name", "c #1.jpg").Error; err != nil {
+		t.Fatal(err)
+	}
+	if got := cover(); got != "/thumbnails/summer/c%20%231.jpg.jpg" {
+		t.Errorf("expected chosen cover, got %s", got)
+	}
+	index.CoverStrategy = CoverFirst
+	if err := index.Store.Delete(ctx, "media", "alice/summer/c #1.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if got := cover(); got != "/thumbnails/summer/a.jpg.jpg" {
+		t.Errorf("expected fallback cover, got %s", got)
+	}
+}
+
+func TestIndexUpdate(t *testing.T) {
+	index := setupTestIndex(t, []string{"alice/summer/a.jpg"}, nil)
+	ctx := context.Background()
+
+	if err := index.Update(ctx, "alice/summer/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.SetThumbnailFailed("alice/summer/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Update(ctx, "alice/summer/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if items := indexedItems(t, index); items["alice/summer/a.jpg"] != ThumbnailFailed {
+		t.Errorf("expected failed thumbnail, got %v", items)
+	}
+
+	putTestObject(t, index, "thumbnails", "alice/summer/a.jpg.jpg", nil)
+	if err := index.Update(ctx, "alice/summer/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if items := indexedItems(t, index); items["alice/summer/a.jpg"] != ThumbnailReady {
+		t.Errorf("expected ready thumbnail, got %v", items)
+	}
+
+	// Updating a removed object removes it from the index
+	if err := index.Store.Delete(ctx, "media", "alice/summer/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Update(ctx, "alice/summer/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if items, albums := indexedItems(t, index), indexedAlbums(t, index); len(items) != 0 || len(albums) != 0 {
+		t.Errorf("expected empty index, got items %v, albums %v", items, albums)
+	}
+}
+
+func TestExifTags(t *testing.T) {
+	index := setupTestIndex(t, []string{"alice/summer/a.jpg", "alice/summer/b.jpg"}, map[string]map[string]string{
+		"alice/summer/a.jpg.jpg": {MetadataKeywords: EncodeKeywords([]string{"Beach", " Summer  Sun", "sea, sand", "a/b", "beach"})},
+	})
+	ctx := context.Background()
+
+	// indexedTags returns the tags of all items by key, manual tags prefixed
+	// with "+"
+	indexedTags := func() map[string][]string {
+		t.Helper()
+		var tags []Tag
+		if err := index.DB.Order("key, name").Find(&tags).Error; err != nil {
+			t.Fatal(err)
+		}
+		ret := map[string][]string{}
+		for _, tag := range tags {
+			name := tag.Name
+			if !tag.Exif {
+				name = "+" + name
+			}
+			ret[tag.Key] = append(ret[tag.Key], name)
+		}
+		return ret
+	}
+
+	if err := index.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if tags, expected := indexedTags(), map[string][]string{
+		"alice/summer/a.jpg": {"beach", "sand", "sea", "summer sun"},
+	}; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected tags %v, got %v", expected, tags)
+	}
+
+	// Unchanged tags are not written again, as that refreshes the search
+	// index of the items
+	tagIDs := func() []uint {
+		t.Helper()
+		var ids []uint
+		if err := index.DB.Model(&Tag{}).Order("id").Pluck("id", &ids).Error; err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	// Rewritten tags would get ids after the one of this tag
+	manual := Tag{Key: "alice/summer/b.jpg", Owner: "alice", Name: "party"}
+	if err := index.DB.Create(&manual).Error; err != nil {
+		t.Fatal(err)
+	}
+	ids := tagIDs()
+	if err := index.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if after := tagIDs(); !reflect.DeepEqual(after, ids) {
+		t.Errorf("tags rewritten: expected ids %v, got %v", ids, after)
+	}
+	if err := index.DB.Delete(&manual).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Tags of the users are kept when the EXIF tags are replaced
+	if err := index.DB.Create(&Tag{Key: "alice/summer/a.jpg", Owner: "alice", Name: "beach"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	putTestObject(t, index, "thumbnails", "alice/summer/a.jpg.jpg", map[string]string{MetadataKeywords: EncodeKeywords([]string{"Sea"})})
+	if err := index.Update(ctx, "alice/summer/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if tags, expected := indexedTags(), map[string][]string{
+		"alice/summer/a.jpg": {"+beach", "sea"},
+	}; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected tags %v, got %v", expected, tags)
+	}
+
+	// All tags are removed with the item
+	if err := index.Store.Delete(ctx, "media", "alice/summer/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if tags := indexedTags(); len(tags) != 0 {
+		t.Errorf("expected no tags, got %v", tags)
+	}
+}
+
+func TestEncodeKeywords(t *testing.T) {
+	if encoded := EncodeKeywords([]string{"Beach", "sea, sand", "Café"}); encoded != "Beach,sea%2C+sand,Caf%C3%A9" || !KeywordsFit([]string{"Beach"}) {
+		t.Errorf("unexpected keywords %q", encoded)
+	}
+
+	// Keywords past the limit are left out
+	keywords := []string{strings.Repeat("a", MaxKeywordsLength-2), "b", "c"}
+	if encoded := EncodeKeywords(keywords); encoded != keywords[0]+",b" || KeywordsFit(keywords) {
+		t.Errorf("expected the keywords to be cut, got %d characters", len(encoded))
+	}
+}
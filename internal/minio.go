@@ -0,0 +1,245 @@
+package s3photoalbum
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// MinioStore is a MediaStore backed by any S3-compatible server
+type MinioStore struct {
+	client *minio.Client
+}
+
+func NewMinioStore(endpoint, accessKey, secretKey string, useSSL bool) (*MinioStore, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MinioStore{client: client}, nil
+}
+
+// convertError maps minio errors to the errors defined by MediaStore
+func convertError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return ErrNotExist
+	}
+	return err
+}
+
+func convertObjectInfo(info minio.ObjectInfo) ObjectInfo {
+
+	// Stat returns the keys without prefix, listings with it
+	var metadata map[string]string
+	if len(info.UserMetadata) > 0 {
+		metadata = make(map[string]string, len(info.UserMetadata))
+		for k, v := range info.UserMetadata {
+			metadata[strings.TrimPrefix(strings.ToLower(k), "x-amz-meta-")] = v
+		}
+	}
+
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+		Metadata:     metadata,
+		IsPrefix:     strings.HasSuffix(info.Key, "/"),
+		Err:          info.Err,
+	}
+}
+
+func (s *MinioStore) List(ctx context.Context, bucket string, opts ListOptions) <-chan ObjectInfo {
+
+	ret := make(chan ObjectInfo)
+
+	go func() {
+		defer close(ret)
+		for object := range s.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+			Prefix:       opts.Prefix,
+			Recursive:    opts.Recursive,
+			MaxKeys:      opts.MaxKeys,
+			StartAfter:   opts.StartAfter,
+			WithMetadata: opts.WithMetadata,
+		}) {
+			select {
+			case ret <- convertObjectInfo(object):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ret
+}
+
+func (s *MinioStore) Stat(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	info, err := s.client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, convertError(err)
+	}
+	return convertObjectInfo(info), nil
+}
+
+func (s *MinioStore) Get(ctx context.Context, bucket, key string) (io.ReadCloser, ObjectInfo, error) {
+	obj, err := s.client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, convertError(err)
+	}
+
+	// GetObject is lazy, Stat() issues the request and reports missing keys
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, ObjectInfo{}, convertError(err)
+	}
+	return obj, convertObjectInfo(info), nil
+}
+
+func (s *MinioStore) Put(ctx context.Context, bucket, key string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	info, err := s.client.PutObject(ctx, bucket, key, r, size, minio.PutObjectOptions{
+		ContentType:  opts.ContentType,
+		UserMetadata: opts.Metadata,
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		ContentType:  opts.ContentType,
+		LastModified: info.LastModified,
+		Metadata:     opts.Metadata,
+	}, nil
+}
+
+// Largest object S3 copies with a single CopyObject request, also used as the
+// size of the parts larger objects are copied in
+var copyPartSize int64 = 5 << 30
+
+// Copy uses a single CopyObject request for objects of up to copyPartSize and
+// copies larger ones in parts with a multipart upload
+func (s *MinioStore) Copy(ctx context.Context, bucket, srcKey, dstKey string) (ObjectInfo, error) {
+	src, err := s.Stat(ctx, bucket, srcKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if src.Size > copyPartSize {
+		err = s.copyParts(ctx, bucket, src, dstKey)
+	} else {
+		_, err = s.client.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: bucket, Object: dstKey},
+			minio.CopySrcOptions{Bucket: bucket, Object: srcKey})
+	}
+	if err != nil {
+		return ObjectInfo{}, convertError(err)
+	}
+	// The response lacks the content type and metadata
+	return s.Stat(ctx, bucket, dstKey)
+}
+
+// copyParts copies the object src to dstKey with a multipart upload of
+// server-side copied parts, keeping its content type and metadata. The
+// upload is aborted if the source changes or any part fails.
+func (s *MinioStore) copyParts(ctx context.Context, bucket string, src ObjectInfo, dstKey string) error {
+
+	core := minio.Core{Client: s.client}
+	uploadID, err := core.NewMultipartUpload(ctx, bucket, dstKey, minio.PutObjectOptions{
+		ContentType:  src.ContentType,
+		UserMetadata: src.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	var parts []minio.CompletePart
+	for offset := int64(0); offset < src.Size; offset += copyPartSize {
+		length := copyPartSize
+		if offset+length > src.Size {
+			length = src.Size - offset
+		}
+		part, err := core.CopyObjectPart(ctx, bucket, src.Key, bucket, dstKey, uploadID, len(parts)+1, offset, length, map[string]string{
+			"X-Amz-Copy-Source-If-Match": src.ETag,
+		})
+		if err != nil {
+			core.AbortMultipartUpload(context.Background(), bucket, dstKey, uploadID)
+			return err
+		}
+		parts = append(parts, part)
+	}
+
+	if _, err := core.CompleteMultipartUpload(ctx, bucket, dstKey, uploadID, parts, minio.PutObjectOptions{}); err != nil {
+		core.AbortMultipartUpload(context.Background(), bucket, dstKey, uploadID)
+		return err
+	}
+	return nil
+}
+
+func (s *MinioStore) Presign(ctx context.Context, bucket, key string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	return s.client.PresignedGetObject(ctx, bucket, key, expiry, params)
+}
+
+func (s *MinioStore) Delete(ctx context.Context, bucket, key string) error {
+	return s.client.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *MinioStore) Watch(ctx context.Context, bucket string) <-chan Notification {
+
+	ret := make(chan Notification)
+
+	go func() {
+		defer close(ret)
+		for info := range s.client.ListenBucketNotification(ctx, bucket, "", "", []string{
+			"s3:ObjectCreated:*",
+			"s3:ObjectRemoved:*",
+		}) {
+			if info.Err != nil {
+				select {
+				case ret <- Notification{Err: info.Err}:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			for _, record := range info.Records {
+				n := Notification{
+					Event: EventCreated,
+					ETag:  record.S3.Object.ETag,
+				}
+
+				if strings.HasPrefix(record.EventName, "s3:ObjectRemoved:") {
+					n.Event = EventRemoved
+				}
+
+				// Keys in notifications are URL-encoded
+				n.Key = record.S3.Object.Key
+				if key, err := url.QueryUnescape(n.Key); err == nil {
+					n.Key = key
+				}
+
+				select {
+				case ret <- n:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ret
+}
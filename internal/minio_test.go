@@ -0,0 +1,47 @@
+package s3photoalbum
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"s3photoalbum/internal/s3test"
+)
+
+func TestMinioCopy(t *testing.T) {
+	s3 := s3test.NewServer()
+	defer s3.Close()
+	s3.CreateBucket("media")
+
+	store, err := NewMinioStore(s3.Endpoint, "access", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("0123456789abc")
+	if err := s3.PutObjectWithMetadata("media", "alice/summer/clip.mp4", data, "video/mp4", map[string]string{"capture-time": "2021-06-01T12:30:00"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Objects larger than a part are copied in parts
+	defer func(size int64) { copyPartSize = size }(copyPartSize)
+	for _, size := range []int64{int64(len(data)), 5} {
+		copyPartSize = size
+		info, err := store.Copy(ctx, "media", "alice/summer/clip.mp4", "alice/winter/clip.mp4")
+		if err != nil {
+			t.Fatalf("part size %d: %v", size, err)
+		}
+		obj := s3.GetObject("media", "alice/winter/clip.mp4")
+		if obj == nil || !bytes.Equal(obj.Data, data) || info.Size != int64(len(data)) || info.ContentType != "video/mp4" ||
+			!reflect.DeepEqual(info.Metadata, map[string]string{"capture-time": "2021-06-01T12:30:00"}) {
+			t.Errorf("part size %d: unexpected copy %+v", size, info)
+		}
+		s3.RemoveObject("media", "alice/winter/clip.mp4")
+	}
+
+	if _, err := store.Copy(ctx, "media", "alice/summer/missing.mp4", "alice/winter/missing.mp4"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+}
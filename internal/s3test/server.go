@@ -0,0 +1,801 @@
+// Package s3test provides an in-process, in-memory stand-in for an
+// S3-compatible server to be used in tests. It implements the subset of the
+// S3 API (and the MinIO bucket notification extension) that s3photoalbum
+// uses. Requests are not authenticated.
+package s3test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object is a single object stored in the fake server
+type Object struct {
+	Data         []byte
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	// User-defined metadata with lower-case keys, without X-Amz-Meta- prefix
+	Metadata map[string]string
+}
+
+// Server is a fake S3 server. Buckets have to be created with CreateBucket
+// before they can be used.
+type Server struct {
+	*httptest.Server
+
+	// Endpoint is the host:port the server is listening on, without scheme
+	Endpoint string
+
+	mu          sync.Mutex
+	buckets     map[string]map[string]*Object
+	subscribers map[string][]chan event
+	uploads     map[string]*multipartUpload
+	lastUpload  int
+}
+
+// multipartUpload is an incomplete multipart upload, its parts are copied
+// from other objects
+type multipartUpload struct {
+	bucket, key string
+	contentType string
+	metadata    map[string]string
+	parts       map[int][]byte
+}
+
+type event struct {
+	name   string
+	key    string
+	etag   string
+	size   int64
+	bucket string
+}
+
+// NewServer starts a new fake S3 server. It should be closed with Close when
+// no longer used.
+func NewServer() *Server {
+	s := &Server{
+		buckets:     make(map[string]map[string]*Object),
+		subscribers: make(map[string][]chan event),
+		uploads:     make(map[string]*multipartUpload),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.Endpoint = strings.TrimPrefix(s.Server.URL, "http://")
+	return s
+}
+
+// CreateBucket creates an empty bucket, if it does not exist yet
+func (s *Server) CreateBucket(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = make(map[string]*Object)
+	}
+}
+
+// PutObject stores an object, sending notifications to all listeners of the
+// bucket as if it was uploaded through the API
+func (s *Server) PutObject(bucket, key string, data []byte, contentType string) error {
+	return s.PutObjectWithMetadata(bucket, key, data, contentType, nil)
+}
+
+// PutObjectWithMetadata stores an object like PutObject, including the
+// user-defined metadata
+func (s *Server) PutObjectWithMetadata(bucket, key string, data []byte, contentType string, metadata map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		return fmt.Errorf("bucket %s does not exist", bucket)
+	}
+
+	sum := md5.Sum(data)
+	obj := &Object{
+		Data:         append([]byte{}, data...),
+		ContentType:  contentType,
+		ETag:         hex.EncodeToString(sum[:]),
+		LastModified: time.Now().UTC().Truncate(time.Second),
+	}
+	if len(metadata) > 0 {
+		obj.Metadata = make(map[string]string, len(metadata))
+		for k, v := range metadata {
+			obj.Metadata[strings.ToLower(k)] = v
+		}
+	}
+	objects[key] = obj
+
+	s.notify(event{name: "s3:ObjectCreated:Put", bucket: bucket, key: key, etag: obj.ETag, size: int64(len(data))})
+	return nil
+}
+
+// GetObject returns the stored object or nil if it does not exist
+func (s *Server) GetObject(bucket, key string) *Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buckets[bucket][key]
+}
+
+// Keys returns the sorted keys of all objects in bucket
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RemoveObject deletes an object, sending notifications to all listeners
+func (s *Server) RemoveObject(bucket, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if obj, ok := s.buckets[bucket][key]; ok {
+		delete(s.buckets[bucket], key)
+		s.notify(event{name: "s3:ObjectRemoved:Delete", bucket: bucket, key: key, etag: obj.ETag})
+	}
+}
+
+// notify must be called with s.mu held
+func (s *Server) notify(e event) {
+	for _, ch := range s.subscribers[e.bucket] {
+		select {
+		case ch <- e:
+		default:
+			// Slow listeners lose events, as they would on a real server
+		}
+	}
+}
+
+type errorResponse struct {
+	XMLName    xml.Name `xml:"Error"`
+	Code       string
+	Message    string
+	BucketName string `xml:",omitempty"`
+	Key        string `xml:",omitempty"`
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, bucket, key string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	xml.NewEncoder(w).Encode(errorResponse{
+		Code:       code,
+		Message:    code,
+		BucketName: bucket,
+		Key:        key,
+	})
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+
+	// Path-style requests: /<bucket>/<key>
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	s.mu.Lock()
+	_, exists := s.buckets[bucket]
+	s.mu.Unlock()
+
+	if !exists {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", bucket, key)
+		return
+	}
+
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Has("location"):
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+		}{})
+	case key == "" && r.Method == http.MethodGet && query.Has("events"):
+		s.listen(w, r, bucket, query["events"])
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, bucket, query)
+	case key != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		s.get(w, r, bucket, key)
+	case key != "" && r.Method == http.MethodPost && query.Has("uploads"):
+		s.createUpload(w, r, bucket, key)
+	case key != "" && r.Method == http.MethodPut && query.Has("uploadId") && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copyPart(w, r, bucket, key, query)
+	case key != "" && r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeUpload(w, r, bucket, key, query.Get("uploadId"))
+	case key != "" && r.Method == http.MethodDelete && query.Has("uploadId"):
+		s.mu.Lock()
+		delete(s.uploads, query.Get("uploadId"))
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case key != "" && r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copy(w, r, bucket, key)
+	case key != "" && r.Method == http.MethodPut:
+		s.put(w, r, bucket, key)
+	case key != "" && r.Method == http.MethodDelete:
+		s.RemoveObject(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", bucket, key)
+	}
+}
+
+const metadataHeaderPrefix = "X-Amz-Meta-"
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	obj := s.GetObject(bucket, key)
+	if obj == nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", bucket, key)
+		return
+	}
+
+	w.Header().Set("ETag", `"`+obj.ETag+`"`)
+	for k, v := range obj.Metadata {
+		w.Header().Set(metadataHeaderPrefix+k, v)
+	}
+	if obj.ContentType != "" {
+		w.Header().Set("Content-Type", obj.ContentType)
+	}
+	http.ServeContent(w, r, key, obj.LastModified, bytes.NewReader(obj.Data))
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, bucket, key string) {
+
+	var body io.Reader = r.Body
+
+	// minio-go uses chunked signatures for uploads over plain http
+	if r.Header.Get("X-Amz-Content-Sha256") == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		body = &chunkedReader{r: bufio.NewReader(r.Body)}
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "IncompleteBody", bucket, key)
+		return
+	}
+
+	metadata := requestMetadata(r)
+	if metadataSize(metadata) > maxMetadataSize {
+		writeError(w, r, http.StatusBadRequest, "MetadataTooLarge", bucket, key)
+		return
+	}
+
+	if err := s.PutObjectWithMetadata(bucket, key, data, r.Header.Get("Content-Type"), metadata); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", bucket, key)
+		return
+	}
+
+	w.Header().Set("ETag", `"`+s.GetObject(bucket, key).ETag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// requestMetadata returns the user-defined metadata sent in the headers
+func requestMetadata(r *http.Request) map[string]string {
+	metadata := map[string]string{}
+	for k, v := range r.Header {
+		if strings.HasPrefix(strings.ToLower(k), strings.ToLower(metadataHeaderPrefix)) && len(v) > 0 {
+			metadata[k[len(metadataHeaderPrefix):]] = v[0]
+		}
+	}
+	return metadata
+}
+
+// Limit of S3 for the user-defined metadata of an object
+const maxMetadataSize = 2048
+
+// metadataSize returns the size of the metadata like S3 counts it, the sum
+// of the lengths of the keys and values
+func metadataSize(metadata map[string]string) int {
+	size := 0
+	for k, v := range metadata {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// copySource returns the object named in the X-Amz-Copy-Source header, nil
+// after writing an error if it is invalid or does not exist
+func (s *Server) copySource(w http.ResponseWriter, r *http.Request, bucket, key string) *Object {
+
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", bucket, key)
+		return nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	if len(parts) != 2 {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", bucket, key)
+		return nil
+	}
+
+	src := s.GetObject(parts[0], parts[1])
+	if src == nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", parts[0], parts[1])
+		return nil
+	}
+	if match := r.Header.Get("X-Amz-Copy-Source-If-Match"); match != "" && strings.Trim(match, `"`) != src.ETag {
+		writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed", parts[0], parts[1])
+		return nil
+	}
+	return src
+}
+
+// copy handles CopyObject requests. Only copying the content type and
+// metadata of the source is supported (x-amz-metadata-directive COPY).
+func (s *Server) copy(w http.ResponseWriter, r *http.Request, bucket, key string) {
+
+	src := s.copySource(w, r, bucket, key)
+	if src == nil {
+		return
+	}
+
+	if err := s.PutObjectWithMetadata(bucket, key, src.Data, src.ContentType, src.Metadata); err != nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", bucket, key)
+		return
+	}
+
+	obj := s.GetObject(bucket, key)
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{
+		ETag:         `"` + obj.ETag + `"`,
+		LastModified: obj.LastModified.Format(time.RFC3339),
+	})
+}
+
+// createUpload handles CreateMultipartUpload requests
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+
+	s.mu.Lock()
+	s.lastUpload++
+	id := strconv.Itoa(s.lastUpload)
+	s.uploads[id] = &multipartUpload{
+		bucket:      bucket,
+		key:         key,
+		contentType: r.Header.Get("Content-Type"),
+		metadata:    requestMetadata(r),
+		parts:       map[int][]byte{},
+	}
+	s.mu.Unlock()
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: bucket, Key: key, UploadId: id})
+}
+
+// upload returns the multipart upload with the id, nil after writing an
+// error if there is none for the key
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, bucket, key, id string) *multipartUpload {
+	s.mu.Lock()
+	upload := s.uploads[id]
+	s.mu.Unlock()
+	if upload == nil || upload.bucket != bucket || upload.key != key {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", bucket, key)
+		return nil
+	}
+	return upload
+}
+
+// copyPart handles UploadPartCopy requests, optionally with a range of the
+// source
+func (s *Server) copyPart(w http.ResponseWriter, r *http.Request, bucket, key string, query url.Values) {
+
+	upload := s.upload(w, r, bucket, key, query.Get("uploadId"))
+	if upload == nil {
+		return
+	}
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || number < 1 {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", bucket, key)
+		return
+	}
+	src := s.copySource(w, r, bucket, key)
+	if src == nil {
+		return
+	}
+
+	data := src.Data
+	if rng := r.Header.Get("X-Amz-Copy-Source-Range"); rng != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || start > end || end >= len(data) {
+			writeError(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", bucket, key)
+			return
+		}
+		data = data[start : end+1]
+	}
+
+	s.mu.Lock()
+	upload.parts[number] = append([]byte(nil), data...)
+	s.mu.Unlock()
+
+	sum := md5.Sum(data)
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyPartResult"`
+		ETag         string
+		LastModified string
+	}{
+		ETag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		LastModified: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// completeUpload handles CompleteMultipartUpload requests, storing the
+// parts in the order of the request as object
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) {
+
+	upload := s.upload(w, r, bucket, key, id)
+	if upload == nil {
+		return
+	}
+	var request struct {
+		Parts []struct {
+			PartNumber int
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", bucket, key)
+		return
+	}
+
+	var data []byte
+	s.mu.Lock()
+	for _, part := range request.Parts {
+		data = append(data, upload.parts[part.PartNumber]...)
+	}
+	delete(s.uploads, id)
+	s.mu.Unlock()
+
+	if err := s.PutObjectWithMetadata(bucket, key, data, upload.contentType, upload.metadata); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", bucket, key)
+		return
+	}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: bucket, Key: key, ETag: `"` + s.GetObject(bucket, key).ETag + `"`})
+}
+
+// chunkedReader decodes a body using the aws-chunked encoding, e.g.
+//
+//	<hex size>;chunk-signature=<signature>\r\n<data>\r\n...0;chunk-signature=<signature>\r\n\r\n
+type chunkedReader struct {
+	r         *bufio.Reader
+	remaining int64
+	done      bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+
+	if c.remaining == 0 {
+		header, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		sizeHex := strings.SplitN(strings.TrimSpace(header), ";", 2)[0]
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		c.remaining = size
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+
+	// Skip the \r\n following every chunk
+	if c.remaining == 0 && err == nil {
+		if _, err := c.r.Discard(2); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+type listObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+	UserMetadata userMetadata `xml:",omitempty"`
+}
+
+// userMetadata is encoded like MinIO does when listing with metadata=true,
+// as one element per header
+type userMetadata map[string]string
+
+func (m userMetadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		name := xml.Name{Local: metadataHeaderPrefix + k}
+		if err := e.EncodeElement(m[k], xml.StartElement{Name: name}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string
+	MaxKeys               int
+	KeyCount              int
+	EncodingType          string
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	Contents              []listObject
+	CommonPrefixes        []commonPrefix
+}
+
+// list implements ListObjectsV2
+func (s *Server) list(w http.ResponseWriter, bucket string, query url.Values) {
+
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	maxKeys := 1000
+	if v, err := strconv.Atoi(query.Get("max-keys")); err == nil && v > 0 && v < maxKeys {
+		maxKeys = v
+	}
+
+	// The continuation token is simply the last key returned
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		after = token
+	}
+
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+	}
+
+	result := listBucketResult{
+		Name:              bucket,
+		Prefix:            encode(prefix),
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		EncodingType:      query.Get("encoding-type"),
+		ContinuationToken: query.Get("continuation-token"),
+		StartAfter:        query.Get("start-after"),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for k := range s.buckets[bucket] {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	lastPrefix := ""
+	for _, k := range keys {
+		entry := k
+		isPrefix := false
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				entry = k[:len(prefix)+i+len(delimiter)]
+				isPrefix = true
+			}
+		}
+
+		if entry <= after || (isPrefix && entry == lastPrefix) {
+			continue
+		}
+
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+
+		if isPrefix {
+			lastPrefix = entry
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encode(entry)})
+		} else {
+			obj := s.buckets[bucket][k]
+			object := listObject{
+				Key:          encode(k),
+				LastModified: obj.LastModified.Format(time.RFC3339),
+				ETag:         `"` + obj.ETag + `"`,
+				Size:         int64(len(obj.Data)),
+				StorageClass: "STANDARD",
+			}
+			// MinIO extension
+			if query.Get("metadata") == "true" {
+				object.UserMetadata = obj.Metadata
+			}
+			result.Contents = append(result.Contents, object)
+		}
+		result.KeyCount++
+		result.NextContinuationToken = entry
+	}
+
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+
+	writeXML(w, result)
+}
+
+type notificationRecord struct {
+	EventName string `json:"eventName"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key  string `json:"key"`
+			Size int64  `json:"size,omitempty"`
+			ETag string `json:"eTag,omitempty"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// matchEvent checks an event name against a pattern like s3:ObjectCreated:*
+func matchEvent(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if p == name || (strings.HasSuffix(p, "*") && strings.HasPrefix(name, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// listen implements the MinIO ListenBucketNotification API, streaming one
+// JSON document per line until the client disconnects
+func (s *Server) listen(w http.ResponseWriter, r *http.Request, bucket string, patterns []string) {
+
+	ch := make(chan event, 100)
+
+	s.mu.Lock()
+	s.subscribers[bucket] = append(s.subscribers[bucket], ch)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		subs := s.subscribers[bucket]
+		for i := range subs {
+			if subs[i] == ch {
+				s.subscribers[bucket] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+	}()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", bucket, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			if !matchEvent(patterns, e.name) {
+				continue
+			}
+
+			var record notificationRecord
+			record.EventName = e.name
+			record.S3.Bucket.Name = e.bucket
+			record.S3.Object.Key = url.QueryEscape(e.key)
+			record.S3.Object.ETag = e.etag
+			record.S3.Object.Size = e.size
+
+			line, err := json.Marshal(map[string][]notificationRecord{"Records": {record}})
+			if err != nil {
+				return
+			}
+			if _, err := w.Write(append(line, '\n')); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// ErrTimeout is returned by the Wait* functions if the condition was not met
+// in time
+var ErrTimeout = errors.New("timed out")
+
+// WaitForListener blocks until a client listens for notifications of bucket
+// or the timeout has passed
+func (s *Server) WaitForListener(bucket string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		n := len(s.subscribers[bucket])
+		s.mu.Unlock()
+		if n > 0 {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ErrTimeout
+}
+
+// WaitForObject blocks until key exists in bucket or the timeout has passed
+func (s *Server) WaitForObject(bucket, key string, timeout time.Duration) (*Object, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if obj := s.GetObject(bucket, key); obj != nil {
+			return obj, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil, ErrTimeout
+}
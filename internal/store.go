@@ -0,0 +1,147 @@
+package s3photoalbum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+// ErrNotExist is returned by a MediaStore when the requested object does not
+// exist in the bucket.
+var ErrNotExist = errors.New("object does not exist")
+
+// ObjectInfo describes a single object (or, for non-recursive listings, a
+// common prefix) in a bucket.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+
+	// User-defined metadata with lower-case keys, e.g. MetadataCaptureTime.
+	// Only set by List if ListOptions.WithMetadata is set.
+	Metadata map[string]string
+
+	// Set when listing non-recursively and the key is a "directory" prefix
+	// ending in "/"
+	IsPrefix bool
+
+	// Set when an error occurred while listing. No further objects will be
+	// sent on the channel.
+	Err error
+}
+
+// ListOptions control which objects are returned by MediaStore.List
+type ListOptions struct {
+	Prefix    string
+	Recursive bool
+	// Hint for the number of keys to fetch per request to the backend. The
+	// channel is not limited by it, cancel the context to stop early.
+	MaxKeys int
+	// Only list keys lexically after this one
+	StartAfter string
+	// Include the user-defined metadata of every object. Only supported by
+	// MinIO for the s3 backend.
+	WithMetadata bool
+}
+
+// PutOptions are passed to MediaStore.Put
+type PutOptions struct {
+	ContentType string
+	// Limited to MaxMetadataSize by S3
+	Metadata map[string]string
+}
+
+// MaxMetadataSize is the limit of S3 for the user-defined metadata of an
+// object as counted by MetadataSize. Larger metadata fails the upload.
+const MaxMetadataSize = 2048
+
+// MetadataSize returns the size of user-defined metadata, the sum of the
+// lengths of the keys and values. The prefix of the headers is counted too,
+// as not all S3 servers leave it out.
+func MetadataSize(metadata map[string]string) int {
+	size := 0
+	for k, v := range metadata {
+		size += len("x-amz-meta-") + len(k) + len(v)
+	}
+	return size
+}
+
+// Metadata set by the thumbnailer on the thumbnails
+const (
+	// Capture time of the original media from its EXIF data, in the local
+	// time of the camera formatted as CaptureTimeFormat
+	MetadataCaptureTime = "capture-time"
+	CaptureTimeFormat   = "2006-01-02T15:04:05"
+)
+
+// EventType is the kind of change reported by MediaStore.Watch
+type EventType string
+
+const (
+	EventCreated EventType = "created"
+	EventRemoved EventType = "removed"
+)
+
+// Notification is sent by MediaStore.Watch for every change in the watched
+// bucket.
+type Notification struct {
+	Event EventType
+	Key   string
+	ETag  string
+	Err   error
+}
+
+// MediaStore abstracts the object storage the media and thumbnails are kept
+// in. Keys always use "/" as separator, e.g. "<username>/<album>/<image>".
+type MediaStore interface {
+	// List sends all objects matching the options on the returned channel.
+	// The channel is closed when the listing is complete or ctx is canceled.
+	List(ctx context.Context, bucket string, opts ListOptions) <-chan ObjectInfo
+
+	// Stat returns information about a single object or ErrNotExist
+	Stat(ctx context.Context, bucket, key string) (ObjectInfo, error)
+
+	// Get returns a reader for the object's content. The caller must close it.
+	Get(ctx context.Context, bucket, key string) (io.ReadCloser, ObjectInfo, error)
+
+	// Put stores size bytes read from r under key. size may be -1 if unknown.
+	Put(ctx context.Context, bucket, key string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error)
+
+	// Copy copies the object srcKey to dstKey within the bucket, including
+	// its content type and metadata, without downloading it. Returns
+	// ErrNotExist if srcKey does not exist.
+	Copy(ctx context.Context, bucket, srcKey, dstKey string) (ObjectInfo, error)
+
+	// Presign returns an URL that allows to GET the object without further
+	// authentication until expiry has passed.
+	Presign(ctx context.Context, bucket, key string, expiry time.Duration, params url.Values) (*url.URL, error)
+
+	// Delete removes the object. Deleting a non-existing object is not an
+	// error.
+	Delete(ctx context.Context, bucket, key string) error
+
+	// Watch sends a notification for every object created in or removed from
+	// the bucket until ctx is canceled.
+	Watch(ctx context.Context, bucket string) <-chan Notification
+}
+
+// NewMediaStore returns the MediaStore configured in config. signingKey is
+// used by backends that can't presign URLs themselves and may be nil if no
+// URLs are generated.
+func NewMediaStore(config CommonConfig, signingKey []byte) (MediaStore, error) {
+	switch config.StorageBackend {
+	case "s3":
+		if config.S3Endpoint == "" || config.S3AccessKey == "" || config.S3SecretKey == "" {
+			return nil, errors.New("S3 endpoint, access key and secret key are required for the s3 backend")
+		}
+		return NewMinioStore(config.S3Endpoint, config.S3AccessKey, config.S3SecretKey, config.S3UseSsl)
+	case "filesystem":
+		return NewFilesystemStore(config.StorageDir, signingKey)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", config.StorageBackend)
+}
@@ -0,0 +1,129 @@
+package s3photoalbum
+
+import (
+	"net/url"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// MetadataKeywords is set by the thumbnailer to the EXIF keywords of the
+// media, encoded by EncodeKeywords
+const MetadataKeywords = "keywords"
+
+// Upper limit for the length of tags in bytes
+const maxTagLength = 100
+
+// Tag is a tag of a media item. The tags from the EXIF keywords of the media
+// are replaced whenever the item is indexed, the tags set by the users are
+// kept until the item is removed.
+type Tag struct {
+	ID    uint   `gorm:"primaryKey"`
+	Key   string `gorm:"uniqueIndex:idx_tags_key_name;not null"`
+	Owner string `gorm:"index:idx_tags_owner_name;not null"`
+	Name  string `gorm:"uniqueIndex:idx_tags_key_name;index:idx_tags_owner_name;not null"`
+	Exif  bool   `gorm:"uniqueIndex:idx_tags_key_name;not null;default:false"`
+}
+
+// NormalizeTag returns the tag in lower case with single spaces, empty if it
+// can't be used as tag. Tags can't contain slashes or commas and can't start
+// with a minus, as they are used in URLs and tag queries.
+func NormalizeTag(s string) string {
+	s = strings.ToLower(strings.Join(strings.Fields(s), " "))
+	if s == "" || len(s) > maxTagLength || strings.ContainsAny(s, "/,") || strings.HasPrefix(s, "-") {
+		return ""
+	}
+	return s
+}
+
+// MaxKeywordsLength is the upper limit for the length of the keywords
+// encoded by EncodeKeywords, so that they fit into the metadata of a
+// thumbnail with the other EXIF data. S3 limits it to 2 KB.
+const MaxKeywordsLength = 1024
+
+// EncodeKeywords encodes keywords for MetadataKeywords. Metadata is sent as
+// HTTP headers, so the keywords are escaped to ASCII. The keywords that
+// don't fit into MaxKeywordsLength are left out.
+func EncodeKeywords(keywords []string) string {
+	encoded, _ := encodeKeywords(keywords)
+	return encoded
+}
+
+// KeywordsFit returns whether EncodeKeywords keeps all of the keywords
+func KeywordsFit(keywords []string) bool {
+	_, complete := encodeKeywords(keywords)
+	return complete
+}
+
+func encodeKeywords(keywords []string) (encoded string, complete bool) {
+	for _, keyword := range keywords {
+		escaped := url.QueryEscape(keyword)
+		if encoded != "" {
+			escaped = "," + escaped
+		}
+		if len(encoded)+len(escaped) > MaxKeywordsLength {
+			return encoded, false
+		}
+		encoded += escaped
+	}
+	return encoded, true
+}
+
+// keywordTags returns the tags of keywords encoded by EncodeKeywords.
+// Keywords are split at commas, as some programs store lists in one keyword,
+// and those that can't be used as tags are left out.
+func keywordTags(encoded string) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, escaped := range strings.Split(encoded, ",") {
+		keyword, err := url.QueryUnescape(escaped)
+		if err != nil {
+			continue
+		}
+		for _, s := range strings.Split(keyword, ",") {
+			if tag := NormalizeTag(s); tag != "" && !seen[tag] {
+				tags = append(tags, tag)
+				seen[tag] = true
+			}
+		}
+	}
+	return tags
+}
+
+// saveExifTags replaces the tags of the media item from its EXIF keywords.
+// Only changed tags are written, as every write refreshes the search index
+// of the item.
+func saveExifTags(db *gorm.DB, item MediaItem) error {
+
+	var existing []string
+	if err := db.Model(&Tag{}).Where("key = ? AND exif", item.Key).Pluck("name", &existing).Error; err != nil {
+		return err
+	}
+	removed := map[string]bool{}
+	for _, name := range existing {
+		removed[name] = true
+	}
+
+	var tags []Tag
+	for _, name := range item.Keywords {
+		if removed[name] {
+			delete(removed, name)
+			continue
+		}
+		tags = append(tags, Tag{Key: item.Key, Owner: item.Owner, Name: name, Exif: true})
+	}
+
+	if len(removed) > 0 {
+		names := make([]string, 0, len(removed))
+		for name := range removed {
+			names = append(names, name)
+		}
+		if err := db.Where("key = ? AND exif AND name IN ?", item.Key, names).Delete(&Tag{}).Error; err != nil {
+			return err
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return db.Create(&tags).Error
+}
@@ -24,6 +24,15 @@ in {
       '';
     };
 
+    databasePath = mkOption {
+      type = types.str;
+      default = "/var/lib/s3photoalbum/data.db";
+      description = ''
+        The SQLite database of s3photoalbum. The thumbnailer writes to it
+        too, its directory and files are writable by the group.
+      '';
+    };
+
     envfile = mkOption {
       type = types.str;
       default = "/var/src/secrets/s3photoalbum/envfile";
@@ -97,8 +106,11 @@ in {
           WorkingDirectory = cfg.dataDir;
           ExecStart = "${pkgs.s3photoalbum}/bin/server";
           Restart = "on-failure";
+          # The database is shared with the thumbnailer through the group
+          UMask = "0007";
           Environment = [
             "S3G_RESOURCES_DIR='${pkgs.s3photoalbum}/share'"
+            "S3G_DATABASE_PATH='${cfg.databasePath}'"
             # Maybe set these here with nix options aswell?
             # S3G_INITIAL_USER
             # S3G_INITIAL_PASS
@@ -109,6 +121,7 @@ in {
         }
         (mkIf (cfg.dataDir == "/var/lib/s3photoalbum") {
           StateDirectory = "s3photoalbum";
+          StateDirectoryMode = "2770";
         })
       ];
     };
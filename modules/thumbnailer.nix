@@ -16,6 +16,24 @@ in {
       '';
     };
 
+    databasePath = mkOption {
+      type = types.str;
+      default = "/var/lib/s3photoalbum/data.db";
+      description = ''
+        The SQLite database of the s3photoalbum server the thumbnailer keeps
+        the media index in.
+      '';
+    };
+
+    databaseGroup = mkOption {
+      type = types.str;
+      default = "s3photoalbum";
+      description = ''
+        Group owning the database of the server, the thumbnailer is added to
+        it.
+      '';
+    };
+
     envfile = mkOption {
       type = types.str;
       default = "/var/src/secrets/s3photoalbum/envfile";
@@ -43,12 +61,15 @@ in {
     systemd.services.s3photoalbum-thumbnailer = {
       description = "A self-hosted photo album - thumbnailer service";
       wantedBy = [ "multi-user.target" ];
+      after = [ "s3photoalbum.service" ];
 
       serviceConfig = mkMerge [
         {
           EnvironmentFile = [ cfg.envfile ];
           User = cfg.user;
           Group = cfg.group;
+          SupplementaryGroups = [ cfg.databaseGroup ];
+          UMask = "0007";
           WorkingDirectory = cfg.dataDir;
           ExecStart = "${pkgs.s3photoalbum}/bin/thumbnailer";
           Restart = "on-failure";
@@ -56,14 +77,19 @@ in {
             "S3G_THUMBNAIL_SIZE=300"
             "S3G_FFMPEG_THUMBNAILER_PATH='${pkgs.ffmpegthumbnailer}/bin/ffmpegthumbnailer'"
             "S3G_EXIF_TOOL_PATH='${pkgs.exiftool}/bin/exiftool'"
+            "S3G_DATABASE_PATH='${cfg.databasePath}'"
           ];
         }
-        (mkIf (cfg.dataDir == "/var/lib/s3photoalbum") {
-          StateDirectory = "s3photoalbum";
-        })
       ];
     };
 
+    # The directory of the database is shared with the server, which owns it
+    # when running on the same host. New files get the group of the directory.
+    systemd.tmpfiles.rules = [
+      "d '${dirOf cfg.databasePath}' 2770 - ${cfg.databaseGroup} -"
+    ] ++ optional (cfg.dataDir != dirOf cfg.databasePath)
+      "d '${cfg.dataDir}' 0750 ${cfg.user} ${cfg.group} -";
+
     users.users = mkIf (cfg.user == "s3photoalbum-thumb") {
       s3photoalbum-thumb = {
         isSystemUser = true;
@@ -72,8 +98,10 @@ in {
       };
     };
 
-    users.groups =
-      mkIf (cfg.group == "s3photoalbum-thumb") { s3photoalbum-thumb = { }; };
+    users.groups = mkMerge [
+      (mkIf (cfg.group == "s3photoalbum-thumb") { s3photoalbum-thumb = { }; })
+      { ${cfg.databaseGroup} = { }; }
+    ];
 
   };
   meta = { maintainers = with lib.maintainers; [ mayniklas pinpox ]; };
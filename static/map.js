@@ -0,0 +1,29 @@
+// Shows the geotagged media embedded into the map page as GeoJSON. Nearby
+// points are clustered, clicking a point shows its thumbnail linking to the
+// image.
+
+const elem = document.getElementById("map");
+if (elem) {
+	const map = L.map(elem);
+	L.tileLayer(elem.dataset.tiles, {
+		attribution: elem.dataset.attribution,
+		maxZoom: 19,
+	}).addTo(map);
+
+	const points = L.geoJSON(JSON.parse(document.getElementById("map-data").textContent), {
+		onEachFeature: (feature, layer) => {
+			const link = document.createElement("a");
+			link.href = feature.properties.url;
+			const img = document.createElement("img");
+			img.src = feature.properties.thumbnailUrl;
+			img.alt = feature.properties.name;
+			link.append(img);
+			layer.bindPopup(link, { className: "map-popup" });
+		},
+	});
+
+	const clusters = L.markerClusterGroup();
+	clusters.addLayer(points);
+	map.addLayer(clusters);
+	map.fitBounds(clusters.getBounds(), { maxZoom: 15, padding: [20, 20] });
+}
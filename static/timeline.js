@@ -0,0 +1,58 @@
+// Appends the following pages of the timeline when scrolling to its end. The
+// pages are fetched as HTML, without JavaScript the link to the next page is
+// followed instead.
+
+const lightbox = GLightbox({ selector: ".glightbox" });
+
+// appendPage moves the days of the fetched page to the timeline. Days and
+// months continuing from the previous page are merged.
+function appendPage(doc) {
+	const timeline = document.querySelector(".timeline");
+	for (const elem of Array.from(doc.querySelector(".timeline").children)) {
+		if (elem.matches(".timeline-month") && document.querySelector(`.timeline-month[data-month="${elem.dataset.month}"]`)) {
+			continue;
+		}
+		if (elem.matches(".timeline-day")) {
+			const day = timeline.querySelector(`.timeline-day[data-date="${elem.dataset.date}"] .albumlist`);
+			if (day) {
+				day.append(...elem.querySelector(".albumlist").children);
+				continue;
+			}
+		}
+		timeline.append(elem);
+	}
+	lightbox.reload();
+}
+
+async function loadNext(observer, link) {
+	observer.unobserve(link);
+	try {
+		const resp = await fetch(link.href, { credentials: "same-origin" });
+		if (!resp.ok) {
+			throw new Error(resp.statusText);
+		}
+		const doc = new DOMParser().parseFromString(await resp.text(), "text/html");
+		appendPage(doc);
+
+		const next = doc.querySelector(".timeline-next");
+		if (!next) {
+			link.parentElement.remove();
+			return;
+		}
+		link.href = next.href;
+		observer.observe(link);
+	} catch (err) {
+		// Leave the link to load the page manually
+		console.log("Failed to load the timeline: ", err);
+	}
+}
+
+const next = document.querySelector(".timeline-next");
+if (next) {
+	const observer = new IntersectionObserver((entries) => {
+		if (entries.some((entry) => entry.isIntersecting)) {
+			loadNext(observer, next);
+		}
+	}, { rootMargin: "500px" });
+	observer.observe(next);
+}
@@ -0,0 +1,123 @@
+// Uploads the files of the album upload form in chunks through the JSON API,
+// so that large videos survive network errors and page reloads. Without
+// JavaScript the form is submitted as multipart form instead.
+
+const chunkSize = 8 * 1024 * 1024;
+const maxRetries = 5;
+
+// Key of an upload in the localStorage, to resume it after a reload. The
+// album is its path below /api/v1, e.g. /albums/2021/summer.
+function uploadKey(album, file) {
+	return ["upload" + album, file.name, file.size, file.lastModified].join("/");
+}
+
+async function apiRequest(method, url, body, headers) {
+	const resp = await fetch(url, { method, body, headers, credentials: "same-origin" });
+	const data = resp.status === 204 ? null : await resp.json();
+	if (!resp.ok) {
+		const err = new Error(data && data.error ? data.error : resp.statusText);
+		err.status = resp.status;
+		err.offset = resp.headers.get("Upload-Offset");
+		throw err;
+	}
+	return data;
+}
+
+// findOrCreateUpload resumes an earlier upload of the file or starts a new one
+async function findOrCreateUpload(album, file) {
+	const id = localStorage.getItem(uploadKey(album, file));
+	if (id) {
+		try {
+			return await apiRequest("GET", "/api/v1/uploads/" + id);
+		} catch (err) {
+			localStorage.removeItem(uploadKey(album, file));
+		}
+	}
+
+	const upload = await apiRequest("POST", "/api/v1" + album + "/uploads",
+		JSON.stringify({ name: file.name, size: file.size }), { "Content-Type": "application/json" });
+	localStorage.setItem(uploadKey(album, file), upload.id);
+	return upload;
+}
+
+async function uploadFile(album, file, onProgress) {
+	const upload = await findOrCreateUpload(album, file);
+	let offset = upload.offset;
+	let retries = 0;
+
+	for (;;) {
+		const chunk = file.slice(offset, offset + chunkSize);
+		try {
+			const result = await apiRequest("PATCH", "/api/v1/uploads/" + upload.id, chunk, {
+				"Content-Type": "application/octet-stream",
+				"Upload-Offset": String(offset),
+			});
+			retries = 0;
+			if (result.offset === undefined) {
+				// Complete, the result is the media item
+				localStorage.removeItem(uploadKey(album, file));
+				onProgress(file.size);
+				return;
+			}
+			offset = result.offset;
+			onProgress(offset);
+		} catch (err) {
+			if (err.status === 409 && err.offset !== null) {
+				// The server has a different offset, e.g. after a lost response
+				offset = Number(err.offset);
+			} else if (err.status !== undefined && err.status < 500) {
+				localStorage.removeItem(uploadKey(album, file));
+				throw err;
+			}
+			if (++retries > maxRetries) {
+				throw err;
+			}
+			await new Promise((resolve) => setTimeout(resolve, 1000 * retries));
+		}
+	}
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+	const form = document.querySelector("form.upload");
+	if (!form || !window.fetch) {
+		return;
+	}
+
+	form.addEventListener("submit", async (event) => {
+		event.preventDefault();
+
+		// The action is /albums/<album path>/upload, or below
+		// /shared/<owner> for albums of other users, the API uses the same
+		// paths
+		const album = form.getAttribute("action").replace(/\/upload$/, "");
+		const files = Array.from(form.elements.files.files);
+		const progress = form.querySelector("progress");
+		const status = form.querySelector(".upload-status");
+
+		const total = files.reduce((sum, file) => sum + file.size, 0);
+		let done = 0;
+		progress.max = total;
+		progress.value = 0;
+		progress.hidden = false;
+		form.elements[1].disabled = true;
+
+		const failed = [];
+		for (const file of files) {
+			status.textContent = file.name;
+			try {
+				await uploadFile(album, file, (offset) => { progress.value = done + offset; });
+			} catch (err) {
+				failed.push(file.name + ": " + err.message);
+			}
+			done += file.size;
+			progress.value = done;
+		}
+
+		if (failed.length > 0) {
+			status.textContent = "Failed to upload " + failed.join(", ");
+			form.elements[1].disabled = false;
+			return;
+		}
+		window.location.reload();
+	});
+});